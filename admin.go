@@ -0,0 +1,163 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wprimadi/gin-captcha/internal/testhook"
+)
+
+// Audit actions
+const (
+	AuditFlush      = "flush"      // Every captcha and counter was removed
+	AuditInvalidate = "invalidate" // A single captcha was removed
+)
+
+// AuditEvent describes an administrative operation on the store
+type AuditEvent struct {
+	Action    string    // One of the Audit* actions
+	CaptchaID string    // Captcha concerned, empty for store-wide actions
+	Trace     string    // Trace token of the captcha concerned, see HeaderTrace
+	Count     int       // Number of captchas removed
+	Time      time.Time // When the operation happened
+}
+
+// DefaultStore returns the store used by the middlewares
+func DefaultStore() *CaptchaStore {
+	return store
+}
+
+// Entries returns the number of captchas in the in-memory store, expired
+// ones included until the next cleanup, e.g. to alert before MaxEntries is
+// reached
+func (s *CaptchaStore) Entries() int {
+	return s.captchas.Len()
+}
+
+// SetAuditFunc registers fn to receive an event for every administrative
+// operation on the store. It must be called before the store is in use.
+func (s *CaptchaStore) SetAuditFunc(fn func(AuditEvent)) {
+	s.audit = fn
+}
+
+// emit sends ev to the audit function, if any
+func (s *CaptchaStore) emit(ev AuditEvent) {
+	if s.audit != nil {
+		ev.Time = time.Now()
+		s.audit(ev)
+	}
+}
+
+// Flush removes every outstanding captcha along with all attempt counters,
+// cooldowns, step tokens, tombstones and remembered verification outcomes.
+// With a config, the captchas and counters removed are those of its Store,
+// which must implement Flusher.
+func (s *CaptchaStore) Flush(ctx context.Context, config ...CaptchaConfig) error {
+	backend := s.backend(givenConfig(config))
+	flusher, ok := backend.(Flusher)
+	if !ok {
+		return fmt.Errorf("captcha: %T can't be flushed: %w", backend, errors.ErrUnsupported)
+	}
+
+	count, err := flusher.Flush(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.counters = make(map[string]counterData)
+	s.tombstones = make(map[string]tombstone)
+	s.replays = make(map[string]verifyOutcome)
+	s.mu.Unlock()
+	s.images.clear()
+
+	s.emit(AuditEvent{Action: AuditFlush, Count: count})
+	return nil
+}
+
+// Invalidate removes the captcha with the given ID, it is a no-op for
+// unknown IDs. With a config, the captcha is removed from its Store, which
+// must implement Invalidator.
+func (s *CaptchaStore) Invalidate(ctx context.Context, id string, config ...CaptchaConfig) error {
+	backend := s.backend(givenConfig(config))
+	invalidator, ok := backend.(Invalidator)
+	if !ok {
+		return fmt.Errorf("captcha: %T can't invalidate captchas: %w", backend, errors.ErrUnsupported)
+	}
+
+	value, exists, err := invalidator.Invalidate(ctx, id)
+	if err != nil {
+		return err
+	}
+	s.images.remove(id)
+	data, _ := decodeCaptcha(value)
+
+	count := 0
+	if exists {
+		count = 1
+	}
+	s.emit(AuditEvent{Action: AuditInvalidate, CaptchaID: id, Trace: data.trace, Count: count})
+	return nil
+}
+
+// The test helpers of the module read answers through testhook
+func init() {
+	testhook.Answer = store.answer
+}
+
+// answer returns the expected answer of an outstanding captcha, for the
+// captchatest package. Only answers are hashed, so with a TextGenerator
+// returning answers other than the displayed text it returns the displayed
+// text.
+func (s *CaptchaStore) answer(id string) (string, bool) {
+	value, exists, _ := s.captchas.Get(id)
+	if !exists {
+		return "", false
+	}
+	data, err := decodeCaptcha(value)
+	if err != nil || data.expired(time.Now()) {
+		return "", false
+	}
+	return data.value, true
+}
+
+// FlushHandler is an admin handler flushing the store of the given config,
+// or the in-memory one, e.g. mounted on "POST /internal/captcha/flush". It
+// must be protected by authentication.
+func FlushHandler(config ...CaptchaConfig) gin.HandlerFunc {
+	cfg := DefaultCaptchaConfig()
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+
+	return func(c *gin.Context) {
+		if err := cfg.state().Flush(c.Request.Context(), cfg); err != nil {
+			logError(c, cfg, "", err)
+			c.JSON(500, gin.H{"error": "Failed to flush captchas"})
+			return
+		}
+		c.JSON(200, gin.H{"message": "Captchas flushed"})
+	}
+}
+
+// InvalidateHandler is an admin handler invalidating the captcha whose ID is
+// the "id" route parameter in the store of the given config, or the
+// in-memory one. It must be protected by authentication.
+func InvalidateHandler(config ...CaptchaConfig) gin.HandlerFunc {
+	cfg := DefaultCaptchaConfig()
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		if err := cfg.state().Invalidate(c.Request.Context(), id, cfg); err != nil {
+			logError(c, cfg, id, err)
+			c.JSON(500, gin.H{"error": "Failed to invalidate captcha"})
+			return
+		}
+		c.JSON(200, gin.H{"message": "Captcha invalidated"})
+	}
+}
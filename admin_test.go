@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// plainStore hides every optional interface of the Store it wraps
+type plainStore struct{ Store }
+
+// adminRouter returns testRouter(cfg) with the admin handlers of cfg
+// mounted on POST /flush and POST /:id/invalidate
+func adminRouter(cfg CaptchaConfig) *gin.Engine {
+	r := testRouter(cfg)
+	r.POST("/flush", FlushHandler(cfg))
+	r.POST("/:id/invalidate", InvalidateHandler(cfg))
+	return r
+}
+
+// adminRequest posts to path on r and returns the response status
+func adminRequest(r *gin.Engine, path string) int {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", path, nil))
+	return w.Code
+}
+
+func TestAdminHandlersCustomStore(t *testing.T) {
+	cfg := testConfig()
+	cfg.Store = NewMemoryStore()
+	r := adminRouter(cfg)
+
+	cookie := generateCookie(t, r)
+	if code := adminRequest(r, "/"+cookie.Value+"/invalidate"); code != 200 {
+		t.Fatalf("invalidate: %d", code)
+	}
+	if w := verifyRequest(r, cookie, "abc123"); w.Code == 200 {
+		t.Error("an invalidated captcha verified")
+	}
+
+	cookie = generateCookie(t, r)
+	if code := adminRequest(r, "/flush"); code != 200 {
+		t.Fatalf("flush: %d", code)
+	}
+	if w := verifyRequest(r, cookie, "abc123"); w.Code == 200 {
+		t.Error("a flushed captcha verified")
+	}
+}
+
+func TestAdminUnsupportedStore(t *testing.T) {
+	cfg := testConfig()
+	cfg.Store = plainStore{NewMemoryStore()}
+	r := adminRouter(cfg)
+
+	if err := store.Flush(context.Background(), cfg); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Flush = %v, want ErrUnsupported", err)
+	}
+	if err := store.Invalidate(context.Background(), "id", cfg); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Invalidate = %v, want ErrUnsupported", err)
+	}
+	for _, path := range []string{"/flush", "/id/invalidate"} {
+		if code := adminRequest(r, path); code != http.StatusInternalServerError {
+			t.Errorf("%s: %d, want 500", path, code)
+		}
+	}
+}
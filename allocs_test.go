@@ -0,0 +1,15 @@
+package middleware_test
+
+import (
+	"testing"
+
+	"github.com/wprimadi/gin-captcha/captchabench"
+)
+
+func TestGenerateAllocBudget(t *testing.T) {
+	if testing.Short() {
+		t.Skip("measures many requests")
+	}
+	t.Logf("%.0f allocations per request, budget %d", captchabench.AllocsPerGenerate(), captchabench.GenerateAllocBudget)
+	captchabench.CheckAllocs(t)
+}
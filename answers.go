@@ -0,0 +1,182 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrCodeLengthMismatch is returned in StrictLength mode for answers of the wrong length
+const ErrCodeLengthMismatch = "captcha_length_mismatch"
+
+// Input modes of the JSON generation responses, for the inputmode attribute
+// of the answer field
+const (
+	InputModeNumeric = "numeric" // Every answer is made of digits, e.g. TypeNumeric
+	InputModeText    = "text"
+)
+
+// answerHash holds the hashes of an accepted answer, as typed, with letters
+// folded to lower case, and for numeric answers without leading zeros
+type answerHash struct {
+	exact  [32]byte
+	folded [32]byte
+	digits [32]byte // Zero unless the answer is all digits
+}
+
+// hashAnswers hashes every accepted answer of a captcha
+func hashAnswers(answers ...string) []answerHash {
+	hashes := make([]answerHash, len(answers))
+	for i, answer := range answers {
+		hashes[i] = answerHash{
+			exact:  sha256.Sum256([]byte(answer)),
+			folded: sha256.Sum256([]byte(foldedNormalizer.Normalize(answer))),
+		}
+		if isDigits(answer) {
+			hashes[i].digits = sha256.Sum256([]byte(digitsNormalizer.Normalize(answer)))
+		}
+	}
+	return hashes
+}
+
+// accepts reports whether input is one of the accepted answers of the
+// captcha, once normalized by cfg.Normalizer. Numeric answers are compared
+// as typed, leading zeros included, unless cfg.NumericLenient is set or
+// cfg.Type is TypeMath.
+// Entries stored without answer hashes accept their value only. Puzzle
+// captchas are only accepted by the verification of puzzles, and the other
+// way round.
+func (d captchaData) accepts(input string, cfg CaptchaConfig) bool {
+	if d.puzzle || cfg.puzzle {
+		return d.puzzle && cfg.puzzle && d.acceptsPosition(input, cfg.puzzleTolerance())
+	}
+
+	n := cfg.Normalizer()
+	input = n.Normalize(input)
+
+	if len(d.answers) == 0 {
+		return input == n.Normalize(d.value)
+	}
+
+	sum := sha256.Sum256([]byte(input))
+	accepted := 0
+	for _, answer := range d.answers {
+		expected := answer.normalized(input, cfg)
+		accepted |= subtle.ConstantTimeCompare(sum[:], expected[:])
+	}
+	return accepted == 1
+}
+
+// normalized returns the hash of the answer normalized like input was by
+// cfg.Normalizer: without leading zeros when TrimNumber made a number of
+// it, folded unless CaseSensitive, as typed otherwise
+func (h answerHash) normalized(input string, cfg CaptchaConfig) [32]byte {
+	if cfg.numericLenient() && isDigits(input) {
+		return h.digits
+	}
+	if cfg.CaseSensitive {
+		return h.exact
+	}
+	return h.folded
+}
+
+// answerLengths returns the rune lengths of the shortest and the longest
+// answer
+func answerLengths(answers []string) (int, int) {
+	minLength, maxLength := 0, 0
+	for i, answer := range answers {
+		n := utf8.RuneCountInString(answer)
+		if i == 0 || n < minLength {
+			minLength = n
+		}
+		maxLength = max(maxLength, n)
+	}
+	return minLength, maxLength
+}
+
+// lengthMatches reports whether input has a length accepts could match.
+// Numeric answers compared leniently may have more or fewer
+// leading zeros and be surrounded by spaces. Entries stored without lengths
+// match any input.
+func (d captchaData) lengthMatches(input string, cfg CaptchaConfig) bool {
+	if d.maxLength == 0 {
+		return true
+	}
+	if cfg.TrimAnswers {
+		input = collapseSpace(input)
+	}
+	if cfg.numericLenient() {
+		if number := TrimNumber.Apply(input); isDigits(number) {
+			return len(number) <= d.maxLength
+		}
+	}
+	n := utf8.RuneCountInString(input)
+	return n >= d.minLength && n <= d.maxLength
+}
+
+// inputMode returns the input mode suited to the answers of the captcha
+func (d captchaData) inputMode() string {
+	if d.numeric {
+		return InputModeNumeric
+	}
+	return InputModeText
+}
+
+// allDigits reports whether every answer is made of digits
+func allDigits(answers []string) bool {
+	for _, answer := range answers {
+		if !isDigits(answer) {
+			return false
+		}
+	}
+	return len(answers) > 0
+}
+
+// foldCase folds the letter case of s, so that strings equal under
+// strings.EqualFold fold the same: each letter becomes the lower case of the
+// smallest of its case variants, e.g. "K", "k" and the Kelvin sign "K" all
+// fold to "k". ASCII letters are lowered as before.
+func foldCase(s string) string {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r < utf8.RuneSelf {
+			b = append(b, toLower(byte(r)))
+			continue
+		}
+		b = utf8.AppendRune(b, foldRune(r))
+	}
+	return string(b)
+}
+
+// foldRune returns the lower case of the smallest case variant of r
+func foldRune(r rune) rune {
+	smallest := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		smallest = min(smallest, f)
+	}
+	return unicode.ToLower(smallest)
+}
+
+// isDigits reports whether s is a non-empty string of ASCII digits
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// trimZeros drops the leading zeros of a numeric answer, keeping one digit
+func trimZeros(s string) string {
+	trimmed := strings.TrimLeft(s, "0")
+	if trimmed == "" {
+		return "0"
+	}
+	return trimmed
+}
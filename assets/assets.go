@@ -0,0 +1,99 @@
+// Package assets embeds the default assets of the captcha middleware at
+// build time, so deployments without filesystem access have them: the Go
+// Bold font, for configs and renderers drawing with a TrueType font, the
+// script of the accessible widget, the default word list of TypeWord and the
+// English voice samples of audio captchas.
+//
+// The files are embedded as they are committed in the repository, so every
+// build of a given version carries the same bytes.
+package assets
+
+import (
+	"embed"
+	"io/fs"
+	"sync"
+
+	"golang.org/x/image/font/opentype"
+)
+
+//go:generate go run ./internal/voicegen -o voices/en
+
+// FontName is the name of the embedded font
+const FontName = "Go Bold"
+
+var (
+	//go:embed fonts/Go-Bold.ttf
+	fontTTF []byte
+
+	//go:embed widget.js
+	widgetJS []byte
+
+	//go:embed words.txt
+	wordsTxt []byte
+
+	//go:embed voices
+	voices embed.FS
+)
+
+// FontTTF returns the embedded font file. The bytes are shared and must not
+// be modified.
+func FontTTF() []byte {
+	return fontTTF
+}
+
+// parsedFont is the embedded font, parsed on first use
+var parsedFont = sync.OnceValue(func() *opentype.Font {
+	f, err := opentype.Parse(fontTTF)
+	if err != nil {
+		// The embedded file is known to be valid
+		panic("assets: parse embedded font: " + err.Error())
+	}
+	return f
+})
+
+// Font returns the embedded font, parsed once and shared between callers
+func Font() *opentype.Font {
+	return parsedFont()
+}
+
+// WidgetScript returns the script of the widget rendered by WidgetHTML: a
+// function expression taking the element ID prefix, the widget text and the
+// refresh and audio URLs. The bytes are shared and must not be modified.
+func WidgetScript() []byte {
+	return widgetJS
+}
+
+// Wordlist returns the default word list of TypeWord, one word per line,
+// lines starting with "#" being comments. The bytes are shared and must not
+// be modified.
+func Wordlist() []byte {
+	return wordsTxt
+}
+
+// Voices returns the embedded voice samples: a directory per language, such
+// as "en", holding one 8 kHz WAV file per digit and letter. They are made by
+// a formant synthesizer, see internal/voicegen.
+func Voices() fs.FS {
+	sub, _ := fs.Sub(voices, "voices")
+	return sub
+}
+
+// voicesSize is the total size of the voice samples
+var voicesSize = sync.OnceValue(func() int {
+	size := 0
+	fs.WalkDir(voices, ".", func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += int(info.Size())
+			}
+		}
+		return nil
+	})
+	return size
+})
+
+// Size returns the total size of the embedded assets in bytes, so their
+// growth can be watched
+func Size() int {
+	return len(fontTTF) + len(widgetJS) + len(wordsTxt) + voicesSize()
+}
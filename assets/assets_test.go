@@ -0,0 +1,44 @@
+package assets
+
+import (
+	"bytes"
+	"io/fs"
+	"testing"
+)
+
+// maxSize is the budget of the embedded assets, so that their growth is
+// caught in review rather than in every binary importing the middleware
+const maxSize = 300 << 10
+
+func TestSize(t *testing.T) {
+	if size := Size(); size > maxSize {
+		t.Errorf("embedded assets take %d bytes, over the %d byte budget", size, maxSize)
+	}
+}
+
+func TestAccessors(t *testing.T) {
+	if len(FontTTF()) == 0 || Font().NumGlyphs() == 0 {
+		t.Error("no embedded font")
+	}
+	if Font() != Font() {
+		t.Error("font parsed twice")
+	}
+	if !bytes.Contains(WidgetScript(), []byte("function")) {
+		t.Error("no widget script")
+	}
+	if len(Wordlist()) == 0 {
+		t.Error("no word list")
+	}
+}
+
+func TestVoices(t *testing.T) {
+	for _, char := range "0123456789abcdefghijklmnopqrstuvwxyz" {
+		data, err := fs.ReadFile(Voices(), "en/"+string(char)+".wav")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, []byte("RIFF")) {
+			t.Errorf("%c.wav is not a WAV file", char)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+// Command voicegen synthesizes the English voice samples embedded by the
+// assets package: one WAV file per digit, letter and arithmetic operator of
+// math captchas, saying its name with
+// a small formant synthesizer. The voice is robotic but needs no recordings,
+// so the samples can be rebuilt from this file alone:
+//
+//	go generate ./assets
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"log"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	synthRate  = 16000 // Rate the voice is synthesized at
+	outputRate = 8000  // Rate the samples are written at, to keep them small
+)
+
+// params are the synthesizer controls at an instant, interpolated between
+// the targets of the phones
+type params struct {
+	f1, f2, f3 float64 // Formant frequencies in Hz
+	b1, b2, b3 float64 // Formant bandwidths in Hz
+	av         float64 // Voicing amplitude
+	ah         float64 // Aspiration amplitude, through the formants
+	af         float64 // Frication amplitude, through its own resonator
+	ff, bf     float64 // Frication center frequency and bandwidth in Hz
+}
+
+// lerp returns the params t of the way from p to q
+func (p params) lerp(q params, t float64) params {
+	mix := func(a, b float64) float64 { return a + (b-a)*t }
+	return params{
+		f1: mix(p.f1, q.f1), f2: mix(p.f2, q.f2), f3: mix(p.f3, q.f3),
+		b1: mix(p.b1, q.b1), b2: mix(p.b2, q.b2), b3: mix(p.b3, q.b3),
+		av: mix(p.av, q.av), ah: mix(p.ah, q.ah), af: mix(p.af, q.af),
+		ff: mix(p.ff, q.ff), bf: mix(p.bf, q.bf),
+	}
+}
+
+// phone is a speech sound: its params glide from start to end over its
+// duration, after a transition of trans from those of the previous phone
+type phone struct {
+	start, end params
+	dur        int // Default duration in ms
+	trans      int // Transition from the previous phone in ms
+}
+
+// voiced returns the phone of a vowel or an approximant with the given
+// formants, gliding from the first three to the last three if six are given
+func voiced(av float64, dur int, f ...float64) phone {
+	p := params{f1: f[0], f2: f[1], f3: f[2], b1: 70, b2: 100, b3: 150, av: av}
+	q := p
+	if len(f) == 6 {
+		q.f1, q.f2, q.f3 = f[3], f[4], f[5]
+	}
+	return phone{start: p, end: q, dur: dur, trans: 35}
+}
+
+// nasal returns the murmur of a nasal consonant
+func nasal(f2 float64) phone {
+	p := params{f1: 270, f2: f2, f3: 2500, b1: 120, b2: 300, b3: 300, av: 0.35}
+	return phone{start: p, end: p, dur: 100, trans: 20}
+}
+
+// fricative returns a noise phone, with some voicing for voiced ones
+func fricative(av, af, ff, bf float64, dur int) phone {
+	p := params{f1: 300, f2: 1500, f3: 2500, b1: 200, b2: 200, b3: 300, av: av, af: af, ff: ff, bf: bf}
+	return phone{start: p, end: p, dur: dur, trans: 15}
+}
+
+// closure returns the silence of a stop, with the formant locus the next
+// vowel glides from and a faint voice bar for voiced stops
+func closure(av, f2, f3 float64, dur int) phone {
+	p := params{f1: 250, f2: f2, f3: f3, b1: 100, b2: 150, b3: 200, av: av}
+	return phone{start: p, end: p, dur: dur, trans: 10}
+}
+
+// burst returns the release of a stop
+func burst(af, ff, bf, f2, f3 float64, dur int) phone {
+	p := params{f1: 250, f2: f2, f3: f3, b1: 100, b2: 150, b3: 200, af: af, ff: ff, bf: bf}
+	return phone{start: p, end: p, dur: dur, trans: 2}
+}
+
+// aspiration returns the breath following a voiceless stop, shaped by the
+// formants of the vowel it precedes
+func aspiration(dur int) phone {
+	return phone{start: params{ah: 0.35, b1: 200, b2: 150, b3: 200}, dur: dur, trans: 5}
+}
+
+// phones are the sounds the names of the digits and letters are made of.
+// The formants are those of an adult male voice of American English.
+var phones = map[string]phone{
+	"iy": voiced(1, 200, 280, 2250, 2900),
+	"ih": voiced(1, 80, 400, 1900, 2550),
+	"ey": voiced(1, 220, 480, 2000, 2600, 320, 2250, 2850),
+	"eh": voiced(1, 120, 550, 1770, 2490),
+	"aa": voiced(1, 150, 710, 1100, 2540),
+	"ao": voiced(1, 130, 590, 880, 2540),
+	"ow": voiced(1, 220, 520, 920, 2400, 380, 820, 2300),
+	"uw": voiced(1, 200, 320, 950, 2200, 300, 850, 2200),
+	"ah": voiced(1, 120, 620, 1220, 2550),
+	"ax": voiced(0.8, 50, 500, 1400, 2500),
+	"ay": voiced(1, 220, 720, 1200, 2500, 380, 2000, 2600),
+	"r":  voiced(0.8, 80, 330, 1100, 1500),
+	"l":  voiced(0.6, 80, 360, 1050, 2700),
+	"w":  voiced(0.7, 60, 300, 650, 2200),
+	"y":  voiced(0.7, 60, 280, 2150, 3000),
+	"m":  nasal(1000),
+	"n":  nasal(1600),
+	"s":  fricative(0, 0.8, 4200, 1200, 120),
+	"z":  fricative(0.35, 0.5, 4200, 1200, 90),
+	"sh": fricative(0, 0.8, 2600, 900, 110),
+	"zh": fricative(0.35, 0.6, 2600, 900, 70),
+	"f":  fricative(0, 0.08, 3000, 3000, 100),
+	"th": fricative(0, 0.06, 3200, 3500, 90),
+	"v":  fricative(0.5, 0.06, 3000, 3000, 70),
+	"h":  aspiration(70),
+
+	// Stops are split into their closure, burst and aspiration, the
+	// closure holding the locus of the formant transition
+	"p.": closure(0, 900, 2300, 45),
+	"p":  burst(0.4, 1000, 1500, 900, 2300, 8),
+	"b.": closure(0.12, 900, 2300, 35),
+	"b":  burst(0.3, 1000, 1500, 900, 2300, 7),
+	"t.": closure(0, 1800, 2700, 45),
+	"t":  burst(0.8, 3800, 1500, 1800, 2700, 10),
+	"d.": closure(0.12, 1800, 2700, 30),
+	"d":  burst(0.6, 3800, 1500, 1800, 2700, 8),
+	"k.": closure(0, 2000, 2500, 45),
+	"k":  burst(0.7, 2000, 600, 2000, 2500, 12),
+	"-":  aspiration(45),
+}
+
+// words are the names of the digits, letters and operators, as phones
+// optionally followed by a duration in ms
+var words = map[string]string{
+	"0": "z:80 iy:70 r:60 ow:170",
+	"1": "w:60 ah:150 n:110",
+	"2": "t. t -:50 uw:200",
+	"3": "th:90 r:50 iy:190",
+	"4": "f:90 ao:130 r:130",
+	"5": "f:90 ay:220 v:80",
+	"6": "s:100 ih:90 k.:50 k -:20 s:100",
+	"7": "s:100 eh:100 v:60 ax:50 n:90",
+	"8": "ey:230 t.:50 t:15 -:30",
+	"9": "n:80 ay:200 n:110",
+	"a": "ey:300",
+	"b": "b.:30 b iy:240",
+	"c": "s:110 iy:220",
+	"d": "d. d iy:240",
+	"e": "iy:280",
+	"f": "eh:140 f:140",
+	"g": "d.:40 zh:70 iy:220",
+	"h": "ey:200 t.:50 sh:110",
+	"i": "ay:300",
+	"j": "d.:40 zh:70 ey:240",
+	"k": "k. k -:45 ey:220",
+	"l": "eh:130 l:160",
+	"m": "eh:130 m:160",
+	"n": "eh:130 n:160",
+	"o": "ow:300",
+	"p": "p. p -:45 iy:220",
+	"q": "k.:40 k -:40 y:60 uw:200",
+	"r": "aa:160 r:170",
+	"s": "eh:130 s:150",
+	"t": "t. t -:45 iy:220",
+	"u": "y:70 uw:230",
+	"v": "v:80 iy:230",
+	"w": "d.:25 d ah:80 b.:35 b ax:35 l:50 y:45 uw:170",
+	"x": "eh:120 k.:35 k -:20 s:140",
+	"y": "w:70 ay:260",
+	"z": "z:100 iy:230",
+
+	"plus":   "p. p -:35 l:50 ah:110 s:120",
+	"minus":  "m:80 ay:150 n:60 ax:50 s:110",
+	"times":  "t. t -:35 ay:170 m:70 z:100",
+	"equals": "iy:110 k.:40 k w:50 ax:50 l:60 z:100",
+}
+
+// keyframe is a point of the params track
+type keyframe struct {
+	at int // Sample index
+	p  params
+}
+
+// track returns the keyframes of the spelled phones and the length of the
+// word in samples
+func track(spec string) ([]keyframe, int) {
+	ms := func(n int) int { return n * synthRate / 1000 }
+
+	var frames []keyframe
+	at := 0
+	for _, token := range strings.Fields(spec) {
+		name, durText, _ := strings.Cut(token, ":")
+		ph, ok := phones[name]
+		if !ok {
+			log.Fatalf("unknown phone %q", name)
+		}
+		dur := ph.dur
+		if durText != "" {
+			dur, _ = strconv.Atoi(durText)
+		}
+
+		// Aspiration takes the formants of the phone it precedes, and
+		// a phone without formants of its own keeps those before it
+		if len(frames) == 0 {
+			silent := ph.start
+			silent.av, silent.ah, silent.af = 0, 0, 0
+			frames = append(frames, keyframe{0, silent})
+			at = ms(10)
+		}
+		if ph.start.f1 == 0 {
+			prev := frames[len(frames)-1].p
+			ph.start.f1, ph.start.f2, ph.start.f3 = prev.f1, prev.f2, prev.f3
+			ph.end = ph.start
+		}
+
+		trans := min(ph.trans, dur)
+		frames = append(frames, keyframe{at + ms(trans), ph.start}, keyframe{at + ms(dur), ph.end})
+		at += ms(dur)
+	}
+
+	// Aspiration glides to the formants of the phone following it
+	for i := 1; i+2 < len(frames); i += 2 {
+		if frames[i].p.ah > 0 {
+			next := frames[i+2].p
+			for _, j := range []int{i, i + 1} {
+				frames[j].p.f1, frames[j].p.f2, frames[j].p.f3 = next.f1, next.f2, next.f3
+			}
+		}
+	}
+
+	last := frames[len(frames)-1].p
+	last.av, last.ah, last.af = 0, 0, 0
+	end := at + ms(25)
+	return append(frames, keyframe{end, last}), end
+}
+
+// resonator is a second order filter with unity gain at 0 Hz, as in the
+// cascade of formants of a Klatt synthesizer
+type resonator struct {
+	y1, y2 float64
+}
+
+func (r *resonator) step(x, f, bw float64) float64 {
+	c := -math.Exp(-2 * math.Pi * bw / synthRate)
+	b := 2 * math.Exp(-math.Pi*bw/synthRate) * math.Cos(2*math.Pi*f/synthRate)
+	a := 1 - b - c
+	y := a*x + b*r.y1 + c*r.y2
+	r.y2, r.y1 = r.y1, y
+	return y
+}
+
+// bandpass is a second order filter with unity gain at its center, shaping
+// the frication noise
+type bandpass struct {
+	x1, x2, y1, y2 float64
+}
+
+func (r *bandpass) step(x, f, bw float64) float64 {
+	w := 2 * math.Pi * f / synthRate
+	alpha := math.Sin(w) * math.Sinh(math.Ln2/2*bw/f*w/math.Sin(w))
+	a0 := 1 + alpha
+	y := (alpha*x - alpha*r.x2 + 2*math.Cos(w)*r.y1 - (1-alpha)*r.y2) / a0
+	r.x2, r.x1 = r.x1, x
+	r.y2, r.y1 = r.y1, y
+	return y
+}
+
+// synthesize returns the waveform of the word at synthRate
+func synthesize(spec string, rnd *rand.Rand) []float64 {
+	frames, n := track(spec)
+	out := make([]float64, n)
+
+	var f1, f2, f3, f4, tilt resonator
+	var fric bandpass
+	phase, k := 0.0, 0
+	for i := range out {
+		for k+1 < len(frames)-1 && frames[k+1].at <= i {
+			k++
+		}
+		from, to := frames[k], frames[k+1]
+		t := 0.0
+		if to.at > from.at {
+			t = min(float64(i-from.at)/float64(to.at-from.at), 1)
+		}
+		p := from.p.lerp(to.p, t)
+
+		// The pitch rises a little then falls, as words said alone do
+		pos := float64(i) / float64(n)
+		f0 := 118 + 14*math.Sin(math.Pi*min(pos*2.5, 1)) - 24*pos
+		phase += f0 / synthRate
+		if phase >= 1 {
+			phase--
+		}
+
+		// Derivative of the glottal flow, open 60% of the period
+		glottal := 0.0
+		if x := phase / 0.6; x < 1 {
+			glottal = 2*x - 3*x*x
+		}
+		noise := rnd.Float64()*2 - 1
+
+		src := tilt.step(glottal*p.av, 0, 3000) + noise*p.ah
+		y := f1.step(src, p.f1, p.b1)
+		y = f2.step(y, p.f2, p.b2)
+		y = f3.step(y, p.f3, p.b3)
+		y = f4.step(y, 3500, 250)
+		if p.af > 0 {
+			y += fric.step(noise*p.af, p.ff, p.bf)
+		} else {
+			fric.step(0, 1000, 1000)
+		}
+		out[i] = y
+	}
+	return out
+}
+
+// decimate halves the rate of data after a low-pass filter below the new
+// Nyquist frequency
+func decimate(data []float64) []float64 {
+	const taps = 31
+	var kernel [taps]float64
+	for i := range kernel {
+		x := float64(i - taps/2)
+		sinc := 0.45
+		if x != 0 {
+			sinc = math.Sin(math.Pi*0.45*x) / (math.Pi * x)
+		}
+		window := 0.54 - 0.46*math.Cos(2*math.Pi*float64(i)/(taps-1))
+		kernel[i] = sinc * window
+	}
+
+	out := make([]float64, len(data)/2)
+	for i := range out {
+		sum := 0.0
+		for j, c := range kernel {
+			if k := 2*i + j - taps/2; k >= 0 && k < len(data) {
+				sum += c * data[k]
+			}
+		}
+		out[i] = sum
+	}
+	return out
+}
+
+// encodeWAV returns data as an 8-bit mono PCM WAV file, normalized to a peak
+// of 90% of the full scale
+func encodeWAV(data []float64) []byte {
+	peak := 0.0
+	for _, v := range data {
+		peak = max(peak, math.Abs(v))
+	}
+
+	pcm := make([]byte, len(data))
+	for i, v := range data {
+		pcm[i] = byte(128 + math.Round(v/peak*0.9*127))
+	}
+
+	var buf bytes.Buffer
+	le := func(v any) { binary.Write(&buf, binary.LittleEndian, v) }
+	buf.WriteString("RIFF")
+	le(uint32(36 + len(pcm) + len(pcm)%2))
+	buf.WriteString("WAVEfmt ")
+	le(uint32(16))
+	le(uint16(1)) // PCM
+	le(uint16(1)) // Mono
+	le(uint32(outputRate))
+	le(uint32(outputRate)) // Bytes per second
+	le(uint16(1))          // Bytes per frame
+	le(uint16(8))          // Bits per sample
+	buf.WriteString("data")
+	le(uint32(len(pcm)))
+	buf.Write(pcm)
+	if len(pcm)%2 == 1 {
+		buf.WriteByte(0) // Chunks are padded to an even size
+	}
+	return buf.Bytes()
+}
+
+func main() {
+	dir := flag.String("o", "voices/en", "directory the WAV files are written to")
+	flag.Parse()
+
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		log.Fatal(err)
+	}
+	for name, spec := range words {
+		// Seeded per word, so the files don't depend on the map order
+		rnd := rand.New(rand.NewPCG(uint64(name[0]), uint64(len(name)-1)))
+		wav := encodeWAV(decimate(synthesize(spec, rnd)))
+		if err := os.WriteFile(filepath.Join(*dir, name+".wav"), wav, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Behavior of the widget rendered by WidgetHTML: the refresh and audio
+// buttons. The markup calls this function with the element ID prefix, the
+// widget text and the configured URLs.
+(function (prefix, text, refreshURL, audioURL) {
+  var el = function (name) { return document.getElementById(prefix + "-" + name); };
+  var status = el("status"), audio = el("audio"), toggle = el("audio-toggle");
+  function stopAudio() {
+    if (!audio) return;
+    audio.pause();
+    toggle.setAttribute("aria-pressed", "false");
+    toggle.textContent = text.PlayAudio;
+  }
+  if (refreshURL) {
+    el("refresh").addEventListener("click", function () {
+      stopAudio();
+      fetch(refreshURL, { method: "POST", headers: { "Content-Type": "application/json" }, body: "{}" })
+        .then(function (res) { if (!res.ok) throw new Error(res.status); return res.json(); })
+        .then(function (data) {
+          el("image").src = "data:image/png;base64," + data.image;
+          el("id").value = data.captcha_id;
+          el("answer").value = "";
+          el("answer").setAttribute("inputmode", data.input_mode);
+          status.textContent = text.Refreshed;
+        })
+        .catch(function () { status.textContent = text.Failed; });
+    });
+  }
+  if (audioURL) {
+    audio.addEventListener("ended", stopAudio);
+    toggle.addEventListener("click", function () {
+      if (toggle.getAttribute("aria-pressed") === "true") {
+        stopAudio();
+        return;
+      }
+      audio.src = audioURL.replace(":id", encodeURIComponent(el("id").value));
+      audio.play();
+      toggle.setAttribute("aria-pressed", "true");
+      toggle.textContent = text.StopAudio;
+    });
+  }
+})
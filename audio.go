@@ -0,0 +1,296 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wprimadi/gin-captcha/assets"
+)
+
+// audioSampleRate is the rate every audio captcha is mixed and served at
+const audioSampleRate = 16000
+
+// SamplePack provides the voice recordings of one language
+type SamplePack interface {
+	// Sample returns the recording of char, false if the pack has none.
+	// The operators of TypeMath are asked for as '+', '-', '×' and '='.
+	Sample(char rune) (Sample, bool)
+}
+
+var (
+	samplePacksMu sync.RWMutex
+	samplePacks   = map[string]SamplePack{"en": embeddedPack{}}
+)
+
+// embeddedPack is the English pack of the assets package, registered by
+// default and decoded on first use
+type embeddedPack struct{}
+
+// embeddedSamples are the decoded samples of embeddedPack
+var embeddedSamples = sync.OnceValue(func() SamplePack {
+	pack, err := LoadWAVPack(assets.Voices(), "en")
+	if err != nil {
+		// The embedded files are known to be valid
+		panic("captcha: load embedded voices: " + err.Error())
+	}
+	return pack
+})
+
+func (embeddedPack) Sample(char rune) (Sample, bool) {
+	return embeddedSamples().Sample(char)
+}
+
+// RegisterSamplePack makes pack available for the language, identified by
+// its primary subtag such as "en", "id" or "es". Registering "en" replaces
+// the embedded English pack.
+func RegisterSamplePack(lang string, pack SamplePack) {
+	samplePacksMu.Lock()
+	samplePacks[strings.ToLower(lang)] = pack
+	samplePacksMu.Unlock()
+}
+
+// samplePack returns the pack registered for the language
+func samplePack(lang string) (SamplePack, bool) {
+	samplePacksMu.RLock()
+	pack, ok := samplePacks[strings.ToLower(lang)]
+	samplePacksMu.RUnlock()
+	return pack, ok
+}
+
+// audioAvailable reports whether any sample pack is registered, which the
+// embedded one is unless replaced
+func audioAvailable() bool {
+	samplePacksMu.RLock()
+	defer samplePacksMu.RUnlock()
+	return len(samplePacks) > 0
+}
+
+// wavPack is a SamplePack loaded from WAV files
+type wavPack map[rune]Sample
+
+func (p wavPack) Sample(char rune) (Sample, bool) {
+	s, ok := p[char]
+	return s, ok
+}
+
+// namedSamples are the characters whose WAV files are named after the word
+// they speak rather than the character, the operators of TypeMath
+var namedSamples = map[string]rune{"plus": '+', "minus": '-', "times": '×', "equals": '='}
+
+// LoadWAVPack reads a sample pack from the WAV files of dir, each named after
+// the character it speaks, such as "7.wav" or "k.wav", or for the TypeMath
+// operators, "plus.wav", "minus.wav", "times.wav" and "equals.wav". Letters
+// are spoken the same in both cases, so a single file per letter is enough.
+func LoadWAVPack(fsys fs.FS, dir string) (SamplePack, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pack := make(wavPack)
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".wav")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		char, ok := namedSamples[name]
+		if !ok && utf8.RuneCountInString(name) != 1 {
+			continue
+		}
+		if !ok {
+			char, _ = utf8.DecodeRuneInString(name)
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		sample, err := DecodeWAV(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+
+		sample = resample(sample, audioSampleRate)
+		pack[unicode.ToLower(char)] = sample
+		pack[unicode.ToUpper(char)] = sample
+	}
+
+	if len(pack) == 0 {
+		return nil, fmt.Errorf("no samples found in %s", dir)
+	}
+	return pack, nil
+}
+
+// audioLanguage picks the sample pack for the request: the first language of
+// the Accept-Language header with a registered pack, or cfg.AudioLanguage
+func audioLanguage(c *gin.Context, cfg CaptchaConfig) (SamplePack, bool) {
+	for _, part := range strings.Split(c.GetHeader("Accept-Language"), ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		primary, _, _ := strings.Cut(tag, "-")
+		if pack, ok := samplePack(primary); ok {
+			return pack, true
+		}
+	}
+	return samplePack(cfg.AudioLanguage)
+}
+
+// spokenText returns the characters text is spoken with. The spaces between
+// the tokens of TypeMath expressions are skipped and their operators are
+// spoken by name, "x" and "×" as '×' and "−" as '-', not as letters. The
+// punctuation of TypeQuestion questions is skipped, their spaces are kept
+// as pauses between the words.
+func spokenText(cfg CaptchaConfig, text string) string {
+	switch cfg.Type {
+	case TypeMath:
+		return strings.Map(func(r rune) rune {
+			switch r {
+			case ' ':
+				return -1
+			case 'x', '*':
+				return '×'
+			case '−':
+				return '-'
+			}
+			return r
+		}, text)
+	case TypeQuestion:
+		return strings.Map(func(r rune) rune {
+			switch {
+			case unicode.IsSpace(r):
+				return ' '
+			case unicode.IsPunct(r), unicode.IsSymbol(r):
+				return -1
+			}
+			return r
+		}, text)
+	}
+	return text
+}
+
+// generateCaptchaAudio spells text with the pack samples, separated by random
+// gaps and mixed with background noise, spaces making longer pauses. Like
+// the image, the audio only depends on its arguments.
+func generateCaptchaAudio(text string, seed [32]byte, pack SamplePack) (Sample, error) {
+	rnd := newSeededSource(seed)
+	defer rnd.release()
+
+	var data []int16
+	silence := func(ms int) {
+		data = append(data, make([]int16, audioSampleRate*ms/1000)...)
+	}
+
+	silence(300 + rnd.Intn(300))
+	for _, char := range text {
+		if char == ' ' {
+			silence(300 + rnd.Intn(200))
+			continue
+		}
+		sample, ok := pack.Sample(char)
+		if !ok {
+			return Sample{}, fmt.Errorf("no audio sample for %q", char)
+		}
+		data = append(data, resample(sample, audioSampleRate).Data...)
+		silence(250 + rnd.Intn(500))
+	}
+
+	// Background noise at a random low level
+	level := 600 + rnd.Intn(900)
+	for i, v := range data {
+		noise := rnd.Intn(2*level+1) - level
+		data[i] = int16(max(min(int(v)+noise, 32767), -32768))
+	}
+
+	return Sample{Rate: audioSampleRate, Data: data}, nil
+}
+
+// CaptchaAudio is a handler serving the audio version of an existing captcha,
+// whose ID is read from the "id" route parameter. It spells the same answer
+// as the image, in the language picked from the Accept-Language header, and
+// neither resets nor consumes the captcha.
+func CaptchaAudio(config ...CaptchaConfig) gin.HandlerFunc {
+	cfg := DefaultCaptchaConfig()
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+
+	mustFitAudioBudget(cfg)
+
+	return func(c *gin.Context) {
+		serveAudio(c, cfg, c.Param("id"))
+	}
+}
+
+// audioIDSources are where GenerateCaptchaAudio reads the captcha ID, first
+// found wins
+var audioIDSources = []Source{SourceQuery, SourceCookie, SourceHeader}
+
+// GenerateCaptchaAudio is a handler serving the audio version of the captcha
+// the client was just shown, like CaptchaAudio but for routes without an ID
+// parameter. It reads the ID sent along with the image of GenerateCaptcha:
+// the IDField query parameter, the IDCookie cookie or the IDHeader header.
+func GenerateCaptchaAudio(config ...CaptchaConfig) gin.HandlerFunc {
+	cfg := DefaultCaptchaConfig()
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+
+	mustValidNames(cfg)
+	mustFitAudioBudget(cfg)
+
+	return func(c *gin.Context) {
+		clientID, _ := readSources(c, cfg.idNames(), audioIDSources, false)
+		if clientID == "" {
+			c.JSON(400, gin.H{"error": "Captcha ID not found"})
+			return
+		}
+		serveAudio(c, cfg, clientID)
+	}
+}
+
+// serveAudio responds with the audio of the captcha with the given ID
+func serveAudio(c *gin.Context, cfg CaptchaConfig, clientID string) {
+	captchaID, data, ok := lookupCaptcha(c, cfg, clientID)
+	if !ok {
+		return
+	}
+	cfg.state().reportFunnel(FunnelFetched, captchaID, data)
+
+	pack, ok := audioLanguage(c, cfg)
+	if !ok {
+		c.JSON(404, gin.H{"error": "Audio captcha not available"})
+		return
+	}
+
+	if clientGone(c, cfg) {
+		return
+	}
+
+	text := spokenText(cfg.withVariant(data.variant), data.value)
+	audio, err := generateCaptchaAudio(text, data.seed, pack)
+	if err != nil {
+		logError(c, cfg, captchaID, err)
+		c.JSON(500, gin.H{"error": "Failed to generate captcha audio"})
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := encodeWAV(&buf, audio); err != nil {
+		logError(c, cfg, captchaID, err)
+		c.JSON(500, gin.H{"error": "Failed to generate captcha audio"})
+		return
+	}
+	if budget := cfg.responseBudget(); budget > 0 && buf.Len() > budget {
+		logError(c, cfg, captchaID, fmt.Errorf("%w: audio response of %d bytes, limit is %d bytes",
+			ErrResponseTooLarge, buf.Len(), budget))
+		c.JSON(500, gin.H{"error": "Failed to generate captcha audio"})
+		return
+	}
+	writeBody(c, "audio/wav", buf.Bytes())
+}
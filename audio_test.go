@@ -0,0 +1,204 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestEmbeddedVoice(t *testing.T) {
+	for _, char := range charset(TypeAlphanumeric) + "+-×=" {
+		if _, ok := (embeddedPack{}).Sample(char); !ok {
+			t.Errorf("no embedded sample for %q", char)
+		}
+	}
+	if err := checkAudioBudget(DefaultCaptchaConfig(), embeddedPack{}); err != nil {
+		t.Errorf("default config: %v", err)
+	}
+	if !audioAvailable() {
+		t.Fatal("no sample pack registered by default")
+	}
+
+	cfg := testConfig()
+	r := gin.New()
+	r.GET("/captcha/new", NewCaptcha(cfg))
+	r.GET("/captcha/:id/audio", CaptchaAudio(cfg))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/captcha/new", nil))
+	var resp struct {
+		AudioURL string `json:"audio_url"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.AudioURL == "" {
+		t.Fatalf("no audio_url in %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", resp.AudioURL, nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "audio/wav" {
+		t.Fatalf("audio: %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	audio, err := DecodeWAV(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Six characters of at least a quarter of a second each
+	if seconds := float64(len(audio.Data)) / float64(audio.Rate); seconds < 6*0.25 {
+		t.Errorf("audio of %.2fs for 6 characters", seconds)
+	}
+}
+
+func TestSpokenText(t *testing.T) {
+	math := DefaultCaptchaConfig()
+	math.Type = TypeMath
+	question := DefaultCaptchaConfig()
+	question.Type = TypeQuestion
+	for _, tc := range []struct {
+		cfg        CaptchaConfig
+		text, want string
+	}{
+		{math, "7 + 3 =", "7+3="},
+		{math, "12 − 4 =", "12-4="},
+		{math, "12 - 4 =", "12-4="},
+		{math, "6 × 7 =", "6×7="},
+		{math, "6 x 7 =", "6×7="},
+		{question, "What color is the sky?", "What color is the sky"},
+		{question, "Which is colder, ice or fire?", "Which is colder ice or fire"},
+		{question, "2 + 2 =\tfour's", "2  2  fours"},
+		{DefaultCaptchaConfig(), "x7 AB", "x7 AB"},
+	} {
+		if got := spokenText(tc.cfg, tc.text); got != tc.want {
+			t.Errorf("spokenText(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestMathAudio(t *testing.T) {
+	for _, text := range []string{"12 − 4 =", "6 x 7 =", "6 × 7 =", "20 + 20 ="} {
+		cfg := DefaultCaptchaConfig()
+		cfg.Type = TypeMath
+		cfg.TextGenerator = fixedText(text)
+		r := gin.New()
+		r.GET("/captcha/new", NewCaptcha(cfg))
+		r.GET("/captcha/:id/audio", CaptchaAudio(cfg))
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/captcha/new", nil))
+		var resp struct {
+			AudioURL string `json:"audio_url"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", resp.AudioURL, nil))
+		if w.Code != 200 {
+			t.Errorf("%q: audio %d %s", text, w.Code, w.Body)
+		}
+	}
+}
+
+func TestLoadWAVPackNamedSamples(t *testing.T) {
+	var wav bytes.Buffer
+	if err := encodeWAV(&wav, Sample{Rate: 8000, Data: make([]int16, 800)}); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{}
+	for _, name := range []string{"plus", "minus", "times", "equals", "7", "k", "seven"} {
+		fsys[name+".wav"] = &fstest.MapFile{Data: wav.Bytes()}
+	}
+
+	pack, err := LoadWAVPack(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, char := range "+-×=7kK" {
+		if _, ok := pack.Sample(char); !ok {
+			t.Errorf("no sample for %q", char)
+		}
+	}
+	if _, ok := pack.Sample('s'); ok {
+		t.Error("seven.wav loaded as a letter")
+	}
+}
+
+func TestQuestionAudio(t *testing.T) {
+	cfg := DefaultCaptchaConfig()
+	cfg.Type = TypeQuestion
+	cfg.Questions = []QuestionAnswer{{Question: "Is ice cold, yes or no?", Answer: "yes"}}
+	cfg.MaxResponseBytes = 1 << 20
+	r := gin.New()
+	r.GET("/captcha/new", NewCaptcha(cfg))
+	r.GET("/captcha/:id/audio", CaptchaAudio(cfg))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/captcha/new", nil))
+	var resp struct {
+		AudioURL string `json:"audio_url"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", resp.AudioURL, nil))
+	if w.Code != 200 {
+		t.Fatalf("audio %d %s", w.Code, w.Body)
+	}
+	if size := estimateAudioSize(cfg, embeddedPack{}); w.Body.Len() > size {
+		t.Errorf("audio of %d bytes, estimated at most %d", w.Body.Len(), size)
+	}
+
+	// The default budget doesn't fit a question spelled out
+	cfg.MaxResponseBytes = 0
+	if err := checkAudioBudget(cfg, embeddedPack{}); !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("budget check: %v", err)
+	}
+}
+
+func TestPairedImageAndAudio(t *testing.T) {
+	cfg := testConfig()
+	r := testRouter(cfg)
+	r.GET("/captcha/new", NewCaptcha(cfg))
+	r.GET("/captcha/:id/image", CaptchaImage(cfg))
+	r.GET("/captcha/:id/audio", CaptchaAudio(cfg))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/captcha/new", nil))
+	var resp struct {
+		ID       string `json:"captcha_id"`
+		ImageURL string `json:"image_url"`
+		AudioURL string `json:"audio_url"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ImageURL != "/captcha/"+resp.ID+"/image" || resp.AudioURL != "/captcha/"+resp.ID+"/audio" {
+		t.Fatalf("urls %q and %q for %q", resp.ImageURL, resp.AudioURL, resp.ID)
+	}
+
+	// Either can be fetched any number of times, in any order, with the
+	// same content
+	bodies := map[string][]byte{}
+	for _, u := range []string{resp.AudioURL, resp.ImageURL, resp.AudioURL, resp.ImageURL} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+		if w.Code != 200 {
+			t.Fatalf("%s: %d %s", u, w.Code, w.Body)
+		}
+		if prev, ok := bodies[u]; ok && !bytes.Equal(prev, w.Body.Bytes()) {
+			t.Errorf("%s changed between fetches", u)
+		}
+		bodies[u] = w.Body.Bytes()
+	}
+
+	if w := trustedRequest(r, resp.ID, "abc123", ""); w.Code != 200 {
+		t.Errorf("verifying after the fetches: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// backgroundImage returns one of BackgroundImages at random, scaled to
+// cover a w by h image and cropped to it around its center, keeping its
+// aspect ratio
+func (cfg CaptchaConfig) backgroundImage(rnd *randSource, w, h int) *image.RGBA {
+	src := cfg.BackgroundImages[rnd.Intn(len(cfg.BackgroundImages))]
+	sr := src.Bounds()
+
+	// The part of src with the aspect ratio of the image
+	if sw, sh := sr.Dx(), sr.Dy(); sw*h > sh*w {
+		cw := max(sh*w/h, 1)
+		sr.Min.X += (sw - cw) / 2
+		sr.Max.X = sr.Min.X + cw
+	} else {
+		ch := max(sw*h/w, 1)
+		sr.Min.Y += (sh - ch) / 2
+		sr.Max.Y = sr.Min.Y + ch
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.ApproxBiLinear.Scale(img, img.Rect, src, sr, draw.Src, nil)
+	// Drawn over white, so that the text contrast is that of what shows
+	for i := 0; i < len(img.Pix); i += 4 {
+		p := img.Pix[i : i+4 : i+4]
+		white := 255 - p[3]
+		p[0], p[1], p[2], p[3] = p[0]+white, p[1]+white, p[2]+white, 255
+	}
+	return img
+}
+
+// averageColor returns the average color of img within r, or of all of it
+// when r misses it
+func averageColor(img *image.RGBA, r image.Rectangle) color.RGBA {
+	r = r.Intersect(img.Rect)
+	if r.Empty() {
+		r = img.Rect
+	}
+	var sum [3]uint64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		i := img.PixOffset(r.Min.X, y)
+		row := img.Pix[i : i+4*r.Dx()]
+		for j := 0; j < len(row); j += 4 {
+			sum[0] += uint64(row[j])
+			sum[1] += uint64(row[j+1])
+			sum[2] += uint64(row[j+2])
+		}
+	}
+	n := uint64(r.Dx() * r.Dy())
+	return color.RGBA{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), 255}
+}
+
+// under returns the colors of a character drawn at r over the background
+// image: the average color beneath it as the background, and black or
+// white, whichever contrasts more with it, as the text color
+func (rc renderColors) under(r image.Rectangle) renderColors {
+	bg := averageColor(rc.image, r)
+	return renderColors{background: bg, text: contrastingColor(bg)}
+}
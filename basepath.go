@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderForwardedPrefix carries the path prefix a reverse proxy stripped from
+// the request, read with TrustForwardedPrefix
+const HeaderForwardedPrefix = "X-Forwarded-Prefix"
+
+// forwardedPrefix matches the X-Forwarded-Prefix values taken as a base
+// path: one or more segments of letters, digits and ._~:@+- so a forged
+// header can't point generated URLs at another host, add cookie attributes
+// or hide a ".." segment behind percent-encoding
+var forwardedPrefix = regexp.MustCompile(`^(/[A-Za-z0-9._~:@+-]+)+/?$`)
+
+// cleanBasePath returns p with a leading slash and no trailing one, or ""
+// for the root
+func cleanBasePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// basePath returns the prefix the app is served under for the request: the
+// X-Forwarded-Prefix header with TrustForwardedPrefix, BasePath otherwise.
+// Headers with a "." or ".." segment, or that aren't a plain path, are
+// ignored.
+func basePath(c *gin.Context, cfg CaptchaConfig) string {
+	if cfg.TrustForwardedPrefix {
+		if p := c.GetHeader(HeaderForwardedPrefix); validPrefix(p) {
+			return cleanBasePath(p)
+		}
+	}
+	return cleanBasePath(cfg.BasePath)
+}
+
+// validPrefix reports whether p is a plain path prefix, safe to write into
+// cookie paths and URLs
+func validPrefix(p string) bool {
+	return forwardedPrefix.MatchString(p) && !hasDotSegment(p)
+}
+
+// hasDotSegment reports whether the path p has a "." or ".." segment
+func hasDotSegment(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// underBase returns the route p under base. Only absolute paths are
+// prefixed; empty values, relative paths and full URLs are returned as is.
+func underBase(base, p string) string {
+	if base == "" || !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") {
+		return p
+	}
+	return base + p
+}
+
+// cookiePath returns the path of the cookies set for the request, so they
+// are only sent to the app behind its prefix
+func cookiePath(c *gin.Context, cfg CaptchaConfig) string {
+	if base := basePath(c, cfg); base != "" {
+		return base
+	}
+	return "/"
+}
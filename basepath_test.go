@@ -0,0 +1,159 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// prefixRouter serves the captcha routes at the root, as an app behind a
+// proxy stripping its prefix sees them
+func prefixRouter(cfg CaptchaConfig) *gin.Engine {
+	r := gin.New()
+	r.GET("/captcha/new", NewCaptcha(cfg))
+	r.GET("/captcha/:id/image", CaptchaImage(cfg))
+	r.GET("/captcha/contract", ContractHandler(ContractEndpoints{Generate: "/captcha/new", Image: "/captcha/:id/image", Verify: "/verify"}, cfg))
+	r.POST("/verify", VerifyCaptchaWithConfig(cfg), func(c *gin.Context) { c.String(200, "ok") })
+	return r
+}
+
+// prefixProxy serves app under prefix, stripping it from the requests and
+// setting X-Forwarded-Prefix like a gateway
+func prefixProxy(t *testing.T, app http.Handler, prefix string) *httptest.Server {
+	backend := httptest.NewServer(app)
+	t.Cleanup(backend.Close)
+	target, _ := url.Parse(backend.URL)
+
+	proxy := &httputil.ReverseProxy{Rewrite: func(r *httputil.ProxyRequest) {
+		r.SetURL(target)
+		r.Out.URL.Path = strings.TrimPrefix(r.In.URL.Path, prefix)
+		r.Out.Header.Set(HeaderForwardedPrefix, prefix)
+	}}
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(front.Close)
+	return front
+}
+
+func TestBehindPrefixProxy(t *testing.T) {
+	cfg := testConfig()
+	cfg.TrustForwardedPrefix = true
+	front := prefixProxy(t, prefixRouter(cfg), "/api/v2")
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	resp, err := client.Get(front.URL + "/api/v2/captcha/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var captcha struct {
+		ID       string `json:"captcha_id"`
+		ImageURL string `json:"image_url"`
+	}
+	json.NewDecoder(resp.Body).Decode(&captcha)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("generate: %d", resp.StatusCode)
+	}
+
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == DefaultIDCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Path != "/api/v2" {
+		t.Fatalf("captcha ID cookie %v, want one with Path /api/v2", cookie)
+	}
+	if want := "/api/v2/captcha/" + captcha.ID + "/image"; captcha.ImageURL != want {
+		t.Errorf("image_url %q, want %q", captcha.ImageURL, want)
+	}
+
+	// The URL handed out works through the proxy
+	resp, err = client.Get(front.URL + captcha.ImageURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("image: %d %s, want 200 image/png", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	var contract Contract
+	resp, err = client.Get(front.URL + "/api/v2/captcha/contract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&contract)
+	resp.Body.Close()
+	want := ContractEndpoints{Generate: "/api/v2/captcha/new", Image: "/api/v2/captcha/:id/image", Verify: "/api/v2/verify"}
+	if contract.Endpoints != want {
+		t.Errorf("contract endpoints %+v, want %+v", contract.Endpoints, want)
+	}
+
+	// The cookie is only sent back under the prefix
+	root, _ := url.Parse(front.URL + "/")
+	if cookies := jar.Cookies(root); len(cookies) != 0 {
+		t.Errorf("cookies sent outside the prefix: %v", cookies)
+	}
+
+	resp, err = client.PostForm(front.URL+"/api/v2/verify", url.Values{DefaultAnswerField: {"abc123"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("verify through the proxy: %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestForwardedPrefixRejected(t *testing.T) {
+	cfg := testConfig()
+	cfg.TrustForwardedPrefix = true
+	r := prefixRouter(cfg)
+
+	for _, prefix := range []string{
+		"//evil.example",
+		"https://evil.example",
+		"/../admin",
+		"/api/./v2",
+		"/api/%2e%2e",
+		"/api;Domain=evil.example",
+		"/api, /other",
+		"/api v2",
+		"/api\r\nSet-Cookie: a=b",
+		"/<script>",
+		"api/v2",
+	} {
+		req := httptest.NewRequest("GET", "/captcha/new", nil)
+		req.Header.Set(HeaderForwardedPrefix, prefix)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		var captcha struct {
+			ImageURL string `json:"image_url"`
+		}
+		json.NewDecoder(w.Body).Decode(&captcha)
+		if !strings.HasPrefix(captcha.ImageURL, "/captcha/") {
+			t.Errorf("prefix %q: image_url %q, want it ignored", prefix, captcha.ImageURL)
+		}
+		for _, c := range w.Result().Cookies() {
+			if c.Path != "/" {
+				t.Errorf("prefix %q: cookie Path %q, want /", prefix, c.Path)
+			}
+		}
+	}
+}
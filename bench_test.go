@@ -0,0 +1,15 @@
+package middleware_test
+
+import (
+	"testing"
+
+	"github.com/wprimadi/gin-captcha/captchabench"
+)
+
+func BenchmarkRender(b *testing.B)             { captchabench.Render(b) }
+func BenchmarkRenderLarge(b *testing.B)        { captchabench.RenderLarge(b) }
+func BenchmarkRenderGradient(b *testing.B)     { captchabench.RenderGradient(b) }
+func BenchmarkRenderSupersampled(b *testing.B) { captchabench.RenderSupersampled(b) }
+func BenchmarkEncodePNG(b *testing.B)          { captchabench.EncodePNG(b) }
+func BenchmarkStoreTake(b *testing.B)          { captchabench.StoreTake(b) }
+func BenchmarkHandler(b *testing.B)            { captchabench.Handler(b) }
@@ -0,0 +1,197 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultMaxResponseBytes is the response budget used when MaxResponseBytes is 0
+const DefaultMaxResponseBytes = 256 << 10
+
+// ErrCodeResponseTooLarge is returned when a request asks for a captcha
+// larger than the response budget
+const ErrCodeResponseTooLarge = "captcha_response_too_large"
+
+// ErrResponseTooLarge is wrapped by the errors of CheckResponseBudget
+var ErrResponseTooLarge = errors.New("captcha response exceeds MaxResponseBytes")
+
+// jsonOverhead bounds the JSON fields sent along with the base64 image
+const jsonOverhead = 512
+
+// estimateMargin covers the size differences between renders of a config,
+// in percent of the sample render
+const estimateMargin = 10
+
+// responseBudget returns the largest response allowed by cfg, 0 when there
+// is no limit
+func (cfg CaptchaConfig) responseBudget() int {
+	switch {
+	case cfg.MaxResponseBytes < 0:
+		return 0
+	case cfg.MaxResponseBytes == 0:
+		return DefaultMaxResponseBytes
+	}
+	return cfg.MaxResponseBytes
+}
+
+// responseSize returns the size of the response carrying an encoded image of
+// n bytes in format
+func responseSize(n int, format string) int {
+	switch format {
+	case FormatJSON:
+		return base64.StdEncoding.EncodedLen(n) + jsonOverhead
+	case FormatDataURI:
+		return len(dataURIPrefix) + base64.StdEncoding.EncodedLen(n)
+	}
+	return n
+}
+
+// EstimateResponseSize estimates the largest response cfg produces in format,
+// FormatPNG, FormatJSON, FormatDataURI, FormatSVG or FormatGIF. It renders a sample at
+// the largest size requests may ask for, with a margin for the differences
+// between renders.
+func EstimateResponseSize(cfg CaptchaConfig, format string) (int, error) {
+	if cfg.AllowOverrides {
+		cfg.Width = max(cfg.Width, cfg.MaxWidth)
+		cfg.Height = max(cfg.Height, cfg.MaxHeight)
+	}
+
+	// Questions and words are drawn as they are, the longest making the
+	// largest image
+	if cfg.TextGenerator == nil {
+		switch cfg.Type {
+		case TypeQuestion:
+			for _, pair := range cfg.Questions {
+				cfg.Length = max(cfg.Length, utf8.RuneCountInString(pair.Question))
+			}
+		case TypeWord:
+			for _, word := range cfg.words() {
+				cfg.Length = max(cfg.Length, utf8.RuneCountInString(word))
+			}
+		}
+	}
+
+	sample := captchaData{value: strings.Repeat("W", cfg.Length)}
+	var buf *bytes.Buffer
+	if drawing, ok := drawingEncoderFor(format); ok && cfg.Renderer == nil {
+		var err error
+		if buf, err = renderDrawn(drawing, sample, cfg); err != nil {
+			return 0, err
+		}
+	} else {
+		img, err := generateCaptchaImage(sample.value, sample.seed, cfg)
+		if err != nil {
+			return 0, err
+		}
+		if buf, err = encodePooled(img); err != nil {
+			return 0, err
+		}
+	}
+	n := buf.Len()
+	releaseBuffer(buf)
+
+	return responseSize(n+n*estimateMargin/100, format), nil
+}
+
+// CheckResponseBudget returns an error stating the estimated size and the
+// limit when the responses of cfg in format may exceed MaxResponseBytes
+func CheckResponseBudget(cfg CaptchaConfig, format string) error {
+	budget := cfg.responseBudget()
+	if budget == 0 {
+		return nil
+	}
+
+	size, err := EstimateResponseSize(cfg, format)
+	if err != nil {
+		return err
+	}
+	if size > budget {
+		return fmt.Errorf("%w: estimated %s response of %d bytes, limit is %d bytes",
+			ErrResponseTooLarge, format, size, budget)
+	}
+	return nil
+}
+
+// mustFitBudget panics when the responses of cfg may exceed its budget, so
+// oversized configurations are caught when the routes are set up
+func mustFitBudget(cfg CaptchaConfig, format string) {
+	if err := CheckResponseBudget(cfg, format); err != nil {
+		panic(err)
+	}
+}
+
+// estimateAudioSize returns the largest WAV the pack can spell for cfg: the
+// longest sample of the charset for every character, with the longest gaps.
+// TypeMath expressions are spoken as the digits of both operands, the
+// operator and the equals sign, TypeQuestion questions in full.
+func estimateAudioSize(cfg CaptchaConfig, pack SamplePack) int {
+	length := cfg.Length
+	switch cfg.Type {
+	case TypeMath:
+		_, hi := cfg.mathRange()
+		length = 2*len(strconv.Itoa(hi)) + 2
+	case TypeQuestion:
+		length = 0
+		for _, pair := range cfg.Questions {
+			length = max(length, utf8.RuneCountInString(spokenText(cfg, pair.Question)))
+		}
+	}
+
+	longest := 0
+	for _, char := range spokenText(cfg, cfg.charset()) {
+		if sample, ok := pack.Sample(char); ok {
+			longest = max(longest, len(resample(sample, audioSampleRate).Data))
+		}
+	}
+
+	gap := audioSampleRate * 750 / 1000
+	samples := audioSampleRate*600/1000 + length*(longest+gap)
+	return wavHeaderSize + 2*samples
+}
+
+// checkAudioBudget returns an error when the audio of cfg spelled by pack may
+// exceed MaxResponseBytes
+func checkAudioBudget(cfg CaptchaConfig, pack SamplePack) error {
+	budget := cfg.responseBudget()
+	if budget == 0 {
+		return nil
+	}
+	if size := estimateAudioSize(cfg, pack); size > budget {
+		return fmt.Errorf("%w: estimated audio response of %d bytes, limit is %d bytes",
+			ErrResponseTooLarge, size, budget)
+	}
+	return nil
+}
+
+// mustFitAudioBudget panics when the audio of cfg spelled by any registered
+// sample pack may exceed its budget
+func mustFitAudioBudget(cfg CaptchaConfig) {
+	samplePacksMu.RLock()
+	defer samplePacksMu.RUnlock()
+
+	for _, pack := range samplePacks {
+		if err := checkAudioBudget(cfg, pack); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// checkResponseSize rejects a response of size bytes exceeding the budget
+// of cfg, e.g. for a request overriding the image size
+func checkResponseSize(cfg CaptchaConfig, size int) *Rejection {
+	budget := cfg.responseBudget()
+	if budget == 0 || size <= budget {
+		return nil
+	}
+	return reject(400, gin.H{
+		"error": fmt.Sprintf("Captcha response of %d bytes exceeds the limit of %d bytes", size, budget),
+		"code":  ErrCodeResponseTooLarge,
+	})
+}
@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"errors"
+	"image"
+)
+
+// ErrCooldown is returned by Captcha.VerifyClient for clients cooling down
+// after CooldownThreshold consecutive failures
+var ErrCooldown = errors.New("captcha: too many failed attempts, try again later")
+
+// Captcha generates and verifies captchas outside of Gin handlers, e.g. to
+// embed one in an email challenge from a background job and verify the
+// answer later on another path. It goes through the same issue and
+// verification paths as the handlers, on a CaptchaStore of its own: its
+// captchas live in the Store of its config, or in a MemoryStore of its own,
+// and its counters, cooldowns and stats are its own too.
+type Captcha struct {
+	cfg CaptchaConfig
+}
+
+// New returns a Captcha generating and verifying with the given config, or
+// the default one. It panics on the misconfigurations GenerateCaptcha panics
+// on, and for Stateless and multi-step configs, which need the HTTP flow.
+// It starts the cleanup loop of its own store, which Close stops.
+func New(config ...CaptchaConfig) *Captcha {
+	cfg := DefaultCaptchaConfig()
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+
+	warnWeakConfig(cfg)
+	mustValidIDLength(cfg)
+	mustValidText(cfg)
+	mustLoadFont(cfg)
+	mustValidStyle(cfg)
+	if cfg.Stateless {
+		panic(errors.New("captcha: New doesn't support Stateless, use the handlers"))
+	}
+	if cfg.Steps > 1 {
+		panic(errors.New("captcha: New doesn't support multi-step captchas, use the handlers"))
+	}
+	cfg.captchas = newCaptchaStore()
+	limitMemoryStore(cfg)
+	limitRenders(cfg)
+
+	cfg.state().startCleanup(cfg.CleanupInterval)
+	return &Captcha{cfg: cfg}
+}
+
+// Generate creates and stores a captcha, and returns its ID, signed with
+// IDKeys if set, and its image. It is counted, logged and reported to the
+// funnel like the captchas of GenerateCaptcha.
+func (c *Captcha) Generate() (id string, img image.Image, err error) {
+	captcha, err := issue(nil, c.cfg, 1, nil, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return signID(c.cfg, captcha.id), captcha.img, nil
+}
+
+// Verify reports whether answer solves the captcha with the given ID. Like
+// the middleware, it consumes the captcha whether the answer is right or
+// not, except for answers StrictLength or RequireDifficulty turn away.
+// Unknown, forged, expired and already used IDs return false; only store
+// failures return an error. Failures count towards no cooldown, see
+// VerifyClient.
+func (c *Captcha) Verify(id, answer string) (bool, error) {
+	return c.VerifyClient("", id, answer)
+}
+
+// VerifyClient is Verify for the client with the given key, e.g. a user ID:
+// with CooldownThreshold and CooldownDuration set, its failures count
+// towards its cooldown, during which it returns ErrCooldown. An empty key
+// is Verify.
+func (c *Captcha) VerifyClient(client, id, answer string) (bool, error) {
+	cfg := c.cfg
+	if client != "" && cooldownEnabled(cfg) {
+		remaining, err := cooldownRemaining(cfg, client)
+		if err != nil {
+			logError(nil, cfg, "", err)
+			return false, err
+		}
+		if remaining > 0 {
+			emitCount(cfg.Metrics, MetricCooldown)
+			logEvent(nil, cfg, Event{Type: EventCooldown})
+			return false, ErrCooldown
+		}
+	}
+	if !cooldownEnabled(cfg) {
+		client = ""
+	}
+
+	captchaID, ok := unsignID(cfg, id)
+	if !ok {
+		reportVerify(nil, cfg, Verification{Result: ResultTampered})
+		return false, nil
+	}
+	if answer == "" {
+		reportVerify(nil, cfg, Verification{Result: ResultMissingValue})
+		return false, nil
+	}
+
+	check, err := verifyAnswer(cfg, client, captchaID, answer)
+	if err != nil {
+		logError(nil, cfg, captchaID, err)
+		return false, err
+	}
+	if check.result != ResultSuccess {
+		reportVerify(nil, cfg, check.data.verification(captchaID, check.result))
+		return false, nil
+	}
+	cfg.state().reportFunnel(FunnelSolved, captchaID, check.data)
+	reportVerify(nil, cfg, check.data.verification(captchaID, ResultSuccess))
+	countSuccess(cfg, client)
+	return true, nil
+}
+
+// Store returns the store of c, e.g. to set its audit or funnel func
+func (c *Captcha) Store() *CaptchaStore {
+	return c.cfg.state()
+}
+
+// Stats returns the counters of the store of c
+func (c *Captcha) Stats() Stats {
+	return c.cfg.state().Stats()
+}
+
+// Close stops the cleanup loop of the store of c, see CaptchaStore.Close.
+// Other Captchas and the handlers keep theirs.
+func (c *Captcha) Close() error {
+	return c.cfg.state().Close()
+}
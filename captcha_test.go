@@ -0,0 +1,207 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingLogger keeps the events logged
+type recordingLogger struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (l *recordingLogger) Log(ev Event) {
+	l.mu.Lock()
+	l.events = append(l.events, ev)
+	l.mu.Unlock()
+}
+
+// count returns the number of events of the given type
+func (l *recordingLogger) count(typ string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, ev := range l.events {
+		if ev.Type == typ {
+			n++
+		}
+	}
+	return n
+}
+
+func (l *recordingLogger) results() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var results []string
+	for _, ev := range l.events {
+		if ev.Type == EventVerified {
+			results = append(results, ev.Result)
+		}
+	}
+	return results
+}
+
+func TestCaptchaGenerateVerify(t *testing.T) {
+	c := New(testConfig())
+	defer c.Close()
+	before := c.Stats()
+
+	id, img, err := c.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 200 || img.Bounds().Dy() != 80 {
+		t.Errorf("image bounds %v", img.Bounds())
+	}
+	if ok, err := c.Verify(id, "abc123"); !ok || err != nil {
+		t.Fatalf("Verify = %v, %v, want true", ok, err)
+	}
+	if ok, _ := c.Verify(id, "abc123"); ok {
+		t.Error("a captcha verified twice")
+	}
+
+	id, _, _ = c.Generate()
+	if ok, _ := c.Verify(id, "wrong"); ok {
+		t.Error("a wrong answer verified")
+	}
+	if ok, _ := c.Verify(id, "abc123"); ok {
+		t.Error("a captcha verified after a wrong answer")
+	}
+
+	after := c.Stats()
+	if got := after.Generated - before.Generated; got != 2 {
+		t.Errorf("generated %d, want 2", got)
+	}
+	if got := after.Successful - before.Successful; got != 1 {
+		t.Errorf("successful %d, want 1", got)
+	}
+	if got := after.Failed - before.Failed; got != 3 {
+		t.Errorf("failed %d, want 3", got)
+	}
+}
+
+func TestCaptchaSharesHandlerPaths(t *testing.T) {
+	logger := &recordingLogger{}
+	cfg := testConfig()
+	cfg.Logger = logger
+	cfg.Store = NewMemoryStore()
+	c := New(cfg)
+	defer c.Close()
+
+	var mu sync.Mutex
+	var stages []string
+	funnel := func(ev FunnelEvent) {
+		mu.Lock()
+		stages = append(stages, ev.Stage)
+		mu.Unlock()
+	}
+	c.Store().SetFunnelFunc(funnel)
+	store.SetFunnelFunc(funnel)
+	defer store.SetFunnelFunc(nil)
+
+	// Generated by New, verified by the middleware through the shared Store
+	id, _, err := c.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := testRouter(cfg)
+	if w := verifyRequest(r, &http.Cookie{Name: DefaultIDCookie, Value: id}, "abc123"); w.Code != 200 {
+		t.Fatalf("middleware verification: %d %s", w.Code, w.Body)
+	}
+	// Gone from the shared Store, the tombstone is the middleware's
+	if ok, _ := c.Verify(id, "abc123"); ok {
+		t.Error("a captcha verified by the middleware verified again")
+	}
+
+	mu.Lock()
+	want := []string{FunnelShown, FunnelAttempted, FunnelSolved}
+	if len(stages) != len(want) || stages[0] != want[0] || stages[1] != want[1] || stages[2] != want[2] {
+		t.Errorf("funnel stages %v, want %v", stages, want)
+	}
+	mu.Unlock()
+
+	results := logger.results()
+	if len(results) != 2 || results[0] != ResultSuccess || results[1] != ResultNotFound {
+		t.Errorf("logged results %v, want success then not found", results)
+	}
+}
+
+func TestCaptchaInstancesIndependent(t *testing.T) {
+	first, second := New(testConfig()), New(testConfig())
+	defer second.Close()
+
+	id, _, _ := first.Generate()
+	if ok, _ := second.Verify(id, "abc123"); ok {
+		t.Error("a captcha of one instance verified on another")
+	}
+	if ok, _ := first.Verify(id, "abc123"); !ok {
+		t.Error("the captcha wasn't left in the store of its instance")
+	}
+	// Nor did the handlers see it
+	r := testRouter(testConfig())
+	id, _, _ = first.Generate()
+	if w := verifyRequest(r, &http.Cookie{Name: DefaultIDCookie, Value: id}, "abc123"); w.Code == 200 {
+		t.Error("a captcha of an instance verified by the middleware")
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := second.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := second.Verify(id, "abc123"); !ok || err != nil {
+		t.Errorf("verification after closing the other instance: %t %v", ok, err)
+	}
+	if got := second.Stats(); got.Generated != 1 || got.Successful != 1 {
+		t.Errorf("stats %+v, want 1 generated and 1 solved", got)
+	}
+	if second.Store().cleaner.stop == nil {
+		t.Error("closing an instance stopped the cleanup of another")
+	}
+}
+
+func TestCaptchaVerifyClientCooldown(t *testing.T) {
+	cfg := testConfig()
+	cfg.CooldownThreshold = 2
+	cfg.CooldownDuration = time.Minute
+	c := New(cfg)
+	defer c.Close()
+	defer store.reset("cooldown:user-1")
+
+	for i := 0; i < 2; i++ {
+		id, _, _ := c.Generate()
+		if ok, err := c.VerifyClient("user-1", id, "wrong"); ok || err != nil {
+			t.Fatalf("failure %d: %v, %v", i, ok, err)
+		}
+	}
+
+	id, _, _ := c.Generate()
+	if _, err := c.VerifyClient("user-1", id, "abc123"); !errors.Is(err, ErrCooldown) {
+		t.Fatalf("VerifyClient during the cooldown: %v, want ErrCooldown", err)
+	}
+	// Other clients, and Verify, are not cooling down
+	if ok, err := c.VerifyClient("user-2", id, "abc123"); !ok || err != nil {
+		t.Errorf("another client: %v, %v", ok, err)
+	}
+}
+
+func TestCaptchaSigned(t *testing.T) {
+	cfg := testConfig()
+	cfg.IDKeys = NewKeyRing([]byte("0123456789abcdef0123456789abcdef"))
+	c := New(cfg)
+	defer c.Close()
+
+	id, _, _ := c.Generate()
+	if ok, _ := c.Verify(id+"x", "abc123"); ok {
+		t.Error("a tampered ID verified")
+	}
+	if ok, err := c.Verify(id, "abc123"); !ok || err != nil {
+		t.Errorf("Verify = %v, %v, want true", ok, err)
+	}
+}
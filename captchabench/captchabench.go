@@ -0,0 +1,230 @@
+// Package captchabench holds the benchmarks of the captcha middleware and
+// its allocation budget as plain functions, so the tests of any module can
+// run them, e.g. in CI:
+//
+//	func BenchmarkRender(b *testing.B)  { captchabench.Render(b) }
+//	func TestAllocBudget(t *testing.T) { captchabench.CheckAllocs(t) }
+package captchabench
+
+import (
+	"bytes"
+	"image/png"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	middleware "github.com/wprimadi/gin-captcha"
+)
+
+// GenerateAllocBudget is the most allocations a request to GenerateCaptcha
+// may make at the default config, checked by CheckAllocs. It leaves about a
+// quarter of headroom over the 59 measured, so only real regressions exceed
+// it.
+const GenerateAllocBudget = 75
+
+// StoreGoroutines is the number of goroutines StoreTake runs at once
+const StoreGoroutines = 64
+
+// text is the captcha text rendered by the benchmarks
+const text = "abc123"
+
+// source is a seeded RandomSource for renders outside the middleware
+type source struct {
+	chacha *rand.ChaCha8
+	rand   *rand.Rand
+}
+
+func newSource(seed uint64) *source {
+	var s [32]byte
+	s[0] = byte(seed)
+	chacha := rand.NewChaCha8(s)
+	return &source{chacha: chacha, rand: rand.New(chacha)}
+}
+
+// Intn implements middleware.RandomSource
+func (s *source) Intn(n int) int {
+	return s.rand.IntN(n)
+}
+
+// Read implements middleware.RandomSource
+func (s *source) Read(p []byte) (int, error) {
+	return s.chacha.Read(p)
+}
+
+// render benchmarks DefaultRenderer at cfg
+func render(b *testing.B, cfg middleware.CaptchaConfig) {
+	b.ReportAllocs()
+	for i := 0; b.Loop(); i++ {
+		if _, err := (middleware.DefaultRenderer{}).Render(text, cfg, newSource(uint64(i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Render benchmarks drawing an image at the default config
+func Render(b *testing.B) {
+	render(b, middleware.DefaultCaptchaConfig())
+}
+
+// RenderLarge benchmarks drawing an image at twice the default width and
+// height, distorted
+func RenderLarge(b *testing.B) {
+	cfg := middleware.DefaultCaptchaConfig()
+	cfg.Width *= 2
+	cfg.Height *= 2
+	cfg.DistortionLevel = 50
+	render(b, cfg)
+}
+
+// RenderGradient benchmarks drawing an image at the default config on a
+// linear and on a radial gradient background
+func RenderGradient(b *testing.B) {
+	for _, gradient := range []struct {
+		name string
+		kind middleware.Gradient
+	}{
+		{"linear", middleware.GradientLinear},
+		{"radial", middleware.GradientRadial},
+	} {
+		b.Run(gradient.name, func(b *testing.B) {
+			cfg := middleware.DefaultCaptchaConfig()
+			cfg.Gradient = gradient.kind
+			render(b, cfg)
+		})
+	}
+}
+
+// RenderSupersampled benchmarks drawing an image at the default config
+// supersampled 2 and 3 times
+func RenderSupersampled(b *testing.B) {
+	for _, scale := range []int{2, 3} {
+		b.Run(strconv.Itoa(scale)+"x", func(b *testing.B) {
+			cfg := middleware.DefaultCaptchaConfig()
+			cfg.Supersample = scale
+			render(b, cfg)
+		})
+	}
+}
+
+// pngBufferPool lets a png.Encoder reuse its internal buffers, as the
+// middleware's encoder does
+type pngBufferPool struct {
+	pool sync.Pool
+}
+
+func (p *pngBufferPool) Get() *png.EncoderBuffer {
+	buf, _ := p.pool.Get().(*png.EncoderBuffer)
+	return buf
+}
+
+func (p *pngBufferPool) Put(buf *png.EncoderBuffer) {
+	p.pool.Put(buf)
+}
+
+// EncodePNG benchmarks encoding a default image into a reused buffer with
+// pooled encoder buffers, as the middleware does, and into a new buffer
+// with a plain encoder, to show what the pools save
+func EncodePNG(b *testing.B) {
+	img, err := (middleware.DefaultRenderer{}).Render(text, middleware.DefaultCaptchaConfig(), newSource(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("pooled", func(b *testing.B) {
+		encoder := &png.Encoder{BufferPool: &pngBufferPool{}}
+		var buf bytes.Buffer
+		encode(b, func() error {
+			buf.Reset()
+			return encoder.Encode(&buf, img)
+		})
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		encode(b, func() error {
+			return png.Encode(new(bytes.Buffer), img)
+		})
+	})
+}
+
+// encode runs fn, encoding an image, for every iteration of b
+func encode(b *testing.B, fn func() error) {
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := fn(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// StoreTake benchmarks setting a captcha in a MemoryStore and taking it
+// back, as generation and verification do, from StoreGoroutines goroutines
+// at once
+func StoreTake(b *testing.B) {
+	store := middleware.NewMemoryStore()
+	var next atomic.Int64
+
+	b.SetParallelism(max(1, StoreGoroutines/runtime.GOMAXPROCS(0)))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			id := strconv.FormatInt(next.Add(1), 16)
+			store.Set(id, "value", time.Minute)
+			if _, ok, _ := store.Take(id); !ok {
+				b.Error("captchabench: a stored captcha could not be taken")
+			}
+		}
+	})
+}
+
+// newRouter returns a router serving GenerateCaptcha at the default config
+// on "/captcha"
+func newRouter() http.Handler {
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.GET("/captcha", middleware.GenerateCaptcha())
+	return r
+}
+
+// generate requests a captcha from router
+func generate(router http.Handler) int {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/captcha", nil))
+	return w.Code
+}
+
+// Handler benchmarks full requests to GenerateCaptcha at the default
+// config, from rendering to the PNG response
+func Handler(b *testing.B) {
+	router := newRouter()
+	b.ReportAllocs()
+	for b.Loop() {
+		if code := generate(router); code != http.StatusOK {
+			b.Fatalf("captchabench: generation returned %d", code)
+		}
+	}
+}
+
+// AllocsPerGenerate returns the average allocations of a request to
+// GenerateCaptcha at the default config
+func AllocsPerGenerate() float64 {
+	router := newRouter()
+	return testing.AllocsPerRun(100, func() {
+		generate(router)
+	})
+}
+
+// CheckAllocs fails the test when a request to GenerateCaptcha allocates
+// more than GenerateAllocBudget times
+func CheckAllocs(t testing.TB) {
+	t.Helper()
+
+	if n := AllocsPerGenerate(); n > GenerateAllocBudget {
+		t.Errorf("captchabench: generation allocates %.0f times, over the budget of %d", n, GenerateAllocBudget)
+	}
+}
@@ -0,0 +1,59 @@
+// Package captchatest provides helpers to exercise the captcha middleware in
+// integration tests without stubbing it out.
+package captchatest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	middleware "github.com/wprimadi/gin-captcha"
+	"github.com/wprimadi/gin-captcha/internal/testhook"
+)
+
+// Solve requests a captcha from generatePath on router and returns its ID, as
+// sent to the client, and answer, read from the default store. It fails the
+// test if no captcha was issued.
+func Solve(t testing.TB, router http.Handler, generatePath string) (id, answer string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, generatePath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("captchatest: GET %s returned %d: %s", generatePath, w.Code, w.Body.String())
+	}
+
+	id = w.Header().Get(middleware.DefaultIDHeader)
+	if id == "" {
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == middleware.DefaultIDCookie {
+				id = cookie.Value
+			}
+		}
+	}
+	if id == "" {
+		t.Fatalf("captchatest: GET %s did not return a captcha ID", generatePath)
+	}
+
+	// Signed IDs carry their signature after a dot
+	storeID, _, _ := strings.Cut(id, ".")
+
+	answer, ok := testhook.Answer(storeID)
+	if !ok {
+		t.Fatalf("captchatest: captcha %q not found in the store", id)
+	}
+	return id, answer
+}
+
+// NewRequest builds a form request to target carrying the captcha ID in both
+// the header and the cookie and the answer in the "captcha" field
+func NewRequest(method, target, id, answer string) *http.Request {
+	form := url.Values{middleware.DefaultAnswerField: {answer}}
+	req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(middleware.DefaultIDHeader, id)
+	req.AddCookie(&http.Cookie{Name: middleware.DefaultIDCookie, Value: id})
+	return req
+}
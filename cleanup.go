@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultCleanupInterval is how often expired captchas are swept when
+// CleanupInterval is 0
+const DefaultCleanupInterval = time.Minute
+
+// cleaner runs the cleanup loop of a store. A single loop runs however many
+// handlers are built, until the store is closed.
+type cleaner struct {
+	mu       sync.Mutex
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// startCleanup starts the cleanup loop unless it is running. A running loop
+// is restarted when interval differs, so the last handler built sets it.
+func (s *CaptchaStore) startCleanup(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultCleanupInterval
+	}
+
+	s.cleaner.mu.Lock()
+	defer s.cleaner.mu.Unlock()
+
+	if s.cleaner.stop != nil {
+		if s.cleaner.interval == interval {
+			return
+		}
+		s.cleaner.halt()
+	}
+
+	s.cleaner.interval = interval
+	s.cleaner.stop = make(chan struct{})
+	s.cleaner.done = make(chan struct{})
+	go s.runCleanup(interval, s.cleaner.stop, s.cleaner.done)
+}
+
+// halt stops the loop and waits for it to return. The lock must be held.
+func (cl *cleaner) halt() {
+	close(cl.stop)
+	<-cl.done
+	cl.stop, cl.done = nil, nil
+}
+
+// Close stops the cleanup loop, e.g. when a test or a server shuts down.
+// Building another generation handler starts it again. Expired captchas are
+// still rejected while it is stopped, they are only no longer freed.
+func (s *CaptchaStore) Close() error {
+	s.cleaner.mu.Lock()
+	defer s.cleaner.mu.Unlock()
+
+	if s.cleaner.stop != nil {
+		s.cleaner.halt()
+	}
+	return nil
+}
+
+// runCleanup sweeps the store every interval until stop is closed
+func (s *CaptchaStore) runCleanup(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.cleanup(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// cleanup removes the captchas, counters, tombstones and remembered
+// outcomes expired at now
+func (s *CaptchaStore) cleanup(now time.Time) {
+	swept := s.captchas.sweep(now)
+	s.stats.evicted.Add(int64(len(swept)))
+	for id, value := range swept {
+		s.images.remove(id)
+
+		// Verified captchas are deleted, the swept ones were never answered
+		if data, err := decodeCaptcha(value); err == nil {
+			s.reportFunnel(FunnelAbandoned, id, data)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, data := range s.counters {
+		if now.After(data.expireTime) {
+			delete(s.counters, key)
+		}
+	}
+	for id, t := range s.tombstones {
+		if now.UnixNano() > t.expires {
+			delete(s.tombstones, id)
+		}
+	}
+	for key, outcome := range s.replays {
+		if now.UnixNano() > outcome.expires {
+			delete(s.replays, key)
+		}
+	}
+}
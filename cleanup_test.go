@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+)
+
+func TestCleanupStopsOnClose(t *testing.T) {
+	// The loop of the handlers built by other tests is stopped first, so it
+	// isn't ignored as a goroutine of before the test
+	store.Close()
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	cfg := testConfig()
+	cfg.CleanupInterval = 10 * time.Millisecond
+	for i := 0; i < 10; i++ {
+		GenerateCaptcha(cfg)
+		NewCaptcha(cfg)
+		GenerateCaptchaFromJSON(cfg)
+		VerifyCaptchaWithConfig(cfg)
+	}
+	captcha := New(cfg)
+
+	// A single loop sweeps the store
+	evicted := store.Stats().Evicted
+	store.captchas.Set("cleanup-test", "expired", -time.Second)
+	deadline := time.Now().Add(time.Second)
+	for store.Stats().Evicted == evicted {
+		if time.Now().After(deadline) {
+			t.Fatal("expired captcha not swept")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Another interval restarts it rather than starting a second one
+	cfg.CleanupInterval = 0
+	GenerateCaptcha(cfg)
+
+	if err := captcha.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// Contract is what a frontend needs to talk to the captcha handlers: the
+// names the captcha ID and answer travel under and the routes to call. SPAs
+// can fetch it from ContractHandler at startup instead of hardcoding names.
+type Contract struct {
+	ID        ContractValue     `json:"id"`         // Captcha ID, as received on generation and sent back on verification
+	Answer    ContractValue     `json:"answer"`     // Answer sent on verification
+	Headers   map[string]string `json:"headers"`    // Other headers of the middleware, keyed by purpose
+	Endpoints ContractEndpoints `json:"endpoints"`  // Routes of the captcha handlers
+	ExpiresIn int               `json:"expires_in"` // Lifetime of a new captcha in seconds
+	Length    int               `json:"length"`     // Characters per captcha, 0 with TypeMath or a custom TextGenerator
+	InputMode string            `json:"input_mode"` // InputModeNumeric or InputModeText
+	Telemetry bool              `json:"telemetry"`  // Whether signed typing telemetry is accepted
+}
+
+// ContractValue describes where a value travels in the requests
+type ContractValue struct {
+	Field   string   `json:"field"`            // Form field and query parameter
+	Cookie  string   `json:"cookie,omitempty"` // Cookie, if the value can come from one
+	Header  string   `json:"header,omitempty"` // Header, if the value can come from one
+	Sources []Source `json:"sources"`          // Sources verification reads, in order of precedence
+}
+
+// ContractEndpoints are the routes the captcha handlers are mounted on, as
+// the frontend should call them. Routes of a captcha hold ":id" where its ID
+// goes, e.g. "/captcha/:id/image".
+type ContractEndpoints struct {
+	Generate string `json:"generate,omitempty"`
+	Verify   string `json:"verify,omitempty"`
+	Image    string `json:"image,omitempty"`
+	Audio    string `json:"audio,omitempty"`
+}
+
+// under returns the endpoints under the path prefix base
+func (e ContractEndpoints) under(base string) ContractEndpoints {
+	return ContractEndpoints{
+		Generate: underBase(base, e.Generate),
+		Verify:   underBase(base, e.Verify),
+		Image:    underBase(base, e.Image),
+		Audio:    underBase(base, e.Audio),
+	}
+}
+
+// DescribeContract returns the contract of the handlers created with cfg,
+// with the endpoints under its BasePath
+func DescribeContract(cfg CaptchaConfig, endpoints ContractEndpoints) Contract {
+	ids, answers := cfg.idNames(), cfg.answerNames()
+	contract := Contract{
+		ID: ContractValue{
+			Field:   ids.field,
+			Cookie:  ids.cookie,
+			Header:  ids.header,
+			Sources: cfg.idSources(),
+		},
+		Answer: ContractValue{
+			Field:   answers.field,
+			Sources: cfg.answerSources(),
+		},
+		Headers: map[string]string{
+			"expires_in":      HeaderExpiresIn,
+			"trace":           HeaderTrace,
+			"idempotency_key": HeaderIdempotencyKey,
+		},
+		Endpoints: endpoints.under(cleanBasePath(cfg.BasePath)),
+		ExpiresIn: int(cfg.ExpireTime.Seconds()),
+		InputMode: InputModeText,
+		Telemetry: cfg.Telemetry && cfg.IDKeys != nil,
+	}
+
+	switch {
+	case cfg.TextGenerator != nil:
+	case cfg.Type == TypeMath:
+		if !cfg.MathNegative {
+			contract.InputMode = InputModeNumeric
+		}
+	case cfg.Type == TypeQuestion, cfg.Type == TypeWord:
+		// The length varies, and the input mode follows each answer
+	default:
+		contract.Length = cfg.Length
+		if isDigits(cfg.charset()) {
+			contract.InputMode = InputModeNumeric
+		}
+	}
+	if cfg.Steps > 1 {
+		contract.Headers["step_token"] = HeaderStepToken
+	}
+	if contract.Telemetry {
+		contract.Headers["telemetry"] = HeaderTelemetry
+		contract.Headers["telemetry_key"] = HeaderTelemetryKey
+	}
+	return contract
+}
+
+// ContractHandler is a handler responding with DescribeContract of the given
+// config, which follows the names the config sets. With TrustForwardedPrefix,
+// the endpoints are put under the prefix of each request.
+func ContractHandler(endpoints ContractEndpoints, config ...CaptchaConfig) gin.HandlerFunc {
+	cfg := DefaultCaptchaConfig()
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+	mustValidNames(cfg)
+
+	contract := DescribeContract(cfg, endpoints)
+	return func(c *gin.Context) {
+		if !cfg.TrustForwardedPrefix {
+			c.JSON(200, contract)
+			return
+		}
+		prefixed := contract
+		prefixed.Endpoints = endpoints.under(basePath(c, cfg))
+		c.JSON(200, prefixed)
+	}
+}
@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clientKey identifies the client for per-client limits
+func clientKey(c *gin.Context, cfg CaptchaConfig) string {
+	if cfg.ClientKeyFunc != nil {
+		return cfg.ClientKeyFunc(c)
+	}
+	return c.ClientIP()
+}
+
+// cooldownEnabled reports whether failed attempts can put a client on cooldown
+func cooldownEnabled(cfg CaptchaConfig) bool {
+	return cfg.CooldownThreshold > 0 && cfg.CooldownDuration > 0
+}
+
+// cooldownRemaining returns how long the client with the given key stays
+// on cooldown, 0 if it isn't
+func cooldownRemaining(cfg CaptchaConfig, key string) (time.Duration, error) {
+	return cfg.state().blockRemaining(cfg, "cooldown:"+key)
+}
+
+// checkCooldown rejects the request with 429 when the client is cooling
+// down, and with 500 when its cooldown can't be read from the store
+func checkCooldown(c *gin.Context, cfg CaptchaConfig) *Rejection {
+	remaining, err := cooldownRemaining(cfg, clientKey(c, cfg))
+	if err != nil {
+		logError(c, cfg, "", err)
+		return reject(500, gin.H{"error": "Failed to check captcha cooldown"})
+	}
+	if remaining <= 0 {
+		return nil
+	}
+
+	emitCount(cfg.Metrics, MetricCooldown)
+	logEvent(c, cfg, Event{Type: EventCooldown})
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+	return reject(429, gin.H{"error": "Too many failed attempts, try again later"})
+}
+
+// cooldownKey returns the key of the client the failures of a verification
+// count against, or "" when they don't count
+func cooldownKey(c *gin.Context, cfg CaptchaConfig) string {
+	if !cooldownEnabled(cfg) {
+		return ""
+	}
+	return clientKey(c, cfg)
+}
+
+// recordFailure counts a failed verification and starts the cooldown on the
+// CooldownThreshold-th consecutive failure
+func recordFailure(c *gin.Context, cfg CaptchaConfig) {
+	countFailure(cfg, cooldownKey(c, cfg))
+}
+
+// countFailure counts a failed verification of the client with the given
+// key, see recordFailure. An empty key counts nothing. Store failures are
+// logged, the verification has failed either way.
+func countFailure(cfg CaptchaConfig, key string) {
+	if key == "" || !cooldownEnabled(cfg) {
+		return
+	}
+	failures, err := cfg.state().incrCount(cfg, "failures:"+key, cfg.CooldownDuration)
+	if err == nil && failures >= cfg.CooldownThreshold {
+		if err = cfg.state().resetCount(cfg, "failures:"+key); err == nil {
+			err = cfg.state().blockCount(cfg, "cooldown:"+key, cfg.CooldownDuration)
+		}
+	}
+	if err != nil {
+		logError(nil, cfg, "", err)
+	}
+}
+
+// recordSuccess clears the consecutive failure count of the client
+func recordSuccess(c *gin.Context, cfg CaptchaConfig) {
+	countSuccess(cfg, cooldownKey(c, cfg))
+}
+
+// countSuccess clears the consecutive failure count of the client with the
+// given key. An empty key clears nothing. Store failures are logged, the
+// verification has succeeded either way.
+func countSuccess(cfg CaptchaConfig, key string) {
+	if key == "" || !cooldownEnabled(cfg) {
+		return
+	}
+	if err := cfg.state().resetCount(cfg, "failures:"+key); err != nil {
+		logError(nil, cfg, "", err)
+	}
+}
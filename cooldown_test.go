@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCooldownBeforeBypass(t *testing.T) {
+	const key = "cooldown-bypass-test"
+	defer store.reset("cooldown:" + key)
+
+	cfg := testConfig()
+	cfg.CooldownThreshold = 1
+	cfg.CooldownDuration = time.Minute
+	cfg.ClientKeyFunc = func(*gin.Context) string { return key }
+	cfg.TrustedDuration = time.Hour
+	cfg.TrustedKeys = NewKeyRing([]byte("0123456789abcdef0123456789abcdef"))
+
+	lowRisk := cfg
+	lowRisk.RiskFunc = func(*gin.Context) float64 { return 0 }
+	lowRisk.RiskThreshold = 0.5
+
+	trusted := testRouter(cfg)
+	bypassed := testRouter(lowRisk)
+
+	// Solving a captcha trusts the client, a low score needs no captcha
+	w := trustedRequest(trusted, generateCookie(t, trusted).Value, "abc123", "")
+	token := trustedCookie(w)
+	if token == "" {
+		t.Fatalf("no trusted cookie after solving a captcha: %d %s", w.Code, w.Body)
+	}
+	if w := trustedRequest(trusted, "", "", token); w.Code != 200 {
+		t.Fatalf("trusted before the cooldown: %d %s", w.Code, w.Body)
+	}
+	if w := trustedRequest(bypassed, "", "", ""); w.Code != 200 {
+		t.Fatalf("bypassed before the cooldown: %d %s", w.Code, w.Body)
+	}
+
+	countFailure(cfg, key)
+	if w := trustedRequest(trusted, "", "", token); w.Code != 429 {
+		t.Errorf("trusted during the cooldown: %d %s", w.Code, w.Body)
+	}
+	if w := trustedRequest(bypassed, "", "", ""); w.Code != 429 {
+		t.Errorf("bypassed during the cooldown: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestCooldownSharedStore(t *testing.T) {
+	cfg := testConfig()
+	cfg.CooldownThreshold = 2
+	cfg.CooldownDuration = time.Minute
+	cfg.Store = NewMemoryStore()
+
+	// Two replicas, each with its own process state, sharing the Store
+	first, second := New(cfg), New(cfg)
+	defer first.Close()
+	defer second.Close()
+
+	id, _, _ := first.Generate()
+	first.VerifyClient("user-1", id, "wrong")
+	id, _, _ = second.Generate()
+	second.VerifyClient("user-1", id, "wrong")
+
+	for _, c := range []*Captcha{first, second} {
+		id, _, _ := c.Generate()
+		if _, err := c.VerifyClient("user-1", id, "abc123"); !errors.Is(err, ErrCooldown) {
+			t.Errorf("VerifyClient after failures on both replicas: %v, want ErrCooldown", err)
+		}
+	}
+	remaining, err := cooldownRemaining(cfg, "user-1")
+	if err != nil || remaining <= 0 || remaining > time.Minute {
+		t.Errorf("cooldown remaining %v, %v, want up to a minute", remaining, err)
+	}
+}
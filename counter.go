@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+)
+
+// counter returns the Store of cfg when it is a Counter, so that replicas
+// sharing it share their counts, or nil when counts are kept in process
+func (cfg CaptchaConfig) counter() Counter {
+	counter, _ := cfg.Store.(Counter)
+	return counter
+}
+
+// incrCount increments the counter for key in the Store of cfg, or in s,
+// see incr
+func (s *CaptchaStore) incrCount(cfg CaptchaConfig, key string, ttl time.Duration) (int, error) {
+	if counter := cfg.counter(); counter != nil {
+		return counter.Incr(key, ttl)
+	}
+	return s.incr(key, ttl), nil
+}
+
+// countOf returns the count of the counter for key, 0 if it doesn't exist
+func (s *CaptchaStore) countOf(cfg CaptchaConfig, key string) (int, error) {
+	if cfg.counter() == nil {
+		return s.count(key), nil
+	}
+	value, ok, err := cfg.Store.Get(key)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// resetCount removes the counter for key
+func (s *CaptchaStore) resetCount(cfg CaptchaConfig, key string) error {
+	if cfg.counter() != nil {
+		return cfg.Store.Delete(key)
+	}
+	s.reset(key)
+	return nil
+}
+
+// blockCount sets the counter for key so that it stays alive for ttl. In a
+// Counter, its value is the deadline in Unix nanoseconds, so that
+// blockRemaining can tell how long it has left.
+func (s *CaptchaStore) blockCount(cfg CaptchaConfig, key string, ttl time.Duration) error {
+	if cfg.counter() == nil {
+		s.block(key, ttl)
+		return nil
+	}
+	// Stores may insert without replacing
+	if err := cfg.Store.Delete(key); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(ttl).UnixNano()
+	return cfg.Store.Set(key, strconv.FormatInt(deadline, 10), ttl)
+}
+
+// blockRemaining returns how long the counter for key set by blockCount
+// stays alive, 0 if it doesn't exist
+func (s *CaptchaStore) blockRemaining(cfg CaptchaConfig, key string) (time.Duration, error) {
+	if cfg.counter() == nil {
+		return s.remaining(key), nil
+	}
+	value, ok, err := cfg.Store.Get(key)
+	if err != nil || !ok {
+		return 0, err
+	}
+	deadline, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return max(time.Until(time.Unix(0, deadline)), 0), nil
+}
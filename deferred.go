@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"html/template"
+	"image"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ContextKeyGeneration holds the *Generation created in DeferResponse mode
+const ContextKeyGeneration = "captcha_generation"
+
+// Generation is a captcha created by GenerateCaptcha in DeferResponse mode,
+// left for the next handlers to send
+type Generation struct {
+	ID        string      // Captcha ID as handed to the client
+	Image     image.Image // Rendered image
+	PNG       []byte      // Image encoded as PNG
+	ExpiresAt time.Time   // When the captcha expires
+	Trace     string      // Trace token, see HeaderTrace
+	InputMode string      // InputModeNumeric or InputModeText, for the inputmode attribute
+}
+
+// DataURI returns the image as a data URI, e.g. for the src of an img
+// element in a template
+func (g *Generation) DataURI() template.URL {
+	return template.URL(dataURIPrefix + base64.StdEncoding.EncodeToString(g.PNG))
+}
+
+// GenerationFromContext returns the captcha created by GenerateCaptcha in
+// DeferResponse mode earlier in the handler chain
+func GenerationFromContext(c *gin.Context) (*Generation, bool) {
+	value, exists := c.Get(ContextKeyGeneration)
+	if !exists {
+		return nil, false
+	}
+	gen, ok := value.(*Generation)
+	return gen, ok
+}
@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// distortion displaces the pixels of a captcha along two sine waves: rows
+// shift horizontally by a wave running down the image, and columns shift
+// vertically by one running across it
+type distortion struct {
+	dx []float64 // Horizontal shift of each row
+	dy []float64 // Vertical shift of each column
+}
+
+// distortionAmplitude returns how far the waves of cfg shift pixels, up to
+// a tenth of the height at DistortionLevel 100
+func (cfg CaptchaConfig) distortionAmplitude() float64 {
+	return float64(cfg.Height) * float64(cfg.DistortionLevel) / 1000
+}
+
+// distortionPeriod returns the wavelength of the waves of cfg, in pixels
+func (cfg CaptchaConfig) distortionPeriod() float64 {
+	if cfg.DistortionPeriod <= 0 {
+		return float64(cfg.Height)
+	}
+	return float64(cfg.DistortionPeriod)
+}
+
+// distortion returns the waves of a render, with random phases, or nil when
+// DistortionLevel is 0. The shifts are computed once per row and column.
+func (cfg CaptchaConfig) distortion(rnd *randSource) *distortion {
+	if cfg.DistortionLevel <= 0 {
+		return nil
+	}
+	amplitude := cfg.distortionAmplitude()
+	step := 2 * math.Pi / cfg.distortionPeriod()
+	phaseX := float64(rnd.Intn(360)) * math.Pi / 180
+	phaseY := float64(rnd.Intn(360)) * math.Pi / 180
+
+	d := &distortion{dx: make([]float64, cfg.Height), dy: make([]float64, cfg.Width)}
+	for y := range d.dx {
+		d.dx[y] = amplitude * math.Sin(float64(y)*step+phaseX)
+	}
+	for x := range d.dy {
+		d.dy[x] = amplitude * math.Sin(float64(x)*step+phaseY)
+	}
+	return d
+}
+
+// apply draws src displaced by the waves into dst, of the same bounds
+// starting at the origin. Pixels are sampled bilinearly, and those shifted
+// in from outside the image take the background color bg.
+func (d *distortion) apply(dst, src *image.RGBA, bg color.RGBA) {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	at := func(x, y int) [4]float64 {
+		if x < 0 || y < 0 || x >= w || y >= h {
+			return [4]float64{float64(bg.R), float64(bg.G), float64(bg.B), float64(bg.A)}
+		}
+		i := y*src.Stride + x*4
+		p := src.Pix[i : i+4 : i+4]
+		return [4]float64{float64(p[0]), float64(p[1]), float64(p[2]), float64(p[3])}
+	}
+
+	for y := 0; y < h; y++ {
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+w*4]
+		for x := 0; x < w; x++ {
+			sx, sy := float64(x)+d.dx[y], float64(y)+d.dy[x]
+			x0, y0 := math.Floor(sx), math.Floor(sy)
+			fx, fy := sx-x0, sy-y0
+			ix, iy := int(x0), int(y0)
+
+			p00, p10 := at(ix, iy), at(ix+1, iy)
+			p01, p11 := at(ix, iy+1), at(ix+1, iy+1)
+			for c := 0; c < 4; c++ {
+				top := p00[c] + (p10[c]-p00[c])*fx
+				bottom := p01[c] + (p11[c]-p01[c])*fx
+				row[x*4+c] = uint8(math.Round(top + (bottom-top)*fy))
+			}
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bufferPool holds the buffers images are encoded into
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// pngBufferPool lets the PNG encoder reuse its internal buffers
+type pngBufferPool struct {
+	pool sync.Pool
+}
+
+func (p *pngBufferPool) Get() *png.EncoderBuffer {
+	buf, _ := p.pool.Get().(*png.EncoderBuffer)
+	return buf
+}
+
+func (p *pngBufferPool) Put(buf *png.EncoderBuffer) {
+	p.pool.Put(buf)
+}
+
+var pngEncoder = &png.Encoder{BufferPool: &pngBufferPool{}}
+
+// ImageEncoder encodes captcha images for a response format registered with
+// RegisterEncoder
+type ImageEncoder interface {
+	ContentType() string // MIME type of the encoded images, e.g. "image/webp"
+	Encode(w io.Writer, img image.Image) error
+}
+
+// pngImageEncoder is the built-in PNG encoder, reusing its buffers
+type pngImageEncoder struct{}
+
+func (pngImageEncoder) ContentType() string {
+	return "image/png"
+}
+
+func (pngImageEncoder) Encode(w io.Writer, img image.Image) error {
+	return pngEncoder.Encode(w, img)
+}
+
+var (
+	encodersMu sync.RWMutex
+	encoders   = make(map[string]ImageEncoder)
+)
+
+// RegisterEncoder makes the response format available to the generation
+// handlers, encoded by enc, e.g. FormatWebP once the webp package is
+// imported. Requests only get the format when their Accept header lists
+// its content type, others get a PNG.
+func RegisterEncoder(format string, enc ImageEncoder) {
+	encodersMu.Lock()
+	encoders[format] = enc
+	encodersMu.Unlock()
+}
+
+// registeredEncoder returns the encoder registered for the format
+func registeredEncoder(format string) (ImageEncoder, bool) {
+	encodersMu.RLock()
+	enc, ok := encoders[format]
+	encodersMu.RUnlock()
+	return enc, ok
+}
+
+// negotiateEncoder returns the encoder of a registered format when the
+// request accepts it, nil otherwise
+func negotiateEncoder(c *gin.Context, format string) ImageEncoder {
+	enc, ok := registeredEncoder(format)
+	if !ok {
+		return nil
+	}
+	// The response depends on the header whichever way it goes
+	c.Header("Vary", "Accept")
+	if !acceptsType(c.GetHeader("Accept"), enc.ContentType()) {
+		return nil
+	}
+	return enc
+}
+
+// acceptsType reports whether the Accept header lists contentType with a
+// non-zero quality. Wildcards don't count, so a client only gets a format
+// it names.
+func acceptsType(accept, contentType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(mediaType), contentType) {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				if q, err := strconv.ParseFloat(value, 64); err == nil && q <= 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// errDrawingEncoder is returned when a drawingEncoder is handed an image
+var errDrawingEncoder = errors.New("captcha: the encoder draws the captcha text, not rendered images")
+
+// drawingEncoder is an ImageEncoder drawing the captcha text itself rather
+// than encoding the rendered image, such as the SVG and GIF encoders
+type drawingEncoder interface {
+	ImageEncoder
+	render(buf *bytes.Buffer, text string, seed [32]byte, cfg CaptchaConfig) error
+}
+
+// drawingEncoderFor returns the drawing encoder of a built-in format
+func drawingEncoderFor(format string) (drawingEncoder, bool) {
+	switch format {
+	case FormatSVG:
+		return svgEncoder{}, true
+	case FormatGIF:
+		return gifEncoder{}, true
+	}
+	return nil, false
+}
+
+// renderDrawn draws the captcha of data with enc into a pooled buffer, to be
+// handed back with releaseBuffer
+func renderDrawn(enc drawingEncoder, data captchaData, cfg CaptchaConfig) (*bytes.Buffer, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	if err := enc.render(buf, data.value, data.seed, cfg); err != nil {
+		releaseBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// encodePooled encodes img as a PNG into a pooled buffer, to be handed back
+// with releaseBuffer once its content has been used
+func encodePooled(img image.Image) (*bytes.Buffer, error) {
+	return encodeWith(img, pngImageEncoder{})
+}
+
+// encodeWith is encodePooled with the given encoder
+func encodeWith(img image.Image, enc ImageEncoder) (*bytes.Buffer, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	if err := enc.Encode(buf, img); err != nil {
+		releaseBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// releaseBuffer returns a buffer from encodePooled to the pool, if any
+func releaseBuffer(buf *bytes.Buffer) {
+	if buf != nil {
+		bufferPool.Put(buf)
+	}
+}
+
+// writePNG encodes img into a pooled buffer and writes it as the response.
+// Encoding errors are returned before anything is written; errors writing
+// the response are recorded on the context since headers are already sent.
+func writePNG(c *gin.Context, img image.Image) error {
+	buf, err := encodePooled(img)
+	if err != nil {
+		return err
+	}
+	defer releaseBuffer(buf)
+
+	writeBody(c, "image/png", buf.Bytes())
+	return nil
+}
+
+// encodePNG encodes img into a new byte slice that can be kept around
+func encodePNG(img image.Image) ([]byte, error) {
+	buf, err := encodePooled(img)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseBuffer(buf)
+
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// dataURIPrefix starts the data URI of a PNG image, followed by the image
+// base64 encoded
+const dataURIPrefix = "data:image/png;base64,"
+
+// writeDataURI writes the data URI of the encoded PNG image as a plain text
+// response. The image is base64 encoded straight into the response.
+func writeDataURI(c *gin.Context, encoded []byte) error {
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Status(200)
+
+	enc := base64.NewEncoder(base64.StdEncoding, c.Writer)
+	_, err := c.Writer.WriteString(dataURIPrefix)
+	if err == nil {
+		_, err = enc.Write(encoded)
+	}
+	if err == nil {
+		err = enc.Close()
+	}
+	if err != nil {
+		c.Error(err)
+	}
+	return err
+}
+
+// writeBody writes the encoded image or audio as the response. Write errors
+// are recorded on the context and returned, the response may be incomplete.
+func writeBody(c *gin.Context, contentType string, data []byte) error {
+	c.Header("Content-Type", contentType)
+	c.Status(200)
+	if _, err := c.Writer.Write(data); err != nil {
+		c.Error(err)
+		return err
+	}
+	return nil
+}
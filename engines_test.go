@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestEnginesShareStore(t *testing.T) {
+	cfg := testConfig()
+	cfg.Store = NewMemoryStore()
+	cfg.NetworkFunc = Subnet16
+	cfg.NetworkTopN = 5
+	cfg.ImageCacheBytes = 1 << 20
+	captcha := New(cfg)
+
+	// Handlers of the same config are built concurrently, on two engines
+	public, internal := gin.New(), gin.New()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		public.GET("/captcha/new", NewCaptcha(cfg))
+		public.GET("/captcha/:id/image", CaptchaImage(cfg))
+	}()
+	go func() {
+		defer wg.Done()
+		internal.GET("/captcha/:id/image", CaptchaImage(cfg))
+		internal.POST("/verify", VerifyCaptchaWithConfig(cfg), func(c *gin.Context) { c.String(200, "ok") })
+	}()
+	wg.Wait()
+
+	publicSrv, internalSrv := httptest.NewServer(public), httptest.NewServer(internal)
+	defer publicSrv.Close()
+	defer internalSrv.Close()
+
+	get := func(url string) (*http.Response, error) {
+		res, err := http.Get(url)
+		if err == nil {
+			_, err = io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+		return res, err
+	}
+
+	const workers, rounds = 8, 10
+	stats := func() Stats {
+		handlers, instance := store.Stats(), captcha.Stats()
+		handlers.Generated += instance.Generated
+		handlers.Successful += instance.Successful
+		return handlers
+	}
+	before := stats()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				// Generated on the public engine...
+				res, err := get(publicSrv.URL + "/captcha/new")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				id := res.Header.Get(DefaultIDHeader)
+				if res, err = get(internalSrv.URL + "/captcha/" + id + "/image"); err != nil || res.StatusCode != 200 {
+					t.Errorf("image on the internal engine: %v %v", res, err)
+					return
+				}
+
+				// ...and solved on the internal one, or through the instance
+				if i%2 == 0 {
+					if ok, err := captcha.Verify(id, "abc123"); !ok || err != nil {
+						t.Errorf("instance verification: %t %v", ok, err)
+					}
+					continue
+				}
+				res, err = http.PostForm(internalSrv.URL+"/verify", url.Values{DefaultIDField: {id}, DefaultAnswerField: {"abc123"}})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				res.Body.Close()
+				if res.StatusCode != 200 {
+					t.Errorf("verification on the internal engine: %d", res.StatusCode)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	after := stats()
+	if n := after.Generated - before.Generated; n != workers*rounds {
+		t.Errorf("%d captchas generated, want %d", n, workers*rounds)
+	}
+	if n := after.Successful - before.Successful; n != workers*rounds {
+		t.Errorf("%d captchas solved, want %d", n, workers*rounds)
+	}
+}
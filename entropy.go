@@ -0,0 +1,194 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EventWeakConfig is logged when a middleware is created with a config whose
+// entropy is below MinEntropy
+const EventWeakConfig = "captcha.weak_config"
+
+// ConfigDescription summarizes the strength of a configuration
+type ConfigDescription struct {
+	CharsetSize       int     `json:"charset_size"`       // Distinct answers per character, after case folding
+	Length            int     `json:"length"`             // Characters per captcha
+	EntropyBits       float64 `json:"entropy_bits"`       // Entropy of a single answer
+	Steps             int     `json:"steps"`              // Captchas solved in sequence
+	ExpireSeconds     int     `json:"expire_seconds"`     // Lifetime of a captcha
+	AttemptsPerID     int     `json:"attempts_per_id"`    // Guesses allowed per captcha, always 1
+	CooldownThreshold int     `json:"cooldown_threshold"` // Consecutive failures before a cooldown, 0 if disabled
+	CooldownSeconds   int     `json:"cooldown_seconds"`   // Wait imposed after CooldownThreshold failures
+}
+
+// charset returns the characters captchas of the given type are made of
+func charset(captchaType CaptchaType) string {
+	switch captchaType {
+	case TypeNumeric:
+		return "0123456789"
+	case TypeAlphabetic:
+		return "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	case TypeAlphanumeric:
+		return "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	case TypeMath:
+		return "0123456789+-x= "
+	}
+	return ""
+}
+
+// AmbiguousChars are the characters ExcludeAmbiguous leaves out, those
+// easily mistaken for one another: 0 O o, 1 I l, 5 S s, 2 Z z and 8 B
+const AmbiguousChars = "0Oo1Il5Ss2Zz8B"
+
+// charset returns the characters the captchas of cfg are drawn from: its
+// Charset when set, those of its Type otherwise, without AmbiguousChars
+// when ExcludeAmbiguous is set. For TypeQuestion they are the characters
+// of the questions.
+func (cfg CaptchaConfig) charset() string {
+	switch cfg.Type {
+	case TypeMath:
+		return charset(TypeMath)
+	case TypeQuestion:
+		var chars strings.Builder
+		for _, pair := range cfg.Questions {
+			chars.WriteString(pair.Question)
+		}
+		return string(distinctRunes(chars.String()))
+	case TypeWord:
+		return string(distinctRunes(strings.Join(cfg.words(), "")))
+	}
+	chars := charset(cfg.Type)
+	if cfg.Charset != "" {
+		chars = cfg.Charset
+	}
+	if cfg.ExcludeAmbiguous {
+		chars = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(AmbiguousChars, r) {
+				return -1
+			}
+			return r
+		}, chars)
+	}
+	return chars
+}
+
+// maxCharsets is how many charsets keep their distinct characters, those
+// of the least recently used one being dropped past it
+const maxCharsets = 16
+
+// charsetKey identifies the charset of a config of a charset type, see
+// charsetRunes
+type charsetKey struct {
+	captchaType CaptchaType
+	charset     string
+	exclude     bool
+}
+
+// charsets holds the distinct characters of the charsets in use, so a large
+// one such as a CJK charset is deduplicated when the handlers are set up
+// rather than for every captcha
+var charsets = newLRU[charsetKey, []rune](maxCharsets)
+
+// charsetRunes returns the distinct characters of the charset of cfg, in
+// order. They are shared and must not be modified.
+func (cfg CaptchaConfig) charsetRunes() []rune {
+	if cfg.Type == TypeQuestion || cfg.Type == TypeWord {
+		// Made of the questions or the words, which don't fit in a key
+		return distinctRunes(cfg.charset())
+	}
+	key := charsetKey{cfg.Type, cfg.Charset, cfg.ExcludeAmbiguous}
+	if runes, ok := charsets.get(key); ok {
+		return runes
+	}
+	return charsets.add(key, distinctRunes(cfg.charset()))
+}
+
+// charsetSize returns the number of answers a character can take, letters
+// of both cases counting once unless verification is case sensitive
+func (cfg CaptchaConfig) charsetSize() int {
+	runes := cfg.charsetRunes()
+	if cfg.CaseSensitive {
+		return len(runes)
+	}
+
+	distinct := make(map[string]struct{}, len(runes))
+	for _, r := range runes {
+		distinct[foldCase(string(r))] = struct{}{}
+	}
+	return len(distinct)
+}
+
+// Entropy returns the entropy of a captcha answer in bits, i.e. the base 2
+// logarithm of the number of answers a guess has to pick from. It describes
+// the built-in CharsetGenerator and MathGenerator, a custom TextGenerator has
+// to be assessed on its own. For TypeMath it counts the distinct results,
+// an upper bound since some results come up more often than others, and
+// for TypeQuestion and TypeWord the distinct answers, as compared.
+func (cfg CaptchaConfig) Entropy() float64 {
+	var n int
+	switch cfg.Type {
+	case TypeMath:
+		n = mathResults(cfg)
+	case TypeQuestion:
+		n = questionAnswers(cfg)
+	case TypeWord:
+		n = wordAnswers(cfg)
+	}
+	if cfg.Type == TypeMath || cfg.Type == TypeQuestion || cfg.Type == TypeWord {
+		if n > 0 {
+			return math.Log2(float64(n))
+		}
+		return 0
+	}
+
+	size := cfg.charsetSize()
+	if size == 0 || cfg.Length <= 0 {
+		return 0
+	}
+	return float64(cfg.Length) * math.Log2(float64(size))
+}
+
+// DescribeConfig returns the figures a security review needs about cfg
+func DescribeConfig(cfg CaptchaConfig) ConfigDescription {
+	return ConfigDescription{
+		CharsetSize:       cfg.charsetSize(),
+		Length:            cfg.Length,
+		EntropyBits:       cfg.Entropy(),
+		Steps:             max(cfg.Steps, 1),
+		ExpireSeconds:     int(cfg.ExpireTime.Seconds()),
+		AttemptsPerID:     1,
+		CooldownThreshold: cfg.CooldownThreshold,
+		CooldownSeconds:   int(cfg.CooldownDuration.Seconds()),
+	}
+}
+
+// DescribeHandler is an admin handler responding with DescribeConfig of the
+// given config
+func DescribeHandler(config ...CaptchaConfig) gin.HandlerFunc {
+	cfg := DefaultCaptchaConfig()
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+
+	description := DescribeConfig(cfg)
+	return func(c *gin.Context) {
+		c.JSON(200, description)
+	}
+}
+
+// warnWeakConfig logs an EventWeakConfig when the entropy of cfg is below
+// MinEntropy
+func warnWeakConfig(cfg CaptchaConfig) {
+	if cfg.Logger == nil || cfg.MinEntropy <= 0 || cfg.TextGenerator != nil {
+		return
+	}
+	if entropy := cfg.Entropy(); entropy < cfg.MinEntropy {
+		cfg.Logger.Log(Event{
+			Type: EventWeakConfig,
+			Err:  fmt.Errorf("captcha entropy of %.1f bits is below MinEntropy (%.1f bits)", entropy, cfg.MinEntropy),
+		})
+	}
+}
@@ -0,0 +1,101 @@
+// Command example serves a login page protected by the captcha middleware.
+// The page fetches captchas in JSON mode, refreshes them, plays the audio
+// version and submits the answer with the form.
+//
+//	go run ./example -difficulty auto -samples ./samples/en
+package main
+
+import (
+	"embed"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	middleware "github.com/wprimadi/gin-captcha"
+)
+
+//go:embed templates
+var templates embed.FS
+
+func main() {
+	addr := flag.String("addr", ":8080", "listen address")
+	difficulty := flag.String("difficulty", "auto", "captcha difficulty: easy, medium, hard or auto to follow the request rate")
+	samples := flag.String("samples", "", "directory of WAV files named after the characters they spell, replacing the embedded voice")
+	flag.Parse()
+
+	r, err := newRouter(*difficulty, *samples)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("listening on %s", *addr)
+	if err := r.Run(*addr); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newRouter returns the routes of the example serving captchas of the given
+// difficulty, spoken with the WAV files of samples when it names a directory
+func newRouter(difficulty, samples string) (*gin.Engine, error) {
+	cfg := middleware.DefaultCaptchaConfig()
+	cfg.CooldownThreshold = 5
+	cfg.CooldownDuration = time.Minute
+
+	switch difficulty {
+	case "easy":
+		cfg = middleware.DifficultyEasy.Apply(cfg)
+	case "medium":
+		cfg = middleware.DifficultyMedium.Apply(cfg)
+	case "hard":
+		cfg = middleware.DifficultyHard.Apply(cfg)
+	case "auto":
+		// Clients asking for many captchas get harder ones, nobody skips them
+		cfg.RiskFunc = middleware.RequestRateRisk(time.Minute, 20)
+		cfg.RiskDifficulty = middleware.DifficultyForRisk
+	default:
+		return nil, fmt.Errorf("unknown difficulty %q", difficulty)
+	}
+
+	// Spoken captchas of hard difficulty outgrow the default response budget
+	cfg.MaxResponseBytes = 512 << 10
+
+	if samples != "" {
+		pack, err := middleware.LoadWAVPack(os.DirFS(samples), ".")
+		if err != nil {
+			return nil, fmt.Errorf("loading samples: %w", err)
+		}
+		middleware.RegisterSamplePack(cfg.AudioLanguage, pack)
+	}
+
+	page := template.Must(template.ParseFS(templates, "templates/login.html"))
+
+	r := gin.Default()
+	r.SetHTMLTemplate(page)
+
+	r.GET("/", func(c *gin.Context) {
+		c.HTML(200, "login.html", gin.H{
+			"Audio":      true,
+			"Difficulty": difficulty,
+		})
+	})
+
+	// JSON mode: the page gets the ID and the base64 image in one response,
+	// and posts again to refresh
+	r.POST("/captcha", middleware.GenerateCaptchaFromJSON(cfg))
+	r.GET("/captcha/:id/audio", middleware.CaptchaAudio(cfg))
+
+	r.POST("/login", middleware.VerifyCaptchaWithConfig(cfg), func(c *gin.Context) {
+		username := c.PostForm("username")
+		if username == "" {
+			c.JSON(400, gin.H{"error": "Username required"})
+			return
+		}
+		c.JSON(200, gin.H{"message": "Welcome, " + username})
+	})
+
+	return r, nil
+}
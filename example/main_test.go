@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	middleware "github.com/wprimadi/gin-captcha"
+	"github.com/wprimadi/gin-captcha/internal/testhook"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestLoginFlow(t *testing.T) {
+	for _, difficulty := range []string{"easy", "medium", "hard", "auto"} {
+		t.Run(difficulty, func(t *testing.T) {
+			r, err := newRouter(difficulty, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := httptest.NewServer(r)
+			defer srv.Close()
+
+			res, err := http.Get(srv.URL + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != 200 || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+				t.Fatalf("page: %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+			}
+
+			// As the page does: a JSON captcha, then the form with its ID
+			id, answer := generate(t, srv.URL)
+			if code, body := login(t, srv.URL, id, answer); code != 200 || !strings.Contains(body, "Welcome, alice") {
+				t.Errorf("login: %d %s", code, body)
+			}
+			if code, _ := login(t, srv.URL, id, answer); code != 400 {
+				t.Errorf("replayed captcha: %d, want 400", code)
+			}
+
+			id, answer = generate(t, srv.URL)
+			if code, _ := login(t, srv.URL, id, answer+"x"); code != 400 {
+				t.Errorf("wrong answer: %d, want 400", code)
+			}
+		})
+	}
+}
+
+func TestUnknownDifficulty(t *testing.T) {
+	if _, err := newRouter("extreme", ""); err == nil {
+		t.Error("no error for an unknown difficulty")
+	}
+}
+
+// generate fetches a captcha in JSON mode and returns its ID and answer
+func generate(t *testing.T, base string) (id, answer string) {
+	t.Helper()
+	res, err := http.Post(base+"/captcha", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var data struct {
+		CaptchaID string `json:"captcha_id"`
+		Image     string `json:"image"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 || data.CaptchaID == "" || data.Image == "" {
+		t.Fatalf("captcha: %d %+v", res.StatusCode, data)
+	}
+
+	answer, ok := testhook.Answer(data.CaptchaID)
+	if !ok {
+		t.Fatalf("captcha %q not stored", data.CaptchaID)
+	}
+	return data.CaptchaID, answer
+}
+
+// login submits the login form with the captcha ID in the header and
+// returns the response status and body
+func login(t *testing.T, base, id, answer string) (int, string) {
+	t.Helper()
+	form := url.Values{"username": {"alice"}, "captcha": {answer}}
+	req, err := http.NewRequest("POST", base+"/login", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(middleware.DefaultIDHeader, id)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var body strings.Builder
+	if _, err := io.Copy(&body, res.Body); err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, body.String()
+}
@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// Variant is a named change of the captcha configuration, rolled out to a
+// share of the captchas by an Experiment
+type Variant struct {
+	Name   string                                // Reported in the "variant" metric tag and log field
+	Weight int                                   // Share of the captchas, relative to the other variants
+	Apply  func(cfg CaptchaConfig) CaptchaConfig // Adjusts the generation config; nil keeps it, e.g. for the control
+}
+
+// Experiment splits the generated captchas between variants, e.g. to compare
+// the solve rate of a new rendering style on 5% of the traffic before
+// switching to it. Each captcha is assigned a variant from its ID, and keeps
+// it for its whole lifetime. Weights can be changed while serving with
+// SetWeights.
+type Experiment struct {
+	mu       sync.RWMutex
+	variants []Variant
+	total    int
+}
+
+// NewExperiment returns an experiment over the given variants, which must
+// have distinct names and non-negative weights with a positive sum
+func NewExperiment(variants ...Variant) (*Experiment, error) {
+	names := make(map[string]bool, len(variants))
+	for _, v := range variants {
+		if v.Name == "" {
+			return nil, errors.New("variant name required")
+		}
+		if names[v.Name] {
+			return nil, fmt.Errorf("duplicate variant %q", v.Name)
+		}
+		names[v.Name] = true
+	}
+
+	e := &Experiment{variants: append([]Variant(nil), variants...)}
+	weights := make(map[string]int, len(variants))
+	for _, v := range variants {
+		weights[v.Name] = v.Weight
+	}
+	if err := e.SetWeights(weights); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// SetWeights changes the weights of the named variants, leaving the others
+// as they are. Captchas already issued keep their variant.
+func (e *Experiment) SetWeights(weights map[string]int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	variants := append([]Variant(nil), e.variants...)
+	for name, weight := range weights {
+		i := e.index(name)
+		if i < 0 {
+			return fmt.Errorf("unknown variant %q", name)
+		}
+		if weight < 0 {
+			return fmt.Errorf("negative weight for variant %q", name)
+		}
+		variants[i].Weight = weight
+	}
+
+	total := 0
+	for _, v := range variants {
+		total += v.Weight
+	}
+	if total <= 0 {
+		return errors.New("variant weights must sum to more than 0")
+	}
+
+	e.variants, e.total = variants, total
+	return nil
+}
+
+// Weights returns the current weight of each variant
+func (e *Experiment) Weights() map[string]int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	weights := make(map[string]int, len(e.variants))
+	for _, v := range e.variants {
+		weights[v.Name] = v.Weight
+	}
+	return weights
+}
+
+// index returns the position of the named variant, or -1
+func (e *Experiment) index(name string) int {
+	for i, v := range e.variants {
+		if v.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// assign returns the name of the variant of a captcha, picked from a hash
+// of its ID so the split follows the weights
+func (e *Experiment) assign(captchaID string) string {
+	h := fnv.New64a()
+	h.Write([]byte(captchaID))
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	n := int(h.Sum64() % uint64(e.total))
+	for _, v := range e.variants {
+		if n < v.Weight {
+			return v.Name
+		}
+		n -= v.Weight
+	}
+	return ""
+}
+
+// withVariant returns cfg adjusted by the named variant of its experiment.
+// Captchas are rendered with their variant on every fetch.
+func (cfg CaptchaConfig) withVariant(name string) CaptchaConfig {
+	if cfg.Experiment == nil || name == "" {
+		return cfg
+	}
+
+	cfg.Experiment.mu.RLock()
+	i := cfg.Experiment.index(name)
+	var apply func(CaptchaConfig) CaptchaConfig
+	if i >= 0 {
+		apply = cfg.Experiment.variants[i].Apply
+	}
+	cfg.Experiment.mu.RUnlock()
+
+	if apply == nil {
+		return cfg
+	}
+	return apply(cfg)
+}
+
+// variantTags returns the metric tags of a captcha variant
+func variantTags(variant string) []string {
+	if variant == "" {
+		return nil
+	}
+	return []string{"variant:" + variant}
+}
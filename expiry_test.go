@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ttlStore is a MemoryStore remembering the TTL each entry was set with, as
+// a Redis store hands it to the server
+type ttlStore struct {
+	*MemoryStore
+	ttls sync.Map // ID to time.Duration
+}
+
+func (s *ttlStore) Set(id, value string, ttl time.Duration) error {
+	s.ttls.Store(id, ttl)
+	return s.MemoryStore.Set(id, value, ttl)
+}
+
+func TestExpiryHotReload(t *testing.T) {
+	// The expiry is reloaded through an experiment, as a config reload would
+	var expiry atomic.Int64
+	expiry.Store(int64(time.Minute))
+	exp, err := NewExperiment(Variant{Name: "reloaded", Weight: 1, Apply: func(cfg CaptchaConfig) CaptchaConfig {
+		cfg.ExpireTime = time.Duration(expiry.Load())
+		return cfg
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &ttlStore{MemoryStore: NewMemoryStore()}
+	cfg := testConfig()
+	cfg.Experiment = exp
+	cfg.Store = backend
+	h := testRouter(cfg)
+
+	const workers, rounds = 4, 40
+	var reloaded atomic.Bool
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				// Reloads to a shorter expiry midway through, while others generate
+				if i == rounds/2 && reloaded.CompareAndSwap(false, true) {
+					expiry.Store(int64(10 * time.Second))
+				}
+				after := reloaded.Load()
+
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest("GET", "/captcha?format="+FormatJSON, nil))
+				var body struct {
+					ID        string `json:"captcha_id"`
+					ExpiresIn int    `json:"expires_in"`
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+					t.Errorf("generate: %d %s", rec.Code, rec.Body)
+					return
+				}
+
+				data, ok, err := store.loadCaptcha(cfg, body.ID)
+				if !ok || err != nil {
+					t.Errorf("captcha %s not stored: %v", body.ID, err)
+					return
+				}
+				honored := time.Until(data.expiresAt())
+				ttl, _ := backend.ttls.Load(body.ID)
+
+				header, _ := strconv.Atoi(rec.Header().Get(HeaderExpiresIn))
+				told := map[string]int{"body": body.ExpiresIn, "header": header}
+				for _, c := range rec.Result().Cookies() {
+					if c.Name == DefaultIDCookie {
+						told["cookie"] = c.MaxAge
+					}
+				}
+				if len(told) != 3 {
+					t.Errorf("no ID cookie")
+				}
+				for where, seconds := range told {
+					lifetime := time.Duration(seconds) * time.Second
+					if lifetime > honored || lifetime > ttl.(time.Duration) {
+						t.Errorf("%s tells %v, the entry lives %v and the store keeps it %v", where, lifetime, honored, ttl)
+					}
+					if after && lifetime > 10*time.Second {
+						t.Errorf("%s tells %v after the expiry was reloaded to 10s", where, lifetime)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,450 @@
+package middleware
+
+import (
+	"cmp"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"os"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// EventFontFallback is logged when characters are drawn with the basic font
+// because the configured font couldn't draw them
+const EventFontFallback = "captcha.font_fallback"
+
+// DefaultFontSize was the size of Font or FontFile used when FontSize is 0,
+// in points.
+//
+// Deprecated: FontSize 0 now scales the text with the image, see
+// FontHeightRatio.
+const DefaultFontSize = 32
+
+// FontHeightRatio is the font size relative to the image height when
+// FontSize is 0, so the text fills larger images rather than keeping one
+// size. The size is also capped for the characters to fit the width.
+const FontHeightRatio = 0.6
+
+// basicGlyphWidth and basicGlyphHeight are the cell size of the basic font
+const (
+	basicGlyphWidth  = 7
+	basicGlyphHeight = 13
+)
+
+// fontKey identifies a font: Font, or FontFile when Font is nil
+type fontKey struct {
+	font *opentype.Font
+	file string
+}
+
+// loadedFont is a parsed font along with the faces drawing it at one size.
+// Faces keep per-glyph buffers, so each render takes its own from the pool.
+type loadedFont struct {
+	font  *opentype.Font
+	faces sync.Pool
+}
+
+// maxFontSizes is how many sizes of each font keep their faces. Sizes vary
+// with FontSizeJitter and the image size requests ask for, so the faces of
+// the least recently drawn ones are dropped past it.
+const maxFontSizes = 16
+
+// fontSizes is a font parsed once, with its faces at the sizes drawn most
+// recently
+type fontSizes struct {
+	font  *opentype.Font
+	sizes *lru[float64, *loadedFont]
+}
+
+// fonts holds the fonts loaded so far, parsed once per file
+var fonts sync.Map // fontKey -> *fontSizes
+
+// hasFont reports whether cfg draws with Fonts, Font or FontFile rather
+// than the basic font
+func (cfg CaptchaConfig) hasFont() bool {
+	return len(cfg.Fonts) > 0 || cfg.Font != nil || cfg.FontFile != ""
+}
+
+// fontChoices returns a config drawing with each of the Fonts of cfg, or cfg
+// itself when it has a single font
+func (cfg CaptchaConfig) fontChoices() []CaptchaConfig {
+	if len(cfg.Fonts) == 0 {
+		return []CaptchaConfig{cfg}
+	}
+	choices := make([]CaptchaConfig, len(cfg.Fonts))
+	for i, f := range cfg.Fonts {
+		choices[i] = cfg
+		choices[i].Font, choices[i].Fonts = f, nil
+	}
+	return choices
+}
+
+// pickFont returns cfg drawing the next character: with one of its Fonts at
+// random, at a size off FontSize by up to FontSizeJitter points
+func (cfg CaptchaConfig) pickFont(rnd *randSource) CaptchaConfig {
+	if len(cfg.Fonts) > 0 {
+		cfg.Font, cfg.Fonts = cfg.Fonts[rnd.Intn(len(cfg.Fonts))], nil
+	}
+	// Whole points, so each font has a few faces to cache
+	if jitter := cfg.FontSizeJitter; jitter > 0 && cfg.hasFont() {
+		cfg.FontSize = cfg.fontSize() + float64(rnd.Intn(2*jitter+1)-jitter)
+	}
+	return cfg
+}
+
+// fontName names the font of cfg in errors: its FontFile, or the full name
+// of Font
+func (cfg CaptchaConfig) fontName() string {
+	switch {
+	case cfg.Font == nil && len(cfg.Fonts) > 0:
+		return "Fonts"
+	case cfg.Font == nil:
+		return cfg.FontFile
+	}
+	if name, err := cfg.Font.Name(nil, sfnt.NameIDFull); err == nil && name != "" {
+		return name
+	}
+	return "Font"
+}
+
+// fontSize returns the size fonts are drawn at: FontSize, or
+// FontHeightRatio of the height, in whole points, and at most what lets
+// Length characters of an average advance of 0.6 em fit 90% of the width
+func (cfg CaptchaConfig) fontSize() float64 {
+	if cfg.FontSize > 0 {
+		return cfg.FontSize
+	}
+	size := FontHeightRatio * float64(cfg.Height)
+	if cfg.Length > 0 {
+		size = min(size, 0.9*float64(cfg.Width)/float64(cfg.Length)/0.6)
+	}
+	return max(math.Round(size), 1)
+}
+
+// basicScale returns the factor the basic font is scaled up by, a whole
+// number so that its pixels stay square: FontSize over its 13 pixels, or
+// fontSize for the width and height of the image
+func (cfg CaptchaConfig) basicScale() int {
+	if cfg.FontSize > 0 {
+		return max(int(math.Round(cfg.FontSize/basicGlyphHeight)), 1)
+	}
+	scale := FontHeightRatio * float64(cfg.Height) / basicGlyphHeight
+	if cfg.Length > 0 {
+		scale = min(scale, 0.9*float64(cfg.Width)/float64(cfg.Length*basicGlyphWidth))
+	}
+	return max(int(scale), 1)
+}
+
+// basicFace returns the basic font scaled for cfg
+func (cfg CaptchaConfig) basicFace() font.Face {
+	if scale := cfg.basicScale(); scale > 1 {
+		return scaledBasicFace{scale}
+	}
+	return basicfont.Face7x13
+}
+
+// isBasicFace reports whether face is the basic font, scaled or not, whose
+// masks needn't be copied
+func isBasicFace(face font.Face) bool {
+	_, scaled := face.(scaledBasicFace)
+	return scaled || face == basicfont.Face7x13
+}
+
+// scaledBasicFace is the basic font scaled up by a whole factor, each pixel
+// becoming a square of scale pixels
+type scaledBasicFace struct {
+	scale int
+}
+
+// maxGlyphScales is how many scales of the basic font keep their glyphs,
+// those of the least recently drawn scale being dropped past it
+const maxGlyphScales = 8
+
+// scaledGlyphs holds the masks of the scaled basic glyphs drawn so far,
+// which are never modified, by scale: under a hundred per scale, the font
+// only having ASCII
+var scaledGlyphs = newLRU[int, *sync.Map](maxGlyphScales) // scale -> rune -> *image.Alpha
+
+func (f scaledBasicFace) Close() error { return nil }
+
+func (f scaledBasicFace) Glyph(dot fixed.Point26_6, r rune) (image.Rectangle, image.Image, image.Point, fixed.Int26_6, bool) {
+	dr, mask, maskp, advance, ok := basicfont.Face7x13.Glyph(fixed.Point26_6{}, r)
+	if !ok {
+		return image.Rectangle{}, nil, image.Point{}, 0, false
+	}
+
+	s := f.scale
+	glyphs, ok := scaledGlyphs.get(s)
+	if !ok {
+		glyphs = scaledGlyphs.add(s, new(sync.Map))
+	}
+	scaled, cached := glyphs.Load(r)
+	if !cached {
+		alpha := mask.(*image.Alpha)
+		glyph := image.NewAlpha(image.Rect(0, 0, dr.Dx()*s, dr.Dy()*s))
+		for y := 0; y < glyph.Rect.Dy(); y++ {
+			for x := 0; x < glyph.Rect.Dx(); x++ {
+				glyph.Pix[y*glyph.Stride+x] = alpha.AlphaAt(maskp.X+x/s, maskp.Y+y/s).A
+			}
+		}
+		scaled, _ = glyphs.LoadOrStore(r, glyph)
+	}
+	origin := image.Pt(dot.X.Round(), dot.Y.Round())
+	dr = image.Rectangle{dr.Min.Mul(s), dr.Max.Mul(s)}.Add(origin)
+	return dr, scaled.(*image.Alpha), image.Point{}, advance * fixed.Int26_6(s), true
+}
+
+func (f scaledBasicFace) GlyphBounds(r rune) (fixed.Rectangle26_6, fixed.Int26_6, bool) {
+	bounds, advance, ok := basicfont.Face7x13.GlyphBounds(r)
+	s := fixed.Int26_6(f.scale)
+	return fixed.Rectangle26_6{Min: bounds.Min.Mul(s << 6), Max: bounds.Max.Mul(s << 6)}, advance * s, ok
+}
+
+func (f scaledBasicFace) GlyphAdvance(r rune) (fixed.Int26_6, bool) {
+	advance, ok := basicfont.Face7x13.GlyphAdvance(r)
+	return advance * fixed.Int26_6(f.scale), ok
+}
+
+func (f scaledBasicFace) Kern(r0, r1 rune) fixed.Int26_6 { return 0 }
+
+func (f scaledBasicFace) Metrics() font.Metrics {
+	m := basicfont.Face7x13.Metrics()
+	s := fixed.Int26_6(f.scale)
+	return font.Metrics{
+		Height:     m.Height * s,
+		Ascent:     m.Ascent * s,
+		Descent:    m.Descent * s,
+		XHeight:    m.XHeight * s,
+		CapHeight:  m.CapHeight * s,
+		CaretSlope: m.CaretSlope,
+	}
+}
+
+// loadFont returns the font of cfg at its size, reading and parsing
+// FontFile on first use. The faces of each size are created once too, for
+// the maxFontSizes sizes drawn most recently.
+func loadFont(cfg CaptchaConfig) (*loadedFont, error) {
+	key := fontKey{cfg.Font, cfg.FontFile}
+	if cfg.Font != nil {
+		key.file = ""
+	}
+
+	var parsed *fontSizes
+	if loaded, ok := fonts.Load(key); ok {
+		parsed = loaded.(*fontSizes)
+	} else {
+		ttf := cfg.Font
+		if ttf == nil {
+			data, err := os.ReadFile(cfg.FontFile)
+			if err != nil {
+				return nil, fmt.Errorf("load captcha font: %w", err)
+			}
+			if ttf, err = opentype.Parse(data); err != nil {
+				return nil, fmt.Errorf("parse captcha font %s: %w", cfg.FontFile, err)
+			}
+		}
+		loaded, _ := fonts.LoadOrStore(key, &fontSizes{font: ttf, sizes: newLRU[float64, *loadedFont](maxFontSizes)})
+		parsed = loaded.(*fontSizes)
+	}
+
+	size := cfg.fontSize()
+	if f, ok := parsed.sizes.get(size); ok {
+		return f, nil
+	}
+
+	// Creating a face validates the size and the font tables
+	face, err := opentype.NewFace(parsed.font, &opentype.FaceOptions{Size: size, DPI: 72})
+	if err != nil {
+		return nil, fmt.Errorf("load captcha font %s: %w", cfg.fontName(), err)
+	}
+
+	f := &loadedFont{font: parsed.font}
+	f.faces.New = func() any {
+		face, _ := opentype.NewFace(parsed.font, &opentype.FaceOptions{Size: size, DPI: 72})
+		return face
+	}
+	f.faces.Put(face)
+	return parsed.sizes.add(size, f), nil
+}
+
+// CheckFont loads the Fonts, Font or FontFile of cfg, returning an error
+// when one can't be read or parsed or FontSizeJitter is negative or not
+// below the size. It also returns an error listing the characters of the
+// charset a font has no glyph for; those are drawn with the basic font.
+// Without a font, it lists the characters the basic font, which only has
+// ASCII, can't draw, such as those of a CJK or Cyrillic Charset.
+func CheckFont(cfg CaptchaConfig) error {
+	if err := loadFonts(cfg); err != nil {
+		return err
+	}
+
+	for _, choice := range cfg.fontChoices() {
+		var missing []rune
+		for _, char := range cfg.charsetRunes() {
+			if !fontHas(choice, char) {
+				missing = append(missing, char)
+			}
+		}
+		switch {
+		case len(missing) == 0:
+			continue
+		case !choice.hasFont():
+			return fmt.Errorf("captcha basic font has no glyph for %q, set Font or FontFile to a font that has", string(missing))
+		}
+		return fmt.Errorf("captcha font %s has no glyph for %q, drawn with the basic font", choice.fontName(), string(missing))
+	}
+	return nil
+}
+
+// loadFonts loads every font of cfg and checks FontSizeJitter
+func loadFonts(cfg CaptchaConfig) error {
+	if !cfg.hasFont() {
+		return nil
+	}
+	if cfg.FontSizeJitter < 0 || float64(cfg.FontSizeJitter) >= cfg.fontSize() {
+		return fmt.Errorf("captcha FontSizeJitter %d must be between 0 and the font size, %g",
+			cfg.FontSizeJitter, cfg.fontSize())
+	}
+	for _, choice := range cfg.fontChoices() {
+		if _, err := loadFont(choice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mustLoadFont panics when the fonts of cfg can't be loaded, so a wrong path
+// or corrupt font is caught when the routes are set up. Missing glyphs are
+// only logged.
+func mustLoadFont(cfg CaptchaConfig) {
+	if err := loadFonts(cfg); err != nil {
+		panic(err)
+	}
+	if err := CheckFont(cfg); err != nil && cfg.Logger != nil {
+		cfg.Logger.Log(Event{Type: EventFontFallback, Err: err})
+	}
+}
+
+// textFace returns the face drawing the text of cfg, after pickFont, and a
+// function handing it back once the render is done. It falls back to the
+// basic font when the font can't be loaded, which mustLoadFont prevents for
+// the handlers.
+func textFace(cfg CaptchaConfig) (font.Face, func(), error) {
+	if !cfg.hasFont() {
+		return cfg.basicFace(), func() {}, nil
+	}
+	f, err := loadFont(cfg)
+	if err != nil {
+		return cfg.basicFace(), func() {}, err
+	}
+	face := f.faces.Get().(font.Face)
+	return face, func() { f.faces.Put(face) }, nil
+}
+
+// renderFaces holds the faces taken by a render, one per font and size, so
+// characters sharing them share a face
+type renderFaces struct {
+	held []heldFace
+	err  error // First font error, the characters falling back to the basic font
+}
+
+type heldFace struct {
+	font    *opentype.Font
+	file    string
+	size    float64
+	face    font.Face
+	release func()
+}
+
+// face returns the face drawing the text of cfg, after pickFont
+func (r *renderFaces) face(cfg CaptchaConfig) (font.Face, error) {
+	for _, h := range r.held {
+		if h.font == cfg.Font && h.file == cfg.FontFile && h.size == cfg.fontSize() {
+			return h.face, nil
+		}
+	}
+	face, release, err := textFace(cfg)
+	if err != nil {
+		release()
+		r.err = cmp.Or(r.err, err)
+		return face, err
+	}
+	r.held = append(r.held, heldFace{cfg.Font, cfg.FontFile, cfg.fontSize(), face, release})
+	return face, nil
+}
+
+// release hands the faces back once the render is done
+func (r *renderFaces) release() {
+	for _, h := range r.held {
+		h.release()
+	}
+}
+
+// glyphFace returns the face drawing char: face when it has a glyph for it,
+// basic, the basic font, otherwise
+func glyphFace(face, basic font.Face, char rune) (font.Face, bool) {
+	if isBasicFace(face) {
+		return face, true
+	}
+	if _, ok := face.GlyphAdvance(char); ok {
+		return face, true
+	}
+	return basic, false
+}
+
+// copyMask copies the part of mask drawn at dr, since faces reuse their mask
+// for the next glyph
+func copyMask(mask image.Image, dr image.Rectangle, maskp image.Point) *image.Alpha {
+	dst := image.NewAlpha(image.Rect(0, 0, dr.Dx(), dr.Dy()))
+	draw.Draw(dst, dst.Bounds(), mask, maskp, draw.Src)
+	return dst
+}
+
+// reportFontFallback counts and logs the characters of a render drawn with
+// the basic font. The characters themselves are left out, they are part of
+// an answer.
+func reportFontFallback(cfg CaptchaConfig, missing int, err error) {
+	if missing == 0 && err == nil {
+		return
+	}
+	if cfg.Metrics != nil {
+		cfg.Metrics.Count(MetricFontFallback, int64(missing))
+	}
+	if cfg.Logger != nil {
+		if err == nil {
+			err = fmt.Errorf("captcha font %s has no glyph for %d characters, drawn with the basic font", cfg.fontName(), missing)
+		}
+		cfg.Logger.Log(Event{Type: EventFontFallback, Err: err})
+	}
+}
+
+// fontHas reports whether char is drawn with every font of cfg, or with the
+// basic font when there is none, rather than a fallback glyph
+func fontHas(cfg CaptchaConfig, char rune) bool {
+	if !cfg.hasFont() {
+		// The basic font only has printable ASCII
+		return char >= ' ' && char <= '~'
+	}
+	if len(cfg.Fonts) > 0 {
+		for _, choice := range cfg.fontChoices() {
+			if !fontHas(choice, char) {
+				return false
+			}
+		}
+		return true
+	}
+	f, err := loadFont(cfg)
+	if err != nil {
+		return false
+	}
+	var buf sfnt.Buffer
+	index, err := f.font.GlyphIndex(&buf, char)
+	return err == nil && index != 0
+}
@@ -0,0 +1,189 @@
+package middleware
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wprimadi/gin-captcha/assets"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// lettersOnlyFont returns the embedded font with a character map of its
+// letters only, so it has no glyph for digits
+var lettersOnlyFont = sync.OnceValues(func() (*opentype.Font, error) {
+	ttf := assets.FontTTF()
+	f, err := sfnt.Parse(ttf)
+	if err != nil {
+		return nil, err
+	}
+
+	// A format 4 subtable with a segment per letter, in order, and the
+	// final one
+	var letters []rune
+	for r := 'A'; r <= 'z'; r++ {
+		if r <= 'Z' || r >= 'a' {
+			letters = append(letters, r)
+		}
+	}
+	segments := len(letters) + 1
+	sub := make([]byte, 16+8*segments)
+	be := binary.BigEndian
+	be.PutUint16(sub[0:], 4)
+	be.PutUint16(sub[2:], uint16(len(sub)))
+	be.PutUint16(sub[6:], uint16(2*segments))
+	ends, starts, deltas := sub[14:], sub[16+2*segments:], sub[16+4*segments:]
+	for i, r := range letters {
+		glyph, err := f.GlyphIndex(nil, r)
+		if err != nil || glyph == 0 {
+			return nil, err
+		}
+		be.PutUint16(ends[2*i:], uint16(r))
+		be.PutUint16(starts[2*i:], uint16(r))
+		be.PutUint16(deltas[2*i:], uint16(glyph)-uint16(r))
+	}
+	be.PutUint16(ends[2*len(letters):], 0xFFFF)
+	be.PutUint16(starts[2*len(letters):], 0xFFFF)
+	be.PutUint16(deltas[2*len(letters):], 1)
+	cmap := append([]byte{0, 0, 0, 1, 0, 3, 0, 1, 0, 0, 0, 12}, sub...)
+
+	// Appended to a copy of the file, the cmap record pointing to it
+	font := append([]byte(nil), ttf...)
+	for len(font)%4 != 0 {
+		font = append(font, 0)
+	}
+	offset := len(font)
+	font = append(font, cmap...)
+	tables := int(be.Uint16(font[4:]))
+	for i := 0; i < tables; i++ {
+		record := font[12+16*i:]
+		if string(record[:4]) == "cmap" {
+			be.PutUint32(record[8:], uint32(offset))
+			be.PutUint32(record[12:], uint32(len(cmap)))
+		}
+	}
+	return opentype.Parse(font)
+})
+
+// countingMetrics is a Metrics summing the counts by name
+type countingMetrics struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (m *countingMetrics) Count(name string, value int64, tags ...string) {
+	m.mu.Lock()
+	m.counts[name] += value
+	m.mu.Unlock()
+}
+
+func (m *countingMetrics) Gauge(string, float64, ...string)        {}
+func (m *countingMetrics) Timing(string, time.Duration, ...string) {}
+
+func TestFontFallbackPerGlyph(t *testing.T) {
+	font, err := lettersOnlyFont()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := &recordingLogger{}
+	metrics := &countingMetrics{counts: make(map[string]int64)}
+	cfg := testConfig()
+	cfg.Font = font
+	cfg.Charset = "AB12"
+	cfg.Logger = logger
+	cfg.Metrics = metrics
+
+	if fontHas(cfg, '1') || !fontHas(cfg, 'A') {
+		t.Fatal("the font must have letters and no digits")
+	}
+
+	// On setup, the digits are reported rather than failing
+	if err := CheckFont(cfg); err == nil || !strings.Contains(err.Error(), `"12"`) {
+		t.Errorf("CheckFont: %v, want the digits listed", err)
+	}
+	mustLoadFont(cfg)
+	if n := logger.count(EventFontFallback); n != 1 {
+		t.Errorf("%d fallback warnings on setup, want 1", n)
+	}
+
+	// Each digit is drawn with the basic font, the letters with the font
+	face, release, err := textFace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	basic := cfg.basicFace()
+	for _, tc := range []struct {
+		char rune
+		font bool
+	}{{'A', true}, {'b', true}, {'1', false}, {'7', false}} {
+		got, ok := glyphFace(face, basic, tc.char)
+		if ok != tc.font || (got == basic) == tc.font {
+			t.Errorf("%q drawn with the font: %t, want %t", tc.char, ok, tc.font)
+		}
+	}
+
+	rnd := newRandSource()
+	defer rnd.release()
+	img := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
+	glyphs := drawText(img, "A1B2", cfg, rnd, renderColors{background: color.RGBA{255, 255, 255, 255}, text: color.RGBA{A: 255}})
+	if len(glyphs) != 4 {
+		t.Fatalf("%d glyphs drawn, want 4", len(glyphs))
+	}
+	for i, g := range glyphs {
+		if g.rect.Empty() {
+			t.Errorf("glyph %d has no ink", i)
+		}
+	}
+	if n := metrics.counts[MetricFontFallback]; n != 2 {
+		t.Errorf("%s counted %d, want the 2 digits", MetricFontFallback, n)
+	}
+	if n := logger.count(EventFontFallback); n != 2 {
+		t.Errorf("%d fallback warnings, want 1 more for the render", n)
+	}
+
+	// Requests still get their captcha
+	cfg.TextGenerator = fixedText("AB12")
+	w := httptest.NewRecorder()
+	testRouter(cfg).ServeHTTP(w, httptest.NewRequest("GET", "/captcha", nil))
+	if w.Code != 200 {
+		t.Errorf("generate: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestFontCachesBounded(t *testing.T) {
+	cfg := DefaultCaptchaConfig()
+	cfg.Font = assets.Font()
+	for size := 10; size < 10+3*maxFontSizes; size++ {
+		cfg.FontSize = float64(size)
+		if _, err := loadFont(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loaded, _ := fonts.Load(fontKey{font: cfg.Font})
+	if n := loaded.(*fontSizes).sizes.len(); n > maxFontSizes {
+		t.Errorf("%d sizes of the font kept, limit is %d", n, maxFontSizes)
+	}
+
+	// An evicted size loads again
+	cfg.FontSize = 10
+	if f, err := loadFont(cfg); err != nil || f.font != cfg.Font {
+		t.Errorf("reloading an evicted size: %v", err)
+	}
+
+	for scale := 2; scale < 2+3*maxGlyphScales; scale++ {
+		if _, _, _, _, ok := (scaledBasicFace{scale}).Glyph(fixed.Point26_6{}, 'A'); !ok {
+			t.Fatalf("no glyph at scale %d", scale)
+		}
+	}
+	if n := scaledGlyphs.len(); n > maxGlyphScales {
+		t.Errorf("glyphs of %d scales kept, limit is %d", n, maxGlyphScales)
+	}
+}
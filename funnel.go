@@ -0,0 +1,49 @@
+package middleware
+
+import "time"
+
+// Funnel stages, in the order a captcha goes through them
+const (
+	FunnelShown     = "shown"     // The captcha was created and handed to the client
+	FunnelFetched   = "fetched"   // Its image or audio was fetched from CaptchaImage or CaptchaAudio, once per fetch
+	FunnelAttempted = "attempted" // An answer was submitted; captchas are single-use, so this is the only attempt
+	FunnelSolved    = "solved"    // The answer was accepted
+	FunnelAbandoned = "abandoned" // The captcha expired without an answer, reported by the cleanup sweep
+)
+
+// FunnelEvent marks a captcha reaching a stage of the solve funnel, for
+// product analytics: how many captchas shown are fetched, attempted, solved
+// or abandoned, split by variant and difficulty.
+type FunnelEvent struct {
+	Stage      string    // One of the Funnel stages
+	CaptchaID  string    // Store ID of the captcha, never the signed one
+	Trace      string    // Trace token of the captcha, see HeaderTrace
+	Variant    string    // Experiment variant of the captcha, see Experiment
+	Difficulty string    // Difficulty preset the captcha was generated with, see RiskDifficulty
+	IssuedAt   time.Time // When the captcha was created
+	Time       time.Time // When the stage was reached
+}
+
+// SetFunnelFunc registers fn to receive the funnel events of every captcha.
+// Like Logger, it is called on the request path and must not block. It must
+// be called before the store is in use.
+func (s *CaptchaStore) SetFunnelFunc(fn func(FunnelEvent)) {
+	s.funnel = fn
+}
+
+// reportFunnel sends the event of a captcha reaching stage to the funnel
+// function of s, if any
+func (s *CaptchaStore) reportFunnel(stage, captchaID string, data captchaData) {
+	if s.funnel == nil {
+		return
+	}
+	s.funnel(FunnelEvent{
+		Stage:      stage,
+		CaptchaID:  captchaID,
+		Trace:      data.trace,
+		Variant:    data.variant,
+		Difficulty: data.difficulty,
+		IssuedAt:   data.issuedAt,
+		Time:       time.Now(),
+	})
+}
@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"time"
+)
+
+const (
+	DefaultFrames     = 4                      // Frames of GIF captchas when Frames is 0
+	MaxFrames         = 20                     // Most frames of a GIF captcha
+	DefaultFrameDelay = 400 * time.Millisecond // Frame delay of GIF captchas when FrameDelay is 0
+)
+
+// gifHiddenEvery hides one character in this many from each frame, in turn
+const gifHiddenEvery = 3
+
+// frames returns the number of frames of GIF captchas, at least 2 so that
+// every character shows in one of them
+func (cfg CaptchaConfig) frames() int {
+	if cfg.Frames <= 0 {
+		return DefaultFrames
+	}
+	return min(max(cfg.Frames, 2), MaxFrames)
+}
+
+// frameDelay returns the delay between GIF frames in hundredths of a second,
+// the unit of the format
+func (cfg CaptchaConfig) frameDelay() int {
+	delay := cfg.FrameDelay
+	if delay <= 0 {
+		delay = DefaultFrameDelay
+	}
+	// Browsers play shorter delays at a default speed
+	return max(int(delay/(10*time.Millisecond)), 2)
+}
+
+// gifEncoder draws captchas as animated GIFs, each frame with its own noise
+// and only some of the characters, so that the answer only shows over the
+// animation
+type gifEncoder struct{}
+
+func (gifEncoder) ContentType() string {
+	return "image/gif"
+}
+
+func (gifEncoder) Encode(w io.Writer, img image.Image) error {
+	return errDrawingEncoder
+}
+
+func (gifEncoder) render(buf *bytes.Buffer, text string, seed [32]byte, cfg CaptchaConfig) error {
+	rnd := newSeededSource(seed)
+	defer rnd.release()
+
+	return gif.EncodeAll(buf, drawGIF(text, cfg, rnd))
+}
+
+// drawGIF draws the frames of a GIF captcha. The characters keep their place
+// across frames, each frame hiding every gifHiddenEvery-th one in turn. The
+// frames share the web-safe palette, written once as the global color table,
+// and are drawn one after the other on the same scratch image.
+func drawGIF(text string, cfg CaptchaConfig, rnd *randSource) *gif.GIF {
+	bounds := image.Rect(0, 0, cfg.Width, cfg.Height)
+
+	// Lay the characters out once
+	colors := cfg.renderColors(rnd)
+	scratch := image.NewRGBA(bounds)
+	glyphs := drawText(scratch, text, cfg, rnd, colors)
+	phase := rnd.Intn(gifHiddenEvery)
+
+	// Every frame is bent along the same waves
+	wave := cfg.distortion(rnd)
+	var distorted *image.RGBA
+	if wave != nil {
+		distorted = image.NewRGBA(bounds)
+	}
+
+	n := cfg.frames()
+	anim := &gif.GIF{
+		Image: make([]*image.Paletted, 0, n),
+		Delay: make([]int, 0, n),
+		Config: image.Config{
+			ColorModel: color.Palette(palette.WebSafe),
+			Width:      cfg.Width,
+			Height:     cfg.Height,
+		},
+	}
+
+	background := image.NewRGBA(bounds)
+	colors.fill(background)
+	visible := make([]glyphBox, 0, len(glyphs))
+	for f := 0; f < n; f++ {
+		draw.Draw(scratch, bounds, background, image.Point{}, draw.Src)
+		addNoiseLines(scratch, cfg, rnd)
+		addNoiseShapes(scratch, cfg, rnd)
+		addNoiseDots(scratch, cfg, rnd)
+
+		visible = visible[:0]
+		for i, g := range glyphs {
+			if (i+f+phase)%gifHiddenEvery == 0 {
+				continue
+			}
+			drawGlyph(scratch, g.rect, g.color, g.mask, g.maskp)
+			visible = append(visible, g)
+		}
+		addOcclusionLines(scratch, cfg, rnd, visible)
+
+		frame := image.NewPaletted(bounds, palette.WebSafe)
+		if wave != nil {
+			wave.apply(distorted, scratch, colors.background)
+			toWebSafe(frame, distorted)
+		} else {
+			toWebSafe(frame, scratch)
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, cfg.frameDelay())
+	}
+	return anim
+}
+
+// toWebSafe copies src into dst, whose palette is palette.WebSafe, rounding
+// each channel to the nearest of its 6 levels. It skips the nearest color
+// search of draw.Draw, the web-safe palette being a 6x6x6 cube.
+func toWebSafe(dst *image.Paletted, src *image.RGBA) {
+	for y := 0; y < src.Rect.Dy(); y++ {
+		s := src.Pix[y*src.Stride : y*src.Stride+src.Rect.Dx()*4]
+		d := dst.Pix[y*dst.Stride : y*dst.Stride+dst.Rect.Dx()]
+		for x := range d {
+			r, g, b := s[x*4], s[x*4+1], s[x*4+2]
+			d[x] = uint8((int(r)+25)/51*36 + (int(g)+25)/51*6 + (int(b)+25)/51)
+		}
+	}
+}
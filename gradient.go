@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Gradient is the shape of a gradient background
+type Gradient int
+
+const (
+	GradientNone   Gradient = iota // Plain background, see BackgroundColor
+	GradientLinear                 // From one color to the other along a random direction
+	GradientRadial                 // From one color at a random center to the other at the farthest corner
+)
+
+// gradientSteps is the number of colors a gradient is drawn with, enough
+// for the steps between them not to show
+const gradientSteps = 256
+
+// gradient is the background of a render with a Gradient
+type gradient struct {
+	kind     Gradient
+	from, to color.RGBA
+	angle    float64 // Direction of GradientLinear, in radians
+	cx, cy   float64 // Center of GradientRadial
+}
+
+// gradient returns the gradient of a render, with random ends when
+// GradientColors leaves them nil, and a random direction or center. Nothing
+// is drawn from rnd at GradientNone.
+func (cfg CaptchaConfig) gradient(rnd *randSource) gradient {
+	g := gradient{kind: cfg.Gradient}
+	if g.kind == GradientNone {
+		return g
+	}
+	g.from = gradientEnd(cfg.GradientColors[0], rnd)
+	g.to = gradientEnd(cfg.GradientColors[1], rnd)
+	switch g.kind {
+	case GradientLinear:
+		g.angle = float64(rnd.Intn(360)) * math.Pi / 180
+	case GradientRadial:
+		g.cx, g.cy = float64(rnd.Intn(cfg.Width)), float64(rnd.Intn(cfg.Height))
+	}
+	return g
+}
+
+// gradientEnd returns c, or a random light color when it is nil
+func gradientEnd(c color.Color, rnd *randSource) color.RGBA {
+	if c != nil {
+		return toRGBA(c)
+	}
+	var rgb [3]byte
+	rnd.read(rgb[:])
+	return color.RGBA{160 + rgb[0]%96, 160 + rgb[1]%96, 160 + rgb[2]%96, 255}
+}
+
+// middle returns the color halfway between the ends, standing for the
+// gradient where a single color is needed
+func (g gradient) middle() color.RGBA {
+	mid := func(a, b uint8) uint8 { return uint8((int(a) + int(b)) / 2) }
+	return color.RGBA{mid(g.from.R, g.to.R), mid(g.from.G, g.to.G), mid(g.from.B, g.to.B), mid(g.from.A, g.to.A)}
+}
+
+// extent returns the length of a linear gradient across w by h, so that it
+// spans the image corner to corner along its direction
+func (g gradient) extent(w, h int) float64 {
+	sin, cos := math.Sincos(g.angle)
+	return max(math.Abs(float64(w)*cos)+math.Abs(float64(h)*sin), 1)
+}
+
+// radius returns the distance from the center of a radial gradient to the
+// farthest corner of w by h
+func (g gradient) radius(w, h int) float64 {
+	dx := max(g.cx, float64(w)-g.cx)
+	dy := max(g.cy, float64(h)-g.cy)
+	return max(math.Hypot(dx, dy), 1)
+}
+
+// draw fills img, whose bounds start at the origin, with the gradient. The
+// colors are interpolated once into a table of gradientSteps entries, so
+// the pixel loops only look them up: linear gradients step through the
+// table along each row, radial ones by the distance to the center, whose
+// squared offsets are computed once per row and column.
+func (g gradient) draw(img *image.RGBA) {
+	var table [gradientSteps][4]uint8
+	for i := range table {
+		t := float64(i) / (gradientSteps - 1)
+		lerp := func(a, b uint8) uint8 { return uint8(math.Round(float64(a) + (float64(b)-float64(a))*t)) }
+		table[i] = [4]uint8{lerp(g.from.R, g.to.R), lerp(g.from.G, g.to.G), lerp(g.from.B, g.to.B), lerp(g.from.A, g.to.A)}
+	}
+	index := func(t float64) int {
+		return min(max(int(t*(gradientSteps-1)+0.5), 0), gradientSteps-1)
+	}
+
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	switch g.kind {
+	case GradientLinear:
+		sin, cos := math.Sincos(g.angle)
+		extent := g.extent(w, h)
+		cx, cy := float64(w)/2, float64(h)/2
+		dt := cos / extent
+		for y := 0; y < h; y++ {
+			row := img.Pix[y*img.Stride : y*img.Stride+w*4]
+			t := (-cx*cos+(float64(y)-cy)*sin)/extent + 0.5
+			for x := 0; x < w; x++ {
+				copy(row[x*4:x*4+4], table[index(t)][:])
+				t += dt
+			}
+		}
+	case GradientRadial:
+		radius := g.radius(w, h)
+		dx2 := make([]float64, w)
+		for x := range dx2 {
+			dx2[x] = (float64(x) - g.cx) * (float64(x) - g.cx)
+		}
+		for y := 0; y < h; y++ {
+			row := img.Pix[y*img.Stride : y*img.Stride+w*4]
+			dy2 := (float64(y) - g.cy) * (float64(y) - g.cy)
+			for x := 0; x < w; x++ {
+				copy(row[x*4:x*4+4], table[index(math.Sqrt(dx2[x]+dy2)/radius)][:])
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// fixedText is a TextGenerator always drawing the same text
+type fixedText string
+
+func (f fixedText) Generate(cfg CaptchaConfig) (string, []string, error) {
+	return string(f), nil, nil
+}
+
+// testConfig returns the default config drawing "AbC123", answered by
+// "abc123"
+func testConfig() CaptchaConfig {
+	cfg := DefaultCaptchaConfig()
+	cfg.TextGenerator = fixedText("AbC123")
+	return cfg
+}
+
+// testRouter serves GenerateCaptcha at /captcha and VerifyCaptchaWithConfig
+// at /verify, answering 200 "ok" when it passes
+func testRouter(cfg CaptchaConfig) *gin.Engine {
+	r := gin.New()
+	r.GET("/captcha", GenerateCaptcha(cfg))
+	r.POST("/verify", VerifyCaptchaWithConfig(cfg), func(c *gin.Context) { c.String(200, "ok") })
+	return r
+}
+
+// generateCookie requests a captcha from h and returns its ID cookie
+func generateCookie(t *testing.T, h http.Handler) *http.Cookie {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/captcha", nil))
+	if w.Code != 200 {
+		t.Fatalf("generate: %d %s", w.Code, w.Body)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == DefaultIDCookie {
+			return c
+		}
+	}
+	t.Fatal("generate: no captcha_id cookie")
+	return nil
+}
+
+// verifyRequest posts answer for the captcha of cookie to h
+func verifyRequest(h http.Handler, cookie *http.Cookie, answer string) *httptest.ResponseRecorder {
+	form := url.Values{"captcha": {answer}}
+	req := httptest.NewRequest("POST", "/verify", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
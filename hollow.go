@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"image"
+	"math"
+)
+
+// TextStyle is the way characters are drawn
+type TextStyle int
+
+const (
+	StyleFilled TextStyle = iota // Solid characters
+	StyleHollow                  // Outlines of the characters, their inside showing the background
+)
+
+// outlineWidth returns the width of the outlines of StyleHollow, in pixels:
+// a twentieth of the font size, so it follows the strokes of the font
+func (cfg CaptchaConfig) outlineWidth() int {
+	return max(int(math.Round(cfg.fontSize()/20)), 1)
+}
+
+// outline returns the mask of the outline of a glyph mask, in coordinates
+// of the image: the pixels within width of its edge. Pixels at least half
+// covered are kept only when one within width of them isn't, and partly
+// covered ones are kept as they are, smoothing the outer edge.
+func outline(mask *image.Alpha, width int) *image.Alpha {
+	r := mask.Rect
+	inside := func(x, y int) bool {
+		return image.Point{x, y}.In(r) && mask.Pix[mask.PixOffset(x, y)] >= 0x80
+	}
+
+	out := image.NewAlpha(r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			a := mask.Pix[mask.PixOffset(x, y)]
+			if a == 0 {
+				continue
+			}
+			if a < 0x80 || nearEdge(inside, x, y, width) {
+				out.Pix[out.PixOffset(x, y)] = a
+			}
+		}
+	}
+	return out
+}
+
+// nearEdge reports whether a pixel within width of (x, y) is outside the
+// glyph
+func nearEdge(inside func(x, y int) bool, x, y, width int) bool {
+	for dy := -width; dy <= width; dy++ {
+		for dx := -width; dx <= width; dx++ {
+			if dx*dx+dy*dy <= width*width && !inside(x+dx, y+dy) {
+				return true
+			}
+		}
+	}
+	return false
+}
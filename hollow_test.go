@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wprimadi/gin-captcha/assets"
+)
+
+func TestStyleHollowInterior(t *testing.T) {
+	cfg := DefaultCaptchaConfig()
+	cfg.Font = assets.Font()
+	cfg.FontSize = 60
+	cfg.Width, cfg.Height = 300, 100
+
+	white := color.RGBA{255, 255, 255, 255}
+	render := func(style TextStyle) *image.RGBA {
+		cfg.TextStyle = style
+		img := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
+		fillImage(img, white)
+		drawText(img, "OBD8", cfg, newSeededSource([32]byte{7}), renderColors{background: white, text: color.RGBA{A: 255}})
+		return img
+	}
+	filled, hollow := render(StyleFilled), render(StyleHollow)
+
+	inked := func(img *image.RGBA, x, y int) bool {
+		return image.Pt(x, y).In(img.Rect) && img.RGBAAt(x, y) != white
+	}
+	// Pixels deeper inside the filled glyphs than the outline is wide
+	depth := cfg.outlineWidth() + 1
+	interior, painted, hollowInk := 0, 0, 0
+	for y := 0; y < cfg.Height; y++ {
+		for x := 0; x < cfg.Width; x++ {
+			if inked(hollow, x, y) {
+				hollowInk++
+			}
+			if !deepInside(func(x, y int) bool { return inked(filled, x, y) }, x, y, depth) {
+				continue
+			}
+			interior++
+			if inked(hollow, x, y) {
+				painted++
+			}
+		}
+	}
+
+	if interior == 0 || hollowInk == 0 {
+		t.Fatalf("%d interior pixels, %d hollow ones: nothing drawn", interior, hollowInk)
+	}
+	if painted > 0 {
+		t.Errorf("hollow glyphs paint %d of their %d interior pixels", painted, interior)
+	}
+}
+
+// deepInside reports whether every pixel within depth of (x, y) is inside
+func deepInside(inside func(x, y int) bool, x, y, depth int) bool {
+	for dy := -depth; dy <= depth; dy++ {
+		for dx := -depth; dx <= depth; dx++ {
+			if !inside(x+dx, y+dy) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// TestStyleHollowSample writes a hollow captcha with rotation and
+// distortion to the temporary directory, for looking at it: run with -v
+// for its path
+func TestStyleHollowSample(t *testing.T) {
+	cfg := DefaultCaptchaConfig()
+	cfg.Font = assets.Font()
+	cfg.TextStyle = StyleHollow
+	cfg.MaxRotation = 30
+	cfg.MaxSkew = 0.2
+	cfg.DistortionLevel = 50
+	cfg.Width, cfg.Height = 300, 100
+	mustValidStyle(cfg)
+
+	img, err := generateCaptchaImage("Hollow", [32]byte{1}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(os.TempDir(), "captcha-hollow-sample.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("hollow sample written to %s", path)
+}
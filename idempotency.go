@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderIdempotencyKey identifies retries of the same verification, see
+// IdempotencyWindow
+const HeaderIdempotencyKey = "Idempotency-Key"
+
+// contextKeyReplay holds the replay key of the current verification
+const contextKeyReplay = "captcha_replay_key"
+
+// verifyOutcome is the response to a verification, kept to answer its retries
+type verifyOutcome struct {
+	expires      int64 // Unix nanoseconds
+	status       int
+	body         gin.H // Error response, nil on success
+	verification Verification
+}
+
+// replayKey returns the store key of a verification, derived from the
+// captcha ID, the submitted answer and the idempotency key, or "" when the
+// request can't be replayed
+func replayKey(c *gin.Context, cfg CaptchaConfig, captchaID, answer string) string {
+	if cfg.IdempotencyWindow <= 0 {
+		return ""
+	}
+	key := c.GetHeader(HeaderIdempotencyKey)
+	if key == "" {
+		return ""
+	}
+
+	h := sha256.New()
+	for _, part := range []string{captchaID, answer, key} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// replayVerification answers a retried verification with the outcome of
+// the original one. It returns false when the request isn't a retry, after
+// marking it so that its own outcome is remembered.
+func replayVerification(c *gin.Context, cfg CaptchaConfig, captchaID, answer string) bool {
+	key := replayKey(c, cfg, captchaID, answer)
+	if key == "" {
+		return false
+	}
+
+	cfg.state().mu.RLock()
+	outcome, exists := cfg.state().replays[key]
+	cfg.state().mu.RUnlock()
+
+	if !exists || time.Now().UnixNano() > outcome.expires {
+		c.Set(contextKeyReplay, key)
+		return false
+	}
+
+	v := outcome.verification
+	c.Set(ContextKeyVerification, &v)
+	if outcome.body != nil {
+		c.JSON(outcome.status, outcome.body)
+		c.Abort()
+		return true
+	}
+
+	if trustedEnabled(cfg) {
+		setTrustedCookie(c, cfg)
+	}
+	c.Next()
+	return true
+}
+
+// rememberVerification keeps the response to a verification for its retries
+func rememberVerification(c *gin.Context, cfg CaptchaConfig, v Verification, status int, body gin.H) {
+	key := c.GetString(contextKeyReplay)
+	if key == "" {
+		return
+	}
+
+	cfg.state().mu.Lock()
+	cfg.state().replays[key] = verifyOutcome{
+		expires:      time.Now().Add(cfg.IdempotencyWindow).UnixNano(),
+		status:       status,
+		body:         body,
+		verification: v,
+	}
+	cfg.state().mu.Unlock()
+}
+
+// rejectVerify fails a verification, remembering the response for retries
+func rejectVerify(c *gin.Context, cfg CaptchaConfig, v Verification, status int, body gin.H) {
+	reportVerify(c, cfg, v)
+	rememberVerification(c, cfg, v, status, body)
+	c.JSON(status, body)
+	c.Abort()
+}
@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// ImageCacheStats reports the activity of the encoded image cache
+type ImageCacheStats struct {
+	Hits    uint64 `json:"hits"`    // Fetches served from the cache
+	Misses  uint64 `json:"misses"`  // Fetches that had to render and encode the image
+	Entries int    `json:"entries"` // Images currently cached
+	Bytes   int64  `json:"bytes"`   // Memory used by the cached images
+}
+
+// imageCache is an LRU cache of encoded images keyed by captcha ID, bounded
+// by the total size of the images
+type imageCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	order    *list.List // Most recently used first
+	items    map[string]*list.Element
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type imageCacheEntry struct {
+	id   string
+	data []byte
+}
+
+func newImageCache() *imageCache {
+	return &imageCache{
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// setLimit bounds the cache to maxBytes, 0 disables it
+func (ic *imageCache) setLimit(maxBytes int64) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	ic.maxBytes = maxBytes
+	ic.evict()
+}
+
+// get returns the cached image of the captcha
+func (ic *imageCache) get(id string) ([]byte, bool) {
+	ic.mu.Lock()
+	elem, exists := ic.items[id]
+	if exists {
+		ic.order.MoveToFront(elem)
+	}
+	ic.mu.Unlock()
+
+	if !exists {
+		ic.misses.Add(1)
+		return nil, false
+	}
+	ic.hits.Add(1)
+	return elem.Value.(*imageCacheEntry).data, true
+}
+
+// add caches the image of the captcha, evicting the least recently used
+// images to stay within the limit
+func (ic *imageCache) add(id string, data []byte) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	if int64(len(data)) > ic.maxBytes {
+		return
+	}
+	if elem, exists := ic.items[id]; exists {
+		ic.removeElement(elem)
+	}
+
+	ic.items[id] = ic.order.PushFront(&imageCacheEntry{id: id, data: data})
+	ic.bytes += int64(len(data))
+	ic.evict()
+}
+
+// remove drops the image of the captcha
+func (ic *imageCache) remove(id string) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	if elem, exists := ic.items[id]; exists {
+		ic.removeElement(elem)
+	}
+}
+
+// clear drops every image
+func (ic *imageCache) clear() {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	ic.order.Init()
+	ic.items = make(map[string]*list.Element)
+	ic.bytes = 0
+}
+
+// evict drops the least recently used images until the cache fits its limit
+func (ic *imageCache) evict() {
+	for ic.bytes > ic.maxBytes && ic.order.Len() > 0 {
+		ic.removeElement(ic.order.Back())
+	}
+}
+
+func (ic *imageCache) removeElement(elem *list.Element) {
+	entry := ic.order.Remove(elem).(*imageCacheEntry)
+	delete(ic.items, entry.id)
+	ic.bytes -= int64(len(entry.data))
+}
+
+// cacheImage caches the encoded image of the captcha for its next fetches.
+// A captcha verified or invalidated while its image was rendered had its
+// image dropped before it was added, so it is checked again afterwards:
+// whichever happens last drops the image.
+func (s *CaptchaStore) cacheImage(cfg CaptchaConfig, captchaID string, data []byte) {
+	s.images.add(captchaID, data)
+	if _, exists, err := s.backend(cfg).Get(captchaID); err != nil || !exists {
+		s.images.remove(captchaID)
+	}
+}
+
+// ImageCacheStats returns the hit and miss counters and the size of the
+// encoded image cache
+func (s *CaptchaStore) ImageCacheStats() ImageCacheStats {
+	s.images.mu.Lock()
+	defer s.images.mu.Unlock()
+
+	return ImageCacheStats{
+		Hits:    s.images.hits.Load(),
+		Misses:  s.images.misses.Load(),
+		Entries: s.images.order.Len(),
+		Bytes:   s.images.bytes,
+	}
+}
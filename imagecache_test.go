@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"encoding/json"
+	"image"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// consumingRenderer verifies the captcha being rendered, as a concurrent
+// request could, before drawing it
+type consumingRenderer struct {
+	consume func()
+}
+
+func (r consumingRenderer) Render(display string, cfg CaptchaConfig, rnd RandomSource) (image.Image, error) {
+	r.consume()
+	return DefaultRenderer{}.Render(display, cfg, rnd)
+}
+
+func TestImageCacheConsumedDuringRender(t *testing.T) {
+	for _, consumed := range []bool{false, true} {
+		var captchaID string
+		cfg := testConfig()
+		cfg.ImageCacheBytes = 1 << 20
+		cfg.Renderer = consumingRenderer{consume: func() {
+			if consumed {
+				store.consumeCaptcha(cfg, captchaID, true)
+			}
+		}}
+
+		r := gin.New()
+		r.GET("/captcha/new", NewCaptcha(cfg))
+		r.GET("/captcha/:id/image", CaptchaImage(cfg))
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/captcha/new", nil))
+		var resp struct {
+			ID       string `json:"captcha_id"`
+			ImageURL string `json:"image_url"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		captchaID, _ = unsignID(cfg, resp.ID)
+
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", resp.ImageURL, nil))
+		if w.Code != 200 {
+			t.Fatalf("consumed=%t: image %d %s", consumed, w.Code, w.Body)
+		}
+		if _, cached := store.images.get(captchaID); cached == consumed {
+			t.Errorf("consumed=%t: image cached %t", consumed, cached)
+		}
+		store.images.remove(captchaID)
+	}
+}
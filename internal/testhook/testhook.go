@@ -0,0 +1,8 @@
+// Package testhook hands the test helpers of the module, such as the
+// captchatest and ocrtest packages, what the captcha middleware keeps out of
+// its API. Being internal, it can't be imported from other modules.
+package testhook
+
+// Answer returns the expected answer of an outstanding captcha of the
+// default store. The middleware package sets it when it is initialized.
+var Answer func(id string) (string, bool)
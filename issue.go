@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"image"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rejection is the error response a captcha request gets when it is refused,
+// e.g. during a cooldown or past its quota. IssueForTemplate returns it as
+// an error instead of sending it.
+type Rejection struct {
+	Status int   // HTTP status
+	Body   gin.H // JSON body, with the message under "error"
+}
+
+// reject returns a Rejection with the given status and body
+func reject(status int, body gin.H) *Rejection {
+	return &Rejection{Status: status, Body: body}
+}
+
+// Error returns the message of the rejection
+func (r *Rejection) Error() string {
+	msg, _ := r.Body["error"].(string)
+	return msg
+}
+
+// abort sends the rejection and aborts the request
+func (r *Rejection) abort(c *gin.Context) {
+	c.JSON(r.Status, r.Body)
+	c.Abort()
+}
+
+// issued is a captcha rendered, encoded and stored, ready to be sent
+type issued struct {
+	id          string // Store ID
+	data        captchaData
+	img         image.Image
+	encoded     *bytes.Buffer // Encoded image, to be handed back with releaseBuffer
+	contentType string        // Content type of the encoded image
+}
+
+// issue creates, renders and encodes a captcha with enc, and only then
+// stores it. It returns the context error when the client went away, before
+// anything is stored. Captcha issues without a request, c being nil, and
+// without an encoder, keeping the image.
+func issue(c *gin.Context, cfg CaptchaConfig, step int, metadata map[string]string, enc ImageEncoder) (issued, error) {
+	// Skip the work for clients that already went away
+	if err := canceled(c, cfg); err != nil {
+		return issued{}, err
+	}
+
+	captchaID, data, err := newCaptcha(cfg, step, metadata)
+	if err != nil {
+		logError(c, cfg, "", err)
+		return issued{}, err
+	}
+	if cfg.Stateless {
+		if captchaID, err = statelessToken(cfg, data); err != nil {
+			logError(c, cfg, "", err)
+			return issued{}, err
+		}
+	}
+
+	// Lay out the generated text, whatever its length
+	cfg = cfg.withVariant(data.variant)
+	cfg.Length = utf8.RuneCountInString(data.value)
+
+	// Render and encode within a slot of MaxConcurrentRenders
+	release, err := cfg.state().renders.acquire(requestContext(c), cfg)
+	if err != nil {
+		return issued{}, err
+	}
+	start := time.Now()
+	var (
+		img image.Image
+		buf *bytes.Buffer
+	)
+	if drawing, ok := enc.(drawingEncoder); ok {
+		// SVG and GIF draw the text themselves, rendering is encoding
+		buf, err = renderDrawn(drawing, data, cfg)
+	} else {
+		img, err = generateCaptchaImage(data.value, data.seed, cfg)
+	}
+	if err != nil {
+		release()
+		logError(c, cfg, captchaID, err)
+		return issued{}, err
+	}
+	emitTiming(cfg.Metrics, MetricRender, start)
+	rendered := time.Since(start)
+
+	if buf == nil && enc != nil {
+		buf, err = encodeWith(img, enc)
+	}
+	release()
+	if err != nil {
+		logError(c, cfg, captchaID, err)
+		return issued{}, err
+	}
+
+	var contentType string
+	if enc != nil {
+		contentType = enc.ContentType()
+	}
+
+	// Only store captchas that are ready to be sent
+	if err := canceled(c, cfg); err != nil {
+		releaseBuffer(buf)
+		return issued{}, err
+	}
+	// Stateless captchas are verified from their token alone
+	if !cfg.Stateless {
+		if err := cfg.state().storeCaptcha(cfg, captchaID, data); err != nil {
+			releaseBuffer(buf)
+			logError(c, cfg, captchaID, err)
+			return issued{}, err
+		}
+	}
+	cfg.state().stats.generated.Add(1)
+	emitCount(cfg.Metrics, MetricGenerated, variantTags(data.variant)...)
+	logEvent(c, cfg, Event{
+		Type:      EventGenerated,
+		CaptchaID: captchaID,
+		Step:      step,
+		Duration:  rendered,
+		Trace:     data.trace,
+		Variant:   data.variant,
+	})
+	cfg.state().reportFunnel(FunnelShown, captchaID, data)
+
+	return issued{id: captchaID, data: data, img: img, encoded: buf, contentType: contentType}, nil
+}
+
+// abortIssue aborts a request whose captcha couldn't be issued, responding
+// with 500 unless the client went away
+func abortIssue(c *gin.Context, err error) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		c.Abort()
+		return
+	}
+	c.JSON(500, gin.H{"error": "Failed to generate captcha"})
+	c.Abort()
+}
+
+// IssueForTemplate creates a captcha while rendering a page, for forms that
+// carry the ID in a hidden field named after IDField, "captcha_id" by
+// default. It returns the ID to send and the image as a data URI for the src
+// attribute of an img tag. The captcha goes through the same risk, cooldown,
+// quota and multi-step handling as GenerateCaptcha; a refused request returns
+// a *Rejection.
+func IssueForTemplate(c *gin.Context, cfg CaptchaConfig) (id string, imgSrc template.URL, err error) {
+	id, imgSrc, _, err = issueForTemplate(c, cfg)
+	return id, imgSrc, err
+}
+
+// issueForTemplate is IssueForTemplate, also returning the stored captcha
+func issueForTemplate(c *gin.Context, cfg CaptchaConfig) (string, template.URL, captchaData, error) {
+	if err := CheckNames(cfg); err != nil {
+		return "", "", captchaData{}, err
+	}
+
+	cfg, step, rej := prepareGeneration(c, cfg)
+	if rej != nil {
+		return "", "", captchaData{}, rej
+	}
+
+	metadata, rej := captchaMetadata(c, cfg)
+	if rej != nil {
+		return "", "", captchaData{}, rej
+	}
+
+	captcha, err := issue(c, cfg, step, metadata, pngImageEncoder{})
+	if err != nil {
+		return "", "", captchaData{}, err
+	}
+	defer releaseBuffer(captcha.encoded)
+	if rej := checkResponseSize(cfg, responseSize(captcha.encoded.Len(), FormatJSON)); rej != nil {
+		removeCaptcha(c, cfg, captcha.id)
+		return "", "", captchaData{}, rej
+	}
+	setTrace(c, captcha.data)
+
+	src := dataURIPrefix + base64.StdEncoding.EncodeToString(captcha.encoded.Bytes())
+	return signID(cfg, captcha.id), template.URL(src), captcha.data, nil
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"errors"
+	"image"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// brokenEncoder is an ImageEncoder that always fails
+type brokenEncoder struct{}
+
+func (brokenEncoder) ContentType() string { return "image/x-broken" }
+
+func (brokenEncoder) Encode(io.Writer, image.Image) error {
+	return errors.New("broken encoder")
+}
+
+// brokenWriter is a gin.ResponseWriter whose body writes fail before
+// anything is sent
+type brokenWriter struct {
+	gin.ResponseWriter
+}
+
+func (brokenWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken writer")
+}
+
+func (brokenWriter) WriteString(string) (int, error) {
+	return 0, errors.New("broken writer")
+}
+
+func TestIssueFailuresLeaveNothing(t *testing.T) {
+	RegisterEncoder("broken", brokenEncoder{})
+	defer func() {
+		encodersMu.Lock()
+		delete(encoders, "broken")
+		encodersMu.Unlock()
+	}()
+
+	r := gin.New()
+	r.GET("/captcha", GenerateCaptcha(testConfig()))
+	broken := r.Group("/broken", func(c *gin.Context) {
+		c.Writer = brokenWriter{c.Writer}
+	})
+	broken.GET("/captcha", GenerateCaptcha(testConfig()))
+
+	for _, tc := range []struct {
+		name, target string
+		status       int
+	}{
+		{"Encoder", "/captcha?format=broken", 500},
+		{"WriterPNG", "/broken/captcha", 200},
+		{"WriterJSON", "/broken/captcha?format=" + FormatJSON, 200},
+		{"WriterDataURI", "/broken/captcha?format=" + FormatDataURI, 200},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			entries := store.Entries()
+			req := httptest.NewRequest("GET", tc.target, nil)
+			req.Header.Set("Accept", brokenEncoder{}.ContentType())
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.status {
+				t.Errorf("status %d, want %d", w.Code, tc.status)
+			}
+			if n := store.Entries(); n != entries {
+				t.Errorf("%d store entries left behind", n-entries)
+			}
+			if cookies := w.Result().Cookies(); len(cookies) > 0 {
+				t.Errorf("cookies %v left behind", cookies)
+			}
+			if id := w.Header().Get(DefaultIDHeader); id != "" {
+				t.Errorf("ID header %q left behind", id)
+			}
+		})
+	}
+}
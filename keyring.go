@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"sync"
+)
+
+// KeyRing holds the keys used by the signing features: an active key signing
+// new values and previous keys still accepted when verifying. It is safe for
+// concurrent use, so keys can be rotated while requests are served.
+type KeyRing struct {
+	mu       sync.RWMutex
+	active   []byte
+	accepted [][]byte
+}
+
+// NewKeyRing creates a key ring signing with active and also accepting
+// values signed with any of the accepted keys
+func NewKeyRing(active []byte, accepted ...[]byte) *KeyRing {
+	return &KeyRing{active: active, accepted: accepted}
+}
+
+// Rotate makes key the active key, the previous active key stays accepted
+// until it is retired
+func (k *KeyRing) Rotate(key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.accepted = append([][]byte{k.active}, k.accepted...)
+	k.active = key
+}
+
+// Retire stops accepting values signed with key. The active key can't be
+// retired, rotate it first.
+func (k *KeyRing) Retire(key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	accepted := k.accepted[:0:0]
+	for _, a := range k.accepted {
+		if !hmac.Equal(a, key) {
+			accepted = append(accepted, a)
+		}
+	}
+	k.accepted = accepted
+}
+
+// Sign returns the HMAC-SHA256 of msg with the active key
+func (k *KeyRing) Sign(msg []byte) []byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return computeMAC(k.active, msg)
+}
+
+// Verify reports whether mac is the signature of msg with the active key or
+// any accepted key
+func (k *KeyRing) Verify(msg, mac []byte) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if hmac.Equal(mac, computeMAC(k.active, msg)) {
+		return true
+	}
+	for _, key := range k.accepted {
+		if hmac.Equal(mac, computeMAC(key, msg)) {
+			return true
+		}
+	}
+	return false
+}
+
+// signatures returns the HMAC-SHA256 of msg with the active key and every
+// accepted key, for values signed with a key derived from msg
+func (k *KeyRing) signatures(msg []byte) [][]byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	macs := [][]byte{computeMAC(k.active, msg)}
+	for _, key := range k.accepted {
+		macs = append(macs, computeMAC(key, msg))
+	}
+	return macs
+}
+
+func computeMAC(key, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
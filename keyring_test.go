@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var (
+	oldKey     = []byte("old-key-0123456789abcdef01234567")
+	newKey     = []byte("new-key-0123456789abcdef01234567")
+	unknownKey = []byte("unknown-0123456789abcdef01234567")
+)
+
+func TestKeyRingRotation(t *testing.T) {
+	ring := NewKeyRing(oldKey)
+	cfg := CaptchaConfig{IDKeys: ring}
+	signedOld := signID(cfg, "abc")
+
+	ring.Rotate(newKey)
+	signedNew := signID(cfg, "abc")
+	if signedNew == signedOld {
+		t.Fatal("rotating didn't change the signature")
+	}
+	signedUnknown := signID(CaptchaConfig{IDKeys: NewKeyRing(unknownKey)}, "abc")
+
+	for _, tt := range []struct {
+		name  string
+		value string
+		want  bool
+	}{
+		{"Active", signedNew, true},
+		{"RotatedOut", signedOld, true},
+		{"UnknownKey", signedUnknown, false},
+		{"Unsigned", "abc", false},
+		{"OtherID", "abd" + signedNew[len("abc"):], false},
+		{"BadEncoding", "abc.!!", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			id, ok := unsignID(cfg, tt.value)
+			if ok != tt.want || (ok && id != "abc") {
+				t.Errorf("unsignID(%q) = %q, %v, want %v", tt.value, id, ok, tt.want)
+			}
+		})
+	}
+
+	ring.Retire(oldKey)
+	if _, ok := unsignID(cfg, signedOld); ok {
+		t.Error("an ID signed with a retired key verified")
+	}
+	if _, ok := unsignID(cfg, signedNew); !ok {
+		t.Error("retiring an old key rejected the active one")
+	}
+}
+
+func TestSignedIDVerification(t *testing.T) {
+	cfg := testConfig()
+	cfg.IDKeys = NewKeyRing(oldKey)
+	r := testRouter(cfg)
+
+	// Issued before the rotation, answered after it
+	cookie := generateCookie(t, r)
+	cfg.IDKeys.Rotate(newKey)
+	if w := verifyRequest(r, cookie, "abc123"); w.Code != 200 {
+		t.Errorf("ID signed with a rotated out key: %d %s", w.Code, w.Body)
+	}
+
+	// Signed with a key the ring never had
+	cookie = generateCookie(t, r)
+	id, _ := unsignID(cfg, cookie.Value)
+	forged := signID(CaptchaConfig{IDKeys: NewKeyRing(unknownKey)}, id)
+	w := verifyRequest(r, &http.Cookie{Name: DefaultIDCookie, Value: forged}, "abc123")
+	if w.Code != 400 || !strings.Contains(w.Body.String(), ErrCodeIDTampered) {
+		t.Errorf("ID signed with an unknown key: %d %s", w.Code, w.Body)
+	}
+}
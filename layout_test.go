@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/wprimadi/gin-captcha/assets"
+)
+
+// minGlyphInk is the fewest pixels a character must paint to be readable
+const minGlyphInk = 10
+
+func TestDrawTextInside(t *testing.T) {
+	styles := []struct {
+		name string
+		set  func(*CaptchaConfig)
+	}{
+		{"Basic", func(*CaptchaConfig) {}},
+		{"Font", func(cfg *CaptchaConfig) { cfg.Font = assets.Font() }},
+		{"FontRotated", func(cfg *CaptchaConfig) {
+			cfg.Font = assets.Font()
+			cfg.MaxRotation = 60
+			cfg.MaxSkew = 0.5
+		}},
+		{"FontLarge", func(cfg *CaptchaConfig) {
+			cfg.Font = assets.Font()
+			cfg.FontSize = 60
+			cfg.FontSizeJitter = 10
+		}},
+		{"BasicRotatedDistorted", func(cfg *CaptchaConfig) {
+			cfg.MaxRotation = 45
+			cfg.DistortionLevel = 100
+		}},
+	}
+	background := color.RGBA{255, 255, 255, 255}
+	for _, style := range styles {
+		for _, width := range []int{60, 200, 400} {
+			for _, height := range []int{30, 80, 150} {
+				for _, length := range []int{4, 6, 10} {
+					name := fmt.Sprintf("%s/%dx%d/%d", style.name, width, height, length)
+					t.Run(name, func(t *testing.T) {
+						cfg := DefaultCaptchaConfig()
+						cfg.Width, cfg.Height, cfg.Length = width, height, length
+						style.set(&cfg)
+						text := "WMQ@gjy8Ab3xQ7Wm"[:length]
+						area := image.Rect(0, 0, width, height)
+
+						for seed := byte(0); seed < 5; seed++ {
+							img := image.NewRGBA(area)
+							fillImage(img, background)
+							glyphs := drawText(img, text, cfg, newSeededSource([32]byte{seed}), renderColors{background: background, text: color.RGBA{A: 255}})
+							if len(glyphs) != length {
+								t.Fatalf("seed %d: %d characters drawn, want %d", seed, len(glyphs), length)
+							}
+							for i, g := range glyphs {
+								if !g.rect.In(area) {
+									t.Errorf("seed %d: character %d at %v, outside %v", seed, i, g.rect, area)
+								}
+								if n := inkPixels(img, g, background); n < minGlyphInk {
+									t.Errorf("seed %d: character %d paints %d pixels, want %d", seed, i, n, minGlyphInk)
+								}
+							}
+						}
+					})
+				}
+			}
+		}
+	}
+}
+
+// fillImage paints img with c
+func fillImage(img *image.RGBA, c color.RGBA) {
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+}
+
+// inkPixels counts the pixels of img the glyph covers that differ from the
+// background
+func inkPixels(img *image.RGBA, g glyphBox, background color.RGBA) int {
+	count := 0
+	r := g.rect.Intersect(img.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if g.covers(x, y) && img.RGBAAt(x, y) != background {
+				count++
+			}
+		}
+	}
+	return count
+}
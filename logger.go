@@ -0,0 +1,186 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Event types passed to the Logger
+const (
+	EventGenerated     = "captcha.generated"      // A captcha was created
+	EventVerified      = "captcha.verified"       // A verification finished, see Result
+	EventCooldown      = "captcha.cooldown"       // A request was rejected during a cooldown
+	EventQuotaExceeded = "captcha.quota_exceeded" // A generation was rejected by the quota
+	EventError         = "captcha.error"          // A captcha couldn't be created, rendered or encoded
+)
+
+// Attribute keys used by the bundled Logger adapters
+const (
+	LogKeyEvent     = "event"
+	LogKeyCaptchaID = "captcha_id"
+	LogKeyClientIP  = "client_ip"
+	LogKeyResult    = "result"
+	LogKeyStep      = "step"
+	LogKeyDuration  = "duration"
+	LogKeyError     = "error"
+	LogKeyMetadata  = "metadata"
+	LogKeyStage     = "stage"
+	LogKeyTrace     = "trace"
+	LogKeyNetwork   = "network"
+	LogKeyVariant   = "variant"
+)
+
+// Event describes something the middleware did. Fields that don't apply to
+// the event type are left empty.
+type Event struct {
+	Type      string            // One of the Event constants
+	CaptchaID string            // Store ID of the captcha, never the signed one
+	ClientIP  string            // Client IP of the request
+	Result    string            // Verification result, one of the Result constants
+	Step      int               // Position of the captcha in a multi-step sequence
+	Duration  time.Duration     // Time spent rendering a generated captcha, or on a warmup stage
+	Err       error             // Cause of an EventError
+	Metadata  map[string]string // Metadata of the verified captcha, see MetadataFunc
+	Stage     string            // Stage of an EventWarmup
+	Trace     string            // Trace token of the captcha, see HeaderTrace
+	Network   string            // Client network label of a failed verification, see NetworkFunc
+	Variant   string            // Experiment variant of the captcha, see Experiment
+}
+
+// Logger receives the events of the middleware. Like Metrics, it is called
+// on the request path and must not block.
+type Logger interface {
+	Log(ev Event)
+}
+
+// Level returns the level the event should be logged at: errors for
+// EventError, warnings for rejected requests and failed verifications.
+func (e Event) Level() slog.Level {
+	switch e.Type {
+	case EventError:
+		return slog.LevelError
+	case EventCooldown, EventQuotaExceeded, EventWeakConfig, EventFontFallback:
+		return slog.LevelWarn
+	case EventVerified:
+		if failed(e.Result) {
+			return slog.LevelWarn
+		}
+	}
+	return slog.LevelInfo
+}
+
+// Attrs returns the fields of the event as attributes keyed with the LogKey
+// constants, leaving the empty ones out
+func (e Event) Attrs() []slog.Attr {
+	attrs := []slog.Attr{slog.String(LogKeyEvent, e.Type)}
+	if e.CaptchaID != "" {
+		attrs = append(attrs, slog.String(LogKeyCaptchaID, e.CaptchaID))
+	}
+	if e.ClientIP != "" {
+		attrs = append(attrs, slog.String(LogKeyClientIP, e.ClientIP))
+	}
+	if e.Result != "" {
+		attrs = append(attrs, slog.String(LogKeyResult, e.Result))
+	}
+	if e.Step > 0 {
+		attrs = append(attrs, slog.Int(LogKeyStep, e.Step))
+	}
+	if e.Duration > 0 {
+		attrs = append(attrs, slog.Duration(LogKeyDuration, e.Duration))
+	}
+	if e.Err != nil {
+		attrs = append(attrs, slog.String(LogKeyError, e.Err.Error()))
+	}
+	if e.Trace != "" {
+		attrs = append(attrs, slog.String(LogKeyTrace, e.Trace))
+	}
+	if e.Network != "" {
+		attrs = append(attrs, slog.String(LogKeyNetwork, e.Network))
+	}
+	if e.Variant != "" {
+		attrs = append(attrs, slog.String(LogKeyVariant, e.Variant))
+	}
+	if e.Stage != "" {
+		attrs = append(attrs, slog.String(LogKeyStage, e.Stage))
+	}
+	if len(e.Metadata) > 0 {
+		group := make([]any, 0, len(e.Metadata))
+		for _, k := range slices.Sorted(maps.Keys(e.Metadata)) {
+			group = append(group, slog.String(k, e.Metadata[k]))
+		}
+		attrs = append(attrs, slog.Group(LogKeyMetadata, group...))
+	}
+	return attrs
+}
+
+// SlogLogger returns a Logger writing events to l, with the event type as
+// the message
+func SlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s slogLogger) Log(ev Event) {
+	s.l.LogAttrs(context.Background(), ev.Level(), ev.Type, ev.Attrs()...)
+}
+
+// logEvent passes ev to the configured Logger, filling in the client IP of
+// the request, if any: Captcha logs without one
+func logEvent(c *gin.Context, cfg CaptchaConfig, ev Event) {
+	if cfg.Logger == nil {
+		return
+	}
+	if c != nil {
+		ev.ClientIP = c.ClientIP()
+	}
+	cfg.Logger.Log(ev)
+}
+
+// logError reports a captcha that couldn't be created, rendered or encoded
+func logError(c *gin.Context, cfg CaptchaConfig, captchaID string, err error) {
+	logEvent(c, cfg, Event{Type: EventError, CaptchaID: captchaID, Err: err})
+}
+
+// reportVerify stores the outcome of a verification in the context, along
+// with the telemetry sent with the answer, and reports it to the stats, the
+// metrics and the logger. Captcha reports without a request, c being nil.
+func reportVerify(c *gin.Context, cfg CaptchaConfig, v Verification) {
+	if c != nil {
+		if cfg.Telemetry && cfg.IDKeys != nil && v.CaptchaID != "" {
+			v.Telemetry = requestTelemetry(c, cfg, v.CaptchaID)
+		}
+		c.Set(ContextKeyVerification, &v)
+	}
+	cfg.state().stats.countVerify(v.Result)
+	emitCount(cfg.Metrics, MetricVerify, append([]string{"result:" + v.Result}, variantTags(v.Variant)...)...)
+
+	var network string
+	if failed(v.Result) {
+		tags := append([]string{"reason:" + v.Result}, variantTags(v.Variant)...)
+		if c != nil {
+			network = failureNetwork(c.ClientIP(), cfg)
+		}
+		if network != "" {
+			tags = append(tags, "network:"+network)
+		}
+		emitCount(cfg.Metrics, MetricVerifyFailed, tags...)
+	}
+
+	logEvent(c, cfg, Event{
+		Type:      EventVerified,
+		CaptchaID: v.CaptchaID,
+		Result:    v.Result,
+		Metadata:  v.Metadata,
+		Trace:     v.Trace,
+		Network:   network,
+		Variant:   v.Variant,
+	})
+}
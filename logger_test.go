@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// keysHandler is a slog.Handler keeping the attribute keys of each record,
+// by message
+type keysHandler struct {
+	mu   sync.Mutex
+	keys map[string][][]string
+}
+
+func (h *keysHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *keysHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *keysHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *keysHandler) Handle(_ context.Context, r slog.Record) error {
+	var keys []string
+	r.Attrs(func(a slog.Attr) bool {
+		keys = append(keys, a.Key)
+		return true
+	})
+	slices.Sort(keys)
+	h.mu.Lock()
+	h.keys[r.Message] = append(h.keys[r.Message], keys)
+	h.mu.Unlock()
+	return nil
+}
+
+// take returns the attribute keys of the records with the given message and
+// forgets them
+func (h *keysHandler) take(msg string) [][]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := h.keys[msg]
+	delete(h.keys, msg)
+	return keys
+}
+
+// sorted returns keys sorted
+func sorted(keys ...string) []string {
+	slices.Sort(keys)
+	return keys
+}
+
+func TestEventAttributes(t *testing.T) {
+	h := &keysHandler{keys: make(map[string][][]string)}
+	cfg := testConfig()
+	cfg.Logger = SlogLogger(slog.New(h))
+	cfg.CooldownThreshold = 2
+	cfg.CooldownDuration = time.Minute
+	cfg.ClientKeyFunc = func(*gin.Context) string { return "logger-test" }
+	cfg.NetworkFunc = func(ip net.IP) string { return "net-a" }
+	cfg.NetworkTopN = 10
+	cfg.MetadataFunc = func(*gin.Context) map[string]string { return map[string]string{"form": "signup"} }
+	defer store.reset("cooldown:logger-test")
+	defer store.reset("failures:logger-test")
+	r := testRouter(cfg)
+
+	expect := func(t *testing.T, event string, want ...string) {
+		t.Helper()
+		got := h.take(event)
+		if len(got) != 1 {
+			t.Fatalf("%d %s events, want 1", len(got), event)
+		}
+		if want = sorted(append(want, LogKeyEvent)...); !slices.Equal(got[0], want) {
+			t.Errorf("%s attributes %v, want %v", event, got[0], want)
+		}
+	}
+
+	t.Run(EventGenerated, func(t *testing.T) {
+		cookie := generateCookie(t, r)
+		expect(t, EventGenerated, LogKeyCaptchaID, LogKeyClientIP, LogKeyStep, LogKeyDuration, LogKeyTrace)
+
+		t.Run("Success", func(t *testing.T) {
+			verifyRequest(r, cookie, "abc123")
+			expect(t, EventVerified, LogKeyCaptchaID, LogKeyClientIP, LogKeyResult, LogKeyTrace, LogKeyMetadata)
+		})
+	})
+
+	t.Run(EventVerified, func(t *testing.T) {
+		verifyRequest(r, nil, "abc123")
+		expect(t, EventVerified, LogKeyClientIP, LogKeyResult, LogKeyNetwork)
+
+		h.take(EventGenerated)
+		verifyRequest(r, generateCookie(t, r), "wrong")
+		h.take(EventGenerated)
+		expect(t, EventVerified, LogKeyCaptchaID, LogKeyClientIP, LogKeyResult, LogKeyTrace, LogKeyMetadata, LogKeyNetwork)
+	})
+
+	t.Run(EventCooldown, func(t *testing.T) {
+		// With the failure above, this one starts the cooldown
+		verifyRequest(r, generateCookie(t, r), "wrong")
+		h.take(EventGenerated)
+		h.take(EventVerified)
+		verifyRequest(r, nil, "abc123")
+		expect(t, EventCooldown, LogKeyClientIP)
+	})
+
+	t.Run(EventQuotaExceeded, func(t *testing.T) {
+		quota := testConfig()
+		quota.Logger = cfg.Logger
+		quota.QuotaKeyFunc = func(*gin.Context) string { return "logger-test-quota" }
+		quota.QuotaLimit = 1
+		defer store.ResetQuota("logger-test-quota")
+		qr := testRouter(quota)
+		generateCookie(t, qr)
+		h.take(EventGenerated)
+		w := httptest.NewRecorder()
+		qr.ServeHTTP(w, httptest.NewRequest("GET", "/captcha", nil))
+		expect(t, EventQuotaExceeded, LogKeyClientIP)
+	})
+
+	t.Run(EventError, func(t *testing.T) {
+		failing := testConfig()
+		failing.Logger = cfg.Logger
+		failing.TextGenerator = failingText{}
+		w := httptest.NewRecorder()
+		testRouter(failing).ServeHTTP(w, httptest.NewRequest("GET", "/captcha", nil))
+		expect(t, EventError, LogKeyClientIP, LogKeyError)
+	})
+}
+
+// failingText is a TextGenerator that always fails
+type failingText struct{}
+
+func (failingText) Generate(CaptchaConfig) (string, []string, error) {
+	return "", nil, errors.New("no text")
+}
+
+func TestAuditEvents(t *testing.T) {
+	c := New(testConfig())
+	defer c.Close()
+	store := c.Store()
+
+	var events []AuditEvent
+	store.SetAuditFunc(func(ev AuditEvent) { events = append(events, ev) })
+	signed, _, _ := c.Generate()
+	id, _ := unsignID(c.cfg, signed)
+	data, _, _ := store.loadCaptcha(c.cfg, id)
+
+	if err := store.Invalidate(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Invalidate(context.Background(), "unknown"); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("%d audit events, want 2", len(events))
+	}
+	for i, want := range []AuditEvent{
+		{Action: AuditInvalidate, CaptchaID: id, Trace: data.trace, Count: 1},
+		{Action: AuditInvalidate, CaptchaID: "unknown", Count: 0},
+	} {
+		got := events[i]
+		if got.Time.IsZero() {
+			t.Errorf("event %d has no time", i)
+		}
+		got.Time = time.Time{}
+		if got != want {
+			t.Errorf("event %d = %+v, want %+v", i, got, want)
+		}
+	}
+}
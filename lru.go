@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lru is a small cache keeping the most recently used values, evicting the
+// least recently used one past its limit
+type lru[K comparable, V any] struct {
+	mu    sync.Mutex
+	limit int
+	order *list.List // Most recently used first
+	items map[K]*list.Element
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func newLRU[K comparable, V any](limit int) *lru[K, V] {
+	return &lru[K, V]{
+		limit: limit,
+		order: list.New(),
+		items: make(map[K]*list.Element),
+	}
+}
+
+// get returns the value of key, marking it as recently used
+func (c *lru[K, V]) get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, exists := c.items[key]
+	if !exists {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry[K, V]).value, true
+}
+
+// add stores value under key unless one is already there, and returns the
+// value kept, evicting the least recently used one past the limit
+func (c *lru[K, V]) add(key K, value V) V {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, exists := c.items[key]; exists {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*lruEntry[K, V]).value
+	}
+	c.items[key] = c.order.PushFront(&lruEntry[K, V]{key, value})
+	if c.order.Len() > c.limit {
+		oldest := c.order.Remove(c.order.Back()).(*lruEntry[K, V])
+		delete(c.items, oldest.key)
+	}
+	return value
+}
+
+// len returns the number of values kept
+func (c *lru[K, V]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,26 @@
+package middleware
+
+import "testing"
+
+func TestLRU(t *testing.T) {
+	c := newLRU[string, int](2)
+	c.add("a", 1)
+	c.add("b", 2)
+	if got := c.add("a", 10); got != 1 {
+		t.Errorf("add over an existing key kept %d, want 1", got)
+	}
+
+	// "a" was used last, so "b" goes
+	c.add("c", 3)
+	if _, ok := c.get("b"); ok {
+		t.Error("least recently used value kept")
+	}
+	for key, want := range map[string]int{"a": 1, "c": 3} {
+		if got, ok := c.get(key); !ok || got != want {
+			t.Errorf("get(%q) = %d, %t, want %d", key, got, ok, want)
+		}
+	}
+	if c.len() != 2 {
+		t.Errorf("len %d, want 2", c.len())
+	}
+}
@@ -0,0 +1,314 @@
+package middleware
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"fmt"
+	"hash/maphash"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memoryShards is the number of independently locked parts of a
+// MemoryStore, so requests for different captchas rarely wait on each other
+const memoryShards = 32
+
+// MemoryStore is the in-memory Store used when the config sets none. Its
+// entries are lost on restart and not shared between processes. Entries are
+// spread over shards by a hash of their ID, each with its own lock. With a
+// maximum set, the oldest entries of the whole store are evicted first.
+type MemoryStore struct {
+	seed       maphash.Seed
+	shards     [memoryShards]memoryShard
+	count      atomic.Int64 // Entries over every shard, so Len takes no lock
+	maxEntries atomic.Int64 // 0 is unlimited
+
+	orderMu sync.Mutex // Taken after the lock of a shard, never before
+	order   *list.List // Entries of every shard, oldest first, for MaxEntries
+}
+
+// memoryShard holds the entries of a MemoryStore whose ID hashes to it
+type memoryShard struct {
+	mu       sync.Mutex
+	entries  map[string]*memoryEntry
+	expiries expiryHeap   // Soonest to expire first, for sweep
+	store    *MemoryStore // Store of the shard, for its count and order
+}
+
+// memoryEntry is a value of a MemoryStore along with its expiry and its
+// positions in the order list of the store and the expiry heap of its shard
+type memoryEntry struct {
+	id      string
+	value   string
+	expires time.Time
+	elem    *list.Element
+	index   int
+}
+
+// expiryHeap is a min-heap of entries by expiry, implementing heap.Interface
+type expiryHeap []*memoryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	entry := x.(*memoryEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	m := &MemoryStore{seed: maphash.MakeSeed(), order: list.New()}
+	for i := range m.shards {
+		m.shards[i].entries = make(map[string]*memoryEntry)
+		m.shards[i].store = m
+	}
+	return m
+}
+
+// shard returns the shard holding id
+func (m *MemoryStore) shard(id string) *memoryShard {
+	return &m.shards[maphash.String(m.seed, id)%memoryShards]
+}
+
+// SetMaxEntries bounds the store to n entries, 0 is unlimited, evicting
+// the oldest entries beyond it. Concurrent Sets may exceed it by one each
+// until they return.
+func (m *MemoryStore) SetMaxEntries(n int) {
+	m.maxEntries.Store(int64(max(n, 0)))
+	m.evict()
+}
+
+// Set implements Store
+func (m *MemoryStore) Set(id string, value string, ttl time.Duration) error {
+	m.set(id, value, ttl)
+	return nil
+}
+
+// set stores a value and returns the IDs evicted to make room for it
+func (m *MemoryStore) set(id string, value string, ttl time.Duration) []string {
+	s := m.shard(id)
+	s.mu.Lock()
+	inserted := s.put(id, value, time.Now().Add(ttl))
+	s.mu.Unlock()
+
+	if !inserted {
+		return nil
+	}
+	return m.evict()
+}
+
+// put sets the value of id until expires and reports whether it was
+// inserted rather than replaced. The lock must be held.
+func (s *memoryShard) put(id, value string, expires time.Time) bool {
+	m := s.store
+	if entry, exists := s.entries[id]; exists {
+		entry.value = value
+		entry.expires = expires
+		m.orderMu.Lock()
+		m.order.MoveToBack(entry.elem)
+		m.orderMu.Unlock()
+		heap.Fix(&s.expiries, entry.index)
+		return false
+	}
+
+	entry := &memoryEntry{id: id, value: value, expires: expires}
+	m.orderMu.Lock()
+	entry.elem = m.order.PushBack(entry)
+	m.orderMu.Unlock()
+	heap.Push(&s.expiries, entry)
+	s.entries[id] = entry
+	m.count.Add(1)
+	return true
+}
+
+// Incr implements Counter. A live counter keeps its expiry and its place
+// in the eviction order.
+func (m *MemoryStore) Incr(key string, ttl time.Duration) (int, error) {
+	s := m.shard(key)
+	s.mu.Lock()
+
+	now := time.Now()
+	if entry, exists := s.entries[key]; exists && !now.After(entry.expires) {
+		defer s.mu.Unlock()
+		n, err := strconv.Atoi(entry.value)
+		if err != nil {
+			return 0, fmt.Errorf("captcha: counter %q: %w", key, err)
+		}
+		entry.value = strconv.Itoa(n + 1)
+		return n + 1, nil
+	}
+
+	inserted := s.put(key, "1", now.Add(ttl))
+	s.mu.Unlock()
+	if inserted {
+		m.evict()
+	}
+	return 1, nil
+}
+
+// evict removes the oldest entries of the store while it holds more than
+// its maximum, and returns their IDs. The oldest entry is looked up first
+// and removed under the lock of its shard, since shard locks are taken
+// before the order lock.
+func (m *MemoryStore) evict() []string {
+	limit := m.maxEntries.Load()
+	if limit <= 0 {
+		return nil
+	}
+
+	var evicted []string
+	for m.count.Load() > limit {
+		m.orderMu.Lock()
+		oldest := m.order.Front()
+		m.orderMu.Unlock()
+		if oldest == nil {
+			break
+		}
+
+		entry := oldest.Value.(*memoryEntry)
+		s := m.shard(entry.id)
+		s.mu.Lock()
+		// Unless a concurrent request removed it first
+		if s.entries[entry.id] == entry {
+			s.remove(entry)
+			evicted = append(evicted, entry.id)
+		}
+		s.mu.Unlock()
+	}
+	return evicted
+}
+
+// Get implements Store. Expired entries are removed on read rather than
+// left for the next sweep.
+func (m *MemoryStore) Get(id string) (string, bool, error) {
+	s := m.shard(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, exists := s.entries[id]
+	if !exists {
+		return "", false, nil
+	}
+	if time.Now().After(entry.expires) {
+		s.remove(entry)
+		return "", false, nil
+	}
+	return entry.value, true, nil
+}
+
+// Delete implements Store
+func (m *MemoryStore) Delete(id string) error {
+	s := m.shard(id)
+	s.mu.Lock()
+	if entry, exists := s.entries[id]; exists {
+		s.remove(entry)
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// Take implements Taker
+func (m *MemoryStore) Take(id string) (string, bool, error) {
+	s := m.shard(id)
+	s.mu.Lock()
+	entry, exists := s.entries[id]
+	if exists {
+		s.remove(entry)
+	}
+	s.mu.Unlock()
+
+	if !exists || time.Now().After(entry.expires) {
+		return "", false, nil
+	}
+	return entry.value, true, nil
+}
+
+// Invalidate implements Invalidator
+func (m *MemoryStore) Invalidate(ctx context.Context, id string) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+	return m.Take(id)
+}
+
+// Flush implements Flusher
+func (m *MemoryStore) Flush(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return m.clear(), nil
+}
+
+// remove deletes an entry from the map, the order list and the expiry heap.
+// The lock must be held.
+func (s *memoryShard) remove(entry *memoryEntry) {
+	delete(s.entries, entry.id)
+	s.store.orderMu.Lock()
+	s.store.order.Remove(entry.elem)
+	s.store.orderMu.Unlock()
+	heap.Remove(&s.expiries, entry.index)
+	s.store.count.Add(-1)
+}
+
+// Len returns the number of entries, expired ones included until the next
+// cleanup
+func (m *MemoryStore) Len() int {
+	return int(m.count.Load())
+}
+
+// clear removes every entry and returns how many there were
+func (m *MemoryStore) clear() int {
+	count := 0
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.Lock()
+		m.orderMu.Lock()
+		for _, entry := range s.entries {
+			m.order.Remove(entry.elem)
+		}
+		m.orderMu.Unlock()
+		count += len(s.entries)
+		m.count.Add(-int64(len(s.entries)))
+		s.entries = make(map[string]*memoryEntry)
+		s.expiries = nil
+		s.mu.Unlock()
+	}
+	return count
+}
+
+// sweep removes the entries expired at now and returns their values by ID.
+// It pops them off the expiry heaps, so it only visits expired entries, and
+// locks one shard at a time.
+func (m *MemoryStore) sweep(now time.Time) map[string]string {
+	swept := make(map[string]string)
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.Lock()
+		for len(s.expiries) > 0 && now.After(s.expiries[0].expires) {
+			entry := s.expiries[0]
+			s.remove(entry)
+			swept[entry.id] = entry.value
+		}
+		s.mu.Unlock()
+	}
+	return swept
+}
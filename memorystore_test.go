@@ -0,0 +1,299 @@
+package middleware
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lockedStore is a map behind a single lock, as the store was before it
+// was sharded, to compare MemoryStore against
+type lockedStore struct {
+	mu      sync.RWMutex
+	entries map[string]memoryEntry
+}
+
+func (s *lockedStore) Set(id, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	s.entries[id] = memoryEntry{value: value, expires: time.Now().Add(ttl)}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *lockedStore) Get(id string) (string, bool, error) {
+	s.mu.RLock()
+	entry, ok := s.entries[id]
+	s.mu.RUnlock()
+	if !ok || time.Now().After(entry.expires) {
+		return "", false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (s *lockedStore) Take(id string) (string, bool, error) {
+	s.mu.Lock()
+	entry, ok := s.entries[id]
+	delete(s.entries, id)
+	s.mu.Unlock()
+	if !ok || time.Now().After(entry.expires) {
+		return "", false, nil
+	}
+	return entry.value, true, nil
+}
+
+// BenchmarkStoreParallel sets, gets and takes captchas from every
+// GOMAXPROCS, as generation and verification do, in a MemoryStore and in a
+// single locked map. Run with -cpu 1,4,16 to see how each scales.
+func BenchmarkStoreParallel(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		store interface {
+			Set(id, value string, ttl time.Duration) error
+			Get(id string) (string, bool, error)
+			Taker
+		}
+	}{
+		{"Sharded", NewMemoryStore()},
+		{"SingleLock", &lockedStore{entries: make(map[string]memoryEntry)}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var next atomic.Int64
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					id := strconv.FormatInt(next.Add(1), 16) + "abcdef0123456789"
+					bc.store.Set(id, "value", time.Minute)
+					bc.store.Get(id)
+					bc.store.Take(id)
+				}
+			})
+		})
+	}
+}
+
+func TestMemoryStoreExpiryHeap(t *testing.T) {
+	rnd := rand.New(rand.NewPCG(1, 2))
+	m := NewMemoryStore()
+	m.SetMaxEntries(16 * memoryShards)
+
+	for i := 0; i < 20000; i++ {
+		id := strconv.Itoa(rnd.IntN(1000))
+		switch rnd.IntN(4) {
+		case 0, 1:
+			m.Set(id, "value", time.Duration(rnd.IntN(200)-50)*time.Millisecond)
+		case 2:
+			m.Take(id)
+		case 3:
+			m.Get(id)
+		}
+		if i%1000 == 0 {
+			m.sweep(time.Now())
+		}
+
+		// Every entry is in the map, the order list and the heap, in order
+		entries := 0
+		for k := range m.shards {
+			s := &m.shards[k]
+			for j, entry := range s.expiries {
+				if entry.index != j || s.entries[entry.id] != entry {
+					t.Fatalf("shard %d: entry %q at %d indexed %d", k, entry.id, j, entry.index)
+				}
+				if j > 0 && entry.expires.Before(s.expiries[(j-1)/2].expires) {
+					t.Fatalf("shard %d: entry %q expires before its parent", k, entry.id)
+				}
+			}
+			if len(s.expiries) != len(s.entries) {
+				t.Fatalf("shard %d: %d entries, %d in the heap", k, len(s.entries), len(s.expiries))
+			}
+			entries += len(s.entries)
+		}
+		if m.order.Len() != entries || m.Len() != entries || entries > 16*memoryShards {
+			t.Fatalf("%d entries, %d in the order list, Len %d", entries, m.order.Len(), m.Len())
+		}
+	}
+
+	m.sweep(time.Now().Add(time.Second))
+	if n := m.Len(); n != 0 {
+		t.Errorf("%d entries left after sweeping them all", n)
+	}
+
+	// Expired entries go on read too
+	m.Set("expired", "value", -time.Second)
+	m.Get("expired")
+	if n := m.Len(); n != 0 {
+		t.Errorf("expired entry kept after a read")
+	}
+}
+
+func TestMemoryStoreMaxEntries(t *testing.T) {
+	m := NewMemoryStore()
+	m.SetMaxEntries(10)
+
+	// Whichever shards they land in, the store keeps exactly the 10 newest
+	for i := 0; i < 100; i++ {
+		evicted := m.set(strconv.Itoa(i), "value", time.Minute)
+		if i >= 10 && (len(evicted) != 1 || evicted[0] != strconv.Itoa(i-10)) {
+			t.Fatalf("set %d evicted %v, want [%d]", i, evicted, i-10)
+		}
+	}
+	if n := m.Len(); n != 10 {
+		t.Fatalf("Len = %d, want 10", n)
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok, _ := m.Get(strconv.Itoa(i)); ok != (i >= 90) {
+			t.Errorf("entry %d kept: %t, want %t", i, ok, i >= 90)
+		}
+	}
+
+	// Setting an entry again makes it the newest
+	m.Set("90", "value", time.Minute)
+	m.Set("100", "value", time.Minute)
+	if _, ok, _ := m.Get("90"); !ok {
+		t.Error("entry 90 evicted after it was set again")
+	}
+	if _, ok, _ := m.Get("91"); ok {
+		t.Error("entry 91 kept, want it evicted as the oldest")
+	}
+
+	// Lowering the maximum evicts the oldest down to it
+	m.SetMaxEntries(3)
+	if n := m.Len(); n != 3 {
+		t.Fatalf("Len = %d after lowering the maximum to 3", n)
+	}
+	for _, id := range []string{"99", "90", "100"} {
+		if _, ok, _ := m.Get(id); !ok {
+			t.Errorf("entry %s evicted, want it among the 3 newest", id)
+		}
+	}
+}
+
+func TestMemoryStoreMaxEntriesParallel(t *testing.T) {
+	const maxEntries, writers, perWriter = 100, 8, 1000
+	m := NewMemoryStore()
+	m.SetMaxEntries(maxEntries)
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				m.Set(fmt.Sprint(w, "-", i), "value", time.Minute)
+				if i%2 == 0 {
+					m.Get(fmt.Sprint(w, "-", i/2))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := m.Len(); n != maxEntries {
+		t.Fatalf("Len = %d after concurrent sets, want %d", n, maxEntries)
+	}
+
+	// The oldest go first, so each writer keeps its latest entries
+	for w := 0; w < writers; w++ {
+		kept := false
+		for i := 0; i < perWriter; i++ {
+			_, ok, _ := m.Get(fmt.Sprint(w, "-", i))
+			if kept && !ok {
+				t.Errorf("writer %d: entry %d evicted before an older one", w, i)
+			}
+			kept = kept || ok
+		}
+	}
+
+	// Newer entries push every older one out
+	for i := 0; i < maxEntries; i++ {
+		m.Set(fmt.Sprint("new-", i), "value", time.Minute)
+	}
+	for w := 0; w < writers; w++ {
+		if _, ok, _ := m.Get(fmt.Sprint(w, "-", perWriter-1)); ok {
+			t.Errorf("writer %d: last entry kept over %d newer ones", w, maxEntries)
+		}
+	}
+	if n := m.Len(); n != maxEntries {
+		t.Errorf("Len = %d, want %d", n, maxEntries)
+	}
+}
+
+func TestMemoryStoreIncr(t *testing.T) {
+	m := NewMemoryStore()
+
+	for want := 1; want <= 3; want++ {
+		if n, err := m.Incr("count", time.Minute); n != want || err != nil {
+			t.Fatalf("Incr = %d, %v, want %d", n, err, want)
+		}
+	}
+	if value, ok, _ := m.Get("count"); value != "3" || !ok {
+		t.Errorf("Get = %q, %t, want the count", value, ok)
+	}
+	m.Delete("count")
+	if n, _ := m.Incr("count", time.Minute); n != 1 {
+		t.Errorf("Incr after Delete = %d, want 1", n)
+	}
+
+	// An expired counter starts over
+	m.Incr("expired", -time.Second)
+	if n, _ := m.Incr("expired", time.Minute); n != 1 {
+		t.Errorf("Incr of an expired counter = %d, want 1", n)
+	}
+
+	m.Set("value", "not a count", time.Minute)
+	if _, err := m.Incr("value", time.Minute); err == nil {
+		t.Error("Incr of a value that isn't a count succeeded")
+	}
+
+	const incrementers, perIncrementer = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < incrementers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perIncrementer; j++ {
+				m.Incr("parallel", time.Minute)
+			}
+		}()
+	}
+	wg.Wait()
+	if value, _, _ := m.Get("parallel"); value != strconv.Itoa(incrementers*perIncrementer) {
+		t.Errorf("count %s after concurrent increments, want %d", value, incrementers*perIncrementer)
+	}
+}
+
+// BenchmarkSweep1M sweeps one expired captcha out of a million outstanding,
+// popping it off the expiry heaps, and scanning every entry under the shard
+// locks as the store did before the heaps
+func BenchmarkSweep1M(b *testing.B) {
+	m := NewMemoryStore()
+	for i := 0; i < 1_000_000; i++ {
+		m.Set(strconv.Itoa(i), "value", time.Hour+time.Duration(i))
+	}
+
+	b.Run("Heap", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			m.Set(fmt.Sprint("expired", i), "value", -time.Second)
+			m.sweep(time.Now())
+		}
+	})
+	b.Run("Scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			m.Set(fmt.Sprint("expired", i), "value", -time.Second)
+			now := time.Now()
+			for k := range m.shards {
+				s := &m.shards[k]
+				s.mu.Lock()
+				for _, entry := range s.entries {
+					if now.After(entry.expires) {
+						s.remove(entry)
+					}
+				}
+				s.mu.Unlock()
+			}
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"errors"
+	"maps"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MaxMetadataSize is the largest metadata a captcha can carry, counting the
+// bytes of every key and value
+const MaxMetadataSize = 1024
+
+// ContextKeyVerification holds the *Verification of the request
+const ContextKeyVerification = "captcha_verification"
+
+// ErrMetadataTooLarge is returned when MetadataFunc exceeds MaxMetadataSize
+var ErrMetadataTooLarge = errors.New("captcha metadata exceeds MaxMetadataSize")
+
+// Verification is the outcome of a captcha verification
+type Verification struct {
+	CaptchaID string            // Store ID of the captcha, empty when it was never looked up
+	Result    string            // One of the Result constants
+	Metadata  map[string]string // Metadata attached on generation, see MetadataFunc
+	Trace     string            // Trace token sent in the X-Captcha-Trace header on generation
+	Variant   string            // Experiment variant the captcha was generated with, see Experiment
+	Telemetry *Telemetry        // Typing telemetry sent with the answer, nil when missing or invalid
+}
+
+// VerificationFromContext returns the outcome of the verification made
+// earlier in the handler chain
+func VerificationFromContext(c *gin.Context) (*Verification, bool) {
+	value, exists := c.Get(ContextKeyVerification)
+	if !exists {
+		return nil, false
+	}
+	v, ok := value.(*Verification)
+	return v, ok
+}
+
+// captchaMetadata returns the metadata to attach to a new captcha, or a
+// rejection when it is too large
+func captchaMetadata(c *gin.Context, cfg CaptchaConfig) (map[string]string, *Rejection) {
+	if cfg.MetadataFunc == nil {
+		return nil, nil
+	}
+
+	metadata := cfg.MetadataFunc(c)
+	size := 0
+	for k, v := range metadata {
+		size += len(k) + len(v)
+	}
+	if size > MaxMetadataSize {
+		logError(c, cfg, "", ErrMetadataTooLarge)
+		return nil, reject(500, gin.H{"error": "Failed to generate captcha"})
+	}
+
+	// Don't let the caller change the stored copy
+	return maps.Clone(metadata), nil
+}
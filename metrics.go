@@ -0,0 +1,72 @@
+package middleware
+
+import "time"
+
+// Metric names
+const (
+	MetricGenerated     = "captcha.generated"      // Captchas created
+	MetricRender        = "captcha.render"         // Time spent rendering an image
+	MetricRenderWait    = "captcha.render.wait"    // Time a render waited for a slot of MaxConcurrentRenders
+	MetricVerify        = "captcha.verify"         // Verifications, tagged with their result
+	MetricStoreEntries  = "captcha.store.entries"  // Outstanding captchas
+	MetricStoreEvicted  = "captcha.store.evicted"  // Captchas evicted from the in-memory store by MaxEntries
+	MetricCooldown      = "captcha.cooldown"       // Requests rejected during a cooldown
+	MetricQuotaExceeded = "captcha.quota_exceeded" // Generations rejected by the quota
+	MetricCanceled      = "captcha.canceled"       // Generations and renders skipped because the client went away
+	MetricVerifyFailed  = "captcha.verify_failed"  // Failed verifications, tagged with their reason and client network
+	MetricTelemetry     = "captcha.telemetry"      // Typing telemetry received, tagged with its status (valid or invalid)
+	MetricFontFallback  = "captcha.font_fallback"  // Characters drawn with the basic font because the font lacks them
+)
+
+// Verification results, reported as the "result" tag of MetricVerify
+const (
+	ResultSuccess          = "success"
+	ResultBypassed         = "bypassed"
+	ResultTrusted          = "trusted"
+	ResultMissingID        = "missing_id"
+	ResultTampered         = "tampered"
+	ResultMissingValue     = "missing_value"
+	ResultNotFound         = "not_found"
+	ResultExpired          = "expired"
+	ResultInvalid          = "invalid"
+	ResultWrongStep        = "wrong_step"
+	ResultAlreadyUsed      = "already_used"
+	ResultLengthMismatch   = "length_mismatch"
+	ResultSourceConflict   = "source_conflict"
+	ResultDifficultyTooLow = "difficulty_too_low"
+)
+
+// failed reports whether a verification result is a failure
+func failed(result string) bool {
+	switch result {
+	case ResultSuccess, ResultBypassed, ResultTrusted:
+		return false
+	}
+	return true
+}
+
+// Metrics receives the measurements of the middleware. Tags are "key:value"
+// pairs. Implementations must not block, they are called on the request path.
+type Metrics interface {
+	Count(name string, value int64, tags ...string)
+	Gauge(name string, value float64, tags ...string)
+	Timing(name string, d time.Duration, tags ...string)
+}
+
+func emitCount(m Metrics, name string, tags ...string) {
+	if m != nil {
+		m.Count(name, 1, tags...)
+	}
+}
+
+func emitGauge(m Metrics, name string, value float64, tags ...string) {
+	if m != nil {
+		m.Gauge(name, value, tags...)
+	}
+}
+
+func emitTiming(m Metrics, name string, start time.Time, tags ...string) {
+	if m != nil {
+		m.Timing(name, time.Since(start), tags...)
+	}
+}
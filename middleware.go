@@ -2,19 +2,22 @@ package middleware
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"image"
 	"image/color"
-	"image/draw"
-	"image/png"
 	"math"
-	"math/big"
+	"net"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/image/font"
-	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/font/opentype"
 	"golang.org/x/image/math/fixed"
 )
 
@@ -25,18 +28,178 @@ const (
 	TypeNumeric      CaptchaType = iota // Numbers only
 	TypeAlphabetic                      // Letters only
 	TypeAlphanumeric                    // Letters and numbers
+	TypeMath                            // Arithmetic expression whose result is the answer, see MathGenerator
+	TypeQuestion                        // Question of Questions, answered in words, see QuestionGenerator
+	TypeWord                            // Word of Wordlist, see WordGenerator
 )
 
 // CaptchaConfig defines the configuration for captcha
 type CaptchaConfig struct {
-	Length        int         // Captcha text length
-	Width         int         // Image width
-	Height        int         // Image height
-	Type          CaptchaType // Captcha type
-	NoiseLevel    int         // Noise level (0–100)
+	Length        int           // Captcha text length
+	Width         int           // Image width
+	Height        int           // Image height
+	Type          CaptchaType   // Captcha type
+	Charset       string        // Characters to draw from instead of those of Type, e.g. "0123456789abcdef"; at least 2 distinct
+	NoiseLevel    int           // Noise level (0–100)
+	NoiseStyle    NoiseStyle    // Shape of the noise lines (default: NoiseLines)
+	NoiseWidth    int           // Stroke width of the noise lines in pixels, up to 10 (default: 1)
+	NoiseShapes   NoiseShape    // Noise primitives drawn, e.g. ShapeLines|ShapeArcs, as many of each as lines (default: DefaultNoiseShapes)
+	NoisePalette  []color.Color // Colors the noise lines and dots are drawn in one of (default: random colors)
 	ExpireTime    time.Duration
 	SessionKey    string // Key to store captcha in session
 	CaseSensitive bool   // Whether it is case sensitive
+
+	ExcludeAmbiguous bool // Leave AmbiguousChars out of the charset, and TypeMath operands written with them
+
+	NumericLenient bool // Accept numeric answers without their leading zeros, e.g. "42" for "0042"
+
+	MathOperators string // Operators of TypeMath expressions, any of "+", "-" and "*" (default: DefaultMathOperators)
+	MathMin       int    // Smallest TypeMath operand, 0 or more
+	MathMax       int    // Largest TypeMath operand, up to MaxMathOperand (default: DefaultMathMax)
+	MathNegative  bool   // Let TypeMath subtractions have negative results instead of putting the larger operand first
+
+	Questions    []QuestionAnswer // Pairs TypeQuestion draws from, uniformly; required with TypeQuestion
+	QuestionText bool             // Also send the TypeQuestion question as text in JSON responses, e.g. for screen readers
+	TrimAnswers  bool             // Drop the spaces around answers and collapse inner runs to one before comparing
+
+	Wordlist      []string // Words TypeWord picks from, at least MinWordlist; DefaultWordlist when empty, see LoadWordlist
+	WordMinLength int      // Shortest TypeWord word, in characters; 0 for no bound
+	WordMaxLength int      // Longest TypeWord word, in characters; 0 for no bound
+
+	StrictLength         bool // Reject answers of the wrong length before comparing them, leaving the captcha unused
+	LengthMismatchCounts bool // Count StrictLength rejections toward CooldownThreshold
+
+	IDSources     []Source // Where verification reads the captcha ID, first found wins (default: DefaultIDSources)
+	AnswerSources []Source // Where verification reads the answer, first found wins (default: DefaultAnswerSources)
+	StrictSources bool     // Reject requests whose sources carry different IDs or answers
+
+	IDField     string // Form field and query parameter of the captcha ID (default: DefaultIDField)
+	IDCookie    string // Cookie of the captcha ID (default: DefaultIDCookie)
+	IDHeader    string // Header of the captcha ID (default: DefaultIDHeader)
+	AnswerField string // Form field and query parameter of the answer (default: DefaultAnswerField)
+
+	Widget Widget // Routes and strings of the HTML widget, see WidgetHTML
+
+	BasePath             string // Path prefix a reverse proxy serves the app under, e.g. "/api/v2", applied to cookie paths and generated URLs
+	TrustForwardedPrefix bool   // Take the prefix from the X-Forwarded-Prefix header instead, for proxies that always set it
+
+	RiskFunc       RiskFunc                       // Scores the request risk; nil always requires a captcha
+	RiskThreshold  float64                        // Scores below this bypass verification
+	RiskDifficulty func(score float64) Difficulty // Picks the difficulty preset on generation; nil keeps the config
+	difficulty     string                         // Name of the preset applied by Difficulty.Apply
+	minDifficulty  *Difficulty                    // Lowest preset verification accepts, see RequireDifficulty
+	puzzle         bool                           // Answers are puzzle x positions, see VerifyPuzzleCaptcha
+	scale          int                            // Pixels drawn per pixel of the image while supersampling, see Supersample
+
+	TrustedDuration time.Duration // How long a solved captcha trusts the client; 0 disables
+	TrustedKeys     *KeyRing      // Keys signing the trusted cookie
+	TrustedBindIP   bool          // Bind the trusted cookie to the client IP
+	TrustedCookie   string        // Name of the trusted cookie (default: DefaultTrustedCookie)
+
+	TrustedPrecedence   TrustedPrecedence // Whether the trusted cookie or a captcha sent along wins (default: PreferTrusted)
+	TrustedBurnsCaptcha bool              // With PreferTrusted, remove the captcha sent along instead of leaving it usable
+
+	CooldownThreshold int                         // Consecutive failures before a cooldown; 0 disables
+	CooldownDuration  time.Duration               // How long a client must wait after CooldownThreshold failures
+	ClientKeyFunc     func(c *gin.Context) string // Identifies the client; nil uses the client IP
+
+	Steps int // Captchas to solve in sequence; 0 or 1 is a single captcha
+
+	ParallelRender       bool // Split rendering across workers; large images always are
+	MaxConcurrentRenders int  // Images rendered at once across handlers, the others wait; 0 is unlimited
+
+	IDKeys    *KeyRing // Keys signing the captcha ID sent to clients; nil leaves it unsigned
+	Telemetry bool     // Accept typing telemetry signed with a key derived from IDKeys, see Telemetry
+
+	QuotaKeyFunc func(c *gin.Context) string // Identifies the quota owner, e.g. an API key; nil disables quotas
+	QuotaLimit   int                         // Captchas generated per quota key and UTC day, per process unless the Store is a Counter
+
+	OcclusionFraction float64 // Fraction of noise lines drawn across the text (0–1)
+	MaxOcclusion      float64 // Largest fraction of a glyph those lines may cover; 0 is unlimited
+
+	ImageCacheBytes int64 // Memory for encoded images served by CaptchaImage; 0 disables the cache
+
+	DeferResponse bool // Leave the response to the next handlers, see GenerationFromContext
+
+	Format         string // Response format of GenerateCaptcha when the request names none: FormatPNG, FormatJSON, FormatDataURI, FormatSVG, FormatGIF or a registered format such as FormatWebP (default: FormatPNG)
+	AllowOverrides bool   // Let requests pick the size and type, see GenerateOptions
+	MaxWidth       int    // Largest width a request may ask for; 0 caps at Width
+	MaxHeight      int    // Largest height a request may ask for; 0 caps at Height
+
+	Frames     int           // Frames of FormatGIF captchas, each hiding some of the characters, 2 to MaxFrames (default: DefaultFrames)
+	FrameDelay time.Duration // How long each FormatGIF frame shows (default: DefaultFrameDelay)
+
+	PuzzlePiece       int           // Side of the GeneratePuzzleCaptcha piece in pixels (default: Height/2)
+	PuzzleTolerance   int           // Pixels the x position sent to VerifyPuzzleCaptcha may be off by (default: DefaultPuzzleTolerance)
+	PuzzleBackgrounds []image.Image // Backgrounds puzzles are cut from, one at random, scaled to the image size; random gradients when empty
+
+	AudioLanguage string // Sample pack used when Accept-Language matches none
+
+	Metrics Metrics // Receives the middleware measurements; nil disables them
+	Logger  Logger  // Receives the middleware events; nil disables them
+
+	MetadataFunc func(c *gin.Context) map[string]string // Metadata attached to new captchas, see Verification
+
+	TextGenerator TextGenerator // Creates the captcha text and answers; nil draws Length characters of Type
+	Renderer      Renderer      // Draws the captcha image; nil uses DefaultRenderer
+
+	IdempotencyWindow time.Duration // How long retries with the same Idempotency-Key get the original outcome, from the same process; 0 disables
+
+	MinEntropy float64 // Log an EventWeakConfig when Entropy is below this many bits; 0 disables
+
+	NetworkFunc func(ip net.IP) string // Labels failed verifications with the client network, e.g. Subnet16; nil disables
+	NetworkTopN int                    // Networks labeled, the others are reported as NetworkOther (default: DefaultNetworkTopN)
+
+	MaxResponseBytes int // Largest image or audio response, checked on setup and per request (default: DefaultMaxResponseBytes); negative disables
+
+	Font     *opentype.Font // Parsed font the text is drawn with, e.g. assets.Font(); takes precedence over FontFile
+	FontFile string         // TrueType or OpenType font the text is drawn with, loaded on setup; "" uses the basic font
+	FontSize float64        // Size of the text in points, the basic font rounding it to multiples of 13; 0 scales it with the image, see FontHeightRatio
+
+	Fonts          []*opentype.Font // Fonts each character is drawn with one of, at random; takes precedence over Font and FontFile
+	FontSizeJitter int              // Points each character's size may be off FontSize by, either way; 0 keeps one size
+
+	MaxRotation float64 // Degrees each character may be rotated by, either way, up to 90, e.g. 30; 0 disables
+	MaxSkew     float64 // Horizontal shear of each character either way, as a ratio of its height up to 1, e.g. 0.3; 0 disables
+
+	DistortionLevel  int // Sine-wave distortion of the drawn image (0–100), 100 shifting pixels by up to a tenth of the height; 0 disables
+	DistortionPeriod int // Wavelength of the distortion in pixels (default: the image height)
+
+	Supersample int // Draw images this many times larger, up to 4, and scale them down to smooth the edges (default: 1)
+
+	TextStyle       TextStyle     // StyleFilled or StyleHollow, drawing the outlines of the characters only (default: StyleFilled)
+	TextColor       color.Color   // Color every character is drawn in, e.g. a brand color, taking precedence over TextPalette
+	TextPalette     []color.Color // Colors each character is drawn in one of, at random (default: DefaultTextPalette)
+	TextAlphaJitter int           // Alpha each character's color may lose, up to 128; 0 keeps them opaque
+	MinTextContrast float64       // Lowest WCAG contrast ratio of a character's color against the background, others passed over (default: DefaultMinTextContrast)
+	SingleTextColor bool          // Draw every character in black or white, whichever stands out more, instead of the palette
+
+	BackgroundColor   color.Color   // Background of the image, the text drawn in black or white to stand out from it (default: white)
+	RandomBackground  bool          // Pick the background of each captcha from BackgroundPalette instead of BackgroundColor
+	BackgroundPalette []color.Color // Backgrounds RandomBackground picks from (default: DefaultBackgroundPalette)
+	BackgroundImages  []image.Image // Backgrounds drawn one of at random, scaled and cropped to the image size, taking precedence over Gradient and BackgroundColor
+
+	Gradient       Gradient       // Gradient background in a random direction, taking precedence over BackgroundColor; GradientNone disables
+	GradientColors [2]color.Color // Ends of the Gradient; nil ends are random light colors
+
+	ClockSkew time.Duration // Captchas stay valid this long past ExpireTime, for replicas with drifting clocks (default: DefaultClockSkew); negative disables
+
+	TTLRateLimit int // Lookups per captcha and minute allowed by CaptchaTTL (default: DefaultTTLRateLimit)
+
+	IDLength int // Random bytes of captcha IDs, hex encoded to twice as many characters, 8 to 32 (default: DefaultIDLength)
+
+	Store      Store // Keeps the outstanding captchas, e.g. shared between replicas; nil uses an in-memory cfg.state(). Counters stay in memory, see README
+	MaxEntries int   // Captchas the in-memory store keeps, the oldest evicted first; 0 is unlimited
+
+	CleanupInterval time.Duration // How often expired captchas and counters are swept (default: DefaultCleanupInterval)
+
+	Stateless       bool     // Sign the answers into the captcha ID instead of storing captchas, see StatelessKeys
+	StatelessKeys   *KeyRing // Keys signing the stateless captchas; required with Stateless
+	StatelessNonces bool     // Remember the nonces of verified stateless captchas in this process, rejecting replays
+
+	Experiment *Experiment // Splits the generated captchas between config variants; nil disables
+
+	captchas *CaptchaStore // Store of the Captcha the config belongs to, see New; nil is the one the handlers share
 }
 
 // DefaultCaptchaConfig returns the default configuration
@@ -50,22 +213,146 @@ func DefaultCaptchaConfig() CaptchaConfig {
 		ExpireTime:    5 * time.Minute,
 		SessionKey:    "captcha",
 		CaseSensitive: false,
+		AudioLanguage: "en",
 	}
 }
 
 // CaptchaStore stores captcha data
 type CaptchaStore struct {
-	mu       sync.RWMutex
-	captchas map[string]captchaData
+	mu         sync.RWMutex
+	captchas   *MemoryStore // Captchas of the configs that set no Store
+	counters   map[string]counterData
+	tombstones map[string]tombstone
+	replays    map[string]verifyOutcome
+	audit      func(AuditEvent)
+	funnel     func(FunnelEvent)
+	images     *imageCache
+	networks   *networkTracker
+	renders    renderLimiter
+	cleaner    cleaner
+	stats      storeStats
 }
 
 type captchaData struct {
-	value      string
+	value      string       // Text shown in the image
+	answers    []answerHash // Accepted answers; none means value is the only one
+	issuedAt   time.Time
+	ttl        time.Duration // Lifetime from issuedAt, see expiresAt
+	grace      time.Duration // Clock skew tolerance past the lifetime, see expired
+	step       int           // Position in a multi-step sequence, starting at 1
+	seed       [32]byte      // Seed of the image noise, so every render is identical
+	metadata   map[string]string
+	trace      string // Trace token linking the generation and the verification
+	variant    string // Experiment variant the captcha was generated with
+	difficulty string // Difficulty preset the captcha was generated with, if any
+	numeric    bool   // Every answer is made of digits, see InputModeNumeric
+	minLength  int    // Rune length of the shortest answer, see StrictLength
+	maxLength  int    // Rune length of the longest answer
+	puzzle     bool   // Slider puzzle answered with an x position, see GeneratePuzzleCaptcha
+}
+
+type counterData struct {
+	count      int
 	expireTime time.Time
 }
 
-var store = &CaptchaStore{
-	captchas: make(map[string]captchaData),
+// store is the store shared by the middlewares
+var store = newCaptchaStore()
+
+// state returns the CaptchaStore keeping the captchas, counters and stats
+// of cfg: that of its Captcha, or the one the handlers share
+func (cfg CaptchaConfig) state() *CaptchaStore {
+	if cfg.captchas != nil {
+		return cfg.captchas
+	}
+	return store
+}
+
+// newCaptchaStore returns an empty store
+func newCaptchaStore() *CaptchaStore {
+	return &CaptchaStore{
+		captchas:   NewMemoryStore(),
+		counters:   make(map[string]counterData),
+		tombstones: make(map[string]tombstone),
+		replays:    make(map[string]verifyOutcome),
+		images:     newImageCache(),
+		networks:   newNetworkTracker(),
+	}
+}
+
+// incr increments the counter for key and returns the new count. A new
+// window of length ttl starts when the previous one has expired.
+func (s *CaptchaStore) incr(key string, ttl time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	data, exists := s.counters[key]
+	if !exists || now.After(data.expireTime) {
+		data = counterData{expireTime: now.Add(ttl)}
+	}
+	data.count++
+	s.counters[key] = data
+	return data.count
+}
+
+// count returns the count of the counter for key, 0 if it doesn't exist or
+// has expired
+func (s *CaptchaStore) count(key string) int {
+	s.mu.RLock()
+	data, exists := s.counters[key]
+	s.mu.RUnlock()
+
+	if !exists || time.Now().After(data.expireTime) {
+		return 0
+	}
+	return data.count
+}
+
+// block sets the counter for key so that it stays alive for ttl
+func (s *CaptchaStore) block(key string, ttl time.Duration) {
+	s.mu.Lock()
+	s.counters[key] = counterData{count: 1, expireTime: time.Now().Add(ttl)}
+	s.mu.Unlock()
+}
+
+// remaining returns how long the counter for key stays alive, 0 if it doesn't exist
+func (s *CaptchaStore) remaining(key string) time.Duration {
+	s.mu.RLock()
+	data, exists := s.counters[key]
+	s.mu.RUnlock()
+
+	if !exists {
+		return 0
+	}
+	return max(time.Until(data.expireTime), 0)
+}
+
+// reset removes the counter for key
+func (s *CaptchaStore) reset(key string) {
+	s.mu.Lock()
+	delete(s.counters, key)
+	s.mu.Unlock()
+}
+
+// put sets the counter for key to count until expireTime
+func (s *CaptchaStore) put(key string, count int, expireTime time.Time) {
+	s.mu.Lock()
+	s.counters[key] = counterData{count: count, expireTime: expireTime}
+	s.mu.Unlock()
+}
+
+// take removes the counter for key and returns it if it hadn't expired
+func (s *CaptchaStore) take(key string) (counterData, bool) {
+	s.mu.Lock()
+	data, exists := s.counters[key]
+	delete(s.counters, key)
+	s.mu.Unlock()
+
+	if !exists || time.Now().After(data.expireTime) {
+		return counterData{}, false
+	}
+	return data, true
 }
 
 // GenerateCaptcha is a middleware to generate captcha
@@ -75,203 +362,616 @@ func GenerateCaptcha(config ...CaptchaConfig) gin.HandlerFunc {
 		cfg = config[0]
 	}
 
-	// Cleanup expired captchas periodically
-	go cleanupExpiredCaptchas()
+	warnWeakConfig(cfg)
+	mustValidNames(cfg)
+	mustValidIDLength(cfg)
+	mustValidText(cfg)
+	mustSupportStateless(cfg)
+	mustLoadFont(cfg)
+	mustValidStyle(cfg)
+	mustValidFormat(cfg)
+	mustFitBudget(cfg, FormatJSON)
+	limitMemoryStore(cfg)
+	limitRenders(cfg)
+
+	cfg.state().startCleanup(cfg.CleanupInterval)
 
 	return func(c *gin.Context) {
-		// Generate random text
-		text := generateRandomText(cfg.Length, cfg.Type)
+		opts := GenerateOptions{Format: c.Query("format")}
+		if cfg.AllowOverrides {
+			var err error
+			if opts, err = optionsFromQuery(c); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if opts.Format == "" {
+			opts.Format = cfg.Format
+		}
 
-		// Generate captcha ID
-		captchaID := generateID()
+		generate(c, cfg, opts)
+	}
+}
 
-		// Store captcha
-		store.mu.Lock()
-		store.captchas[captchaID] = captchaData{
-			value:      text,
-			expireTime: time.Now().Add(cfg.ExpireTime),
+// generate creates a captcha with the request options applied to cfg and
+// sends it in the requested format
+func generate(c *gin.Context, cfg CaptchaConfig, opts GenerateOptions) {
+	cfg, err := opts.apply(cfg)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		c.Abort()
+		return
+	}
+
+	cfg, step, rej := prepareGeneration(c, cfg)
+	if rej != nil {
+		rej.abort(c)
+		return
+	}
+
+	metadata, rej := captchaMetadata(c, cfg)
+	if rej != nil {
+		rej.abort(c)
+		return
+	}
+
+	// Registered formats are negotiated, falling back to PNG. SVG and GIF
+	// draw the built-in style, custom renderers get a PNG.
+	var enc ImageEncoder = pngImageEncoder{}
+	if drawing, ok := drawingEncoderFor(opts.Format); ok {
+		if !cfg.DeferResponse && cfg.Renderer == nil {
+			enc = drawing
+		}
+	} else if !cfg.DeferResponse {
+		if negotiated := negotiateEncoder(c, opts.Format); negotiated != nil {
+			enc = negotiated
 		}
-		store.mu.Unlock()
+	}
 
-		// Generate image
-		img := generateCaptchaImage(text, cfg)
+	captcha, err := issue(c, cfg, step, metadata, enc)
+	if err != nil {
+		abortIssue(c, err)
+		return
+	}
+	defer releaseBuffer(captcha.encoded)
 
-		// Encode to PNG
-		var buf bytes.Buffer
-		if err := png.Encode(&buf, img); err != nil {
-			c.JSON(500, gin.H{"error": "Failed to generate captcha"})
-			return
+	// Enforce the budget on the sizes requests may pick
+	if rej := checkResponseSize(cfg, responseSize(captcha.encoded.Len(), opts.Format)); rej != nil {
+		removeCaptcha(c, cfg, captcha.id)
+		rej.abort(c)
+		return
+	}
+
+	// Set captcha ID in cookie or response header
+	clientID := setCaptchaID(c, cfg, captcha.id, captcha.data)
+	setTrace(c, captcha.data)
+	setTelemetryKey(c, cfg, captcha.id)
+
+	if cfg.DeferResponse {
+		c.Set(ContextKeyGeneration, &Generation{
+			ID:        clientID,
+			Image:     captcha.img,
+			PNG:       bytes.Clone(captcha.encoded.Bytes()),
+			ExpiresAt: captcha.data.expiresAt(),
+			Trace:     captcha.data.trace,
+			InputMode: captcha.data.inputMode(),
+		})
+		c.Next()
+		return
+	}
+
+	switch opts.Format {
+	case FormatJSON:
+		err = writeCaptchaJSON(c, clientID, captcha.data, captcha.encoded.Bytes(), questionText(cfg, captcha.data))
+	case FormatDataURI:
+		err = writeDataURI(c, captcha.encoded.Bytes())
+	default:
+		err = writeBody(c, captcha.contentType, captcha.encoded.Bytes())
+	}
+	if err != nil {
+		// The client didn't get the captcha, don't leave it behind
+		removeCaptcha(c, cfg, captcha.id)
+		unsetCaptchaID(c, cfg)
+	}
+}
+
+// prepareGeneration applies the per-request adjustments to cfg before a
+// captcha is created and returns its step in the sequence, or the rejection
+// of the request
+func prepareGeneration(c *gin.Context, cfg CaptchaConfig) (CaptchaConfig, int, *Rejection) {
+	// Pick the difficulty preset from the request risk
+	if cfg.RiskFunc != nil && cfg.RiskDifficulty != nil {
+		score := cfg.RiskFunc(c)
+		c.Set(ContextKeyRiskScore, score)
+		cfg = cfg.RiskDifficulty(score).Apply(cfg)
+	}
+
+	if cooldownEnabled(cfg) {
+		if rej := checkCooldown(c, cfg); rej != nil {
+			return cfg, 0, rej
 		}
+	}
+
+	if cfg.QuotaKeyFunc != nil && cfg.QuotaLimit > 0 {
+		if rej := checkQuota(c, cfg); rej != nil {
+			return cfg, 0, rej
+		}
+	}
+
+	if cfg.Steps > 1 {
+		return resolveStep(c, cfg)
+	}
+
+	return cfg, 1, nil
+}
+
+// canceled returns the context error of a request whose client went away
+func canceled(c *gin.Context, cfg CaptchaConfig) error {
+	err := requestContext(c).Err()
+	if err != nil {
+		emitCount(cfg.Metrics, MetricCanceled)
+	}
+	return err
+}
+
+// requestContext returns the context of the request, or the background one
+// for Captcha, which has none
+func requestContext(c *gin.Context) context.Context {
+	if c == nil {
+		return context.Background()
+	}
+	return c.Request.Context()
+}
+
+// clientGone reports whether the client closed the request, in which case
+// the request is aborted without a response
+func clientGone(c *gin.Context, cfg CaptchaConfig) bool {
+	if canceled(c, cfg) == nil {
+		return false
+	}
+	c.Abort()
+	return true
+}
 
-		// Set captcha ID in cookie or response header
-		c.Header("X-Captcha-ID", captchaID)
-		c.SetCookie("captcha_id", captchaID, int(cfg.ExpireTime.Seconds()), "/", "", false, true)
+// newCaptcha generates a captcha text under a new ID, see storeCaptcha
+func newCaptcha(cfg CaptchaConfig, step int, metadata map[string]string) (string, captchaData, error) {
+	// Generate captcha ID
+	captchaID, err := generateID(cfg.idLength())
+	if err != nil {
+		return "", captchaData{}, err
+	}
+
+	// Assign the experiment variant, which may change the text too
+	var variant string
+	if cfg.Experiment != nil {
+		variant = cfg.Experiment.assign(captchaID)
+		cfg = cfg.withVariant(variant)
+	}
 
-		// Return image
-		c.Data(200, "image/png", buf.Bytes())
+	// Generate the text and its answers
+	text, answers, err := textGenerator(cfg).Generate(cfg)
+	if err != nil {
+		return "", captchaData{}, err
+	}
+	if len(answers) == 0 {
+		answers = []string{text}
 	}
+
+	data := captchaData{
+		value:      text,
+		answers:    hashAnswers(answers...),
+		issuedAt:   time.Now(),
+		ttl:        cfg.ExpireTime,
+		grace:      cfg.clockSkew(),
+		step:       step,
+		seed:       newSeed(),
+		metadata:   metadata,
+		trace:      generateTrace(),
+		variant:    variant,
+		difficulty: cfg.difficulty,
+		numeric:    allDigits(answers),
+	}
+	data.minLength, data.maxLength = answerLengths(answers)
+	return captchaID, data, nil
+}
+
+// expiresIn returns the whole seconds left before the captcha expires. The
+// stored expiry is the only one honored, so every lifetime handed to clients
+// derives from it, rounded down so they are never told it lives longer.
+func (d captchaData) expiresIn() int {
+	return max(int(time.Until(d.expiresAt())/time.Second), 0)
 }
 
 // VerifyCaptcha is a middleware to verify captcha
 func VerifyCaptcha(caseSensitive ...bool) gin.HandlerFunc {
+	cfg := DefaultCaptchaConfig()
+	if len(caseSensitive) > 0 {
+		cfg.CaseSensitive = caseSensitive[0]
+	}
+	return VerifyCaptchaWithConfig(cfg)
+}
+
+// VerifyCaptchaWithConfig is a middleware to verify captcha using the given configuration
+func VerifyCaptchaWithConfig(cfg CaptchaConfig) gin.HandlerFunc {
+	warnWeakConfig(cfg)
+	mustValidNames(cfg)
+	mustSupportStateless(cfg)
+
+	if cfg.NetworkFunc != nil && cfg.NetworkTopN > 0 {
+		cfg.state().networks.setTopN(cfg.NetworkTopN)
+	}
+
 	return func(c *gin.Context) {
-		captchaID, err := c.Cookie("captcha_id")
-		if err != nil {
-			captchaID = c.GetHeader("X-Captcha-ID")
+		// A client on cooldown can't skip it with a low risk score or a
+		// trusted token
+		if cooldownEnabled(cfg) {
+			if rej := checkCooldown(c, cfg); rej != nil {
+				rej.abort(c)
+				return
+			}
+		}
+
+		// Skip the captcha for low-risk requests
+		if cfg.RiskFunc != nil {
+			score := cfg.RiskFunc(c)
+			c.Set(ContextKeyRiskScore, score)
+			if score < cfg.RiskThreshold {
+				c.Set(ContextKeyBypassed, true)
+				reportVerify(c, cfg, Verification{Result: ResultBypassed})
+				c.Next()
+				return
+			}
+		}
+
+		// Let recently verified clients through
+		if trustedPasses(c, cfg) {
+			c.Set(ContextKeyTrusted, true)
+			reportVerify(c, cfg, Verification{Result: ResultTrusted})
+			c.Next()
+			return
+		}
+
+		// Forms rendered with IssueForTemplate carry the ID in a field
+		captchaID, userInput, ok := requestCaptcha(c, cfg)
+		if !ok {
+			return
 		}
 
 		if captchaID == "" {
+			reportVerify(c, cfg, Verification{Result: ResultMissingID})
 			c.JSON(400, gin.H{"error": "Captcha ID not found"})
 			c.Abort()
 			return
 		}
 
-		userInput := c.PostForm("captcha")
-		if userInput == "" {
-			userInput = c.Query("captcha")
+		// Reject forged IDs before they reach the store
+		captchaID, ok = unsignID(cfg, captchaID)
+		if !ok {
+			reportVerify(c, cfg, Verification{Result: ResultTampered})
+			c.JSON(400, gin.H{"error": "Invalid captcha ID", "code": ErrCodeIDTampered})
+			c.Abort()
+			return
 		}
 
 		if userInput == "" {
+			reportVerify(c, cfg, Verification{Result: ResultMissingValue})
 			c.JSON(400, gin.H{"error": "Captcha value required"})
 			c.Abort()
 			return
 		}
 
-		// Verify captcha
-		store.mu.RLock()
-		data, exists := store.captchas[captchaID]
-		store.mu.RUnlock()
+		// Answer retries with the outcome of the original request
+		if replayVerification(c, cfg, captchaID, userInput) {
+			return
+		}
 
-		if !exists {
-			c.JSON(400, gin.H{"error": "Invalid or expired captcha"})
-			c.Abort()
+		if cfg.Stateless {
+			verifyStateless(c, cfg, captchaID, userInput)
 			return
 		}
 
-		if time.Now().After(data.expireTime) {
-			store.mu.Lock()
-			delete(store.captchas, captchaID)
-			store.mu.Unlock()
-			c.JSON(400, gin.H{"error": "Captcha expired"})
-			c.Abort()
+		// Verify captcha
+		check, err := verifyAnswer(cfg, cooldownKey(c, cfg), captchaID, userInput)
+		if err != nil {
+			abortStore(c, cfg, captchaID, err)
+			return
+		}
+		data := check.data
+		switch check.result {
+		case ResultSuccess:
+		case ResultAlreadyUsed:
+			rejectVerify(c, cfg, Verification{CaptchaID: captchaID, Result: ResultAlreadyUsed}, 400,
+				gin.H{"error": "Captcha already used", "code": ErrCodeAlreadyUsed, "outcome": check.outcome})
+			return
+		case ResultNotFound:
+			rejectVerify(c, cfg, Verification{CaptchaID: captchaID, Result: ResultNotFound}, 400,
+				gin.H{"error": "Invalid or expired captcha"})
+			return
+		case ResultExpired:
+			rejectVerify(c, cfg, data.verification(captchaID, ResultExpired), 400,
+				gin.H{"error": "Captcha expired"})
+			return
+		case ResultDifficultyTooLow:
+			// Send the client for a harder captcha before judging the answer
+			rejectVerify(c, cfg, data.verification(captchaID, ResultDifficultyTooLow), 400, gin.H{
+				"error":               "Captcha difficulty too low for this request",
+				"code":                ErrCodeDifficultyTooLow,
+				"required_difficulty": cfg.minDifficulty.String(),
+			})
+			return
+		case ResultLengthMismatch:
+			rejectVerify(c, cfg, data.verification(captchaID, ResultLengthMismatch), 400,
+				gin.H{"error": "Captcha answer has the wrong length", "code": ErrCodeLengthMismatch})
+			return
+		default:
+			rejectVerify(c, cfg, data.verification(captchaID, ResultInvalid), 400,
+				gin.H{"error": "Invalid captcha"})
 			return
 		}
 
-		// Compare values
-		isCaseSensitive := false
-		if len(caseSensitive) > 0 {
-			isCaseSensitive = caseSensitive[0]
+		if cfg.Steps > 1 && !completeStep(c, cfg, captchaID, data) {
+			return
 		}
+		cfg.state().reportFunnel(FunnelSolved, captchaID, data)
 
-		valid := false
-		if isCaseSensitive {
-			valid = userInput == data.value
-		} else {
-			valid = equalIgnoreCase(userInput, data.value)
+		verification := data.verification(captchaID, ResultSuccess)
+		reportVerify(c, cfg, verification)
+		rememberVerification(c, cfg, verification, 200, nil)
+		recordSuccess(c, cfg)
+		if trustedEnabled(cfg) {
+			setTrustedCookie(c, cfg)
 		}
 
-		// Delete captcha after verification (one-time use)
-		store.mu.Lock()
-		delete(store.captchas, captchaID)
-		store.mu.Unlock()
+		c.Next()
+	}
+}
 
-		if !valid {
-			c.JSON(400, gin.H{"error": "Invalid captcha"})
-			c.Abort()
-			return
+// answerCheck is the outcome of verifyAnswer
+type answerCheck struct {
+	result  string      // ResultSuccess or the reason the answer failed
+	data    captchaData // The captcha answered, unless it wasn't found
+	outcome string      // Result of the verification that consumed the captcha, for ResultAlreadyUsed
+}
+
+// verifyAnswer checks input against the stored captcha with the given ID,
+// the verification VerifyCaptchaWithConfig and Captcha share. The captcha is
+// consumed, leaving its tombstone, whether the answer is right or not,
+// except for answers RequireDifficulty or StrictLength turn away, and the
+// attempt is reported to the funnel. Failures count towards the cooldown of
+// the client with the given key, if any. Only store failures return an
+// error; the caller reports the result.
+func verifyAnswer(cfg CaptchaConfig, client, captchaID, input string) (answerCheck, error) {
+	data, exists, err := cfg.state().loadCaptcha(cfg, captchaID)
+	if err != nil {
+		return answerCheck{}, err
+	}
+	if !exists {
+		return missingAnswer(cfg, client, captchaID), nil
+	}
+
+	if data.expired(time.Now()) {
+		cfg.state().reportFunnel(FunnelAttempted, captchaID, data)
+		removeCaptcha(nil, cfg, captchaID)
+		countFailure(cfg, client)
+		return answerCheck{result: ResultExpired, data: data}, nil
+	}
+	if !data.meetsDifficulty(cfg) {
+		return answerCheck{result: ResultDifficultyTooLow, data: data}, nil
+	}
+	// Turn away answers that can't match, such as pastes of long text
+	if cfg.StrictLength && !data.lengthMatches(input, cfg) {
+		if cfg.LengthMismatchCounts {
+			countFailure(cfg, client)
 		}
+		return answerCheck{result: ResultLengthMismatch, data: data}, nil
+	}
 
-		c.Next()
+	// Compare values, then delete the captcha (one-time use)
+	valid := data.accepts(input, cfg)
+	consumed, err := cfg.state().consumeCaptcha(cfg, captchaID, valid)
+	if err != nil {
+		return answerCheck{}, err
+	}
+	if !consumed {
+		// A concurrent verification consumed it first
+		return missingAnswer(cfg, client, captchaID), nil
+	}
+	cfg.state().reportFunnel(FunnelAttempted, captchaID, data)
+
+	if !valid {
+		countFailure(cfg, client)
+		return answerCheck{result: ResultInvalid, data: data}, nil
+	}
+	return answerCheck{result: ResultSuccess, data: data}, nil
+}
+
+// missingAnswer is the outcome of verifying a captcha that isn't in the
+// store, telling captchas consumed by a recent verification apart
+func missingAnswer(cfg CaptchaConfig, client, captchaID string) answerCheck {
+	if t, ok := cfg.state().tombstone(captchaID); ok {
+		return answerCheck{result: ResultAlreadyUsed, outcome: t.outcome()}
 	}
+	countFailure(cfg, client)
+	return answerCheck{result: ResultNotFound}
 }
 
-// generateRandomText creates random text based on the type
-func generateRandomText(length int, captchaType CaptchaType) string {
-	var charset string
+// generateRandomText creates random text of length characters drawn
+// uniformly from runes, which must be distinct
+func generateRandomText(length int, runes []rune) string {
+	rnd := newRandSource()
+	defer rnd.release()
 
-	switch captchaType {
-	case TypeNumeric:
-		charset = "0123456789"
-	case TypeAlphabetic:
-		charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
-	case TypeAlphanumeric:
-		charset = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var result strings.Builder
+	result.Grow(length * utf8.UTFMax)
+	for i := 0; i < length; i++ {
+		result.WriteRune(runes[rnd.Intn(len(runes))])
 	}
 
-	result := make([]byte, length)
-	for i := range result {
-		num, _ := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
-		result[i] = charset[num.Int64()]
+	return result.String()
+}
+
+// distinctRunes returns the characters of s in order, without repeats
+func distinctRunes(s string) []rune {
+	runes := make([]rune, 0, len(s))
+	seen := make(map[rune]struct{}, len(s))
+	for _, r := range s {
+		if _, ok := seen[r]; !ok {
+			seen[r] = struct{}{}
+			runes = append(runes, r)
+		}
+	}
+	return runes
+}
+
+// DefaultIDLength is the random bytes of captcha IDs when IDLength is 0
+const DefaultIDLength = 16
+
+// Bounds of IDLength: shorter IDs could be guessed, longer ones wouldn't fit
+// the id column of SQLStoreSchema once hex encoded
+const (
+	minIDLength = 8
+	maxIDLength = 32
+)
+
+// idLength returns the random bytes of the captcha IDs of cfg
+func (cfg CaptchaConfig) idLength() int {
+	if cfg.IDLength > 0 {
+		return cfg.IDLength
 	}
+	return DefaultIDLength
+}
 
-	return string(result)
+// mustValidIDLength panics when the IDLength of cfg is out of bounds
+func mustValidIDLength(cfg CaptchaConfig) {
+	if n := cfg.idLength(); n < minIDLength || n > maxIDLength {
+		panic(fmt.Errorf("captcha: IDLength %d is out of [%d, %d]", n, minIDLength, maxIDLength))
+	}
 }
 
-// generateID creates a random ID
-func generateID() string {
-	b := make([]byte, 16)
-	rand.Read(b)
-	return string(b)
+// generateID creates an ID of n random bytes, hex encoded so it is safe in
+// URLs, cookies and headers. A failed read is returned rather than leaving
+// the ID predictable.
+func generateID(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
 }
 
-// generateCaptchaImage creates a captcha image with noise
-func generateCaptchaImage(text string, cfg CaptchaConfig) image.Image {
-	img := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
+// drawCaptcha draws the default captcha image: the text over noise lines
+// and dots, crossed by more lines
+func drawCaptcha(text string, cfg CaptchaConfig, rnd *randSource) *image.RGBA {
+	if cfg.Supersample > 1 {
+		return drawSupersampled(text, cfg, rnd)
+	}
+	return paintCaptcha(image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height)), nil, text, cfg, rnd)
+}
 
+// paintCaptcha draws the captcha onto img, whose bounds start at the
+// origin, and returns it. The distortion is drawn into scratch, or into a
+// new image when it is nil, which is returned instead.
+func paintCaptcha(img, scratch *image.RGBA, text string, cfg CaptchaConfig, rnd *randSource) *image.RGBA {
 	// Background
-	bgColor := color.RGBA{255, 255, 255, 255}
-	draw.Draw(img, img.Bounds(), &image.Uniform{bgColor}, image.Point{}, draw.Src)
+	colors := cfg.renderColors(rnd)
+	colors.fill(img)
 
 	// Add noise lines
-	addNoiseLines(img, cfg)
+	addNoiseLines(img, cfg, rnd)
+
+	// Add noise circles, ellipses and arcs
+	addNoiseShapes(img, cfg, rnd)
 
 	// Add noise dots
-	addNoiseDots(img, cfg)
+	addNoiseDots(img, cfg, rnd)
 
 	// Draw text
-	drawText(img, text, cfg)
+	glyphs := drawText(img, text, cfg, rnd, colors)
+
+	// Add noise lines across the text
+	addOcclusionLines(img, cfg, rnd, glyphs)
+
+	// Bend the text and noise along sine waves
+	if wave := cfg.distortion(rnd); wave != nil {
+		if scratch == nil {
+			scratch = image.NewRGBA(img.Rect)
+		}
+		wave.apply(scratch, img, colors.background)
+		img = scratch
+	}
 
 	return img
 }
 
 // addNoiseLines adds random noise lines
-func addNoiseLines(img *image.RGBA, cfg CaptchaConfig) {
-	numLines := cfg.NoiseLevel / 10
+func addNoiseLines(img *image.RGBA, cfg CaptchaConfig, rnd *randSource) {
+	if !cfg.hasNoise(ShapeLines) {
+		return
+	}
+	numLines := cfg.NoiseLevel/10 - routedLines(cfg)
+	pen := brush(cfg.noiseWidth())
+	var points []image.Point
 	for i := 0; i < numLines; i++ {
-		x1, _ := rand.Int(rand.Reader, big.NewInt(int64(cfg.Width)))
-		y1, _ := rand.Int(rand.Reader, big.NewInt(int64(cfg.Height)))
-		x2, _ := rand.Int(rand.Reader, big.NewInt(int64(cfg.Width)))
-		y2, _ := rand.Int(rand.Reader, big.NewInt(int64(cfg.Height)))
+		if cfg.NoiseStyle != NoiseLines {
+			points = noiseCurve(cfg, rnd, points)
+			drawPolyline(img, points, pen, cfg.noiseColor(rnd, 200))
+			continue
+		}
 
-		r, _ := rand.Int(rand.Reader, big.NewInt(256))
-		g, _ := rand.Int(rand.Reader, big.NewInt(256))
-		b, _ := rand.Int(rand.Reader, big.NewInt(256))
+		x1 := rnd.Intn(cfg.Width)
+		y1 := rnd.Intn(cfg.Height)
+		x2 := rnd.Intn(cfg.Width)
+		y2 := rnd.Intn(cfg.Height)
 
-		lineColor := color.RGBA{uint8(r.Int64()), uint8(g.Int64()), uint8(b.Int64()), 200}
-		drawLine(img, int(x1.Int64()), int(y1.Int64()), int(x2.Int64()), int(y2.Int64()), lineColor)
+		drawStroke(img, x1, y1, x2, y2, pen, cfg.noiseColor(rnd, 200))
 	}
 }
 
 // addNoiseDots adds random noise dots
-func addNoiseDots(img *image.RGBA, cfg CaptchaConfig) {
-	numDots := cfg.NoiseLevel * 5
-	for i := 0; i < numDots; i++ {
-		x, _ := rand.Int(rand.Reader, big.NewInt(int64(cfg.Width)))
-		y, _ := rand.Int(rand.Reader, big.NewInt(int64(cfg.Height)))
+func addNoiseDots(img *image.RGBA, cfg CaptchaConfig, rnd *randSource) {
+	if !cfg.hasNoise(ShapeDots) {
+		return
+	}
+	if workers := renderWorkers(cfg); workers > 1 {
+		addNoiseDotsParallel(img, cfg, rnd, workers)
+		return
+	}
+	addNoiseDotsBand(img, cfg, rnd, 0, cfg.Height, cfg.NoiseLevel*5)
+}
+
+// addNoiseDotsBand adds n random noise dots between rows y0 and y1, clipped
+// to them so that bands drawn at once never write the same pixels
+func addNoiseDotsBand(img *image.RGBA, cfg CaptchaConfig, rnd *randSource, y0, y1, n int) {
+	scale := cfg.pixelScale()
+	for i := 0; i < n; i++ {
+		x := rnd.Intn(cfg.Width)
+		y := y0 + rnd.Intn(y1-y0)
 
-		r, _ := rand.Int(rand.Reader, big.NewInt(256))
-		g, _ := rand.Int(rand.Reader, big.NewInt(256))
-		b, _ := rand.Int(rand.Reader, big.NewInt(256))
+		c := cfg.noiseColor(rnd, 150)
+		// Dots cover as many pixels as they will once downscaled
+		for dy := 0; dy < scale && y+dy < y1; dy++ {
+			for dx := 0; dx < scale; dx++ {
+				setPixel(img, x+dx, y+dy, c)
+			}
+		}
+	}
+}
 
-		dotColor := color.RGBA{uint8(r.Int64()), uint8(g.Int64()), uint8(b.Int64()), 150}
-		img.Set(int(x.Int64()), int(y.Int64()), dotColor)
+// setPixel stores c at (x, y) like img.Set, writing straight into img.Pix
+// to avoid the color.Color conversion
+func setPixel(img *image.RGBA, x, y int, c color.RGBA) {
+	if !(image.Point{x, y}.In(img.Rect)) {
+		return
 	}
+	i := img.PixOffset(x, y)
+	p := img.Pix[i : i+4 : i+4]
+	p[0], p[1], p[2], p[3] = c.R, c.G, c.B, c.A
 }
 
-// drawLine draws a line on the image
-func drawLine(img *image.RGBA, x1, y1, x2, y2 int, c color.Color) {
-	dx := math.Abs(float64(x2 - x1))
-	dy := math.Abs(float64(y2 - y1))
+// walkLine calls fn for every point of the line from (x1, y1) to (x2, y2)
+func walkLine(x1, y1, x2, y2 int, fn func(x, y int)) {
+	dx := abs(x2 - x1)
+	dy := abs(y2 - y1)
 	sx, sy := 1, 1
 	if x1 >= x2 {
 		sx = -1
@@ -282,7 +982,7 @@ func drawLine(img *image.RGBA, x1, y1, x2, y2 int, c color.Color) {
 	err := dx - dy
 
 	for {
-		img.Set(x1, y1, c)
+		fn(x1, y1)
 		if x1 == x2 && y1 == y2 {
 			break
 		}
@@ -298,63 +998,134 @@ func drawLine(img *image.RGBA, x1, y1, x2, y2 int, c color.Color) {
 	}
 }
 
-// drawText draws text onto the image
-func drawText(img *image.RGBA, text string, cfg CaptchaConfig) {
-	textColor := color.RGBA{0, 0, 0, 255}
-	point := fixed.Point26_6{
-		X: fixed.Int26_6((cfg.Width / (cfg.Length + 1)) * 64),
-		Y: fixed.Int26_6((cfg.Height / 2) * 64),
-	}
+// placedChar is a character of drawText with the face drawing it
+type placedChar struct {
+	char    rune
+	face    font.Face
+	yOffset int
+	box     image.Rectangle // Bounds of the glyph around its dot once transformed, in pixels
 
-	d := &font.Drawer{
-		Dst:  img,
-		Src:  image.NewUniform(textColor),
-		Face: basicfont.Face7x13,
-		Dot:  point,
-	}
+	transform glyphTransform
+	color     color.RGBA
+}
+
+// drawText draws text onto the image and returns where each character
+// landed. Each character may have its own font, size and transform, so
+// they are laid out by the bounds of their glyphs, with equal gaps between
+// them and at both ends. Every glyph is kept inside the image, clear of
+// the pixels the distortion may shift in from beyond its edges; glyphs too
+// wide together overlap instead, the first and last against the edges.
+func drawText(img *image.RGBA, text string, cfg CaptchaConfig, rnd *randSource, colors renderColors) []glyphBox {
+	var point fixed.Point26_6
 
-	spacing := cfg.Width / (cfg.Length + 1)
+	var faces renderFaces
+	defer faces.release()
+	basic := cfg.basicFace()
 
-	for i, char := range text {
+	area := image.Rect(0, 0, cfg.Width, cfg.Height).Inset(int(math.Ceil(cfg.distortionAmplitude())))
+	chars := make([]placedChar, 0, len(text))
+	glyphs := make([]glyphBox, 0, len(text))
+	missing, total := 0, 0
+
+	for _, char := range text {
 		// Random vertical offset for each character
-		offset, _ := rand.Int(rand.Reader, big.NewInt(20))
-		yOffset := int(offset.Int64()) - 10
+		yOffset := (rnd.Intn(20) - 10) * cfg.pixelScale()
 
-		d.Dot.X = fixed.Int26_6((spacing * (i + 1)) * 64)
-		d.Dot.Y = fixed.Int26_6((cfg.Height/2 + yOffset) * 64)
+		// Characters the font lacks are drawn with the basic font
+		face, err := faces.face(cfg.pickFont(rnd))
+		charFace, ok := glyphFace(face, basic, char)
+		if !ok || err != nil {
+			missing++
+		}
 
-		d.DrawString(string(char))
+		bounds, _, _ := charFace.GlyphBounds(char)
+		c := placedChar{char, charFace, yOffset,
+			image.Rect(bounds.Min.X.Floor(), bounds.Min.Y.Floor(), bounds.Max.X.Ceil(), bounds.Max.Y.Ceil()),
+			cfg.glyphTransform(rnd), color.RGBA{}}
+		glyph := c.box
+		if !c.transform.identity() {
+			c.box = c.transform.bounds(glyph)
+		}
+		if w, h := c.box.Dx(), c.box.Dy(); w > area.Dx() || h > area.Dy() {
+			// Scaled down to fit, leaving a pixel each side for rounding
+			c.transform.shrink = max(min(float64(area.Dx()-2)/float64(w), float64(area.Dy()-2)/float64(h)), 0.1)
+			c.box = c.transform.bounds(glyph)
+		}
+		// Over an image, the color is picked once the character is placed
+		if colors.image == nil {
+			c.color = cfg.glyphColor(colors, rnd)
+		}
+		chars = append(chars, c)
+		total += c.box.Dx()
 	}
-}
 
-// cleanupExpiredCaptchas removes expired captchas periodically
-func cleanupExpiredCaptchas() {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
+	gap := float64(area.Dx()-total) / float64(len(chars)+1)
+	x := float64(area.Min.X) + gap
+	if total > area.Dx() && len(chars) > 1 {
+		gap = float64(area.Dx()-total) / float64(len(chars)-1)
+		x = float64(area.Min.X)
+	}
+	for _, c := range chars {
+		// Center the glyph vertically, offset within the room left
+		room := max((area.Dy()-c.box.Dy())/2, 0)
+		point.X = fixed.I(int(math.Round(x)) - c.box.Min.X)
+		point.Y = fixed.I((area.Min.Y+area.Max.Y)/2 - (c.box.Min.Y+c.box.Max.Y)/2 + min(max(c.yOffset, -room), room))
+		x += float64(c.box.Dx()) + gap
 
-	for range ticker.C {
-		store.mu.Lock()
-		now := time.Now()
-		for id, data := range store.captchas {
-			if now.After(data.expireTime) {
-				delete(store.captchas, id)
-			}
+		dr, mask, maskp, _, ok := c.face.Glyph(point, c.char)
+		if !ok {
+			continue
+		}
+		switch {
+		case !c.transform.identity():
+			// Rotated and sheared around its center, in its own buffer
+			var transformed *image.Alpha
+			dr, transformed = c.transform.apply(dr, mask, maskp)
+			mask, maskp = transformed, dr.Min
+		case !isBasicFace(c.face) || cfg.TextStyle == StyleHollow:
+			mask, maskp = copyMask(mask, dr, maskp), image.Point{}
+		}
+		if cfg.TextStyle == StyleHollow {
+			// Outlined once rotated, so the outline keeps its width
+			mask = outline(mask.(*image.Alpha), cfg.outlineWidth())
+		}
+		// Moved back should rounding have left the glyph a pixel out
+		dr = dr.Add(nudge(dr, area))
+		if colors.image != nil {
+			c.color = cfg.glyphColor(colors.under(dr), rnd)
 		}
-		store.mu.Unlock()
+		drawGlyph(img, dr, c.color, mask, maskp)
+		glyphs = append(glyphs, glyphBox{rect: dr, mask: mask, maskp: maskp, color: c.color})
 	}
+
+	reportFontFallback(cfg, missing, faces.err)
+	return glyphs
 }
 
-// equalIgnoreCase compares two strings ignoring case sensitivity
-func equalIgnoreCase(a, b string) bool {
-	if len(a) != len(b) {
-		return false
+// nudge returns the offset moving r inside bounds, or against their top
+// left corner when r is larger
+func nudge(r, bounds image.Rectangle) image.Point {
+	var d image.Point
+	switch {
+	case r.Min.X < bounds.Min.X:
+		d.X = bounds.Min.X - r.Min.X
+	case r.Max.X > bounds.Max.X:
+		d.X = max(bounds.Max.X-r.Max.X, bounds.Min.X-r.Min.X)
 	}
-	for i := range a {
-		if toLower(a[i]) != toLower(b[i]) {
-			return false
-		}
+	switch {
+	case r.Min.Y < bounds.Min.Y:
+		d.Y = bounds.Min.Y - r.Min.Y
+	case r.Max.Y > bounds.Max.Y:
+		d.Y = max(bounds.Max.Y-r.Max.Y, bounds.Min.Y-r.Min.Y)
 	}
-	return true
+	return d
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
 }
 
 func toLower(c byte) byte {
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"net"
+	"sync"
+)
+
+// DefaultNetworkTopN is the number of networks labeled when NetworkTopN is 0
+const DefaultNetworkTopN = 20
+
+// NetworkOther labels the failures of networks outside the top N
+const NetworkOther = "other"
+
+// Subnet16 is a NetworkFunc grouping clients by IPv4 /16, or IPv6 /32
+func Subnet16(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(16, 32)), Mask: net.CIDRMask(16, 32)}).String()
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return (&net.IPNet{IP: ip16.Mask(net.CIDRMask(32, 128)), Mask: net.CIDRMask(32, 128)}).String()
+	}
+	return NetworkOther
+}
+
+// networkTracker counts failures per network with the Space-Saving
+// algorithm: it tracks 4N networks, a new one replacing the least counted
+// and inheriting its count as an overestimate. Networks are ranked by the
+// failures they are guaranteed to have, and only the top N are labeled, so
+// a stream of one-off networks doesn't churn the labels.
+type networkTracker struct {
+	mu      sync.Mutex
+	topN    int
+	entries map[string]networkCount
+}
+
+// networkCount is the failure count of a tracked network, err of which may
+// have been inherited from the network it replaced
+type networkCount struct {
+	count uint64
+	err   uint64
+}
+
+// guaranteed returns the failures the network certainly had
+func (n networkCount) guaranteed() uint64 {
+	return n.count - n.err
+}
+
+func newNetworkTracker() *networkTracker {
+	return &networkTracker{
+		topN:    DefaultNetworkTopN,
+		entries: make(map[string]networkCount),
+	}
+}
+
+// setTopN sets how many networks are labeled, restarting the counts when
+// it changes
+func (t *networkTracker) setTopN(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Mounting the verifier on another engine keeps the counts
+	if n == t.topN {
+		return
+	}
+	t.topN = n
+	t.entries = make(map[string]networkCount)
+}
+
+// label counts a failure from network and returns the label to report it
+// under: the network itself if it is among the top N, otherwise NetworkOther
+func (t *networkTracker) label(network string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, tracked := t.entries[network]
+	if !tracked && len(t.entries) >= 4*t.topN {
+		// Replace the least counted network
+		var minNetwork string
+		var minCount uint64
+		for n, e := range t.entries {
+			if minNetwork == "" || e.count < minCount {
+				minNetwork, minCount = n, e.count
+			}
+		}
+		delete(t.entries, minNetwork)
+		entry = networkCount{count: minCount, err: minCount}
+	}
+	entry.count++
+	t.entries[network] = entry
+
+	// Ties rank against the network, so one-offs stay under "other"
+	ahead := 0
+	for n, e := range t.entries {
+		if n != network && e.guaranteed() >= entry.guaranteed() {
+			ahead++
+		}
+	}
+	if ahead >= t.topN {
+		return NetworkOther
+	}
+	return network
+}
+
+// failureNetwork returns the network label of the client for a failed
+// verification, or "" when NetworkFunc isn't set
+func failureNetwork(ip string, cfg CaptchaConfig) string {
+	if cfg.NetworkFunc == nil {
+		return ""
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return NetworkOther
+	}
+	return cfg.state().networks.label(cfg.NetworkFunc(parsed))
+}
@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// NoiseStyle is the shape of the noise lines
+type NoiseStyle int
+
+const (
+	NoiseLines  NoiseStyle = iota // Straight lines between random points
+	NoiseCurves                   // Cubic Bezier curves across the image, bent through the text
+	NoiseWaves                    // Sine waves across the image, running along the text
+)
+
+// maxNoiseWidth bounds NoiseWidth, in pixels
+const maxNoiseWidth = 10
+
+// noiseWidth returns the stroke width of the noise lines of cfg
+func (cfg CaptchaConfig) noiseWidth() int {
+	return max(cfg.NoiseWidth, 1)
+}
+
+// textBand returns the rows the text is centered in, of FontHeightRatio of
+// the height
+func (cfg CaptchaConfig) textBand() (int, int) {
+	half := int(float64(cfg.Height) * FontHeightRatio / 2)
+	return cfg.Height/2 - half, cfg.Height/2 + half
+}
+
+// pixelBrush is the brush of 1 pixel wide lines
+var pixelBrush = []image.Point{{}}
+
+// brush returns the offsets of the pixels of a round brush of width pixels
+func brush(width int) []image.Point {
+	if width <= 1 {
+		return pixelBrush
+	}
+	r := float64(width) / 2
+	lo := -(width - 1) / 2
+	var points []image.Point
+	for dy := lo; dy < lo+width; dy++ {
+		for dx := lo; dx < lo+width; dx++ {
+			// Distance from the center of the brush to the pixel center
+			cx, cy := float64(dx-lo)+0.5-r, float64(dy-lo)+0.5-r
+			if cx*cx+cy*cy <= r*r {
+				points = append(points, image.Point{dx, dy})
+			}
+		}
+	}
+	return points
+}
+
+// drawStroke draws a line of the brush's width on the image
+func drawStroke(img *image.RGBA, x1, y1, x2, y2 int, brush []image.Point, c color.RGBA) {
+	walkLine(x1, y1, x2, y2, func(x, y int) {
+		for _, p := range brush {
+			setPixel(img, x+p.X, y+p.Y, c)
+		}
+	})
+}
+
+// drawPolyline draws the segments between consecutive points
+func drawPolyline(img *image.RGBA, points []image.Point, brush []image.Point, c color.RGBA) {
+	for i := 1; i < len(points); i++ {
+		drawStroke(img, points[i-1].X, points[i-1].Y, points[i].X, points[i].Y, brush, c)
+	}
+}
+
+// noiseCurve returns the points of a random noise line of cfg's NoiseStyle
+// other than NoiseLines, flattened into segments a few pixels long. Curves
+// start in the left quarter of the image and end in the right one, their
+// control points in the text band; waves oscillate around a row of it.
+func noiseCurve(cfg CaptchaConfig, rnd *randSource, points []image.Point) []image.Point {
+	top, bottom := cfg.textBand()
+	band := max(bottom-top, 1)
+	points = points[:0]
+
+	switch cfg.NoiseStyle {
+	case NoiseCurves:
+		quarter := max(cfg.Width/4, 1)
+		x0, y0 := float64(rnd.Intn(quarter)), float64(rnd.Intn(cfg.Height))
+		x1, y1 := float64(cfg.Width/3), float64(top+rnd.Intn(band))
+		x2, y2 := float64(cfg.Width*2/3), float64(top+rnd.Intn(band))
+		x3, y3 := float64(cfg.Width-1-rnd.Intn(quarter)), float64(rnd.Intn(cfg.Height))
+
+		n := max(cfg.Width/4, 8)
+		for i := 0; i <= n; i++ {
+			t := float64(i) / float64(n)
+			u := 1 - t
+			x := u*u*u*x0 + 3*u*u*t*x1 + 3*u*t*t*x2 + t*t*t*x3
+			y := u*u*u*y0 + 3*u*u*t*y1 + 3*u*t*t*y2 + t*t*t*y3
+			points = append(points, image.Point{int(math.Round(x)), int(math.Round(y))})
+		}
+	case NoiseWaves:
+		center := float64(top + rnd.Intn(band))
+		amplitude := float64(band/4 + rnd.Intn(band/4+1))
+		period := float64(cfg.Width/2 + rnd.Intn(cfg.Width*3/2+1))
+		phase := float64(rnd.Intn(360)) * math.Pi / 180
+
+		for x := 0; ; x = min(x+4, cfg.Width-1) {
+			y := center + amplitude*math.Sin(2*math.Pi*float64(x)/period+phase)
+			points = append(points, image.Point{x, int(math.Round(y))})
+			if x == cfg.Width-1 {
+				break
+			}
+		}
+	}
+	return points
+}
@@ -0,0 +1,7 @@
+//go:build !race
+
+package middleware
+
+// raceEnabled reports whether the tests run under the race detector, which
+// slows everything down too much for timing assertions
+const raceEnabled = false
@@ -0,0 +1,83 @@
+package middleware
+
+import "strings"
+
+// NormalizeStep is a step of a Normalizer, rewriting answers one way. Steps
+// are plain functions of the answer, so each can be run and tested alone.
+type NormalizeStep struct {
+	Name  string
+	Apply func(answer string) string
+}
+
+var (
+	// FoldCase folds the letter case of answers, for case-insensitive
+	// comparison: "ПРИВЕТ" and "привет" fold the same, as "ABC" and "abc"
+	FoldCase = NormalizeStep{Name: "fold_case", Apply: foldCase}
+
+	// TrimNumber drops the spaces around numeric answers and their leading
+	// zeros, keeping one digit. Other answers are left as they are.
+	TrimNumber = NormalizeStep{Name: "trim_number", Apply: trimNumber}
+
+	// CollapseSpace drops the spaces around answers and collapses the inner
+	// runs of spaces to one, e.g. " light  blue " to "light blue"
+	CollapseSpace = NormalizeStep{Name: "collapse_space", Apply: collapseSpace}
+)
+
+// Normalizer rewrites answers through its steps, in order, before they are
+// compared
+type Normalizer struct {
+	Steps []NormalizeStep
+}
+
+// Normalize returns answer rewritten by every step of n
+func (n Normalizer) Normalize(answer string) string {
+	for _, step := range n.Steps {
+		answer = step.Apply(answer)
+	}
+	return answer
+}
+
+// Normalizer returns the normalizer answers are compared through when
+// verifying with cfg: FoldCase unless CaseSensitive, CollapseSpace with
+// TrimAnswers, then TrimNumber with NumericLenient or TypeMath. Frontends
+// can run the same steps on the typed answer, e.g. to show it as it will be
+// compared.
+func (cfg CaptchaConfig) Normalizer() Normalizer {
+	var n Normalizer
+	if !cfg.CaseSensitive {
+		n.Steps = append(n.Steps, FoldCase)
+	}
+	if cfg.TrimAnswers {
+		n.Steps = append(n.Steps, CollapseSpace)
+	}
+	if cfg.numericLenient() {
+		n.Steps = append(n.Steps, TrimNumber)
+	}
+	return n
+}
+
+// numericLenient reports whether numeric answers are compared without their
+// leading zeros and surrounding spaces, always the case for TypeMath results
+func (cfg CaptchaConfig) numericLenient() bool {
+	return cfg.NumericLenient || cfg.Type == TypeMath
+}
+
+// The normalizers answers are hashed with when generated, one for each way
+// a config can normalize them, so the verifying config needn't be known yet
+var (
+	foldedNormalizer = Normalizer{Steps: []NormalizeStep{FoldCase}}
+	digitsNormalizer = Normalizer{Steps: []NormalizeStep{TrimNumber}}
+)
+
+// trimNumber implements TrimNumber
+func trimNumber(s string) string {
+	if trimmed := strings.TrimSpace(s); isDigits(trimmed) {
+		return trimZeros(trimmed)
+	}
+	return s
+}
+
+// collapseSpace implements CollapseSpace
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
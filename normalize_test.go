@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNormalizeSteps(t *testing.T) {
+	for _, tc := range []struct {
+		step     NormalizeStep
+		in, want string
+	}{
+		{FoldCase, "AbC", "abc"},
+		{FoldCase, "ПРИВЕТ", "привет"},
+		{FoldCase, " A B ", " a b "},
+		{FoldCase, "0042", "0042"},
+		{FoldCase, "", ""},
+		{TrimNumber, "0042", "42"},
+		{TrimNumber, " 0042 ", "42"},
+		{TrimNumber, "000", "0"},
+		{TrimNumber, "42", "42"},
+		{TrimNumber, "00A", "00A"},
+		{TrimNumber, "0 42", "0 42"},
+		{TrimNumber, " ", " "},
+		{TrimNumber, "", ""},
+		{CollapseSpace, " light  blue ", "light blue"},
+		{CollapseSpace, "a\t\nb", "a b"},
+		{CollapseSpace, "   ", ""},
+		{CollapseSpace, "AbC", "AbC"},
+		{CollapseSpace, "", ""},
+	} {
+		if got := tc.step.Apply(tc.in); got != tc.want {
+			t.Errorf("%s(%q) = %q, want %q", tc.step.Name, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestConfigNormalizer(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   CaptchaConfig
+		steps []string
+	}{
+		{CaptchaConfig{}, []string{"fold_case"}},
+		{CaptchaConfig{TrimAnswers: true}, []string{"fold_case", "collapse_space"}},
+		{CaptchaConfig{NumericLenient: true}, []string{"fold_case", "trim_number"}},
+		{CaptchaConfig{TrimAnswers: true, NumericLenient: true}, []string{"fold_case", "collapse_space", "trim_number"}},
+		{CaptchaConfig{CaseSensitive: true}, nil},
+		{CaptchaConfig{CaseSensitive: true, TrimAnswers: true}, []string{"collapse_space"}},
+		{CaptchaConfig{CaseSensitive: true, NumericLenient: true}, []string{"trim_number"}},
+		{CaptchaConfig{CaseSensitive: true, TrimAnswers: true, NumericLenient: true}, []string{"collapse_space", "trim_number"}},
+		{CaptchaConfig{Type: TypeMath}, []string{"fold_case", "trim_number"}},
+		{CaptchaConfig{Type: TypeMath, CaseSensitive: true, TrimAnswers: true}, []string{"collapse_space", "trim_number"}},
+	} {
+		var steps []string
+		for _, step := range tc.cfg.Normalizer().Steps {
+			steps = append(steps, step.Name)
+		}
+		if !slices.Equal(steps, tc.steps) {
+			t.Errorf("%+v: steps %v, want %v", tc.cfg, steps, tc.steps)
+		}
+	}
+}
+
+// permutations returns every ordering of steps
+func permutations(steps []NormalizeStep) [][]NormalizeStep {
+	if len(steps) <= 1 {
+		return [][]NormalizeStep{steps}
+	}
+	var all [][]NormalizeStep
+	for i := range steps {
+		rest := slices.Concat(steps[:i], steps[i+1:])
+		for _, p := range permutations(rest) {
+			all = append(all, append([]NormalizeStep{steps[i]}, p...))
+		}
+	}
+	return all
+}
+
+func TestNormalizeStepOrder(t *testing.T) {
+	// Answers normalized with every step, in the order of the config
+	want := map[string]string{
+		"":              "",
+		"   ":           "",
+		"0":             "0",
+		"000":           "0",
+		"0042":          "42",
+		" 0042 ":        "42",
+		"0 042":         "0 042",
+		"00A":           "00a",
+		"AbC":           "abc",
+		" Light  BLUE ": "light blue",
+		"ПРИВЕТ  мир":   "привет мир",
+		"\t007\n":       "7",
+		"A  B":          "a b",
+	}
+	all := []NormalizeStep{FoldCase, CollapseSpace, TrimNumber}
+	full := CaptchaConfig{TrimAnswers: true, NumericLenient: true}.Normalizer()
+
+	// Steps commute, so whatever subset a config picks, its order doesn't
+	// change the result
+	for mask := 1; mask < 1<<len(all); mask++ {
+		var subset []NormalizeStep
+		for i, step := range all {
+			if mask&(1<<i) != 0 {
+				subset = append(subset, step)
+			}
+		}
+		perms := permutations(subset)
+		for in := range want {
+			first := Normalizer{Steps: perms[0]}.Normalize(in)
+			for _, p := range perms[1:] {
+				if got := (Normalizer{Steps: p}).Normalize(in); got != first {
+					t.Errorf("%q: %v gives %q, %v gives %q", in, stepNames(perms[0]), first, stepNames(p), got)
+				}
+			}
+		}
+	}
+	for in, w := range want {
+		if got := full.Normalize(in); got != w {
+			t.Errorf("Normalize(%q) = %q, want %q", in, got, w)
+		}
+	}
+}
+
+// stepNames returns the names of steps
+func stepNames(steps []NormalizeStep) []string {
+	names := make([]string, len(steps))
+	for i, step := range steps {
+		names[i] = step.Name
+	}
+	return names
+}
+
+func TestAcceptsNormalized(t *testing.T) {
+	numeric := captchaData{value: "0042", answers: hashAnswers("0042")}
+	letters := captchaData{value: "AbC", answers: hashAnswers("AbC")}
+	words := captchaData{value: "What color?", answers: hashAnswers("light blue")}
+	for i, tc := range []struct {
+		data  captchaData
+		cfg   CaptchaConfig
+		input string
+		want  bool
+	}{
+		{numeric, CaptchaConfig{}, "0042", true},
+		{numeric, CaptchaConfig{}, "42", false},
+		{numeric, CaptchaConfig{NumericLenient: true}, "42", true},
+		{numeric, CaptchaConfig{NumericLenient: true}, " 00042 ", true},
+		{numeric, CaptchaConfig{NumericLenient: true}, "43", false},
+		{numeric, CaptchaConfig{Type: TypeMath}, "042", true},
+		{letters, CaptchaConfig{}, "abc", true},
+		{letters, CaptchaConfig{}, " abc", false},
+		{letters, CaptchaConfig{TrimAnswers: true}, " abc ", true},
+		{letters, CaptchaConfig{CaseSensitive: true}, "abc", false},
+		{letters, CaptchaConfig{CaseSensitive: true}, "AbC", true},
+		{letters, CaptchaConfig{NumericLenient: true}, "ABC", true},
+		{words, CaptchaConfig{TrimAnswers: true}, "  Light   Blue ", true},
+		{words, CaptchaConfig{}, "light  blue", false},
+		{captchaData{value: "0042"}, CaptchaConfig{NumericLenient: true}, "42", true},
+		{captchaData{value: "AbC"}, CaptchaConfig{}, "abc", true},
+		{captchaData{value: "AbC"}, CaptchaConfig{CaseSensitive: true}, "abc", false},
+	} {
+		if got := tc.data.accepts(tc.input, tc.cfg); got != tc.want {
+			t.Errorf("%d: %+v accepts(%q) = %t, want %t", i, tc.cfg, tc.input, got, tc.want)
+		}
+	}
+}
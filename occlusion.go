@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// maxOcclusionTries bounds the attempts at placing a routed line that keeps
+// every glyph readable
+const maxOcclusionTries = 10
+
+// glyphBox is a character drawn on the captcha: its bounds and the mask of
+// the pixels it covers
+type glyphBox struct {
+	rect  image.Rectangle
+	mask  image.Image
+	maskp image.Point
+	color color.RGBA
+}
+
+// covers reports whether the glyph paints the image pixel (x, y)
+func (g glyphBox) covers(x, y int) bool {
+	if !(image.Point{x, y}.In(g.rect)) {
+		return false
+	}
+	_, _, _, a := g.mask.At(x-g.rect.Min.X+g.maskp.X, y-g.rect.Min.Y+g.maskp.Y).RGBA()
+	return a > 0
+}
+
+// pixels counts the pixels the glyph paints
+func (g glyphBox) pixels() int {
+	count := 0
+	for y := g.rect.Min.Y; y < g.rect.Max.Y; y++ {
+		for x := g.rect.Min.X; x < g.rect.Max.X; x++ {
+			if g.covers(x, y) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// routedLines returns how many of the noise lines are routed through the text
+func routedLines(cfg CaptchaConfig) int {
+	if cfg.OcclusionFraction <= 0 {
+		return 0
+	}
+	return int(math.Round(float64(cfg.NoiseLevel/10) * min(cfg.OcclusionFraction, 1)))
+}
+
+// addOcclusionLines draws noise lines crossing at least two glyphs each. A
+// line is only kept when no glyph ends up with more than cfg.MaxOcclusion of
+// its pixels covered by routed lines.
+func addOcclusionLines(img *image.RGBA, cfg CaptchaConfig, rnd *randSource, glyphs []glyphBox) {
+	if len(glyphs) < 2 {
+		return
+	}
+
+	total := make([]int, len(glyphs))
+	covered := make([]int, len(glyphs))
+	for i, g := range glyphs {
+		total[i] = g.pixels()
+	}
+	seen := make(map[image.Point]bool)
+	pen := brush(cfg.noiseWidth())
+
+	for n := routedLines(cfg); n > 0; n-- {
+		for try := 0; try < maxOcclusionTries; try++ {
+			x1, y1, x2, y2 := routeThroughGlyphs(cfg, rnd, glyphs)
+
+			// Count the glyph pixels the line would newly cover, once each
+			// where the brush overlaps itself along the line
+			added := make([]int, len(glyphs))
+			var hits []image.Point
+			var stroked map[image.Point]bool
+			if len(pen) > 1 {
+				stroked = make(map[image.Point]bool)
+			}
+			walkLine(x1, y1, x2, y2, func(x, y int) {
+				for _, offset := range pen {
+					p := image.Point{x + offset.X, y + offset.Y}
+					if seen[p] || stroked[p] {
+						continue
+					}
+					if stroked != nil {
+						stroked[p] = true
+					}
+					for i, g := range glyphs {
+						if g.covers(p.X, p.Y) {
+							added[i]++
+							hits = append(hits, p)
+						}
+					}
+				}
+			})
+
+			if !withinOcclusion(cfg, total, covered, added) {
+				continue
+			}
+
+			for i := range covered {
+				covered[i] += added[i]
+			}
+			for _, p := range hits {
+				seen[p] = true
+			}
+
+			drawStroke(img, x1, y1, x2, y2, pen, cfg.noiseColor(rnd, 200))
+			break
+		}
+	}
+}
+
+// routeThroughGlyphs picks a line through random points of two different
+// glyphs, extended to the left and right edges of the image
+func routeThroughGlyphs(cfg CaptchaConfig, rnd *randSource, glyphs []glyphBox) (int, int, int, int) {
+	i := rnd.Intn(len(glyphs) - 1)
+	j := i + 1 + rnd.Intn(len(glyphs)-i-1)
+
+	ax, ay := randomPointIn(rnd, glyphs[i].rect)
+	bx, by := randomPointIn(rnd, glyphs[j].rect)
+	if ax == bx {
+		return ax, 0, bx, cfg.Height - 1
+	}
+
+	slope := float64(by-ay) / float64(bx-ax)
+	y1 := float64(ay) - slope*float64(ax)
+	y2 := float64(ay) + slope*float64(cfg.Width-1-ax)
+	return 0, int(math.Round(y1)), cfg.Width - 1, int(math.Round(y2))
+}
+
+// randomPointIn returns a random point inside r
+func randomPointIn(rnd *randSource, r image.Rectangle) (int, int) {
+	return r.Min.X + rnd.Intn(max(r.Dx(), 1)), r.Min.Y + rnd.Intn(max(r.Dy(), 1))
+}
+
+// withinOcclusion reports whether adding the covered pixels keeps every
+// glyph under the occlusion limit
+func withinOcclusion(cfg CaptchaConfig, total, covered, added []int) bool {
+	if cfg.MaxOcclusion <= 0 {
+		return true
+	}
+	for i := range total {
+		if total[i] > 0 && float64(covered[i]+added[i])/float64(total[i]) > cfg.MaxOcclusion {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,10 @@
+// Package ocrtest measures how well an off-the-shelf OCR engine reads the
+// captchas of a configuration, to compare noise settings and difficulty
+// presets empirically.
+//
+// It runs Tesseract through gosseract and is only built with the
+// "tesseract" build tag, so that builds without Tesseract installed aren't
+// affected:
+//
+//	go test -tags tesseract ./...
+package ocrtest
@@ -0,0 +1,118 @@
+//go:build tesseract
+
+package ocrtest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/otiai10/gosseract/v2"
+	middleware "github.com/wprimadi/gin-captcha"
+	"github.com/wprimadi/gin-captcha/internal/testhook"
+)
+
+// Result is the outcome of a Score run
+type Result struct {
+	Total  int     // Captchas rendered
+	Solved int     // Captchas whose answer the OCR read correctly
+	Rate   float64 // Solved / Total
+}
+
+// Score renders n captchas with cfg and returns how many of them Tesseract
+// reads correctly. The OCR is restricted to the characters of cfg.Type and
+// answers are compared like VerifyCaptcha would.
+func Score(cfg middleware.CaptchaConfig, n int) (Result, error) {
+	// Render only, whatever limits the config sets on real traffic
+	cfg.RiskFunc = nil
+	cfg.QuotaKeyFunc = nil
+	cfg.CooldownThreshold = 0
+	cfg.Steps = 0
+	cfg.DeferResponse = false
+
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.GET("/captcha", middleware.GenerateCaptcha(cfg))
+
+	client := gosseract.NewClient()
+	defer client.Close()
+	if err := client.SetWhitelist(whitelist(cfg.Type)); err != nil {
+		return Result{}, err
+	}
+	if err := client.SetPageSegMode(gosseract.PSM_SINGLE_LINE); err != nil {
+		return Result{}, err
+	}
+
+	result := Result{Total: n}
+	for i := 0; i < n; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/captcha", nil))
+		if w.Code != http.StatusOK {
+			return result, fmt.Errorf("ocrtest: generating a captcha returned %d: %s", w.Code, w.Body.String())
+		}
+
+		// Signed IDs carry their signature after a dot
+		id, _, _ := strings.Cut(w.Header().Get(middleware.DefaultIDHeader), ".")
+		answer, ok := testhook.Answer(id)
+		if !ok {
+			return result, fmt.Errorf("ocrtest: captcha %q not found in the store", id)
+		}
+		middleware.DefaultStore().Invalidate(context.Background(), id)
+
+		if err := client.SetImageFromBytes(w.Body.Bytes()); err != nil {
+			return result, err
+		}
+		text, err := client.Text()
+		if err != nil {
+			return result, err
+		}
+
+		if matches(strings.Join(strings.Fields(text), ""), answer, cfg.CaseSensitive) {
+			result.Solved++
+		}
+	}
+
+	if n > 0 {
+		result.Rate = float64(result.Solved) / float64(n)
+	}
+	return result, nil
+}
+
+// AssertBelow fails the test when Tesseract reads more than maxRate of n
+// captchas rendered with cfg
+func AssertBelow(t testing.TB, cfg middleware.CaptchaConfig, n int, maxRate float64) Result {
+	t.Helper()
+
+	result, err := Score(cfg, n)
+	if err != nil {
+		t.Fatalf("ocrtest: %v", err)
+	}
+	if result.Rate > maxRate {
+		t.Errorf("ocrtest: OCR solved %d of %d captchas (%.1f%%), above the %.1f%% allowed",
+			result.Solved, result.Total, result.Rate*100, maxRate*100)
+	}
+	return result
+}
+
+// whitelist returns the characters captchas of the given type are made of
+func whitelist(captchaType middleware.CaptchaType) string {
+	switch captchaType {
+	case middleware.TypeNumeric:
+		return "0123456789"
+	case middleware.TypeAlphabetic:
+		return "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	}
+	return "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+}
+
+// matches compares the OCR output with the answer
+func matches(text, answer string, caseSensitive bool) bool {
+	if caseSensitive {
+		return text == answer
+	}
+	return strings.EqualFold(text, answer)
+}
@@ -0,0 +1,252 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Response formats of the generate handlers
+const (
+	FormatPNG     = "png"     // Binary PNG image
+	FormatJSON    = "json"    // JSON with the captcha ID and the base64 encoded image
+	FormatDataURI = "datauri" // The image as a data URI in plain text, for the src of an img element
+	FormatSVG     = "svg"     // SVG image drawing the glyphs as outlines among noise paths
+	FormatGIF     = "gif"     // Animated GIF image, each frame showing only some of the characters
+	FormatWebP    = "webp"    // Binary WebP image, once the webp package is imported
+)
+
+// maxOptionsBody bounds the JSON body accepted by GenerateCaptchaFromJSON
+const maxOptionsBody = 4 << 10
+
+// GenerateOptions are per-request overrides of the captcha configuration,
+// honored when AllowOverrides is set. Zero values keep the configuration.
+type GenerateOptions struct {
+	Width  int    `json:"width"`  // Image width, capped by MaxWidth
+	Height int    `json:"height"` // Image height, capped by MaxHeight
+	Type   string `json:"type"`   // "numeric", "alphabetic", "alphanumeric", "math" or "word"
+	Format string `json:"format"` // FormatPNG, FormatJSON, FormatDataURI, FormatSVG, FormatGIF or a registered format
+}
+
+// captchaTypeNames maps the type names accepted in requests to their types
+var captchaTypeNames = map[string]CaptchaType{
+	"numeric":      TypeNumeric,
+	"alphabetic":   TypeAlphabetic,
+	"alphanumeric": TypeAlphanumeric,
+	"math":         TypeMath,
+	"word":         TypeWord,
+}
+
+// knownFormat reports whether format is a built-in or registered response
+// format, "" standing for the default
+func knownFormat(format string) bool {
+	switch format {
+	case "", FormatPNG, FormatJSON, FormatDataURI, FormatSVG, FormatGIF:
+		return true
+	}
+	_, ok := registeredEncoder(format)
+	return ok
+}
+
+// mustValidFormat panics when the Format of cfg is unknown
+func mustValidFormat(cfg CaptchaConfig) {
+	if !knownFormat(cfg.Format) {
+		panic(fmt.Errorf("captcha: unknown Format %q", cfg.Format))
+	}
+}
+
+// apply returns cfg with the options applied, or an error describing the
+// first option outside the server-side caps
+func (o GenerateOptions) apply(cfg CaptchaConfig) (CaptchaConfig, error) {
+	maxWidth, maxHeight := cfg.Width, cfg.Height
+	if cfg.MaxWidth > 0 {
+		maxWidth = cfg.MaxWidth
+	}
+	if cfg.MaxHeight > 0 {
+		maxHeight = cfg.MaxHeight
+	}
+
+	if o.Width != 0 {
+		if o.Width < 0 || o.Width > maxWidth {
+			return cfg, fmt.Errorf("width must be between 1 and %d", maxWidth)
+		}
+		cfg.Width = o.Width
+	}
+
+	if o.Height != 0 {
+		if o.Height < 0 || o.Height > maxHeight {
+			return cfg, fmt.Errorf("height must be between 1 and %d", maxHeight)
+		}
+		cfg.Height = o.Height
+	}
+
+	if o.Type != "" {
+		captchaType, ok := captchaTypeNames[o.Type]
+		if !ok {
+			return cfg, fmt.Errorf("unknown captcha type %q", o.Type)
+		}
+		cfg.Type = captchaType
+	}
+
+	if !knownFormat(o.Format) {
+		return cfg, fmt.Errorf("unknown format %q", o.Format)
+	}
+
+	return cfg, nil
+}
+
+// optionsFromQuery reads the options from the query parameters
+func optionsFromQuery(c *gin.Context) (GenerateOptions, error) {
+	opts := GenerateOptions{
+		Type:   c.Query("type"),
+		Format: c.Query("format"),
+	}
+
+	var err error
+	if value := c.Query("width"); value != "" {
+		if opts.Width, err = strconv.Atoi(value); err != nil {
+			return opts, fmt.Errorf("invalid width %q", value)
+		}
+	}
+	if value := c.Query("height"); value != "" {
+		if opts.Height, err = strconv.Atoi(value); err != nil {
+			return opts, fmt.Errorf("invalid height %q", value)
+		}
+	}
+
+	return opts, nil
+}
+
+// optionsFromJSON reads the options from a JSON body, rejecting unknown
+// fields so that typos don't silently fall back to the defaults
+func optionsFromJSON(body io.Reader) (GenerateOptions, error) {
+	var opts GenerateOptions
+
+	data, err := io.ReadAll(io.LimitReader(body, maxOptionsBody))
+	if err != nil {
+		return opts, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return opts, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return opts, fmt.Errorf("invalid JSON body")
+	}
+
+	var unknown []string
+	for name := range fields {
+		switch name {
+		case "width", "height", "type", "format":
+		default:
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return opts, fmt.Errorf("unknown fields: %s", strings.Join(unknown, ", "))
+	}
+
+	if err := json.Unmarshal(data, &opts); err != nil {
+		return opts, fmt.Errorf("invalid JSON body")
+	}
+	return opts, nil
+}
+
+// GenerateCaptchaFromJSON is a handler generating a captcha with options read
+// from a JSON body, such as {"width":320,"height":120,"type":"numeric"}. It
+// responds in JSON unless the body asks for another format. Options are only
+// honored when AllowOverrides is set, within the same caps as the query
+// parameters of GenerateCaptcha.
+func GenerateCaptchaFromJSON(config ...CaptchaConfig) gin.HandlerFunc {
+	cfg := DefaultCaptchaConfig()
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+
+	warnWeakConfig(cfg)
+	mustValidNames(cfg)
+	mustValidIDLength(cfg)
+	mustValidText(cfg)
+	mustSupportStateless(cfg)
+	mustLoadFont(cfg)
+	mustValidStyle(cfg)
+	mustFitBudget(cfg, FormatJSON)
+	limitMemoryStore(cfg)
+	limitRenders(cfg)
+
+	cfg.state().startCleanup(cfg.CleanupInterval)
+
+	return func(c *gin.Context) {
+		opts, err := optionsFromJSON(c.Request.Body)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		if !cfg.AllowOverrides {
+			opts = GenerateOptions{Format: opts.Format}
+		}
+		if opts.Format == "" {
+			opts.Format = FormatJSON
+		}
+
+		generate(c, cfg, opts)
+	}
+}
+
+// writeCaptchaJSON sends the captcha ID, the base64 encoded image, its MIME
+// type and the input mode suited to the answer. The image is base64 encoded
+// straight into the response rather than into a string, so the response is
+// sent chunked. A non-empty question is sent too, see QuestionText.
+// Like writeBody, it returns the error of an incomplete write.
+func writeCaptchaJSON(c *gin.Context, clientID string, data captchaData, encoded []byte, question string) error {
+	id, err := json.Marshal(clientID)
+	if err != nil {
+		return err
+	}
+	suffix := []byte(`","input_mode":"` + data.inputMode() + `","mime_type":"image/png"`)
+	if question != "" {
+		text, err := json.Marshal(question)
+		if err != nil {
+			return err
+		}
+		suffix = append(append(suffix, `,"question":`...), text...)
+	}
+	suffix = append(suffix, '}')
+
+	// Same fields and order as marshaling them in a gin.H
+	prefix := make([]byte, 0, 128)
+	prefix = append(prefix, `{"captcha_id":`...)
+	prefix = append(prefix, id...)
+	prefix = append(prefix, `,"expires_in":`...)
+	prefix = strconv.AppendInt(prefix, int64(data.expiresIn()), 10)
+	prefix = append(prefix, `,"image":"`...)
+
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.Status(200)
+
+	enc := base64.NewEncoder(base64.StdEncoding, c.Writer)
+	_, err = c.Writer.Write(prefix)
+	if err == nil {
+		_, err = enc.Write(encoded)
+	}
+	if err == nil {
+		err = enc.Close()
+	}
+	if err == nil {
+		_, err = c.Writer.Write(suffix)
+	}
+	if err != nil {
+		c.Error(err)
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"image"
+	"runtime"
+	"sync"
+)
+
+// parallelRenderPixels is the image size from which rendering is split
+// across workers even when ParallelRender is off
+const parallelRenderPixels = 100_000
+
+// maxRenderWorkers bounds the bands, and so the goroutines, of a single
+// render
+const maxRenderWorkers = 8
+
+// renderWorkers returns how many horizontal bands the image is split into,
+// 1 meaning the render stays on the calling goroutine. The count comes from
+// cfg alone, since each band draws from its own random source: hosts with
+// different CPU counts must draw the same pixels for the same seed.
+func renderWorkers(cfg CaptchaConfig) int {
+	if !cfg.ParallelRender && cfg.Width*cfg.Height < parallelRenderPixels {
+		return 1
+	}
+	// Keep bands at least 16 rows high
+	return max(min(maxRenderWorkers, cfg.Height/16), 1)
+}
+
+// addNoiseDotsParallel spreads the noise dots over horizontal bands, each
+// drawn with its own random source, at most GOMAXPROCS of them at once
+func addNoiseDotsParallel(img *image.RGBA, cfg CaptchaConfig, rnd *randSource, workers int) {
+	numDots := cfg.NoiseLevel * 5
+
+	// Split the sources up front so the band assignment doesn't depend on
+	// goroutine scheduling
+	sources := make([]*randSource, workers)
+	for i := range sources {
+		sources[i] = rnd.split()
+	}
+
+	running := make(chan struct{}, min(runtime.GOMAXPROCS(0), workers))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		y0 := cfg.Height * i / workers
+		y1 := cfg.Height * (i + 1) / workers
+		n := numDots*y1/cfg.Height - numDots*y0/cfg.Height
+
+		wg.Add(1)
+		running <- struct{}{}
+		go func(src *randSource) {
+			defer wg.Done()
+			defer func() { <-running }()
+			defer src.release()
+			addNoiseDotsBand(img, cfg, src, y0, y1, n)
+		}(sources[i])
+	}
+	wg.Wait()
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"bytes"
+	"image"
+	"runtime"
+	"testing"
+)
+
+func TestRenderSameAcrossGOMAXPROCS(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  func() CaptchaConfig
+	}{
+		{"ParallelRender", func() CaptchaConfig {
+			cfg := DefaultCaptchaConfig()
+			cfg.ParallelRender = true
+			return cfg
+		}},
+		{"Large", func() CaptchaConfig {
+			cfg := DefaultCaptchaConfig()
+			cfg.Width, cfg.Height = 600, 240
+			return cfg
+		}},
+		{"Supersample", func() CaptchaConfig {
+			cfg := DefaultCaptchaConfig()
+			cfg.Supersample = 3
+			return cfg
+		}},
+	}
+
+	seed := [32]byte{1, 2, 3}
+	render := func(t *testing.T, cfg CaptchaConfig, procs int) []byte {
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+		img, err := generateCaptchaImage("AB12cd", seed, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img.(*image.RGBA).Pix
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg()
+			if workers := renderWorkers(cfg.supersampled(max(cfg.Supersample, 1))); workers < 2 {
+				t.Fatalf("renders on %d band, want several", workers)
+			}
+			if !bytes.Equal(render(t, cfg, 1), render(t, cfg, 4)) {
+				t.Error("pixels differ between GOMAXPROCS 1 and 4")
+			}
+		})
+	}
+}
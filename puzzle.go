@@ -0,0 +1,352 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	xdraw "golang.org/x/image/draw"
+)
+
+// DefaultPuzzleTolerance is the PuzzleTolerance used when it is 0
+const DefaultPuzzleTolerance = 5
+
+// minPuzzlePiece is the smallest side of a puzzle piece, in pixels
+const minPuzzlePiece = 10
+
+// ErrInvalidPuzzle is wrapped by the errors of CheckPuzzle
+var ErrInvalidPuzzle = errors.New("invalid puzzle captcha settings")
+
+// puzzlePiece returns the side of the square of puzzle pieces
+func (cfg CaptchaConfig) puzzlePiece() int {
+	if cfg.PuzzlePiece <= 0 {
+		return cfg.Height / 2
+	}
+	return cfg.PuzzlePiece
+}
+
+// puzzleTab returns the radius of the round tab on the right of puzzle
+// pieces, which makes them stick out of their bounding square
+func (cfg CaptchaConfig) puzzleTab() int {
+	return cfg.puzzlePiece() / 5
+}
+
+// puzzleTolerance returns how far an x position may be off the target
+func (cfg CaptchaConfig) puzzleTolerance() int {
+	if cfg.PuzzleTolerance <= 0 {
+		return DefaultPuzzleTolerance
+	}
+	return cfg.PuzzleTolerance
+}
+
+// CheckPuzzle returns an error when cfg can't make puzzle captchas: with
+// Stateless, which puzzles don't support, or a piece smaller than 10 pixels
+// or too large for the image to leave a start area and room to slide it
+func CheckPuzzle(cfg CaptchaConfig) error {
+	if cfg.Stateless {
+		return fmt.Errorf("%w: Stateless isn't supported", ErrInvalidPuzzle)
+	}
+	piece := cfg.puzzlePiece()
+	width := piece + cfg.puzzleTab()
+	switch {
+	case piece < minPuzzlePiece:
+		return fmt.Errorf("%w: piece of %d pixels, at least %d are needed", ErrInvalidPuzzle, piece, minPuzzlePiece)
+	case cfg.Width < 3*width || cfg.Height < piece:
+		return fmt.Errorf("%w: piece of %d pixels doesn't fit %dx%d with room to slide it",
+			ErrInvalidPuzzle, piece, cfg.Width, cfg.Height)
+	}
+	return nil
+}
+
+// mustValidPuzzle panics when cfg can't make puzzle captchas, so a bad
+// setting is caught when the routes are set up
+func mustValidPuzzle(cfg CaptchaConfig) {
+	if err := CheckPuzzle(cfg); err != nil {
+		panic(err)
+	}
+}
+
+// GeneratePuzzleCaptcha is a handler generating a slider puzzle: a
+// background with a piece cut out, to be slid back into place. It responds
+// in JSON with the captcha ID, the background and the piece as base64 PNGs,
+// and the y position of the piece, which only slides horizontally. The x
+// position of the piece is verified by VerifyPuzzleCaptcha.
+func GeneratePuzzleCaptcha(config ...CaptchaConfig) gin.HandlerFunc {
+	cfg := DefaultCaptchaConfig()
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+
+	mustValidNames(cfg)
+	mustValidIDLength(cfg)
+	mustValidPuzzle(cfg)
+	limitMemoryStore(cfg)
+	limitRenders(cfg)
+
+	cfg.state().startCleanup(cfg.CleanupInterval)
+
+	return func(c *gin.Context) {
+		cfg, step, rej := prepareGeneration(c, cfg)
+		if rej != nil {
+			rej.abort(c)
+			return
+		}
+
+		metadata, rej := captchaMetadata(c, cfg)
+		if rej != nil {
+			rej.abort(c)
+			return
+		}
+
+		generatePuzzle(c, cfg, step, metadata)
+	}
+}
+
+// generatePuzzle creates, renders and stores a puzzle captcha and sends it
+func generatePuzzle(c *gin.Context, cfg CaptchaConfig, step int, metadata map[string]string) {
+	if clientGone(c, cfg) {
+		return
+	}
+
+	captchaID, data, err := newPuzzle(cfg, step, metadata)
+	if err != nil {
+		logError(c, cfg, "", err)
+		abortIssue(c, err)
+		return
+	}
+
+	release, err := cfg.state().renders.acquire(c.Request.Context(), cfg)
+	if err != nil {
+		abortIssue(c, err)
+		return
+	}
+	start := time.Now()
+	background, piece, y := drawPuzzle(data.seed, cfg)
+	emitTiming(cfg.Metrics, MetricRender, start)
+	rendered := time.Since(start)
+
+	var images [2]string
+	for i, img := range []image.Image{background, piece} {
+		buf, err := encodePooled(img)
+		if err != nil {
+			release()
+			logError(c, cfg, captchaID, err)
+			abortIssue(c, err)
+			return
+		}
+		images[i] = base64.StdEncoding.EncodeToString(buf.Bytes())
+		releaseBuffer(buf)
+	}
+	release()
+
+	if rej := checkResponseSize(cfg, len(images[0])+len(images[1])+jsonOverhead); rej != nil {
+		rej.abort(c)
+		return
+	}
+
+	// Only store puzzles that are ready to be sent
+	if clientGone(c, cfg) {
+		return
+	}
+	if err := cfg.state().storeCaptcha(cfg, captchaID, data); err != nil {
+		abortStore(c, cfg, captchaID, err)
+		return
+	}
+	cfg.state().stats.generated.Add(1)
+	emitCount(cfg.Metrics, MetricGenerated)
+	logEvent(c, cfg, Event{
+		Type:      EventGenerated,
+		CaptchaID: captchaID,
+		Step:      step,
+		Duration:  rendered,
+		Trace:     data.trace,
+	})
+	cfg.state().reportFunnel(FunnelShown, captchaID, data)
+
+	clientID := setCaptchaID(c, cfg, captchaID, data)
+	setTrace(c, data)
+	setTelemetryKey(c, cfg, captchaID)
+
+	c.JSON(200, gin.H{
+		"captcha_id": clientID,
+		"expires_in": data.expiresIn(),
+		"background": images[0],
+		"piece":      images[1],
+		"piece_y":    y,
+		"mime_type":  "image/png",
+	})
+}
+
+// newPuzzle creates a puzzle captcha under a new ID. Its layout derives from
+// the seed, and the x position of the piece is its answer.
+func newPuzzle(cfg CaptchaConfig, step int, metadata map[string]string) (string, captchaData, error) {
+	captchaID, err := generateID(cfg.idLength())
+	if err != nil {
+		return "", captchaData{}, err
+	}
+
+	seed := newSeed()
+	rnd := newSeededSource(seed)
+	x, _ := puzzleLayout(cfg, rnd)
+	rnd.release()
+
+	return captchaID, captchaData{
+		answers:  hashAnswers(strconv.Itoa(x)),
+		issuedAt: time.Now(),
+		ttl:      cfg.ExpireTime,
+		grace:    cfg.clockSkew(),
+		step:     step,
+		seed:     seed,
+		metadata: metadata,
+		trace:    generateTrace(),
+		numeric:  true,
+		puzzle:   true,
+	}, nil
+}
+
+// puzzleLayout draws the position of the piece: clear of the start area on
+// the left, where the piece sits before it is slid, and within the image
+func puzzleLayout(cfg CaptchaConfig, rnd *randSource) (int, int) {
+	piece := cfg.puzzlePiece()
+	width := piece + cfg.puzzleTab()
+	x := width + rnd.Intn(cfg.Width-2*width+1)
+	y := rnd.Intn(cfg.Height - piece + 1)
+	return x, y
+}
+
+// drawPuzzle draws the background of the puzzle of seed with the piece cut
+// out, the piece, and its y position. Every render of a seed is identical.
+func drawPuzzle(seed [32]byte, cfg CaptchaConfig) (*image.RGBA, *image.RGBA, int) {
+	rnd := newSeededSource(seed)
+	defer rnd.release()
+
+	x, y := puzzleLayout(cfg, rnd)
+	background := puzzleBackground(cfg, rnd)
+
+	piece, tab := cfg.puzzlePiece(), cfg.puzzleTab()
+	cut := image.NewRGBA(image.Rect(0, 0, piece+tab, piece))
+	for py := 0; py < piece; py++ {
+		for px := 0; px < piece+tab; px++ {
+			inside, edge := puzzleMask(px, py, piece, tab)
+			if !inside {
+				continue
+			}
+			bx, by := x+px, y+py
+			src := background.RGBAAt(bx, by)
+
+			// The piece keeps the pixels, outlined, and the hole is shaded
+			if edge {
+				cut.SetRGBA(px, py, color.RGBA{255, 255, 255, 255})
+				background.SetRGBA(bx, by, color.RGBA{255, 255, 255, 255})
+				continue
+			}
+			cut.SetRGBA(px, py, src)
+			background.SetRGBA(bx, by, color.RGBA{src.R / 3, src.G / 3, src.B / 3, 255})
+		}
+	}
+	return background, cut, y
+}
+
+// puzzleMask reports whether (px, py) is in the piece, a square of side
+// piece with a round tab of radius tab on its right, and on its outline
+func puzzleMask(px, py, piece, tab int) (inside, edge bool) {
+	in := func(x, y int) bool {
+		if x >= 0 && x < piece && y >= 0 && y < piece {
+			return true
+		}
+		dx, dy := float64(x-piece)+0.5, float64(y-piece/2)+0.5
+		return x >= piece && math.Hypot(dx, dy) <= float64(tab)
+	}
+	if !in(px, py) {
+		return false, false
+	}
+	return true, !in(px-1, py) || !in(px+1, py) || !in(px, py-1) || !in(px, py+1)
+}
+
+// puzzleBackground returns one of PuzzleBackgrounds scaled to the image
+// size, or a random gradient crossed by noise when there are none
+func puzzleBackground(cfg CaptchaConfig, rnd *randSource) *image.RGBA {
+	bounds := image.Rect(0, 0, cfg.Width, cfg.Height)
+	img := image.NewRGBA(bounds)
+
+	if n := len(cfg.PuzzleBackgrounds); n > 0 {
+		src := cfg.PuzzleBackgrounds[rnd.Intn(n)]
+		xdraw.ApproxBiLinear.Scale(img, bounds, src, src.Bounds(), draw.Src, nil)
+		return img
+	}
+
+	var from, to [3]byte
+	rnd.read(from[:])
+	rnd.read(to[:])
+	// Pale enough for the noise and the shaded hole to show
+	for i := range from {
+		from[i] = 128 + from[i]/2
+		to[i] = 128 + to[i]/2
+	}
+	angle := float64(rnd.Intn(360)) * math.Pi / 180
+	dx, dy := math.Cos(angle), math.Sin(angle)
+	span := math.Abs(dx)*float64(cfg.Width) + math.Abs(dy)*float64(cfg.Height)
+	originX, originY := min(dx, 0)*float64(cfg.Width), min(dy, 0)*float64(cfg.Height)
+
+	for y := 0; y < cfg.Height; y++ {
+		for x := 0; x < cfg.Width; x++ {
+			t := ((float64(x)-originX)*dx + (float64(y)-originY)*dy) / span
+			t = min(max(t, 0), 1)
+			var c color.RGBA
+			c.R = uint8(float64(from[0]) + (float64(to[0])-float64(from[0]))*t)
+			c.G = uint8(float64(from[1]) + (float64(to[1])-float64(from[1]))*t)
+			c.B = uint8(float64(from[2]) + (float64(to[2])-float64(from[2]))*t)
+			c.A = 255
+			img.SetRGBA(x, y, c)
+		}
+	}
+	addNoiseLines(img, cfg, rnd)
+	addNoiseDots(img, cfg, rnd)
+	return img
+}
+
+// acceptsPosition reports whether input is an x position within tolerance
+// pixels of the answer of a puzzle captcha. Every position of the range is
+// compared, so the comparison takes the same time wherever the answer is.
+func (d captchaData) acceptsPosition(input string, tolerance int) bool {
+	f, err := strconv.ParseFloat(strings.TrimSpace(input), 64)
+	if err != nil || math.IsNaN(f) || math.Abs(f) > math.MaxInt32 || len(d.answers) == 0 {
+		return false
+	}
+	x := int(math.Round(f))
+
+	accepted := 0
+	for offset := -tolerance; offset <= tolerance; offset++ {
+		sum := sha256.Sum256([]byte(strconv.Itoa(x + offset)))
+		accepted |= subtle.ConstantTimeCompare(sum[:], d.answers[0].exact[:])
+	}
+	return accepted == 1
+}
+
+// VerifyPuzzleCaptcha is a middleware verifying puzzle captchas of
+// GeneratePuzzleCaptcha. The answer is the x position the piece was slid
+// to, read like the answer of VerifyCaptchaWithConfig, and passes within
+// PuzzleTolerance pixels of the cut out. Puzzle and text captchas only pass
+// the verification of their own kind.
+func VerifyPuzzleCaptcha(config ...CaptchaConfig) gin.HandlerFunc {
+	cfg := DefaultCaptchaConfig()
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+	if cfg.Stateless {
+		panic(fmt.Errorf("%w: Stateless isn't supported", ErrInvalidPuzzle))
+	}
+
+	cfg.puzzle = true
+	return VerifyCaptchaWithConfig(cfg)
+}
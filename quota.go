@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// quotaWindow returns the store key of the current daily window for key
+// and the time the window resets
+func quotaWindow(key string) (string, time.Time) {
+	now := time.Now().UTC()
+	reset := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return "quota:" + key + ":" + now.Format("2006-01-02"), reset
+}
+
+// checkQuota counts a generation against the quota of the request's key and
+// rejects the request with 429 once the daily limit is exceeded, and with
+// 500 when it can't be counted in the store
+func checkQuota(c *gin.Context, cfg CaptchaConfig) *Rejection {
+	key := cfg.QuotaKeyFunc(c)
+	if key == "" {
+		return nil
+	}
+
+	windowKey, reset := quotaWindow(key)
+	used, err := cfg.state().incrCount(cfg, windowKey, time.Until(reset))
+	if err != nil {
+		logError(c, cfg, "", err)
+		return reject(500, gin.H{"error": "Failed to generate captcha"})
+	}
+
+	c.Header("X-Captcha-Quota-Limit", strconv.Itoa(cfg.QuotaLimit))
+	c.Header("X-Captcha-Quota-Remaining", strconv.Itoa(max(cfg.QuotaLimit-used, 0)))
+	c.Header("X-Captcha-Quota-Reset", strconv.FormatInt(reset.Unix(), 10))
+
+	if used <= cfg.QuotaLimit {
+		return nil
+	}
+
+	emitCount(cfg.Metrics, MetricQuotaExceeded)
+	logEvent(c, cfg, Event{Type: EventQuotaExceeded})
+	c.Header("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+	return reject(429, gin.H{"error": "Captcha quota exceeded"})
+}
+
+// QuotaUsage returns how many captchas were generated today for the quota
+// key. With a config whose Store is a Counter, the usage is read from that
+// Store, where every replica sharing it counts.
+func (s *CaptchaStore) QuotaUsage(key string, config ...CaptchaConfig) (int, error) {
+	windowKey, _ := quotaWindow(key)
+	return s.countOf(givenConfig(config), windowKey)
+}
+
+// ResetQuota clears today's usage of the quota key, in the Store of the
+// config when it is a Counter, see QuotaUsage
+func (s *CaptchaStore) ResetQuota(key string, config ...CaptchaConfig) error {
+	windowKey, _ := quotaWindow(key)
+	return s.resetCount(givenConfig(config), windowKey)
+}
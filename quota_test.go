@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// generateStatus requests a captcha from h and returns the response status
+func generateStatus(h *gin.Engine) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/captcha", nil))
+	return w.Code
+}
+
+func TestQuotaSharedStore(t *testing.T) {
+	const key = "shared-quota-test"
+	cfg := testConfig()
+	cfg.QuotaKeyFunc = func(*gin.Context) string { return key }
+	cfg.QuotaLimit = 3
+	cfg.Store = NewMemoryStore()
+
+	// Two replicas, each with its own process state, sharing the Store
+	replica := func() *gin.Engine {
+		cfg := cfg
+		cfg.captchas = newCaptchaStore()
+		return testRouter(cfg)
+	}
+	first, second := replica(), replica()
+
+	for i, h := range []*gin.Engine{first, second, first} {
+		if code := generateStatus(h); code != 200 {
+			t.Fatalf("generation %d within the quota: %d", i, code)
+		}
+	}
+	if code := generateStatus(second); code != 429 {
+		t.Errorf("generation over the quota on another replica: %d, want 429", code)
+	}
+
+	// Read and reset in the shared Store, whichever CaptchaStore is asked
+	if used, err := store.QuotaUsage(key, cfg); used != 4 || err != nil {
+		t.Errorf("QuotaUsage = %d, %v, want 4", used, err)
+	}
+	if used, _ := store.QuotaUsage(key); used != 0 {
+		t.Errorf("QuotaUsage without the config = %d, want the usage of the process", used)
+	}
+	if err := store.ResetQuota(key, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if code := generateStatus(first); code != 200 {
+		t.Errorf("generation after ResetQuota: %d", code)
+	}
+}
@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"math"
+	mrand "math/rand/v2"
+	"sync"
+)
+
+// randomPool holds buffered readers over crypto/rand, so a render reads the
+// entropy source in a few large batches instead of once per random number
+var randomPool = sync.Pool{
+	New: func() any { return bufio.NewReaderSize(rand.Reader, 1024) },
+}
+
+// RandomSource is the randomness a Renderer draws from. It is seeded per
+// captcha, so renderers drawing only from it produce identical images every
+// time a captcha is rendered.
+type RandomSource interface {
+	Intn(n int) int             // Uniform random number in [0, n)
+	Read(p []byte) (int, error) // Fills p with random bytes, never fails
+}
+
+// randSource draws uniformly distributed numbers from crypto/rand, or from a
+// ChaCha8 stream when seeded
+type randSource struct {
+	r      *bufio.Reader
+	buf    [4]byte
+	seeded bool
+}
+
+// newRandSource takes a buffered reader from the pool, it must be given back
+// with release once the caller is done
+func newRandSource() *randSource {
+	return &randSource{r: randomPool.Get().(*bufio.Reader)}
+}
+
+// newSeededSource returns a source producing the same numbers for the same
+// seed, it must be given back with release once the caller is done
+func newSeededSource(seed [32]byte) *randSource {
+	r := randomPool.Get().(*bufio.Reader)
+	r.Reset(mrand.NewChaCha8(seed))
+	return &randSource{r: r, seeded: true}
+}
+
+// newSeed returns a random seed for newSeededSource
+func newSeed() [32]byte {
+	var seed [32]byte
+	rand.Read(seed[:])
+	return seed
+}
+
+// split returns an independent source for a parallel render worker, seeded
+// from s so that seeded renders stay deterministic
+func (s *randSource) split() *randSource {
+	var seed [32]byte
+	s.read(seed[:])
+	return newSeededSource(seed)
+}
+
+// release returns the buffered reader to the pool
+func (s *randSource) release() {
+	if s.seeded {
+		s.r.Reset(rand.Reader)
+	}
+	randomPool.Put(s.r)
+	s.r = nil
+}
+
+// uint32 reads 4 random bytes. Neither crypto/rand nor ChaCha8 fail to fill
+// a buffer, so read errors are not expected here.
+func (s *randSource) uint32() uint32 {
+	s.read(s.buf[:])
+	return binary.LittleEndian.Uint32(s.buf[:])
+}
+
+// rgb reads 3 random bytes into the buffer of s, which unlike a local array
+// doesn't escape, for the channels of a color
+func (s *randSource) rgb() (r, g, b byte) {
+	s.read(s.buf[:3])
+	return s.buf[0], s.buf[1], s.buf[2]
+}
+
+// read fills p with random bytes
+func (s *randSource) read(p []byte) {
+	io.ReadFull(s.r, p)
+}
+
+// Read fills p with random bytes, implementing RandomSource
+func (s *randSource) Read(p []byte) (int, error) {
+	s.read(p)
+	return len(p), nil
+}
+
+// byte reads a single random byte
+func (s *randSource) byte() byte {
+	b, _ := s.r.ReadByte()
+	return b
+}
+
+// Intn returns a uniform random number in [0, n). Values above the largest
+// multiple of n are rejected so the result isn't biased towards low numbers.
+func (s *randSource) Intn(n int) int {
+	if n <= 0 {
+		return 0
+	}
+
+	if n <= 256 {
+		limit := 256 - 256%n
+		for {
+			if v := int(s.byte()); v < limit {
+				return v % n
+			}
+		}
+	}
+
+	limit := math.MaxUint32 - math.MaxUint32%uint32(n)
+	for {
+		if v := s.uint32(); v < limit {
+			return int(v % uint32(n))
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"math"
+	"testing"
+)
+
+// chiSquaredLimit returns the chi-squared value exceeded by chance with a
+// probability of about 1e-5 at df degrees of freedom, from the
+// Wilson-Hilferty approximation
+func chiSquaredLimit(df int) float64 {
+	const z = 4.265 // Standard normal quantile of 1 - 1e-5
+	k := float64(df)
+	v := 1 - 2/(9*k) + z*math.Sqrt(2/(9*k))
+	return k * v * v * v
+}
+
+func TestGeneratedCharactersUniform(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		chars string
+	}{
+		{"Numeric", charset(TypeNumeric)},
+		{"Alphanumeric", charset(TypeAlphanumeric)},
+		{"Odd", "abcdefg"}, // Not a divisor of 256, so rejection sampling matters
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			const captchas, length = 20000, 6
+			runes := distinctRunes(tt.chars)
+			counts := make(map[rune]int, len(runes))
+			for i := 0; i < captchas; i++ {
+				for _, r := range generateRandomText(length, runes) {
+					counts[r]++
+				}
+			}
+			if len(counts) != len(runes) {
+				t.Fatalf("drew %d distinct characters of %d", len(counts), len(runes))
+			}
+
+			expected := float64(captchas*length) / float64(len(runes))
+			var chi2 float64
+			for _, r := range runes {
+				d := float64(counts[r]) - expected
+				chi2 += d * d / expected
+			}
+			if limit := chiSquaredLimit(len(runes) - 1); chi2 > limit {
+				t.Errorf("chi-squared %.1f above %.1f for %d degrees of freedom", chi2, limit, len(runes)-1)
+			}
+		})
+	}
+}
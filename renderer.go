@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"errors"
+	"image"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Renderer draws the image of a captcha showing display. Renders must only
+// draw randomness from rnd, so that every fetch of a captcha returns the
+// same image.
+type Renderer interface {
+	Render(display string, cfg CaptchaConfig, rnd RandomSource) (image.Image, error)
+}
+
+// DefaultRenderer is the built-in Renderer, drawing the text over noise
+// lines and dots
+type DefaultRenderer struct{}
+
+// Render implements Renderer
+func (DefaultRenderer) Render(display string, cfg CaptchaConfig, rnd RandomSource) (image.Image, error) {
+	src, ok := rnd.(*randSource)
+	if !ok {
+		// Parallel rendering needs our own source, seed it from the given one
+		var seed [32]byte
+		rnd.Read(seed[:])
+		src = newSeededSource(seed)
+		defer src.release()
+	}
+	return drawCaptcha(display, cfg, src), nil
+}
+
+// errNoImage is returned when a Renderer returns neither an image nor an error
+var errNoImage = errors.New("captcha renderer returned no image")
+
+// generateCaptchaImage renders a captcha image with the Renderer of cfg. The
+// image only depends on its arguments, the same seed always gives the same
+// pixels. Images of another size than the config are scaled to it.
+func generateCaptchaImage(text string, seed [32]byte, cfg CaptchaConfig) (image.Image, error) {
+	var renderer Renderer = DefaultRenderer{}
+	if cfg.Renderer != nil {
+		renderer = cfg.Renderer
+	}
+
+	rnd := newSeededSource(seed)
+	defer rnd.release()
+
+	img, err := renderer.Render(text, cfg, rnd)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, errNoImage
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() == cfg.Width && bounds.Dy() == cfg.Height {
+		return img, nil
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
+	xdraw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), img, bounds, xdraw.Src, nil)
+	return scaled, nil
+}
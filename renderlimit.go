@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// renderLimiter bounds the images rendered at once. Only renders go through
+// it, so verifications, which never render, are never queued behind them.
+type renderLimiter struct {
+	mu    sync.Mutex
+	slots chan struct{} // nil when unlimited
+}
+
+// setLimit bounds the renders to n at once, 0 is unlimited. Renders holding
+// a slot of the previous limit keep it until they are done.
+func (l *renderLimiter) setLimit(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if n <= 0 {
+		l.slots = nil
+		return
+	}
+	if l.slots == nil || cap(l.slots) != n {
+		l.slots = make(chan struct{}, n)
+	}
+}
+
+// acquire waits for a render slot and returns the function releasing it.
+// It returns the context error when ctx is done first.
+func (l *renderLimiter) acquire(ctx context.Context, cfg CaptchaConfig) (func(), error) {
+	l.mu.Lock()
+	slots := l.slots
+	l.mu.Unlock()
+
+	if slots == nil {
+		return func() {}, nil
+	}
+
+	start := time.Now()
+	select {
+	case slots <- struct{}{}:
+		emitTiming(cfg.Metrics, MetricRenderWait, start)
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		emitCount(cfg.Metrics, MetricCanceled)
+		return nil, ctx.Err()
+	}
+}
+
+// limitRenders applies the MaxConcurrentRenders of cfg to the shared limiter
+func limitRenders(cfg CaptchaConfig) {
+	if cfg.MaxConcurrentRenders > 0 {
+		cfg.state().renders.setLimit(cfg.MaxConcurrentRenders)
+	}
+}
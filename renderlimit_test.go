@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// maxVerifyP99 is the verification p99 allowed while generation is flooded,
+// renders taking milliseconds each
+const maxVerifyP99 = 5 * time.Millisecond
+
+func TestVerifyLatencyUnderGenerationFlood(t *testing.T) {
+	if testing.Short() {
+		t.Skip("floods generation for a while")
+	}
+	if raceEnabled {
+		t.Skip("timings are meaningless under the race detector")
+	}
+
+	cfg := testConfig()
+	cfg.MaxConcurrentRenders = max(runtime.GOMAXPROCS(0)/2, 1)
+	defer store.renders.setLimit(0)
+	h := testRouter(cfg)
+
+	const verifications = 300
+	ids := make([]string, verifications)
+	for i := range ids {
+		ids[i] = generateCookie(t, h).Value
+	}
+
+	// Many more clients than render slots keep generating meanwhile
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 16*runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/captcha", nil))
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	latencies := make([]time.Duration, len(ids))
+	for i, id := range ids {
+		start := time.Now()
+		w := verifyRequest(h, &http.Cookie{Name: DefaultIDCookie, Value: id}, "abc123")
+		latencies[i] = time.Since(start)
+		if w.Code != 200 {
+			t.Fatalf("verification: %d %s", w.Code, w.Body)
+		}
+	}
+	slices.Sort(latencies)
+	p50, p99 := latencies[len(latencies)/2], latencies[len(latencies)*99/100]
+	t.Logf("verification p50 %v, p99 %v", p50, p99)
+	if p99 > maxVerifyP99 {
+		t.Errorf("verification p99 %v during a generation flood, want under %v", p99, maxVerifyP99)
+	}
+}
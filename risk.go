@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Context keys set by the risk scoring hook
+const (
+	ContextKeyRiskScore = "captcha_risk_score" // float64 score returned by RiskFunc
+	ContextKeyBypassed  = "captcha_bypassed"   // true when verification was skipped
+)
+
+// RiskFunc scores how risky a request is, typically between 0 and 1
+type RiskFunc func(c *gin.Context) float64
+
+// Difficulty selects one of the built-in captcha presets
+type Difficulty int
+
+const (
+	DifficultyEasy   Difficulty = iota // Short numeric text with light noise
+	DifficultyMedium                   // Default length and noise
+	DifficultyHard                     // Long alphanumeric text with heavy noise
+)
+
+// Apply returns cfg adjusted to the difficulty preset
+func (d Difficulty) Apply(cfg CaptchaConfig) CaptchaConfig {
+	switch d {
+	case DifficultyEasy:
+		cfg.Length = 4
+		cfg.Type = TypeNumeric
+		cfg.NoiseLevel = 20
+	case DifficultyMedium:
+		cfg.Length = 6
+		cfg.Type = TypeAlphanumeric
+		cfg.NoiseLevel = 50
+	case DifficultyHard:
+		cfg.Length = 8
+		cfg.Type = TypeAlphanumeric
+		cfg.NoiseLevel = 80
+	}
+	cfg.difficulty = d.String()
+	return cfg
+}
+
+// String returns the name of the difficulty preset
+func (d Difficulty) String() string {
+	switch d {
+	case DifficultyEasy:
+		return "easy"
+	case DifficultyMedium:
+		return "medium"
+	case DifficultyHard:
+		return "hard"
+	}
+	return fmt.Sprintf("Difficulty(%d)", int(d))
+}
+
+// ErrCodeDifficultyTooLow is returned when a route requires a harder captcha
+// than the one submitted
+const ErrCodeDifficultyTooLow = "captcha_difficulty_too_low"
+
+// parseDifficulty returns the preset named name
+func parseDifficulty(name string) (Difficulty, bool) {
+	for _, d := range []Difficulty{DifficultyEasy, DifficultyMedium, DifficultyHard} {
+		if d.String() == name {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// RequireDifficulty returns cfg for a verifier refusing captchas issued
+// below the difficulty preset d, e.g. for a password reset route:
+//
+//	r.POST("/password-reset", VerifyCaptchaWithConfig(cfg.RequireDifficulty(DifficultyHard)), handler)
+//
+// The preset of a captcha is the one applied by Difficulty.Apply when it was
+// generated, through RiskDifficulty or on the generation config. Captchas
+// generated without one are refused too.
+func (cfg CaptchaConfig) RequireDifficulty(d Difficulty) CaptchaConfig {
+	cfg.minDifficulty = &d
+	return cfg
+}
+
+// meetsDifficulty reports whether the captcha was issued at the difficulty
+// required by cfg, if any
+func (d captchaData) meetsDifficulty(cfg CaptchaConfig) bool {
+	if cfg.minDifficulty == nil {
+		return true
+	}
+	issued, ok := parseDifficulty(d.difficulty)
+	return ok && issued >= *cfg.minDifficulty
+}
+
+// AlwaysRequire is the default RiskFunc, it never lets a request bypass the captcha
+func AlwaysRequire(c *gin.Context) float64 {
+	return 1
+}
+
+// DifficultyForRisk maps a score between 0 and 1 to a difficulty preset
+func DifficultyForRisk(score float64) Difficulty {
+	switch {
+	case score < 0.3:
+		return DifficultyEasy
+	case score < 0.7:
+		return DifficultyMedium
+	default:
+		return DifficultyHard
+	}
+}
+
+// RequestRateRisk returns a RiskFunc scoring clients by the number of requests
+// their IP made within window. Reaching limit requests scores 1.
+func RequestRateRisk(window time.Duration, limit int) RiskFunc {
+	return func(c *gin.Context) float64 {
+		count := store.incr("rate:"+c.ClientIP(), window)
+		return math.Min(float64(count)/float64(limit), 1)
+	}
+}
@@ -0,0 +1,192 @@
+package middleware
+
+import (
+	"errors"
+	"path"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NewCaptcha is a handler creating a captcha without rendering it. It responds
+// with the captcha ID and the URL of its image, served by CaptchaImage on the
+// ":id/image" route next to the request path (e.g. "/captcha/new" links to
+// "/captcha/:id/image"). When a sample pack is registered, the response also
+// links to the audio served by CaptchaAudio on the ":id/audio" route.
+func NewCaptcha(config ...CaptchaConfig) gin.HandlerFunc {
+	cfg := DefaultCaptchaConfig()
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+
+	warnWeakConfig(cfg)
+	mustValidNames(cfg)
+	mustValidIDLength(cfg)
+	mustValidText(cfg)
+	if cfg.Stateless {
+		panic(errors.New("captcha: NewCaptcha doesn't support Stateless, its captchas are rendered later"))
+	}
+	limitMemoryStore(cfg)
+
+	cfg.state().startCleanup(cfg.CleanupInterval)
+
+	return func(c *gin.Context) {
+		cfg, step, rej := prepareGeneration(c, cfg)
+		if rej != nil {
+			rej.abort(c)
+			return
+		}
+
+		metadata, rej := captchaMetadata(c, cfg)
+		if rej != nil {
+			rej.abort(c)
+			return
+		}
+
+		if clientGone(c, cfg) {
+			return
+		}
+
+		captchaID, data, err := newCaptcha(cfg, step, metadata)
+		if err != nil {
+			logError(c, cfg, "", err)
+			c.JSON(500, gin.H{"error": "Failed to generate captcha"})
+			return
+		}
+		if err := cfg.state().storeCaptcha(cfg, captchaID, data); err != nil {
+			logError(c, cfg, captchaID, err)
+			c.JSON(500, gin.H{"error": "Failed to generate captcha"})
+			return
+		}
+		cfg.state().stats.generated.Add(1)
+		emitCount(cfg.Metrics, MetricGenerated, variantTags(data.variant)...)
+		logEvent(c, cfg, Event{
+			Type:      EventGenerated,
+			CaptchaID: captchaID,
+			Step:      step,
+			Trace:     data.trace,
+			Variant:   data.variant,
+		})
+		cfg.state().reportFunnel(FunnelShown, captchaID, data)
+		clientID := setCaptchaID(c, cfg, captchaID, data)
+		setTrace(c, data)
+		setTelemetryKey(c, cfg, captchaID)
+
+		// Routes of the captcha sit next to this one, under the prefix
+		base := basePath(c, cfg)
+		dir := path.Dir(c.Request.URL.Path)
+		response := gin.H{
+			"captcha_id": clientID,
+			"image_url":  underBase(base, path.Join(dir, clientID, "image")),
+			"expires_in": data.expiresIn(),
+			"input_mode": data.inputMode(),
+		}
+		if audioAvailable() {
+			response["audio_url"] = underBase(base, path.Join(dir, clientID, "audio"))
+		}
+		if question := questionText(cfg, data); question != "" {
+			response["question"] = question
+		}
+		c.JSON(200, response)
+	}
+}
+
+// CaptchaImage is a handler serving the image of an existing captcha, whose ID
+// is read from the "id" route parameter. Fetching the image neither resets nor
+// consumes the captcha, and every fetch returns the same pixels so renders
+// can't be averaged to cancel the noise out.
+func CaptchaImage(config ...CaptchaConfig) gin.HandlerFunc {
+	cfg := DefaultCaptchaConfig()
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+
+	mustLoadFont(cfg)
+	mustValidStyle(cfg)
+	mustFitBudget(cfg, FormatPNG)
+	limitRenders(cfg)
+
+	if cfg.ImageCacheBytes > 0 {
+		cfg.state().images.setLimit(cfg.ImageCacheBytes)
+	}
+
+	return func(c *gin.Context) {
+		captchaID, data, ok := lookupCaptcha(c, cfg, c.Param("id"))
+		if !ok {
+			return
+		}
+		cfg.state().reportFunnel(FunnelFetched, captchaID, data)
+
+		if cfg.ImageCacheBytes > 0 {
+			if cached, ok := cfg.state().images.get(captchaID); ok {
+				writeBody(c, "image/png", cached)
+				return
+			}
+		}
+
+		if clientGone(c, cfg) {
+			return
+		}
+
+		// Lay out the stored text, whatever difficulty or variant it was issued at
+		cfg := cfg.withVariant(data.variant)
+		cfg.Length = utf8.RuneCountInString(data.value)
+
+		// Generate image, the streamed encoding below doesn't hold the slot
+		release, err := cfg.state().renders.acquire(c.Request.Context(), cfg)
+		if err != nil {
+			c.Abort()
+			return
+		}
+		img, err := generateCaptchaImage(data.value, data.seed, cfg)
+		release()
+		if err != nil {
+			logError(c, cfg, captchaID, err)
+			c.JSON(500, gin.H{"error": "Failed to generate captcha"})
+			return
+		}
+
+		if cfg.ImageCacheBytes <= 0 {
+			// Encode to PNG and return image
+			if err := writePNG(c, img); err != nil {
+				logError(c, cfg, captchaID, err)
+				c.JSON(500, gin.H{"error": "Failed to generate captcha"})
+			}
+			return
+		}
+
+		// Encode to PNG, keep it for the next fetches and return image
+		encoded, err := encodePNG(img)
+		if err != nil {
+			logError(c, cfg, captchaID, err)
+			c.JSON(500, gin.H{"error": "Failed to generate captcha"})
+			return
+		}
+		cfg.state().cacheImage(cfg, captchaID, encoded)
+		writeBody(c, "image/png", encoded)
+	}
+}
+
+// lookupCaptcha returns the outstanding captcha for an ID received from the
+// client, without consuming it. It responds with an error when there is none.
+func lookupCaptcha(c *gin.Context, cfg CaptchaConfig, clientID string) (string, captchaData, bool) {
+	captchaID, ok := unsignID(cfg, clientID)
+	if !ok {
+		c.JSON(400, gin.H{"error": "Invalid captcha ID", "code": ErrCodeIDTampered})
+		return "", captchaData{}, false
+	}
+
+	data, exists, err := cfg.state().loadCaptcha(cfg, captchaID)
+	if err != nil {
+		logError(c, cfg, captchaID, err)
+		c.JSON(500, gin.H{"error": "Failed to load captcha"})
+		return "", captchaData{}, false
+	}
+	if !exists || data.expired(time.Now()) {
+		c.JSON(404, gin.H{"error": "Invalid or expired captcha"})
+		return "", captchaData{}, false
+	}
+
+	return captchaID, data, true
+}
@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// NoiseShape is a kind of noise primitive, NoiseShapes combining them
+type NoiseShape uint
+
+const (
+	ShapeLines    NoiseShape = 1 << iota // Lines of NoiseStyle
+	ShapeDots                            // Single pixels
+	ShapeCircles                         // Hollow circles
+	ShapeEllipses                        // Filled translucent ellipses
+	ShapeArcs                            // Arcs of circles
+)
+
+// DefaultNoiseShapes are the shapes drawn when NoiseShapes is 0
+const DefaultNoiseShapes = ShapeLines | ShapeDots
+
+// allNoiseShapes has the bits of every noise shape set
+const allNoiseShapes = ShapeLines | ShapeDots | ShapeCircles | ShapeEllipses | ShapeArcs
+
+// ellipseAlpha is the alpha filled ellipses are blended with, light enough
+// for the text to stay readable over them
+const ellipseAlpha = 96
+
+// noiseShapes returns the shapes of cfg
+func (cfg CaptchaConfig) noiseShapes() NoiseShape {
+	if cfg.NoiseShapes == 0 {
+		return DefaultNoiseShapes
+	}
+	return cfg.NoiseShapes
+}
+
+// hasNoise reports whether cfg draws the noise shape
+func (cfg CaptchaConfig) hasNoise(shape NoiseShape) bool {
+	return cfg.noiseShapes()&shape != 0
+}
+
+// addNoiseShapes adds the circles, ellipses and arcs of NoiseShapes, as
+// many of each as noise lines, at random positions and sizes
+func addNoiseShapes(img *image.RGBA, cfg CaptchaConfig, rnd *randSource) {
+	n := cfg.NoiseLevel / 10
+	pen := brush(cfg.noiseWidth())
+	minRadius := max(cfg.Height/8, 2)
+
+	if cfg.hasNoise(ShapeCircles) {
+		for i := 0; i < n; i++ {
+			cx, cy := rnd.Intn(cfg.Width), rnd.Intn(cfg.Height)
+			r := minRadius + rnd.Intn(max(cfg.Height/2-minRadius, 1))
+			c := cfg.noiseColor(rnd, 200)
+			walkCircle(r, func(x, y int) {
+				stamp(img, cx+x, cy+y, pen, c)
+			})
+		}
+	}
+
+	if cfg.hasNoise(ShapeEllipses) {
+		for i := 0; i < n; i++ {
+			cx, cy := rnd.Intn(cfg.Width), rnd.Intn(cfg.Height)
+			rx := minRadius + rnd.Intn(max(cfg.Width/4-minRadius, 1))
+			ry := minRadius + rnd.Intn(max(cfg.Height/3-minRadius, 1))
+			c := fade(cfg.noiseColor(rnd, 255), ellipseAlpha)
+			fillEllipse(img, cx, cy, rx, ry, c)
+		}
+	}
+
+	if cfg.hasNoise(ShapeArcs) {
+		for i := 0; i < n; i++ {
+			cx, cy := rnd.Intn(cfg.Width), rnd.Intn(cfg.Height)
+			r := minRadius + rnd.Intn(max(cfg.Height-minRadius, 1))
+			// A quarter to three quarters of the circle
+			start := float64(rnd.Intn(360)) * math.Pi / 180
+			sweep := float64(90+rnd.Intn(181)) * math.Pi / 180
+			c := cfg.noiseColor(rnd, 200)
+			walkCircle(r, func(x, y int) {
+				if inArc(math.Atan2(float64(y), float64(x)), start, sweep) {
+					stamp(img, cx+x, cy+y, pen, c)
+				}
+			})
+		}
+	}
+}
+
+// stamp draws the brush at (x, y), clipped to the image
+func stamp(img *image.RGBA, x, y int, brush []image.Point, c color.RGBA) {
+	for _, p := range brush {
+		setPixel(img, x+p.X, y+p.Y, c)
+	}
+}
+
+// fade returns the premultiplied color c with its alpha scaled to a
+func fade(c color.RGBA, a uint8) color.RGBA {
+	scale := func(v uint8) uint8 { return uint8(uint32(v) * uint32(a) / 255) }
+	return color.RGBA{scale(c.R), scale(c.G), scale(c.B), scale(c.A)}
+}
+
+// inArc reports whether the angle, in radians, is within sweep of start
+func inArc(angle, start, sweep float64) bool {
+	return math.Mod(angle-start+4*math.Pi, 2*math.Pi) <= sweep
+}
+
+// walkCircle calls fn for every point of the circle of radius r around the
+// origin, found with the midpoint circle algorithm: one octant is walked
+// and mirrored into the seven others
+func walkCircle(r int, fn func(x, y int)) {
+	x, y := r, 0
+	err := 1 - r
+	for x >= y {
+		fn(x, y)
+		fn(y, x)
+		fn(-y, x)
+		fn(-x, y)
+		fn(-x, -y)
+		fn(-y, -x)
+		fn(y, -x)
+		fn(x, -y)
+
+		y++
+		if err < 0 {
+			err += 2*y + 1
+		} else {
+			x--
+			err += 2*(y-x) + 1
+		}
+	}
+}
+
+// fillEllipse blends the ellipse of radii rx and ry around (cx, cy) into
+// the image in the premultiplied color c. The midpoint ellipse algorithm
+// finds the half width of each row, filled as a span clipped to the image.
+func fillEllipse(img *image.RGBA, cx, cy, rx, ry int, c color.RGBA) {
+	halfWidths := make([]int, ry+1)
+	walkEllipse(rx, ry, func(x, y int) {
+		halfWidths[y] = max(halfWidths[y], x)
+	})
+
+	b := img.Rect
+	for dy := -ry; dy <= ry; dy++ {
+		y := cy + dy
+		if y < b.Min.Y || y >= b.Max.Y {
+			continue
+		}
+		w := halfWidths[abs(dy)]
+		for x := max(cx-w, b.Min.X); x <= min(cx+w, b.Max.X-1); x++ {
+			i := img.PixOffset(x, y)
+			p := img.Pix[i : i+4 : i+4]
+			for j, v := range [4]uint8{c.R, c.G, c.B, c.A} {
+				p[j] = v + uint8(uint32(p[j])*uint32(255-c.A)/255)
+			}
+		}
+	}
+}
+
+// walkEllipse calls fn for the points of the quarter of the ellipse of
+// radii rx and ry around the origin with x and y positive, with the
+// midpoint ellipse algorithm: its flat region stepping x, then its steep
+// region stepping y
+func walkEllipse(rx, ry int, fn func(x, y int)) {
+	rx2, ry2 := rx*rx, ry*ry
+	x, y := 0, ry
+	px, py := 0, 2*rx2*y
+
+	// Region 1, stepping x
+	p := ry2 - rx2*ry + rx2/4
+	for px < py {
+		fn(x, y)
+		x++
+		px += 2 * ry2
+		if p < 0 {
+			p += ry2 + px
+		} else {
+			y--
+			py -= 2 * rx2
+			p += ry2 + px - py
+		}
+	}
+
+	// Region 2, stepping y
+	p = ry2*(2*x+1)*(2*x+1)/4 + rx2*(y-1)*(y-1) - rx2*ry2
+	for y >= 0 {
+		fn(x, y)
+		y--
+		py -= 2 * rx2
+		if p > 0 {
+			p += rx2 - py
+		} else {
+			x++
+			px += 2 * ry2
+			p += rx2 - py + px
+		}
+	}
+}
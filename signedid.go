@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrCodeIDTampered is returned when a signed captcha ID fails verification
+const ErrCodeIDTampered = "captcha_id_tampered"
+
+// HeaderExpiresIn carries the seconds a new captcha is valid for
+const HeaderExpiresIn = "X-Captcha-Expires-In"
+
+// signID returns the value handed to clients for id, signed when IDKeys is set
+func signID(cfg CaptchaConfig, id string) string {
+	if cfg.IDKeys == nil {
+		return id
+	}
+	return id + "." + base64.RawURLEncoding.EncodeToString(cfg.IDKeys.Sign([]byte(id)))
+}
+
+// unsignID returns the captcha ID of a value received from a client. Signed
+// values are accepted when any key of the ring verifies them.
+func unsignID(cfg CaptchaConfig, value string) (string, bool) {
+	if cfg.IDKeys == nil {
+		return value, true
+	}
+
+	id, encoded, ok := strings.Cut(value, ".")
+	if !ok {
+		return "", false
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || !cfg.IDKeys.Verify([]byte(id), signature) {
+		return "", false
+	}
+	return id, true
+}
+
+// setCaptchaID hands the captcha ID to the client in the response header and
+// cookie, and returns the value sent. Both expire with the stored entry.
+func setCaptchaID(c *gin.Context, cfg CaptchaConfig, id string, data captchaData) string {
+	value := signID(cfg, id)
+	expiresIn := data.expiresIn()
+	names := cfg.idNames()
+	c.Header(names.header, value)
+	c.Header(HeaderExpiresIn, strconv.Itoa(expiresIn))
+	c.SetCookie(names.cookie, value, expiresIn, cookiePath(c, cfg), "", false, true)
+	return value
+}
+
+// unsetCaptchaID takes back the captcha ID handed with setCaptchaID while
+// the response headers aren't sent yet, so that a client whose captcha
+// failed to be sent isn't left with the ID of a removed entry
+func unsetCaptchaID(c *gin.Context, cfg CaptchaConfig) {
+	if c.Writer.Written() {
+		return
+	}
+	names := cfg.idNames()
+	header := c.Writer.Header()
+	header.Del(names.header)
+	header.Del(HeaderExpiresIn)
+
+	cookies := header.Values("Set-Cookie")
+	header.Del("Set-Cookie")
+	for _, cookie := range cookies {
+		if !strings.HasPrefix(cookie, names.cookie+"=") {
+			header.Add("Set-Cookie", cookie)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package middleware
+
+import "time"
+
+// DefaultClockSkew is the expiry tolerance used when ClockSkew is 0
+const DefaultClockSkew = 2 * time.Second
+
+// clockSkew returns the expiry tolerance of cfg
+func (cfg CaptchaConfig) clockSkew() time.Duration {
+	switch {
+	case cfg.ClockSkew < 0:
+		return 0
+	case cfg.ClockSkew == 0:
+		return DefaultClockSkew
+	}
+	return cfg.ClockSkew
+}
+
+// expiresAt returns when the captcha expires, as told to clients
+func (d captchaData) expiresAt() time.Time {
+	return d.issuedAt.Add(d.ttl)
+}
+
+// expired reports whether the captcha is expired at now. Captchas are kept
+// for the clock skew tolerance they were issued with past their lifetime, so
+// a replica whose clock runs ahead of the issuing one doesn't reject them
+// right at the boundary.
+func (d captchaData) expired(now time.Time) bool {
+	return now.Sub(d.issuedAt) > d.ttl+d.grace
+}
@@ -0,0 +1,194 @@
+package middleware
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Source is a part of the verification request the captcha ID or answer is
+// read from
+type Source string
+
+// Default names of the captcha ID and answer in requests and responses,
+// used when the config leaves them empty
+const (
+	DefaultIDField     = "captcha_id"   // Form field and query parameter carrying the captcha ID
+	DefaultIDCookie    = "captcha_id"   // Cookie carrying the captcha ID
+	DefaultIDHeader    = "X-Captcha-ID" // Header carrying the captcha ID
+	DefaultAnswerField = "captcha"      // Form field and query parameter carrying the answer
+)
+
+// Sources of the captcha ID and answer. IDs can be read from any of them,
+// answers from the form and the query only.
+const (
+	SourceForm   Source = "form"
+	SourceQuery  Source = "query"
+	SourceCookie Source = "cookie"
+	SourceHeader Source = "header"
+)
+
+// ErrCodeSourceConflict is returned in StrictSources mode when two sources
+// carry different values
+const ErrCodeSourceConflict = "captcha_source_conflict"
+
+// Default orders of precedence, the first source carrying a value wins
+var (
+	DefaultIDSources     = []Source{SourceForm, SourceCookie, SourceHeader}
+	DefaultAnswerSources = []Source{SourceForm, SourceQuery}
+)
+
+// sourceNames are the names a value is read under in each source
+type sourceNames struct {
+	field  string // Form field and query parameter
+	cookie string // Cookie, empty when the value can't come from one
+	header string // Header, empty when the value can't come from one
+}
+
+// ErrInvalidName is returned by CheckNames for configured names that aren't
+// RFC 7230 tokens
+var ErrInvalidName = errors.New("invalid captcha name")
+
+// CheckNames returns an error when a name of cfg isn't an RFC 7230 token:
+// letters, digits and !#$%&'*+-.^_`|~ only. Names are written into response
+// headers and cookies, so a name carrying CR, LF or another separator, e.g.
+// from tenant settings, could otherwise inject headers. BasePath, written
+// into cookie paths and URLs, must be a plain path of the characters
+// X-Forwarded-Prefix accepts.
+func CheckNames(cfg CaptchaConfig) error {
+	names := []struct{ option, value string }{
+		{"IDField", cfg.IDField},
+		{"IDCookie", cfg.IDCookie},
+		{"IDHeader", cfg.IDHeader},
+		{"AnswerField", cfg.AnswerField},
+		{"TrustedCookie", cfg.TrustedCookie},
+	}
+	for _, name := range names {
+		// Empty names fall back to the defaults
+		if name.value != "" && !isToken(name.value) {
+			return fmt.Errorf("%w: %s %q", ErrInvalidName, name.option, name.value)
+		}
+	}
+	if base := cleanBasePath(cfg.BasePath); base != "" && !validPrefix(base) {
+		return fmt.Errorf("%w: BasePath %q", ErrInvalidName, cfg.BasePath)
+	}
+	return nil
+}
+
+// mustValidNames panics when a name of cfg is invalid, so a bad name is
+// caught when the routes are set up rather than written into a response
+func mustValidNames(cfg CaptchaConfig) {
+	if err := CheckNames(cfg); err != nil {
+		panic(err)
+	}
+}
+
+// isToken reports whether s is an RFC 7230 token
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// idNames returns the names of the captcha ID in cfg
+func (cfg CaptchaConfig) idNames() sourceNames {
+	return sourceNames{
+		field:  cmp.Or(cfg.IDField, DefaultIDField),
+		cookie: cmp.Or(cfg.IDCookie, DefaultIDCookie),
+		header: cmp.Or(cfg.IDHeader, DefaultIDHeader),
+	}
+}
+
+// answerNames returns the names of the answer in cfg
+func (cfg CaptchaConfig) answerNames() sourceNames {
+	return sourceNames{field: cmp.Or(cfg.AnswerField, DefaultAnswerField)}
+}
+
+// idSources returns the sources of the captcha ID in cfg
+func (cfg CaptchaConfig) idSources() []Source {
+	if len(cfg.IDSources) == 0 {
+		return DefaultIDSources
+	}
+	return cfg.IDSources
+}
+
+// answerSources returns the sources of the answer in cfg
+func (cfg CaptchaConfig) answerSources() []Source {
+	if len(cfg.AnswerSources) == 0 {
+		return DefaultAnswerSources
+	}
+	return cfg.AnswerSources
+}
+
+// read returns the value of source, "" when it carries none
+func (n sourceNames) read(c *gin.Context, source Source) string {
+	switch source {
+	case SourceForm:
+		return c.PostForm(n.field)
+	case SourceQuery:
+		return c.Query(n.field)
+	case SourceCookie:
+		if n.cookie != "" {
+			value, _ := c.Cookie(n.cookie)
+			return value
+		}
+	case SourceHeader:
+		if n.header != "" {
+			return c.GetHeader(n.header)
+		}
+	}
+	return ""
+}
+
+// readSources returns the value of the first source carrying one. In strict
+// mode, it also reports false when another source carries a different value.
+func readSources(c *gin.Context, names sourceNames, sources []Source, strict bool) (string, bool) {
+	value := ""
+	for _, source := range sources {
+		v := names.read(c, source)
+		if v == "" {
+			continue
+		}
+		if value == "" {
+			value = v
+			if !strict {
+				break
+			}
+		} else if v != value {
+			return "", false
+		}
+	}
+	return value, true
+}
+
+// requestCaptcha reads the captcha ID and answer of a verification request
+// from the configured sources, or responds with an error when the sources
+// disagree in StrictSources mode
+func requestCaptcha(c *gin.Context, cfg CaptchaConfig) (id, answer string, ok bool) {
+	id, idOK := readSources(c, cfg.idNames(), cfg.idSources(), cfg.StrictSources)
+	answer, answerOK := readSources(c, cfg.answerNames(), cfg.answerSources(), cfg.StrictSources)
+	if !idOK || !answerOK {
+		field := "ID"
+		if idOK {
+			field = "value"
+		}
+		reportVerify(c, cfg, Verification{Result: ResultSourceConflict})
+		c.JSON(400, gin.H{"error": "Conflicting captcha " + field + " in the request", "code": ErrCodeSourceConflict})
+		c.Abort()
+		return "", "", false
+	}
+	return id, answer, true
+}
@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// allIDSources are the sources an ID can be read from
+var allIDSources = []Source{SourceForm, SourceQuery, SourceCookie, SourceHeader}
+
+// sourceValues are values of the captcha ID or answer by source
+type sourceValues map[Source]string
+
+// sourcesRequest posts to /verify the ID and answer values in their sources
+func sourcesRequest(ids, answers sourceValues) *http.Request {
+	form, query := url.Values{}, url.Values{}
+	set := func(name string, source Source, value string) {
+		switch source {
+		case SourceForm:
+			form.Set(name, value)
+		case SourceQuery:
+			query.Set(name, value)
+		}
+	}
+	for source, id := range ids {
+		set(DefaultIDField, source, id)
+	}
+	for source, answer := range answers {
+		set(DefaultAnswerField, source, answer)
+	}
+
+	req := httptest.NewRequest("POST", "/verify?"+query.Encode(), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if id, ok := ids[SourceCookie]; ok {
+		req.AddCookie(&http.Cookie{Name: DefaultIDCookie, Value: id})
+	}
+	if id, ok := ids[SourceHeader]; ok {
+		req.Header.Set(DefaultIDHeader, id)
+	}
+	return req
+}
+
+// sourcesRouter returns a testRouter reading the ID from every source and
+// the answer from the form and the query, in that order
+func sourcesRouter(strict bool) http.Handler {
+	cfg := testConfig()
+	cfg.IDSources = allIDSources
+	cfg.AnswerSources = DefaultAnswerSources
+	cfg.StrictSources = strict
+	return testRouter(cfg)
+}
+
+// verifySources generates a captcha and posts the values of ids and answers,
+// where "id" stands for its ID
+func verifySources(t *testing.T, h http.Handler, ids, answers sourceValues) *httptest.ResponseRecorder {
+	t.Helper()
+	id := generateCookie(t, h).Value
+	resolved := make(sourceValues, len(ids))
+	for source, value := range ids {
+		resolved[source] = strings.ReplaceAll(value, "id", id)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, sourcesRequest(resolved, answers))
+	return w
+}
+
+func TestSourcePairs(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		h := sourcesRouter(strict)
+		for _, idSource := range allIDSources {
+			for _, answerSource := range DefaultAnswerSources {
+				t.Run(fmt.Sprintf("%s/%s/strict=%t", idSource, answerSource, strict), func(t *testing.T) {
+					w := verifySources(t, h, sourceValues{idSource: "id"}, sourceValues{answerSource: "abc123"})
+					if w.Code != 200 {
+						t.Errorf("%d %s", w.Code, w.Body)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestSourceConflicts(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		sources []Source
+		values  func(first, second Source) (ids, answers sourceValues)
+	}{
+		{"ID", allIDSources, func(first, second Source) (sourceValues, sourceValues) {
+			return sourceValues{first: "id", second: "id-other"}, sourceValues{SourceForm: "abc123"}
+		}},
+		{"Answer", DefaultAnswerSources, func(first, second Source) (sourceValues, sourceValues) {
+			return sourceValues{SourceHeader: "id"}, sourceValues{first: "abc123", second: "wrong"}
+		}},
+	} {
+		for i, first := range tc.sources {
+			for _, second := range tc.sources[i+1:] {
+				t.Run(fmt.Sprintf("%s/%s/%s", tc.name, first, second), func(t *testing.T) {
+					// The first source in order wins, whichever carries the right value
+					ids, answers := tc.values(first, second)
+					if w := verifySources(t, sourcesRouter(false), ids, answers); w.Code != 200 {
+						t.Errorf("first source right: %d %s", w.Code, w.Body)
+					}
+					ids, answers = tc.values(second, first)
+					if w := verifySources(t, sourcesRouter(false), ids, answers); w.Code != 400 || strings.Contains(w.Body.String(), ErrCodeSourceConflict) {
+						t.Errorf("second source right: %d %s", w.Code, w.Body)
+					}
+
+					// Strict mode rejects disagreeing sources, and accepts agreeing ones
+					ids, answers = tc.values(first, second)
+					if w := verifySources(t, sourcesRouter(true), ids, answers); w.Code != 400 || !strings.Contains(w.Body.String(), ErrCodeSourceConflict) {
+						t.Errorf("strict conflict: %d %s", w.Code, w.Body)
+					}
+					agree := func(values sourceValues) sourceValues {
+						values[second] = values[first]
+						return values
+					}
+					if tc.name == "ID" {
+						ids = agree(ids)
+					} else {
+						answers = agree(answers)
+					}
+					if w := verifySources(t, sourcesRouter(true), ids, answers); w.Code != 200 {
+						t.Errorf("strict agreeing: %d %s", w.Code, w.Body)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestSourcePrecedence(t *testing.T) {
+	cfg := testConfig()
+	cfg.IDSources = []Source{SourceHeader, SourceCookie}
+	cfg.AnswerSources = []Source{SourceQuery, SourceForm}
+	h := testRouter(cfg)
+
+	ids := sourceValues{SourceHeader: "id", SourceCookie: "id-other"}
+	if w := verifySources(t, h, ids, sourceValues{SourceQuery: "abc123", SourceForm: "wrong"}); w.Code != 200 {
+		t.Errorf("configured order: %d %s", w.Code, w.Body)
+	}
+	ids = sourceValues{SourceHeader: "id", SourceForm: "id-other"}
+	if w := verifySources(t, h, ids, sourceValues{SourceForm: "abc123"}); w.Code != 200 {
+		t.Errorf("unlisted source read: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestNameInjection(t *testing.T) {
+	options := map[string]func(*CaptchaConfig, string){
+		"IDField":       func(cfg *CaptchaConfig, v string) { cfg.IDField = v },
+		"IDCookie":      func(cfg *CaptchaConfig, v string) { cfg.IDCookie = v },
+		"IDHeader":      func(cfg *CaptchaConfig, v string) { cfg.IDHeader = v },
+		"AnswerField":   func(cfg *CaptchaConfig, v string) { cfg.AnswerField = v },
+		"TrustedCookie": func(cfg *CaptchaConfig, v string) { cfg.TrustedCookie = v },
+		"BasePath":      func(cfg *CaptchaConfig, v string) { cfg.BasePath = "/" + v },
+	}
+	handlers := map[string]func(CaptchaConfig){
+		"GenerateCaptcha":         func(cfg CaptchaConfig) { GenerateCaptcha(cfg) },
+		"VerifyCaptchaWithConfig": func(cfg CaptchaConfig) { VerifyCaptchaWithConfig(cfg) },
+		"NewCaptcha":              func(cfg CaptchaConfig) { NewCaptcha(cfg) },
+		"ContractHandler":         func(cfg CaptchaConfig) { ContractHandler(ContractEndpoints{}, cfg) },
+	}
+	values := []string{
+		"x\rSet-Cookie: a=b",
+		"x\nSet-Cookie: a=b",
+		"x\r\nSet-Cookie: a=b",
+		"x y",
+		"x;Domain=evil.example",
+	}
+
+	for option, set := range options {
+		for _, value := range values {
+			cfg := testConfig()
+			set(&cfg, value)
+			if err := CheckNames(cfg); !errors.Is(err, ErrInvalidName) || !strings.Contains(err.Error(), option) {
+				t.Errorf("%s %q: CheckNames = %v, want ErrInvalidName naming the option", option, value, err)
+			}
+			for name, build := range handlers {
+				func() {
+					defer func() {
+						if err, _ := recover().(error); !errors.Is(err, ErrInvalidName) {
+							t.Errorf("%s %q: %s didn't panic with ErrInvalidName", option, value, name)
+						}
+					}()
+					build(cfg)
+				}()
+			}
+		}
+
+		// A plain name is written as is
+		cfg := testConfig()
+		set(&cfg, "X-Tenant_1")
+		if err := CheckNames(cfg); err != nil {
+			t.Errorf("%s X-Tenant_1: CheckNames = %v, want nil", option, err)
+		}
+	}
+}
+
+func TestBasePathDotSegments(t *testing.T) {
+	for _, base := range []string{"/../admin", "/api/./v2", "/api/%2e%2e"} {
+		cfg := testConfig()
+		cfg.BasePath = base
+		if err := CheckNames(cfg); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("BasePath %q: CheckNames = %v, want ErrInvalidName", base, err)
+		}
+	}
+	for _, base := range []string{"", "/", "/api/v2", "api/v2/"} {
+		cfg := testConfig()
+		cfg.BasePath = base
+		if err := CheckNames(cfg); err != nil {
+			t.Errorf("BasePath %q: CheckNames = %v, want nil", base, err)
+		}
+	}
+}
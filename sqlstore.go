@@ -0,0 +1,228 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SQLCleanupInterval is how often an SQLStore deletes its expired rows
+const SQLCleanupInterval = time.Minute
+
+// sqlTableName matches the table names NewSQLStore accepts, optionally
+// qualified by a schema
+var sqlTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// SQLStore is a Store keeping captchas in an SQL table through database/sql,
+// for deployments that already run PostgreSQL, MySQL or SQLite. The table
+// is created with the statements of SQLStoreSchema. Expired rows are never
+// returned, and are deleted by Cleanup, which Set also runs in the
+// background every SQLCleanupInterval.
+type SQLStore struct {
+	db    *sql.DB
+	table string
+
+	// NumberedPlaceholders writes the query parameters as $1, $2... as
+	// PostgreSQL requires, instead of the "?" of MySQL and SQLite
+	NumberedPlaceholders bool
+
+	lastCleanup atomic.Int64 // Unix nanoseconds
+}
+
+// NewSQLStore returns a store keeping captchas in the given table of db. It
+// panics when table isn't a plain, optionally schema-qualified, name.
+func NewSQLStore(db *sql.DB, table string) *SQLStore {
+	if !sqlTableName.MatchString(table) {
+		panic(fmt.Sprintf("captcha: invalid SQL table name %q", table))
+	}
+	s := &SQLStore{db: db, table: table}
+	s.lastCleanup.Store(time.Now().UnixNano())
+	return s
+}
+
+// SQLStoreSchema returns the statements creating the table of an SQLStore.
+// Expiries are stored as Unix nanoseconds so they compare the same way
+// whatever the database time zone.
+func SQLStoreSchema(table string) string {
+	index := strings.ReplaceAll(table, ".", "_") + "_expires_at"
+	return "CREATE TABLE " + table + " (\n" +
+		"    id         VARCHAR(64) PRIMARY KEY,\n" +
+		"    value      TEXT NOT NULL,\n" +
+		"    expires_at BIGINT NOT NULL\n" +
+		");\n" +
+		"CREATE INDEX " + index + " ON " + table + " (expires_at);\n"
+}
+
+// query returns q for the table of s, with "?" replaced by numbered
+// placeholders when the database needs them
+func (s *SQLStore) query(q string) string {
+	q = strings.ReplaceAll(q, "{table}", s.table)
+	if !s.NumberedPlaceholders {
+		return q
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Set implements Store. Captchas are set once under a random ID, so it
+// inserts without needing a dialect-specific upsert.
+func (s *SQLStore) Set(id string, value string, ttl time.Duration) error {
+	s.maybeCleanup()
+
+	expires := time.Now().Add(ttl).UnixNano()
+	_, err := s.db.Exec(s.query("INSERT INTO {table} (id, value, expires_at) VALUES (?, ?, ?)"), id, value, expires)
+	return err
+}
+
+// Get implements Store
+func (s *SQLStore) Get(id string) (string, bool, error) {
+	return s.get(context.Background(), id)
+}
+
+// get returns the value of id unless it has expired
+func (s *SQLStore) get(ctx context.Context, id string) (string, bool, error) {
+	var value string
+	err := s.db.QueryRowContext(ctx, s.query("SELECT value FROM {table} WHERE id = ? AND expires_at > ?"),
+		id, time.Now().UnixNano()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// Delete implements Store
+func (s *SQLStore) Delete(id string) error {
+	_, err := s.db.Exec(s.query("DELETE FROM {table} WHERE id = ?"), id)
+	return err
+}
+
+// Take implements Taker. It reads the row, then deletes it: of concurrent
+// takes, only the one whose delete removed the row gets the value, which
+// holds on every database without FOR UPDATE or DELETE ... RETURNING.
+func (s *SQLStore) Take(id string) (string, bool, error) {
+	return s.Invalidate(context.Background(), id)
+}
+
+// Invalidate implements Invalidator, taking the row like Take
+func (s *SQLStore) Invalidate(ctx context.Context, id string) (string, bool, error) {
+	value, ok, err := s.get(ctx, id)
+	if err != nil || !ok {
+		return "", false, err
+	}
+
+	res, err := s.db.ExecContext(ctx, s.query("DELETE FROM {table} WHERE id = ?"), id)
+	if err != nil {
+		return "", false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return "", false, err
+	}
+	if n == 0 {
+		// A concurrent take deleted it first
+		return "", false, nil
+	}
+	return value, true, nil
+}
+
+// Flush implements Flusher, deleting every row, expired ones included
+func (s *SQLStore) Flush(ctx context.Context) (int, error) {
+	res, err := s.db.ExecContext(ctx, s.query("DELETE FROM {table}"))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// sqlIncrAttempts is how many times Incr retries an increment that a
+// concurrent one got in before
+const sqlIncrAttempts = 8
+
+// Incr implements Counter without a dialect-specific upsert or cast. It
+// reads the count, then updates the row only if it still holds that count,
+// or inserts the row when there is none; of concurrent increments, those
+// whose update or insert lost the race read the count again.
+func (s *SQLStore) Incr(key string, ttl time.Duration) (int, error) {
+	var insertErr error
+	for i := 0; i < sqlIncrAttempts; i++ {
+		value, ok, err := s.Get(key)
+		if err != nil {
+			return 0, err
+		}
+
+		if !ok {
+			// Replace the expired row, if any
+			if _, err := s.db.Exec(s.query("DELETE FROM {table} WHERE id = ? AND expires_at <= ?"), key, time.Now().UnixNano()); err != nil {
+				return 0, err
+			}
+			// Failing, unless a concurrent increment inserted it first
+			if insertErr = s.Set(key, "1", ttl); insertErr == nil {
+				return 1, nil
+			}
+			continue
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("captcha: counter %q: %w", key, err)
+		}
+		res, err := s.db.Exec(s.query("UPDATE {table} SET value = ? WHERE id = ? AND value = ? AND expires_at > ?"),
+			strconv.Itoa(n+1), key, value, time.Now().UnixNano())
+		if err != nil {
+			return 0, err
+		}
+		if updated, err := res.RowsAffected(); err != nil {
+			return 0, err
+		} else if updated == 1 {
+			return n + 1, nil
+		}
+	}
+	if insertErr != nil {
+		return 0, insertErr
+	}
+	return 0, fmt.Errorf("captcha: counter %q: too many concurrent increments", key)
+}
+
+// Cleanup deletes the expired rows and returns how many there were
+func (s *SQLStore) Cleanup(ctx context.Context) (int64, error) {
+	res, err := s.db.ExecContext(ctx, s.query("DELETE FROM {table} WHERE expires_at <= ?"), time.Now().UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// maybeCleanup starts a Cleanup in the background when the last one is more
+// than SQLCleanupInterval ago. Errors are left to the next run.
+func (s *SQLStore) maybeCleanup() {
+	now := time.Now().UnixNano()
+	last := s.lastCleanup.Load()
+	if now-last < int64(SQLCleanupInterval) || !s.lastCleanup.CompareAndSwap(last, now) {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), SQLCleanupInterval)
+		defer cancel()
+		s.Cleanup(ctx)
+	}()
+}
@@ -0,0 +1,288 @@
+//go:build sqlite
+
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openSQLite returns an in-memory SQLite database, private to the test, with
+// the table of an SQLStore named captchas
+func openSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(SQLStoreSchema("captchas")); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSQLStore(t *testing.T) {
+	s := NewSQLStore(openSQLite(t), "captchas")
+
+	if err := s.Set("live", "value", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("gone", "value", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok, err := s.Get("live"); value != "value" || !ok || err != nil {
+		t.Errorf("Get(live) = %q, %t, %v", value, ok, err)
+	}
+	if _, ok, err := s.Get("gone"); ok || err != nil {
+		t.Errorf("Get(gone) = %t, %v, want the expired row hidden", ok, err)
+	}
+	if _, ok, err := s.Get("unknown"); ok || err != nil {
+		t.Errorf("Get(unknown) = %t, %v", ok, err)
+	}
+
+	if n, err := s.Cleanup(context.Background()); n != 1 || err != nil {
+		t.Errorf("Cleanup = %d, %v, want the expired row deleted", n, err)
+	}
+
+	if value, ok, err := s.Take("live"); value != "value" || !ok || err != nil {
+		t.Errorf("Take(live) = %q, %t, %v", value, ok, err)
+	}
+	if _, ok, err := s.Take("live"); ok || err != nil {
+		t.Errorf("second Take(live) = %t, %v", ok, err)
+	}
+
+	if err := s.Set("deleted", "value", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := s.Get("deleted"); ok {
+		t.Error("deleted row returned")
+	}
+}
+
+func TestSQLStoreConcurrentTake(t *testing.T) {
+	s := NewSQLStore(openSQLite(t), "captchas")
+
+	const rows, takers = 50, 8
+	for i := 0; i < rows; i++ {
+		if err := s.Set(fmt.Sprint("id", i), "value", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < rows; i++ {
+		id := fmt.Sprint("id", i)
+		var wins atomic.Int32
+		var wg sync.WaitGroup
+		for j := 0; j < takers; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, ok, err := s.Take(id)
+				if err != nil {
+					t.Error(err)
+				}
+				if ok {
+					wins.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := wins.Load(); n != 1 {
+			t.Fatalf("%s taken %d times, want once", id, n)
+		}
+	}
+}
+
+func TestSQLStoreIncr(t *testing.T) {
+	s := NewSQLStore(openSQLite(t), "captchas")
+
+	for want := 1; want <= 3; want++ {
+		if n, err := s.Incr("count", time.Minute); n != want || err != nil {
+			t.Fatalf("Incr = %d, %v, want %d", n, err, want)
+		}
+	}
+	if value, ok, _ := s.Get("count"); value != "3" || !ok {
+		t.Errorf("Get = %q, %t, want the count", value, ok)
+	}
+
+	// An expired counter starts over
+	s.Incr("expired", -time.Second)
+	if n, err := s.Incr("expired", time.Minute); n != 1 || err != nil {
+		t.Errorf("Incr of an expired counter = %d, %v, want 1", n, err)
+	}
+
+	const incrementers, perIncrementer = 8, 20
+	var wg sync.WaitGroup
+	for i := 0; i < incrementers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perIncrementer; j++ {
+				if _, err := s.Incr("parallel", time.Minute); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if value, _, _ := s.Get("parallel"); value != fmt.Sprint(incrementers*perIncrementer) {
+		t.Errorf("count %s after concurrent increments, want %d", value, incrementers*perIncrementer)
+	}
+}
+
+func TestSQLStoreSharedCooldown(t *testing.T) {
+	cfg := testConfig()
+	cfg.CooldownThreshold = 2
+	cfg.CooldownDuration = time.Minute
+	cfg.Store = NewSQLStore(openSQLite(t), "captchas")
+	first, second := New(cfg), New(cfg)
+	defer first.Close()
+	defer second.Close()
+
+	for _, c := range []*Captcha{first, second} {
+		id, _, _ := c.Generate()
+		if ok, err := c.VerifyClient("user-1", id, "wrong"); ok || err != nil {
+			t.Fatalf("failure: %t, %v", ok, err)
+		}
+	}
+	id, _, _ := first.Generate()
+	if _, err := first.VerifyClient("user-1", id, "abc123"); !errors.Is(err, ErrCooldown) {
+		t.Errorf("VerifyClient after failures on both replicas: %v, want ErrCooldown", err)
+	}
+}
+
+func TestSQLStoreSharedQuota(t *testing.T) {
+	const key = "sql-quota-test"
+	cfg := testConfig()
+	cfg.QuotaKeyFunc = func(*gin.Context) string { return key }
+	cfg.QuotaLimit = 2
+	cfg.Store = NewSQLStore(openSQLite(t), "captchas")
+	replica := func() *gin.Engine {
+		cfg := cfg
+		cfg.captchas = newCaptchaStore()
+		return testRouter(cfg)
+	}
+	first, second := replica(), replica()
+
+	generateStatus(first)
+	generateStatus(second)
+	if code := generateStatus(first); code != 429 {
+		t.Errorf("generation over the quota: %d, want 429", code)
+	}
+	if used, err := store.QuotaUsage(key, cfg); used != 3 || err != nil {
+		t.Errorf("QuotaUsage = %d, %v, want 3", used, err)
+	}
+	if err := store.ResetQuota(key, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if code := generateStatus(second); code != 200 {
+		t.Errorf("generation after ResetQuota: %d", code)
+	}
+}
+
+func TestSQLStoreAdminHandlers(t *testing.T) {
+	db := openSQLite(t)
+	cfg := testConfig()
+	cfg.Store = NewSQLStore(db, "captchas")
+	r := adminRouter(cfg)
+
+	rows := func() int {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM captchas").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	cookie := generateCookie(t, r)
+	if code := adminRequest(r, "/"+cookie.Value+"/invalidate"); code != 200 {
+		t.Fatalf("invalidate: %d", code)
+	}
+	if n := rows(); n != 0 {
+		t.Errorf("%d rows after invalidating the only captcha", n)
+	}
+	if w := verifyRequest(r, cookie, "abc123"); w.Code == 200 {
+		t.Error("an invalidated captcha verified")
+	}
+
+	var events []AuditEvent
+	store.SetAuditFunc(func(ev AuditEvent) { events = append(events, ev) })
+	defer store.SetAuditFunc(nil)
+
+	generateCookie(t, r)
+	cookie = generateCookie(t, r)
+	if code := adminRequest(r, "/flush"); code != 200 {
+		t.Fatalf("flush: %d", code)
+	}
+	if n := rows(); n != 0 {
+		t.Errorf("%d rows after a flush", n)
+	}
+	if len(events) != 1 || events[0].Action != AuditFlush || events[0].Count != 2 {
+		t.Errorf("audit events %+v, want a flush of 2 captchas", events)
+	}
+	if w := verifyRequest(r, cookie, "abc123"); w.Code == 200 {
+		t.Error("a flushed captcha verified")
+	}
+}
+
+func TestSQLStoreOneTimeUse(t *testing.T) {
+	cfg := testConfig()
+	cfg.Store = NewSQLStore(openSQLite(t), "captchas")
+	h := testRouter(cfg)
+
+	// Concurrent verifications of one captcha, only one passes
+	const attempts = 8
+	for round := 0; round < 10; round++ {
+		cookie := generateCookie(t, h)
+		var passed atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < attempts; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if w := verifyRequest(h, cookie, "abc123"); w.Code == 200 {
+					passed.Add(1)
+				} else if w.Code != 400 {
+					t.Errorf("verification: %d %s", w.Code, w.Body)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := passed.Load(); n != 1 {
+			t.Fatalf("captcha passed %d times, want once", n)
+		}
+	}
+}
+
+func TestNewSQLStoreTableName(t *testing.T) {
+	for _, table := range []string{"captchas", "auth.captchas", "_c1"} {
+		NewSQLStore(nil, table)
+	}
+	for _, table := range []string{"", "1captchas", "captchas; DROP TABLE users", "a.b.c", "cap-tchas"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewSQLStore(%q) didn't panic", table)
+				}
+			}()
+			NewSQLStore(nil, table)
+		}()
+	}
+	s := &SQLStore{table: "t", NumberedPlaceholders: true}
+	if q := s.query("SELECT ? FROM {table} WHERE a = ?"); q != "SELECT $1 FROM t WHERE a = $2" {
+		t.Errorf("numbered query %q", q)
+	}
+}
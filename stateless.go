@@ -0,0 +1,168 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// statelessSeparator separates the parts of a stateless token. It is neither
+// in the base64url alphabet nor the "." of signed IDs.
+const statelessSeparator = "~"
+
+// statelessPrefix separates the stateless MACs from the other values signed
+// with the same keys
+const statelessPrefix = "captcha-stateless:"
+
+// mustSupportStateless panics when cfg enables Stateless without the keys or
+// with a feature that needs the captcha stored
+func mustSupportStateless(cfg CaptchaConfig) {
+	if !cfg.Stateless {
+		return
+	}
+	if cfg.StatelessKeys == nil {
+		panic(errors.New("captcha: Stateless requires StatelessKeys"))
+	}
+	if cfg.Steps > 1 {
+		panic(errors.New("captcha: Stateless doesn't support multi-step captchas"))
+	}
+}
+
+// normalizedAnswer returns the hash of answer as signed in stateless
+// tokens, normalized by cfg.Normalizer
+func normalizedAnswer(answer string, cfg CaptchaConfig) [32]byte {
+	return sha256.Sum256([]byte(cfg.Normalizer().Normalize(answer)))
+}
+
+// statelessHash picks the hash of h normalizedAnswer would compute from the
+// answer itself
+func statelessHash(h answerHash, cfg CaptchaConfig) [32]byte {
+	if cfg.numericLenient() && h.digits != [32]byte{} {
+		return h.digits
+	}
+	if cfg.CaseSensitive {
+		return h.exact
+	}
+	return h.folded
+}
+
+// statelessMessage returns the message signed for an answer hash, expiry and
+// nonce. Every part has a fixed length, so no two combinations collide.
+func statelessMessage(answer [32]byte, expires int64, nonce []byte) []byte {
+	msg := make([]byte, 0, len(statelessPrefix)+len(answer)+8+len(nonce))
+	msg = append(msg, statelessPrefix...)
+	msg = append(msg, answer[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, uint64(expires))
+	return append(msg, nonce...)
+}
+
+// statelessToken returns the token standing for the captcha in place of a
+// stored entry: the nonce, the expiry in Unix seconds, and the MAC of every
+// accepted answer with them. The nonce is drawn apart from the image seed,
+// which must stay secret.
+func statelessToken(cfg CaptchaConfig, data captchaData) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generate nonce: %w", err)
+	}
+	expires := data.expiresAt().Unix()
+
+	parts := []string{base64.RawURLEncoding.EncodeToString(nonce), strconv.FormatInt(expires, 10)}
+	for _, h := range data.answers {
+		mac := cfg.StatelessKeys.Sign(statelessMessage(statelessHash(h, cfg), expires, nonce))
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(mac))
+	}
+	return strings.Join(parts, statelessSeparator), nil
+}
+
+// parseStatelessToken splits a token from statelessToken into its nonce,
+// expiry and MACs
+func parseStatelessToken(token string) (nonce []byte, expires int64, macs [][]byte, ok bool) {
+	parts := strings.Split(token, statelessSeparator)
+	if len(parts) < 3 {
+		return nil, 0, nil, false
+	}
+
+	nonce, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(nonce) != 16 {
+		return nil, 0, nil, false
+	}
+	expires, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, 0, nil, false
+	}
+	for _, part := range parts[2:] {
+		mac, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil || len(mac) != sha256.Size {
+			return nil, 0, nil, false
+		}
+		macs = append(macs, mac)
+	}
+	return nonce, expires, macs, true
+}
+
+// verifyStateless verifies the answer to a stateless captcha against the
+// MACs of its token, in place of the store lookup of VerifyCaptchaWithConfig
+func verifyStateless(c *gin.Context, cfg CaptchaConfig, token, userInput string) {
+	nonce, expires, macs, ok := parseStatelessToken(token)
+	if !ok {
+		recordFailure(c, cfg)
+		rejectVerify(c, cfg, Verification{CaptchaID: token, Result: ResultNotFound}, 400,
+			gin.H{"error": "Invalid or expired captcha"})
+		return
+	}
+
+	// Tokens carry no grace, the verifying config has the tolerance
+	deadline := time.Unix(expires, 0).Add(cfg.clockSkew())
+	if time.Now().After(deadline) {
+		recordFailure(c, cfg)
+		rejectVerify(c, cfg, Verification{CaptchaID: token, Result: ResultExpired}, 400,
+			gin.H{"error": "Captcha expired"})
+		return
+	}
+
+	// Claim the nonce before comparing, so each token gets one attempt
+	nonceKey := "stateless:" + string(nonce)
+	if cfg.StatelessNonces {
+		if t, used := cfg.state().claim(nonceKey, deadline); used {
+			rejectVerify(c, cfg, Verification{CaptchaID: token, Result: ResultAlreadyUsed}, 400,
+				gin.H{"error": "Captcha already used", "code": ErrCodeAlreadyUsed, "outcome": t.outcome()})
+			return
+		}
+	}
+
+	msg := statelessMessage(normalizedAnswer(userInput, cfg), expires, nonce)
+	valid := false
+	for _, mac := range macs {
+		// Keep comparing once one matched, so timing doesn't tell which
+		valid = cfg.StatelessKeys.Verify(msg, mac) || valid
+	}
+	if cfg.StatelessNonces {
+		cfg.state().buryUntil(nonceKey, valid, deadline)
+	}
+
+	if !valid {
+		recordFailure(c, cfg)
+		rejectVerify(c, cfg, Verification{CaptchaID: token, Result: ResultInvalid}, 400,
+			gin.H{"error": "Invalid captcha"})
+		return
+	}
+
+	verification := Verification{CaptchaID: token, Result: ResultSuccess}
+	reportVerify(c, cfg, verification)
+	rememberVerification(c, cfg, verification, 200, nil)
+	recordSuccess(c, cfg)
+	if trustedEnabled(cfg) {
+		setTrustedCookie(c, cfg)
+	}
+
+	c.Next()
+}
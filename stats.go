@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Stats is a snapshot of the activity of a store since the process started
+type Stats struct {
+	Outstanding int   `json:"outstanding"`              // Captchas in the in-memory store, expired ones included until the next cleanup
+	Generated   int64 `json:"generated"`                // Captchas created
+	Successful  int64 `json:"successful_verifications"` // Captchas solved
+	Failed      int64 `json:"failed_verifications"`     // Verifications failed for any reason, expired captchas included
+	Expired     int64 `json:"expired_on_verify"`        // Verifications of captchas past their expiry
+	Evicted     int64 `json:"cleanup_evictions"`        // Expired captchas removed by the cleanup loop
+}
+
+// storeStats holds the counters of Stats. They are atomic, so counting
+// doesn't take the store locks.
+type storeStats struct {
+	generated  atomic.Int64
+	successful atomic.Int64
+	failed     atomic.Int64
+	expired    atomic.Int64
+	evicted    atomic.Int64
+}
+
+// countVerify counts a verification by its result
+func (st *storeStats) countVerify(result string) {
+	switch {
+	case result == ResultSuccess:
+		st.successful.Add(1)
+	case failed(result):
+		st.failed.Add(1)
+		if result == ResultExpired {
+			st.expired.Add(1)
+		}
+	}
+}
+
+// Stats returns the counters of the store. Captchas of configs with their
+// own Store are counted too, but not as outstanding.
+func (s *CaptchaStore) Stats() Stats {
+	return Stats{
+		Outstanding: s.captchas.Len(),
+		Generated:   s.stats.generated.Load(),
+		Successful:  s.stats.successful.Load(),
+		Failed:      s.stats.failed.Load(),
+		Expired:     s.stats.expired.Load(),
+		Evicted:     s.stats.evicted.Load(),
+	}
+}
+
+// statsResponse is the body of StatsHandler
+type statsResponse struct {
+	Stats
+	ImageCache ImageCacheStats   `json:"image_cache"`
+	Config     ConfigDescription `json:"config"`
+}
+
+// StatsHandler is an admin handler responding with the Stats of the store,
+// its ImageCacheStats and the DescribeConfig of the config as JSON, e.g.
+// mounted on "GET /internal/captcha/stats". It must be protected by
+// authentication.
+func StatsHandler(config ...CaptchaConfig) gin.HandlerFunc {
+	cfg := DefaultCaptchaConfig()
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+	description := DescribeConfig(cfg)
+
+	return func(c *gin.Context) {
+		c.JSON(200, statsResponse{
+			Stats:      cfg.state().Stats(),
+			ImageCache: cfg.state().ImageCacheStats(),
+			Config:     description,
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStatsHandler(t *testing.T) {
+	cfg := testConfig()
+	cfg.CooldownThreshold = 5
+	cfg.CooldownDuration = time.Minute
+
+	r := gin.New()
+	r.GET("/stats", StatsHandler(cfg))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/stats", nil))
+	if w.Code != 200 {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	var got struct {
+		Stats
+		ImageCache ImageCacheStats   `json:"image_cache"`
+		Config     ConfigDescription `json:"config"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Config != DescribeConfig(cfg) {
+		t.Errorf("config %+v, want %+v", got.Config, DescribeConfig(cfg))
+	}
+	if cache := store.ImageCacheStats(); got.ImageCache.Hits > cache.Hits || got.ImageCache.Misses > cache.Misses {
+		t.Errorf("image cache %+v, store has %+v", got.ImageCache, cache)
+	}
+
+	// The counters of Stats stay at the top level
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"outstanding", "generated", "successful_verifications", "failed_verifications", "expired_on_verify", "cleanup_evictions", "image_cache", "config"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("no %q in %s", key, w.Body)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Package statsd sends the captcha middleware metrics to a StatsD or
+// DogStatsD agent over UDP.
+package statsd
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPacketSize keeps packets under the usual network MTU
+const maxPacketSize = 1432
+
+// Config configures a Client
+type Config struct {
+	Address       string        // Agent address (default: "127.0.0.1:8125")
+	Prefix        string        // Prepended to every metric name, e.g. "myapp."
+	Tags          []string      // Tags added to every metric, e.g. "env:prod"
+	BufferSize    int           // Metrics queued before new ones are dropped (default: 4096)
+	FlushInterval time.Duration // How often queued metrics are sent (default: 1 second)
+}
+
+// Client implements middleware.Metrics in DogStatsD format. Metrics are
+// queued and sent asynchronously, when the queue is full they are dropped
+// rather than blocking the request.
+type Client struct {
+	conn    net.Conn
+	prefix  string
+	tags    []string
+	queue   chan string
+	flush   time.Duration
+	done    chan struct{}
+	stopped chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error // Result of the first Close
+}
+
+// New connects a client to the agent and starts its sender
+func New(cfg Config) (*Client, error) {
+	if cfg.Address == "" {
+		cfg.Address = "127.0.0.1:8125"
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 4096
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn:    conn,
+		prefix:  cfg.Prefix,
+		tags:    cfg.Tags,
+		queue:   make(chan string, cfg.BufferSize),
+		flush:   cfg.FlushInterval,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+// Count sends a counter
+func (c *Client) Count(name string, value int64, tags ...string) {
+	c.send(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+// Gauge sends a gauge
+func (c *Client) Gauge(name string, value float64, tags ...string) {
+	c.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", tags)
+}
+
+// Timing sends a timing in milliseconds
+func (c *Client) Timing(name string, d time.Duration, tags ...string) {
+	c.send(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64), "ms", tags)
+}
+
+// Close sends the queued metrics and closes the connection. Later calls
+// return the result of the first one.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		<-c.stopped
+		c.closeErr = c.conn.Close()
+	})
+	return c.closeErr
+}
+
+// send formats a metric and queues it, dropping it when the queue is full
+func (c *Client) send(name, value, kind string, tags []string) {
+	var b strings.Builder
+	b.WriteString(c.prefix)
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(kind)
+
+	if len(c.tags)+len(tags) > 0 {
+		b.WriteString("|#")
+		b.WriteString(strings.Join(append(c.tags[:len(c.tags):len(c.tags)], tags...), ","))
+	}
+
+	select {
+	case c.queue <- b.String():
+	default:
+	}
+}
+
+// run batches queued metrics into packets until the client is closed
+func (c *Client) run() {
+	defer close(c.stopped)
+
+	ticker := time.NewTicker(c.flush)
+	defer ticker.Stop()
+
+	var packet []byte
+	write := func() {
+		if len(packet) > 0 {
+			// Metrics are best effort, a lost packet is not worth reporting
+			c.conn.Write(packet)
+			packet = packet[:0]
+		}
+	}
+	add := func(line string) {
+		if len(packet)+len(line)+1 > maxPacketSize {
+			write()
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+
+	for {
+		select {
+		case line := <-c.queue:
+			add(line)
+
+		case <-ticker.C:
+			write()
+
+		case <-c.done:
+			// Send what is left in the queue
+			for {
+				select {
+				case line := <-c.queue:
+					add(line)
+				default:
+					write()
+					return
+				}
+			}
+		}
+	}
+}
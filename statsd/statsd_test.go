@@ -0,0 +1,49 @@
+package statsd
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCloseTwice(t *testing.T) {
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	c, err := New(Config{Address: agent.LocalAddr().String(), Prefix: "test."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Count("solved", 1)
+
+	// Concurrent and repeated closes neither panic nor fail
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Close(); err != nil {
+				t.Errorf("Close: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := c.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	// The queued metric was sent by the first close
+	buf := make([]byte, maxPacketSize)
+	agent.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := agent.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no packet sent on Close: %v", err)
+	}
+	if got := string(buf[:n]); got != "test.solved:1|c" {
+		t.Errorf("packet %q, want %q", got, "test.solved:1|c")
+	}
+}
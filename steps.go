@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Error codes returned in multi-step mode
+const (
+	ErrCodeStepTokenInvalid = "captcha_step_token_invalid" // Step token missing, unknown or expired
+	ErrCodeWrongStep        = "captcha_wrong_step"         // Captcha doesn't belong to this sequence
+)
+
+// HeaderStepToken carries the token continuing a multi-step sequence, also
+// accepted in the "step_token" query parameter
+const HeaderStepToken = "X-Captcha-Step-Token"
+
+// resolveStep reads the step token of the request. Requests without a token
+// start a new sequence, others continue the sequence of the token, which is
+// consumed. The returned config expires with the sequence.
+func resolveStep(c *gin.Context, cfg CaptchaConfig) (CaptchaConfig, int, *Rejection) {
+	token := c.GetHeader(HeaderStepToken)
+	if token == "" {
+		token = c.Query("step_token")
+	}
+
+	if token == "" {
+		return cfg, 1, nil
+	}
+
+	data, ok := cfg.state().take("step:" + token)
+	if !ok {
+		return cfg, 0, reject(400, gin.H{"error": "Invalid or expired step token", "code": ErrCodeStepTokenInvalid})
+	}
+
+	// The whole sequence shares the expiry of its first captcha
+	cfg.ExpireTime = time.Until(data.expireTime)
+	return cfg, data.count, nil
+}
+
+// completeStep handles a correctly solved captcha in multi-step mode. It
+// returns true when it was the last step, otherwise it responds with the
+// token needed to fetch the next captcha.
+func completeStep(c *gin.Context, cfg CaptchaConfig, captchaID string, data captchaData) bool {
+	if data.step > cfg.Steps {
+		rejectVerify(c, cfg, data.verification(captchaID, ResultWrongStep), 400,
+			gin.H{"error": "Captcha doesn't belong to this sequence", "code": ErrCodeWrongStep})
+		return false
+	}
+
+	if data.step == cfg.Steps {
+		return true
+	}
+
+	// The captcha is solved, only the sequence goes on
+	cfg.state().reportFunnel(FunnelSolved, captchaID, data)
+
+	token, err := generateID(DefaultIDLength)
+	if err != nil {
+		abortStore(c, cfg, captchaID, err)
+		return false
+	}
+	cfg.state().put("step:"+token, data.step+1, data.expiresAt())
+
+	c.JSON(200, gin.H{"step_token": token, "next_step": data.step + 1})
+	c.Abort()
+	return false
+}
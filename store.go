@@ -0,0 +1,273 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Store keeps the outstanding captchas, serialized, so that replicas behind
+// a load balancer can share them. Implementations must be safe for
+// concurrent use and must not return entries past their ttl.
+type Store interface {
+	Set(id string, value string, ttl time.Duration) error
+	Get(id string) (value string, ok bool, err error)
+	Delete(id string) error
+}
+
+// Taker is implemented by stores that can get and delete an entry in one
+// atomic step. With stores that can't, two concurrent verifications of the
+// same captcha may both read it before either deletes it.
+type Taker interface {
+	Take(id string) (value string, ok bool, err error)
+}
+
+// Counter is implemented by stores that can increment a counter in one
+// atomic step, so that the replicas sharing the store share the failure
+// counts and cooldowns of their clients too. With stores that can't, each
+// process keeps its own. Incr adds one to the counter of key and returns
+// the new count; a counter that doesn't exist or has expired starts over at
+// 1 and expires after ttl. Get returns the count in decimal, and Delete
+// removes the counter.
+type Counter interface {
+	Incr(key string, ttl time.Duration) (int, error)
+}
+
+// Flusher is implemented by stores that can remove every entry at once, so
+// that FlushHandler and CaptchaStore.Flush can empty them. Flush returns how
+// many entries it removed, counters included.
+type Flusher interface {
+	Flush(ctx context.Context) (int, error)
+}
+
+// Invalidator is implemented by stores that can remove a captcha on behalf
+// of InvalidateHandler and CaptchaStore.Invalidate. Invalidate gets and
+// deletes the entry like Taker, within ctx.
+type Invalidator interface {
+	Invalidate(ctx context.Context, id string) (value string, ok bool, err error)
+}
+
+// limitMemoryStore applies the MaxEntries of cfg to the in-memory store
+func limitMemoryStore(cfg CaptchaConfig) {
+	if cfg.MaxEntries > 0 && cfg.Store == nil {
+		cfg.state().captchas.SetMaxEntries(cfg.MaxEntries)
+	}
+}
+
+// givenConfig returns the optional config of a CaptchaStore method, or the
+// zero config, whose captchas live in the in-memory store
+func givenConfig(config []CaptchaConfig) CaptchaConfig {
+	if len(config) > 0 {
+		return config[0]
+	}
+	return CaptchaConfig{}
+}
+
+// captchaStore returns the Store of cfg
+func (cfg CaptchaConfig) captchaStore() Store {
+	return cfg.state().backend(cfg)
+}
+
+// backend returns the Store of cfg, or the in-memory store of s
+func (s *CaptchaStore) backend(cfg CaptchaConfig) Store {
+	if cfg.Store != nil {
+		return cfg.Store
+	}
+	return s.captchas
+}
+
+// captchaVersion is the version of the storedCaptcha layout written by
+// encodeCaptcha. Fields are only ever added, which older decoders ignore,
+// so it is only bumped when the meaning of a field changes. Decoders accept
+// the previous version too, so replicas sharing a store can be upgraded one
+// at a time.
+const captchaVersion = 1
+
+// storedCaptcha is the serialized form of a captchaData. Entries written
+// before versioning have version 0, whose layout is the same as version 1.
+type storedCaptcha struct {
+	Version   int               `json:"ver,omitempty"`
+	Value     string            `json:"v"`
+	Answers   [][]byte          `json:"a,omitempty"` // exact, folded and digits hashes, concatenated
+	IssuedAt  int64             `json:"i"`           // Unix nanoseconds
+	TTL       time.Duration     `json:"t"`
+	Grace     time.Duration     `json:"g,omitempty"`
+	Step      int               `json:"s"`
+	Seed      []byte            `json:"r"`
+	Metadata  map[string]string `json:"m,omitempty"`
+	Trace     string            `json:"tr,omitempty"`
+	Variant   string            `json:"x,omitempty"`
+	Level     string            `json:"d,omitempty"` // Difficulty
+	Numeric   bool              `json:"n,omitempty"`
+	MinLength int               `json:"lo,omitempty"`
+	MaxLength int               `json:"hi,omitempty"`
+	Puzzle    bool              `json:"p,omitempty"`
+}
+
+// errCorruptCaptcha is returned for stored values that can't be decoded
+var errCorruptCaptcha = errors.New("corrupt captcha in store")
+
+// errCaptchaVersion is returned for stored values of a version this
+// release can't decode, e.g. written by a replica two releases ahead
+var errCaptchaVersion = errors.New("unsupported captcha version in store")
+
+// encodeCaptcha serializes a captcha for the store
+func encodeCaptcha(d captchaData) (string, error) {
+	s := storedCaptcha{
+		Version:   captchaVersion,
+		Value:     d.value,
+		IssuedAt:  d.issuedAt.UnixNano(),
+		TTL:       d.ttl,
+		Grace:     d.grace,
+		Step:      d.step,
+		Seed:      d.seed[:],
+		Metadata:  d.metadata,
+		Trace:     d.trace,
+		Variant:   d.variant,
+		Level:     d.difficulty,
+		Numeric:   d.numeric,
+		MinLength: d.minLength,
+		MaxLength: d.maxLength,
+		Puzzle:    d.puzzle,
+	}
+	for _, h := range d.answers {
+		s.Answers = append(s.Answers, append(append(h.exact[:], h.folded[:]...), h.digits[:]...))
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// decodeCaptcha parses a captcha serialized by encodeCaptcha
+func decodeCaptcha(value string) (captchaData, error) {
+	var s storedCaptcha
+	if err := json.Unmarshal([]byte(value), &s); err != nil {
+		return captchaData{}, fmt.Errorf("%w: %v", errCorruptCaptcha, err)
+	}
+	if s.Version < captchaVersion-1 || s.Version > captchaVersion {
+		return captchaData{}, fmt.Errorf("%w: %d", errCaptchaVersion, s.Version)
+	}
+	if len(s.Seed) != 32 {
+		return captchaData{}, errCorruptCaptcha
+	}
+
+	d := captchaData{
+		value:      s.Value,
+		issuedAt:   time.Unix(0, s.IssuedAt),
+		ttl:        s.TTL,
+		grace:      s.Grace,
+		step:       s.Step,
+		metadata:   s.Metadata,
+		trace:      s.Trace,
+		variant:    s.Variant,
+		difficulty: s.Level,
+		numeric:    s.Numeric,
+		minLength:  s.MinLength,
+		maxLength:  s.MaxLength,
+		puzzle:     s.Puzzle,
+	}
+	copy(d.seed[:], s.Seed)
+	for _, b := range s.Answers {
+		if len(b) != 96 {
+			return captchaData{}, errCorruptCaptcha
+		}
+		var h answerHash
+		copy(h.exact[:], b[:32])
+		copy(h.folded[:], b[32:64])
+		copy(h.digits[:], b[64:])
+		d.answers = append(d.answers, h)
+	}
+	return d, nil
+}
+
+// expiredRetention is how long captchas are kept past their expiry, so that
+// verifications can tell expired captchas from unknown IDs
+const expiredRetention = time.Minute
+
+// storeCaptcha makes a captcha from newCaptcha verifiable
+func (s *CaptchaStore) storeCaptcha(cfg CaptchaConfig, captchaID string, data captchaData) error {
+	value, err := encodeCaptcha(data)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(data.expiresAt()) + data.grace + expiredRetention
+	if cfg.Store != nil {
+		if err := cfg.Store.Set(captchaID, value, ttl); err != nil {
+			return fmt.Errorf("store captcha: %w", err)
+		}
+		return nil
+	}
+
+	evicted := s.captchas.set(captchaID, value, ttl)
+	for _, id := range evicted {
+		s.images.remove(id)
+	}
+	if len(evicted) > 0 && cfg.Metrics != nil {
+		cfg.Metrics.Count(MetricStoreEvicted, int64(len(evicted)))
+	}
+	emitGauge(cfg.Metrics, MetricStoreEntries, float64(s.captchas.Len()))
+	return nil
+}
+
+// loadCaptcha returns the outstanding captcha with the given ID
+func (s *CaptchaStore) loadCaptcha(cfg CaptchaConfig, captchaID string) (captchaData, bool, error) {
+	value, ok, err := s.backend(cfg).Get(captchaID)
+	if err != nil {
+		return captchaData{}, false, fmt.Errorf("load captcha: %w", err)
+	}
+	if !ok {
+		return captchaData{}, false, nil
+	}
+	data, err := decodeCaptcha(value)
+	if err != nil {
+		return captchaData{}, false, err
+	}
+	return data, true, nil
+}
+
+// removeCaptcha deletes a captcha along with its cached image, logging
+// store errors since the captcha is abandoned either way
+func removeCaptcha(c *gin.Context, cfg CaptchaConfig, captchaID string) {
+	if err := cfg.captchaStore().Delete(captchaID); err != nil {
+		logError(c, cfg, captchaID, fmt.Errorf("remove captcha: %w", err))
+	}
+	cfg.state().images.remove(captchaID)
+}
+
+// abortStore responds 500 to a verification the store failed, rather than
+// telling the client its captcha is invalid
+func abortStore(c *gin.Context, cfg CaptchaConfig, captchaID string, err error) {
+	logError(c, cfg, captchaID, err)
+	c.JSON(500, gin.H{"error": "Failed to verify captcha"})
+	c.Abort()
+}
+
+// consumeCaptcha removes a verified captcha and leaves a tombstone recording
+// whether it was solved. It returns false when the captcha was already gone,
+// i.e. a concurrent request consumed it first.
+func (s *CaptchaStore) consumeCaptcha(cfg CaptchaConfig, captchaID string, solved bool) (bool, error) {
+	backend := s.backend(cfg)
+	exists := true
+	if taker, ok := backend.(Taker); ok {
+		_, taken, err := taker.Take(captchaID)
+		if err != nil {
+			return false, fmt.Errorf("consume captcha: %w", err)
+		}
+		exists = taken
+	} else if err := backend.Delete(captchaID); err != nil {
+		return false, fmt.Errorf("consume captcha: %w", err)
+	}
+
+	s.images.remove(captchaID)
+	if exists {
+		s.bury(captchaID, solved)
+	}
+	return exists, nil
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storedFixture is a captcha as serialized by version 1, answered by "0042"
+const storedFixture = `{"ver":1,"v":"AbC","a":["HiDzgxN64GxJieSXHmc6pdGwcUOGHFDeNU9cHxpzL54eIPODE3rgbEmJ5JceZzql0bBxQ4YcUN41T1wfGnMvnnNHXLQKVo6NqKBFztEQE34Vn4kKxNqIO2sX3GUbOoBJ"],"i":1700000000000000000,"t":60000000000,"g":1000000000,"s":2,"r":"AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=","m":{"form":"signup"},"tr":"tr1","x":"b","d":"hard","n":true,"lo":4,"hi":4}`
+
+// fixtureCaptcha returns the captcha of storedFixture
+func fixtureCaptcha() captchaData {
+	d := captchaData{
+		value:      "AbC",
+		answers:    hashAnswers("0042"),
+		issuedAt:   time.Unix(0, 1700000000000000000),
+		ttl:        time.Minute,
+		grace:      time.Second,
+		step:       2,
+		metadata:   map[string]string{"form": "signup"},
+		trace:      "tr1",
+		variant:    "b",
+		difficulty: "hard",
+		numeric:    true,
+		minLength:  4,
+		maxLength:  4,
+	}
+	for i := range d.seed {
+		d.seed[i] = byte(i)
+	}
+	return d
+}
+
+func TestCaptchaVersions(t *testing.T) {
+	want := fixtureCaptcha()
+	encoded, err := encodeCaptcha(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded != storedFixture {
+		t.Errorf("encoded as\n%s\nwant\n%s", encoded, storedFixture)
+	}
+
+	// Every version this release decodes, as written by the releases that
+	// wrote it: version 0 entries predate the field
+	versions := map[int]string{
+		0: strings.Replace(storedFixture, `"ver":1,`, "", 1),
+		1: storedFixture,
+	}
+	for version := captchaVersion - 1; version <= captchaVersion; version++ {
+		value, ok := versions[version]
+		if !ok {
+			t.Fatalf("no fixture for version %d", version)
+		}
+		got, err := decodeCaptcha(value)
+		if err != nil {
+			t.Errorf("version %d: %v", version, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("version %d decoded as %+v, want %+v", version, got, want)
+		}
+		if !got.accepts("42", CaptchaConfig{NumericLenient: true}) {
+			t.Errorf("version %d: answer hashes lost", version)
+		}
+
+		// And written back as the current version
+		if again, err := encodeCaptcha(got); err != nil || again != storedFixture {
+			t.Errorf("version %d re-encoded as %s, %v", version, again, err)
+		}
+	}
+
+	// Fields added by later releases are ignored
+	if _, err := decodeCaptcha(strings.Replace(storedFixture, `"ver":1,`, `"ver":1,"zz":[1,2],`, 1)); err != nil {
+		t.Errorf("unknown field: %v", err)
+	}
+}
+
+func TestDecodeCaptchaErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, value string
+		err         error
+	}{
+		{"NextVersion", strings.Replace(storedFixture, `"ver":1`, `"ver":2`, 1), errCaptchaVersion},
+		{"NegativeVersion", strings.Replace(storedFixture, `"ver":1`, `"ver":-1`, 1), errCaptchaVersion},
+		{"NotJSON", "AbC", errCorruptCaptcha},
+		{"ShortSeed", strings.Replace(storedFixture, `"r":"AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="`, `"r":"AAEC"`, 1), errCorruptCaptcha},
+		{"NoSeed", strings.Replace(storedFixture, `"r":"AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",`, "", 1), errCorruptCaptcha},
+		{"ShortAnswer", `{"ver":1,"v":"AbC","a":["AAEC"],"r":"AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="}`, errCorruptCaptcha},
+	} {
+		if _, err := decodeCaptcha(tc.value); !errors.Is(err, tc.err) {
+			t.Errorf("%s: error %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// maxRotation bounds MaxRotation, in degrees, past which characters may be
+// drawn on their side or upside down
+const maxRotation = 90
+
+// ErrInvalidStyle is wrapped by the errors of CheckStyle
+var ErrInvalidStyle = errors.New("invalid captcha style settings")
+
+// CheckStyle returns an error when the drawing settings of cfg are out of
+// range: MaxRotation must be between 0 and 90 degrees, MaxSkew between 0
+// and 1, DistortionLevel between 0 and 100 and DistortionPeriod not
+// negative, TextAlphaJitter between 0 and 128, MinTextContrast between 0
+// and 21, Supersample between 0 and 4, NoiseWidth between 0 and 10, and
+// TextStyle, NoiseStyle, NoiseShapes and Gradient known values. The palettes can't hold nil
+// colors, no color can be fully transparent, and BackgroundImages can't
+// hold nil or empty images.
+func CheckStyle(cfg CaptchaConfig) error {
+	for _, palette := range []struct {
+		name   string
+		colors []color.Color
+	}{
+		{"BackgroundPalette", cfg.BackgroundPalette},
+		{"TextPalette", cfg.TextPalette},
+		{"NoisePalette", cfg.NoisePalette},
+	} {
+		for i, c := range palette.colors {
+			if c == nil || transparent(c) {
+				return fmt.Errorf("%w: %s color %d is nil or fully transparent", ErrInvalidStyle, palette.name, i)
+			}
+		}
+	}
+	for i, img := range cfg.BackgroundImages {
+		if img == nil || img.Bounds().Empty() {
+			return fmt.Errorf("%w: BackgroundImages image %d is nil or empty", ErrInvalidStyle, i)
+		}
+	}
+	for _, optional := range []struct {
+		name string
+		c    color.Color
+	}{
+		{"TextColor", cfg.TextColor},
+		{"BackgroundColor", cfg.BackgroundColor},
+		{"GradientColors[0]", cfg.GradientColors[0]},
+		{"GradientColors[1]", cfg.GradientColors[1]},
+	} {
+		if optional.c != nil && transparent(optional.c) {
+			return fmt.Errorf("%w: %s is fully transparent", ErrInvalidStyle, optional.name)
+		}
+	}
+
+	switch {
+	case cfg.MaxRotation < 0 || cfg.MaxRotation > maxRotation || math.IsNaN(cfg.MaxRotation):
+		return fmt.Errorf("%w: MaxRotation %g must be between 0 and %d degrees", ErrInvalidStyle, cfg.MaxRotation, maxRotation)
+	case cfg.MaxSkew < 0 || cfg.MaxSkew > 1 || math.IsNaN(cfg.MaxSkew):
+		return fmt.Errorf("%w: MaxSkew %g must be between 0 and 1", ErrInvalidStyle, cfg.MaxSkew)
+	case cfg.DistortionLevel < 0 || cfg.DistortionLevel > 100:
+		return fmt.Errorf("%w: DistortionLevel %d must be between 0 and 100", ErrInvalidStyle, cfg.DistortionLevel)
+	case cfg.DistortionPeriod < 0:
+		return fmt.Errorf("%w: DistortionPeriod %d is negative", ErrInvalidStyle, cfg.DistortionPeriod)
+	case cfg.TextAlphaJitter < 0 || cfg.TextAlphaJitter > maxTextAlphaJitter:
+		return fmt.Errorf("%w: TextAlphaJitter %d must be between 0 and %d", ErrInvalidStyle, cfg.TextAlphaJitter, maxTextAlphaJitter)
+	case cfg.MinTextContrast < 0 || cfg.MinTextContrast > 21 || math.IsNaN(cfg.MinTextContrast):
+		return fmt.Errorf("%w: MinTextContrast %g must be between 0 and 21", ErrInvalidStyle, cfg.MinTextContrast)
+	case cfg.Supersample < 0 || cfg.Supersample > maxSupersample:
+		return fmt.Errorf("%w: Supersample %d must be between 0 and %d", ErrInvalidStyle, cfg.Supersample, maxSupersample)
+	case cfg.TextStyle < StyleFilled || cfg.TextStyle > StyleHollow:
+		return fmt.Errorf("%w: unknown TextStyle %d", ErrInvalidStyle, cfg.TextStyle)
+	case cfg.NoiseShapes&^allNoiseShapes != 0:
+		return fmt.Errorf("%w: unknown NoiseShapes bits %#x", ErrInvalidStyle, uint(cfg.NoiseShapes&^allNoiseShapes))
+	case cfg.NoiseStyle < NoiseLines || cfg.NoiseStyle > NoiseWaves:
+		return fmt.Errorf("%w: unknown NoiseStyle %d", ErrInvalidStyle, cfg.NoiseStyle)
+	case cfg.NoiseWidth < 0 || cfg.NoiseWidth > maxNoiseWidth:
+		return fmt.Errorf("%w: NoiseWidth %d must be between 0 and %d pixels", ErrInvalidStyle, cfg.NoiseWidth, maxNoiseWidth)
+	case cfg.Gradient < GradientNone || cfg.Gradient > GradientRadial:
+		return fmt.Errorf("%w: unknown Gradient %d", ErrInvalidStyle, cfg.Gradient)
+	}
+	return nil
+}
+
+// mustValidStyle panics when the drawing settings of cfg are out of range,
+// so a bad setting is caught when the routes are set up
+func mustValidStyle(cfg CaptchaConfig) {
+	if err := CheckStyle(cfg); err != nil {
+		panic(err)
+	}
+}
+
+// DefaultBackgroundPalette is the palette RandomBackground picks from when
+// BackgroundPalette is empty: light and dark tints, the text being drawn in
+// black or white, whichever stands out more
+var DefaultBackgroundPalette = []color.Color{
+	color.RGBA{0xf5, 0xf5, 0xdc, 0xff}, // Beige
+	color.RGBA{0xe3, 0xf2, 0xfd, 0xff}, // Light blue
+	color.RGBA{0xfc, 0xe4, 0xec, 0xff}, // Light pink
+	color.RGBA{0xe8, 0xf5, 0xe9, 0xff}, // Mint
+	color.RGBA{0xff, 0xf8, 0xe1, 0xff}, // Cream
+	color.RGBA{0xed, 0xe7, 0xf6, 0xff}, // Lavender
+	color.RGBA{0x26, 0x32, 0x38, 0xff}, // Slate
+	color.RGBA{0x1a, 0x23, 0x7e, 0xff}, // Navy
+	color.RGBA{0x3e, 0x27, 0x23, 0xff}, // Brown
+	color.RGBA{0x00, 0x4d, 0x40, 0xff}, // Teal
+}
+
+// renderColors are the colors of a render
+type renderColors struct {
+	background color.RGBA // Middle of the gradient or average of the image, if any
+	text       color.RGBA
+	gradient   gradient
+	image      *image.RGBA // Background image, scaled to the render
+}
+
+// renderColors returns the colors of a render: its background, one of
+// BackgroundImages, a Gradient or picked from the palette when
+// RandomBackground is set, and the text color standing out most from it.
+// Nothing is drawn from rnd unless one of those is set.
+func (cfg CaptchaConfig) renderColors(rnd *randSource) renderColors {
+	var background color.Color
+	switch {
+	case len(cfg.BackgroundImages) > 0:
+		img := cfg.backgroundImage(rnd, cfg.Width, cfg.Height)
+		bg := averageColor(img, img.Rect)
+		return renderColors{background: bg, text: contrastingColor(bg), image: img}
+	case cfg.Gradient != GradientNone:
+		g := cfg.gradient(rnd)
+		return renderColors{background: g.middle(), text: contrastingColor(g.from, g.to), gradient: g}
+	case cfg.RandomBackground:
+		palette := cfg.BackgroundPalette
+		if len(palette) == 0 {
+			palette = DefaultBackgroundPalette
+		}
+		background = palette[rnd.Intn(len(palette))]
+	case cfg.BackgroundColor != nil:
+		background = cfg.BackgroundColor
+	default:
+		return renderColors{background: color.RGBA{255, 255, 255, 255}, text: color.RGBA{0, 0, 0, 255}}
+	}
+
+	bg := toRGBA(background)
+	return renderColors{background: bg, text: contrastingColor(bg)}
+}
+
+// fill draws the background onto img, whose bounds start at the origin
+func (rc renderColors) fill(img *image.RGBA) {
+	if rc.image != nil {
+		copy(img.Pix, rc.image.Pix)
+		return
+	}
+	if rc.gradient.kind != GradientNone {
+		rc.gradient.draw(img)
+		return
+	}
+	draw.Draw(img, img.Bounds(), &image.Uniform{rc.background}, image.Point{}, draw.Src)
+}
+
+// contrastingColor returns black or white, whichever contrasts more with
+// the least contrasting of backgrounds
+func contrastingColor(backgrounds ...color.RGBA) color.RGBA {
+	black, white := math.Inf(1), math.Inf(1)
+	for _, bg := range backgrounds {
+		black = min(black, contrastRatio(bg, color.RGBA{0, 0, 0, 255}))
+		white = min(white, contrastRatio(bg, color.RGBA{255, 255, 255, 255}))
+	}
+	if black >= white {
+		return color.RGBA{0, 0, 0, 255}
+	}
+	return color.RGBA{255, 255, 255, 255}
+}
+
+// transparent reports whether c is fully transparent
+func transparent(c color.Color) bool {
+	_, _, _, a := c.RGBA()
+	return a == 0
+}
+
+// toRGBA converts c to color.RGBA, without the allocation of
+// color.RGBAModel for colors that already are
+func toRGBA(c color.Color) color.RGBA {
+	if rgba, ok := c.(color.RGBA); ok {
+		return rgba
+	}
+	return color.RGBAModel.Convert(c).(color.RGBA)
+}
+
+// luminance returns the relative luminance of c, from 0 for black to 1 for
+// white, as defined by WCAG
+func luminance(c color.RGBA) float64 {
+	linear := func(v uint8) float64 {
+		s := float64(v) / 0xff
+		if s <= 0.03928 {
+			return s / 12.92
+		}
+		return math.Pow((s+0.055)/1.055, 2.4)
+	}
+	return 0.2126*linear(c.R) + 0.7152*linear(c.G) + 0.0722*linear(c.B)
+}
+
+// contrastRatio returns the WCAG contrast ratio of a and b, from 1 for the
+// same luminance to 21 for black on white
+func contrastRatio(a, b color.RGBA) float64 {
+	la, lb := luminance(a), luminance(b)
+	return (max(la, lb) + 0.05) / (min(la, lb) + 0.05)
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"image"
+	"sync"
+)
+
+// maxSupersample bounds Supersample, past which the larger drawing costs
+// far more than it smooths
+const maxSupersample = 4
+
+// supersamplePool holds the large images supersampled captchas are drawn
+// on, so that drawing at 2 or 3 times the size doesn't allocate as much
+// more per request
+var supersamplePool sync.Pool
+
+// acquireSupersample returns a w by h image from the pool, its pixels left
+// as they were: every render fills its background first
+func acquireSupersample(w, h int) *image.RGBA {
+	n := 4 * w * h
+	img, _ := supersamplePool.Get().(*image.RGBA)
+	if img == nil || cap(img.Pix) < n {
+		return image.NewRGBA(image.Rect(0, 0, w, h))
+	}
+	img.Pix, img.Stride, img.Rect = img.Pix[:n], 4*w, image.Rect(0, 0, w, h)
+	return img
+}
+
+// releaseSupersample gives an image of acquireSupersample back to the pool
+func releaseSupersample(img *image.RGBA) {
+	supersamplePool.Put(img)
+}
+
+// pixelScale returns the pixels drawn per pixel of the final image
+func (cfg CaptchaConfig) pixelScale() int {
+	return max(cfg.scale, 1)
+}
+
+// supersampled returns cfg with every size in pixels or points multiplied
+// by scale, for drawing the image that large
+func (cfg CaptchaConfig) supersampled(scale int) CaptchaConfig {
+	cfg.scale = scale
+	cfg.Width *= scale
+	cfg.Height *= scale
+	cfg.FontSize *= float64(scale)
+	cfg.FontSizeJitter *= scale
+	cfg.NoiseWidth = cfg.noiseWidth() * scale
+	cfg.DistortionPeriod *= scale
+	return cfg
+}
+
+// drawSupersampled draws the captcha Supersample times larger on pooled
+// images and scales it down to the size of cfg
+func drawSupersampled(text string, cfg CaptchaConfig, rnd *randSource) *image.RGBA {
+	scale := cfg.Supersample
+	large := cfg.supersampled(scale)
+
+	img := acquireSupersample(large.Width, large.Height)
+	defer releaseSupersample(img)
+	var scratch *image.RGBA
+	if cfg.DistortionLevel > 0 {
+		scratch = acquireSupersample(large.Width, large.Height)
+		defer releaseSupersample(scratch)
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
+	downscale(out, paintCaptcha(img, scratch, text, large, rnd), scale)
+	return out
+}
+
+// downscale draws src into dst, scale times smaller, each pixel of dst the
+// average of a scale by scale box of src
+func downscale(dst, src *image.RGBA, scale int) {
+	area := uint32(scale * scale)
+	w, h := dst.Rect.Dx(), dst.Rect.Dy()
+	for y := 0; y < h; y++ {
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+w*4]
+		for x := 0; x < w; x++ {
+			var sum [4]uint32
+			for sy := y * scale; sy < (y+1)*scale; sy++ {
+				i := sy*src.Stride + x*scale*4
+				box := src.Pix[i : i+scale*4]
+				for j := 0; j < len(box); j += 4 {
+					sum[0] += uint32(box[j])
+					sum[1] += uint32(box[j+1])
+					sum[2] += uint32(box[j+2])
+					sum[3] += uint32(box[j+3])
+				}
+			}
+			for c := range sum {
+				row[x*4+c] = uint8((sum[c] + area/2) / area)
+			}
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package middleware
+
+import (
+	"bytes"
+	"cmp"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"strconv"
+
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// svgMaxRotation bounds the random rotation of each SVG glyph, in radians,
+// when MaxRotation is 0
+const svgMaxRotation = 0.35
+
+// svgEncoder draws captchas as SVG, the glyphs as outlines among noise
+// shapes
+type svgEncoder struct{}
+
+func (svgEncoder) ContentType() string {
+	return "image/svg+xml"
+}
+
+func (svgEncoder) Encode(w io.Writer, img image.Image) error {
+	return errDrawingEncoder
+}
+
+func (svgEncoder) render(buf *bytes.Buffer, text string, seed [32]byte, cfg CaptchaConfig) error {
+	rnd := newSeededSource(seed)
+	defer rnd.release()
+
+	writeSVG(buf, text, cfg, rnd)
+	return nil
+}
+
+// svgPath builds the d attribute of a path, placing glyph points with a
+// shift, a scale, a rotation and a translation to the origin
+type svgPath struct {
+	buf              []byte
+	shiftX, shiftY   float64
+	scale            float64
+	sin, cos         float64
+	skew             float64
+	originX, originY float64
+}
+
+// point appends the command cmd, if any, and the transformed point (x, y)
+func (p *svgPath) point(cmd byte, x, y float64) {
+	if cmd != 0 {
+		p.buf = append(p.buf, cmd)
+	} else {
+		p.buf = append(p.buf, ' ')
+	}
+	x, y = (x+p.shiftX)*p.scale, (y+p.shiftY)*p.scale
+	x += y * p.skew
+	p.buf = appendCoord(p.buf, p.originX+x*p.cos-y*p.sin)
+	p.buf = append(p.buf, ',')
+	p.buf = appendCoord(p.buf, p.originY+x*p.sin+y*p.cos)
+}
+
+// appendCoord appends v with one decimal, enough at image sizes
+func appendCoord(b []byte, v float64) []byte {
+	return strconv.AppendFloat(b, math.Round(v*10)/10, 'f', -1, 64)
+}
+
+// writeSVG draws the captcha as an SVG document. Every shape is a filled
+// path: the glyphs are outlines rather than text elements, so the answer
+// can't be read from the markup, and noise paths are interleaved with them
+// so they can't be told apart by their position in the document.
+func writeSVG(buf *bytes.Buffer, text string, cfg CaptchaConfig, rnd *randSource) {
+	buf.WriteString(`<svg xmlns="http://www.w3.org/2000/svg" width="`)
+	buf.WriteString(strconv.Itoa(cfg.Width))
+	buf.WriteString(`" height="`)
+	buf.WriteString(strconv.Itoa(cfg.Height))
+	buf.WriteString(`" viewBox="0 0 `)
+	buf.WriteString(strconv.Itoa(cfg.Width))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.Itoa(cfg.Height))
+	buf.WriteString(`">`)
+	colors := cfg.renderColors(rnd)
+	writeSVGBackground(buf, colors, cfg)
+	light := colors.text.R > 127
+
+	glyphs := svgGlyphs(text, cfg, rnd)
+	noise := max(cfg.NoiseLevel/10, 1)
+	for i := 0; i < len(glyphs) || noise > 0; i++ {
+		// Spread the noise between the glyphs, some of it after the last one
+		n := noise
+		if i < len(glyphs) {
+			n = rnd.Intn(noise + 1)
+		}
+		for ; n > 0; n-- {
+			writeSVGNoise(buf, cfg, rnd)
+			noise--
+		}
+		if i < len(glyphs) {
+			rgb := svgGlyphColor(rnd, light)
+			if cfg.TextColor != nil {
+				c := toRGBA(cfg.TextColor)
+				rgb = [3]byte{c.R, c.G, c.B}
+			}
+			writeSVGPath(buf, glyphs[i], rgb)
+		}
+	}
+	buf.WriteString(`</svg>`)
+}
+
+// svgGlyphs returns the outlines of the characters of text, each rotated
+// and offset at random
+func svgGlyphs(text string, cfg CaptchaConfig, rnd *randSource) [][]byte {
+	var (
+		sbuf    sfnt.Buffer
+		err     error
+		missing int
+	)
+
+	spacing := cfg.Width / (cfg.Length + 1)
+	// Basic glyphs are scaled up to half the height, within their slot
+	basicScale := min(float64(cfg.Height)/2/13, float64(spacing)*0.9/7)
+
+	rotation := svgMaxRotation
+	if cfg.MaxRotation > 0 {
+		rotation = cfg.MaxRotation * math.Pi / 180
+	}
+
+	paths := make([][]byte, 0, len(text))
+	i := 0
+	for _, char := range text {
+		i++
+		yOffset := rnd.Intn(20) - 10
+		angle := randomSpread(rnd, rotation)
+
+		p := &svgPath{
+			sin:     math.Sin(angle),
+			cos:     math.Cos(angle),
+			skew:    randomSpread(rnd, cfg.MaxSkew),
+			originX: float64(spacing * i),
+			originY: float64(cfg.Height/2 + yOffset),
+		}
+
+		if cfg.hasFont() {
+			charCfg := cfg.pickFont(rnd)
+			f, ferr := loadFont(charCfg)
+			if ferr == nil && appendSFNTGlyph(p, f.font, &sbuf, char, charCfg) {
+				paths = append(paths, p.buf)
+				continue
+			}
+			err = cmp.Or(err, ferr)
+			missing++
+		}
+		// Basic glyphs are rotated around their center
+		p.scale = basicScale
+		p.shiftX, p.shiftY = -3.5, 4.5
+		appendBasicGlyph(p, char)
+		paths = append(paths, p.buf)
+	}
+
+	reportFontFallback(cfg, missing, err)
+	return paths
+}
+
+// appendSFNTGlyph appends the outline of char in f, returning false when the
+// font has no glyph for it
+func appendSFNTGlyph(p *svgPath, f *sfnt.Font, sbuf *sfnt.Buffer, char rune, cfg CaptchaConfig) bool {
+	index, err := f.GlyphIndex(sbuf, char)
+	if err != nil || index == 0 {
+		return false
+	}
+	ppem := fixed.Int26_6(cfg.fontSize() * 64)
+	segments, err := f.LoadGlyph(sbuf, index, ppem, nil)
+	if err != nil {
+		return false
+	}
+
+	p.scale = 1
+	coord := func(v fixed.Int26_6) float64 { return float64(v) / 64 }
+	for _, s := range segments {
+		switch s.Op {
+		case sfnt.SegmentOpMoveTo:
+			if len(p.buf) > 0 {
+				p.buf = append(p.buf, 'Z')
+			}
+			p.point('M', coord(s.Args[0].X), coord(s.Args[0].Y))
+		case sfnt.SegmentOpLineTo:
+			p.point('L', coord(s.Args[0].X), coord(s.Args[0].Y))
+		case sfnt.SegmentOpQuadTo:
+			p.point('Q', coord(s.Args[0].X), coord(s.Args[0].Y))
+			p.point(0, coord(s.Args[1].X), coord(s.Args[1].Y))
+		case sfnt.SegmentOpCubeTo:
+			p.point('C', coord(s.Args[0].X), coord(s.Args[0].Y))
+			p.point(0, coord(s.Args[1].X), coord(s.Args[1].Y))
+			p.point(0, coord(s.Args[2].X), coord(s.Args[2].Y))
+		}
+	}
+	if len(p.buf) > 0 {
+		p.buf = append(p.buf, 'Z')
+	}
+	return true
+}
+
+// appendBasicGlyph appends the pixels of char in the basic font as a
+// rectangle per run of set pixels in a row
+func appendBasicGlyph(p *svgPath, char rune) {
+	dr, mask, maskp, _, ok := basicfont.Face7x13.Glyph(fixed.Point26_6{}, char)
+	if !ok {
+		return
+	}
+	alpha := mask.(*image.Alpha)
+	for y := 0; y < dr.Dy(); y++ {
+		for x := 0; x < dr.Dx(); {
+			if alpha.AlphaAt(maskp.X+x, maskp.Y+y).A == 0 {
+				x++
+				continue
+			}
+			start := x
+			for x < dr.Dx() && alpha.AlphaAt(maskp.X+x, maskp.Y+y).A != 0 {
+				x++
+			}
+			x0, x1 := float64(dr.Min.X+start), float64(dr.Min.X+x)
+			y0, y1 := float64(dr.Min.Y+y), float64(dr.Min.Y+y+1)
+			p.point('M', x0, y0)
+			p.point('L', x1, y0)
+			p.point('L', x1, y1)
+			p.point('L', x0, y1)
+			p.buf = append(p.buf, 'Z')
+		}
+	}
+}
+
+// writeSVGNoise writes a noise stroke as a thin filled quad, a path like the
+// glyphs
+func writeSVGNoise(buf *bytes.Buffer, cfg CaptchaConfig, rnd *randSource) {
+	x1, y1 := float64(rnd.Intn(cfg.Width)), float64(rnd.Intn(cfg.Height))
+	x2, y2 := float64(rnd.Intn(cfg.Width)), float64(rnd.Intn(cfg.Height))
+
+	// Offset the ends across the line by half its width
+	length := math.Hypot(x2-x1, y2-y1)
+	if length == 0 {
+		length = 1
+	}
+	half := (1 + float64(rnd.Intn(3))) / 2
+	nx, ny := -(y2-y1)/length*half, (x2-x1)/length*half
+
+	p := &svgPath{cos: 1, scale: 1}
+	p.point('M', x1+nx, y1+ny)
+	p.point('L', x2+nx, y2+ny)
+	p.point('L', x2-nx, y2-ny)
+	p.point('L', x1-nx, y1-ny)
+	p.buf = append(p.buf, 'Z')
+
+	c := cfg.noiseColor(rnd, 255)
+	writeSVGPath(buf, p.buf, [3]byte{c.R, c.G, c.B})
+}
+
+// svgGlyphColor returns a random dark color, or a light one on dark
+// backgrounds, so the glyphs stand out from the noise without sharing a
+// fill that would give them away
+func svgGlyphColor(rnd *randSource, light bool) [3]byte {
+	var rgb [3]byte
+	rnd.read(rgb[:])
+	for i := range rgb {
+		rgb[i] %= 96
+		if light {
+			rgb[i] = 255 - rgb[i]
+		}
+	}
+	return rgb
+}
+
+// writeSVGPath writes a path element filled with rgb
+func writeSVGPath(buf *bytes.Buffer, d []byte, rgb [3]byte) {
+	buf.WriteString(`<path d="`)
+	buf.Write(d)
+	buf.WriteString(`" fill="#`)
+	writeHex(buf, rgb)
+	buf.WriteString(`"/>`)
+}
+
+// writeSVGBackground writes the rectangle filling the image with the
+// background color, or with the gradient element it refers to
+func writeSVGBackground(buf *bytes.Buffer, colors renderColors, cfg CaptchaConfig) {
+	rgb := func(c color.RGBA) [3]byte { return [3]byte{c.R, c.G, c.B} }
+	g := colors.gradient
+
+	switch g.kind {
+	case GradientLinear:
+		sin, cos := math.Sincos(g.angle)
+		half := g.extent(cfg.Width, cfg.Height) / 2
+		cx, cy := float64(cfg.Width)/2, float64(cfg.Height)/2
+		buf.WriteString(`<defs><linearGradient id="bg" gradientUnits="userSpaceOnUse" x1="`)
+		buf.Write(appendCoord(nil, cx-half*cos))
+		buf.WriteString(`" y1="`)
+		buf.Write(appendCoord(nil, cy-half*sin))
+		buf.WriteString(`" x2="`)
+		buf.Write(appendCoord(nil, cx+half*cos))
+		buf.WriteString(`" y2="`)
+		buf.Write(appendCoord(nil, cy+half*sin))
+		buf.WriteString(`">`)
+		writeSVGStops(buf, rgb(g.from), rgb(g.to))
+		buf.WriteString(`</linearGradient></defs>`)
+	case GradientRadial:
+		buf.WriteString(`<defs><radialGradient id="bg" gradientUnits="userSpaceOnUse" cx="`)
+		buf.Write(appendCoord(nil, g.cx))
+		buf.WriteString(`" cy="`)
+		buf.Write(appendCoord(nil, g.cy))
+		buf.WriteString(`" r="`)
+		buf.Write(appendCoord(nil, g.radius(cfg.Width, cfg.Height)))
+		buf.WriteString(`">`)
+		writeSVGStops(buf, rgb(g.from), rgb(g.to))
+		buf.WriteString(`</radialGradient></defs>`)
+	default:
+		buf.WriteString(`<rect width="100%" height="100%" fill="#`)
+		writeHex(buf, rgb(colors.background))
+		buf.WriteString(`"/>`)
+		return
+	}
+	buf.WriteString(`<rect width="100%" height="100%" fill="url(#bg)"/>`)
+}
+
+// writeSVGStops writes the stops of a gradient from one color to the other
+func writeSVGStops(buf *bytes.Buffer, from, to [3]byte) {
+	buf.WriteString(`<stop offset="0" stop-color="#`)
+	writeHex(buf, from)
+	buf.WriteString(`"/><stop offset="1" stop-color="#`)
+	writeHex(buf, to)
+	buf.WriteString(`"/>`)
+}
+
+// writeHex writes rgb as the six hex digits of a color
+func writeHex(buf *bytes.Buffer, rgb [3]byte) {
+	const hex = "0123456789abcdef"
+
+	for _, b := range rgb {
+		buf.WriteByte(hex[b>>4])
+		buf.WriteByte(hex[b&15])
+	}
+}
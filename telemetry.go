@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Telemetry headers
+const (
+	HeaderTelemetry    = "X-Captcha-Telemetry"     // Signed typing telemetry sent with the answer
+	HeaderTelemetryKey = "X-Captcha-Telemetry-Key" // Key signing the telemetry of a new captcha
+)
+
+// maxTelemetrySize bounds the telemetry value accepted from a client
+const maxTelemetrySize = 512
+
+// Telemetry is how the answer of a captcha was typed, as reported by the
+// widget script: counts and durations only, never the keys themselves. The
+// signature binds it to the captcha, but the key is handed to the client,
+// so it is a scoring signal rather than proof and never fails a request.
+type Telemetry struct {
+	Keypresses int           // Keys pressed in the answer field
+	Pastes     int           // Paste events in the answer field
+	Duration   time.Duration // From the first input in the answer field to submission
+}
+
+// telemetryPayload is the JSON signed by the widget script
+type telemetryPayload struct {
+	Keypresses int   `json:"keypresses"`
+	Pastes     int   `json:"pastes"`
+	DurationMS int64 `json:"duration_ms"`
+}
+
+// telemetryMessage returns the message the telemetry key of a captcha is
+// derived from, so the key of a captcha signs nothing else
+func telemetryMessage(captchaID string) []byte {
+	return []byte("telemetry\x00" + captchaID)
+}
+
+// TelemetryKey returns the key signing the telemetry of a captcha, for the
+// ID as handed to the client. It is sent in the X-Captcha-Telemetry-Key
+// header on generation; server-rendered forms can embed it in the page. It
+// returns "" when Telemetry is disabled or the ID is invalid.
+func TelemetryKey(cfg CaptchaConfig, clientID string) string {
+	if !cfg.Telemetry || cfg.IDKeys == nil {
+		return ""
+	}
+	captchaID, ok := unsignID(cfg, clientID)
+	if !ok {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(cfg.IDKeys.Sign(telemetryMessage(captchaID)))
+}
+
+// setTelemetryKey sends the telemetry key of a new captcha
+func setTelemetryKey(c *gin.Context, cfg CaptchaConfig, captchaID string) {
+	if cfg.Telemetry && cfg.IDKeys != nil {
+		c.Header(HeaderTelemetryKey, TelemetryKey(cfg, signID(cfg, captchaID)))
+	}
+}
+
+// requestTelemetry returns the telemetry sent with the answer to a captcha,
+// read from the X-Captcha-Telemetry header or the "captcha_telemetry" form
+// field. It returns nil when there is none or its signature doesn't match.
+func requestTelemetry(c *gin.Context, cfg CaptchaConfig, captchaID string) *Telemetry {
+	value := c.GetHeader(HeaderTelemetry)
+	if value == "" {
+		value = c.PostForm("captcha_telemetry")
+	}
+	if value == "" {
+		return nil
+	}
+
+	telemetry, ok := parseTelemetry(cfg, captchaID, value)
+	if !ok {
+		emitCount(cfg.Metrics, MetricTelemetry, "status:invalid")
+		return nil
+	}
+	emitCount(cfg.Metrics, MetricTelemetry, "status:valid")
+	return telemetry
+}
+
+// parseTelemetry verifies and decodes a "<payload>.<signature>" telemetry
+// value, both parts base64url encoded
+func parseTelemetry(cfg CaptchaConfig, captchaID, value string) (*Telemetry, bool) {
+	if len(value) > maxTelemetrySize {
+		return nil, false
+	}
+
+	encoded, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, false
+	}
+
+	// Check against the keys derived from every key of the ring
+	valid := false
+	for _, key := range cfg.IDKeys.signatures(telemetryMessage(captchaID)) {
+		if hmac.Equal(mac, computeMAC(key, payload)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, false
+	}
+
+	// Reject unknown fields so nothing beyond counts and durations is kept
+	var p telemetryPayload
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, false
+	}
+	if p.Keypresses < 0 || p.Pastes < 0 || p.DurationMS < 0 {
+		return nil, false
+	}
+
+	return &Telemetry{
+		Keypresses: p.Keypresses,
+		Pastes:     p.Pastes,
+		Duration:   time.Duration(p.DurationMS) * time.Millisecond,
+	}, true
+}
@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// DefaultMinTextContrast is the MinTextContrast used when it is 0: the WCAG
+// minimum for large text, which captcha characters are
+const DefaultMinTextContrast = 3
+
+// maxTextAlphaJitter bounds TextAlphaJitter, keeping characters at least
+// half opaque
+const maxTextAlphaJitter = 128
+
+// DefaultTextPalette is the palette characters are drawn in when
+// TextPalette is empty: saturated dark hues
+var DefaultTextPalette = []color.Color{
+	color.RGBA{0x8b, 0x00, 0x00, 0xff}, // Dark red
+	color.RGBA{0x0d, 0x47, 0xa1, 0xff}, // Dark blue
+	color.RGBA{0x1b, 0x5e, 0x20, 0xff}, // Dark green
+	color.RGBA{0x4a, 0x14, 0x8c, 0xff}, // Purple
+	color.RGBA{0xbf, 0x36, 0x0c, 0xff}, // Burnt orange
+	color.RGBA{0x00, 0x4d, 0x40, 0xff}, // Teal
+	color.RGBA{0x1a, 0x23, 0x7e, 0xff}, // Indigo
+	color.RGBA{0x88, 0x0e, 0x4f, 0xff}, // Plum
+}
+
+// minTextContrast returns the lowest contrast ratio of the characters of
+// cfg against the background
+func (cfg CaptchaConfig) minTextContrast() float64 {
+	if cfg.MinTextContrast <= 0 {
+		return DefaultMinTextContrast
+	}
+	return cfg.MinTextContrast
+}
+
+// glyphColor returns the color of a character: TextColor when set, the
+// contrasting text color of colors with SingleTextColor, otherwise a random color of the palette,
+// with up to TextAlphaJitter less alpha. Colors whose contrast against the
+// background is below MinTextContrast at their lowest alpha are passed
+// over for the next one of the palette, and the contrasting text color is
+// used when none is left.
+func (cfg CaptchaConfig) glyphColor(colors renderColors, rnd *randSource) color.RGBA {
+	switch {
+	case cfg.TextColor != nil:
+		return toRGBA(cfg.TextColor)
+	case cfg.SingleTextColor:
+		return colors.text
+	}
+	palette := cfg.TextPalette
+	if len(palette) == 0 {
+		palette = DefaultTextPalette
+	}
+	alpha := uint8(255)
+	if cfg.TextAlphaJitter > 0 {
+		alpha -= uint8(rnd.Intn(cfg.TextAlphaJitter + 1))
+	}
+	lowest := uint8(255 - cfg.TextAlphaJitter)
+
+	start := rnd.Intn(len(palette))
+	for i := range palette {
+		c := toRGBA(palette[(start+i)%len(palette)])
+		if colors.contrasts(withAlpha(c, lowest), cfg.minTextContrast()) {
+			return withAlpha(c, alpha)
+		}
+	}
+	return colors.text
+}
+
+// contrasts reports whether c, drawn over the background, has a contrast
+// ratio of at least ratio against it, or against both ends of a gradient
+func (rc renderColors) contrasts(c color.RGBA, ratio float64) bool {
+	if rc.gradient.kind != GradientNone {
+		return contrastRatio(over(c, rc.gradient.from), rc.gradient.from) >= ratio &&
+			contrastRatio(over(c, rc.gradient.to), rc.gradient.to) >= ratio
+	}
+	return contrastRatio(over(c, rc.background), rc.background) >= ratio
+}
+
+// withAlpha returns the opaque color c with alpha a, premultiplied
+func withAlpha(c color.RGBA, a uint8) color.RGBA {
+	scale := func(v uint8) uint8 { return uint8(uint32(v) * uint32(a) / 255) }
+	return color.RGBA{scale(c.R), scale(c.G), scale(c.B), a}
+}
+
+// noiseColor returns the color of a noise line or dot: a random color of
+// NoisePalette when set, otherwise a random color with alpha
+func (cfg CaptchaConfig) noiseColor(rnd *randSource, alpha uint8) color.RGBA {
+	if len(cfg.NoisePalette) > 0 {
+		return toRGBA(cfg.NoisePalette[rnd.Intn(len(cfg.NoisePalette))])
+	}
+	r, g, b := rnd.rgb()
+	return color.RGBA{r, g, b, alpha}
+}
+
+// over returns the premultiplied color c drawn over the opaque bg
+func over(c, bg color.RGBA) color.RGBA {
+	blend := func(s, d uint8) uint8 { return s + uint8(uint32(d)*uint32(255-c.A)/255) }
+	return color.RGBA{blend(c.R, bg.R), blend(c.G, bg.G), blend(c.B, bg.B), 255}
+}
+
+// drawGlyph draws the mask of a glyph at r onto dst in the color c, as
+// draw.DrawMask with draw.Over would, without boxing c into an image for
+// the *image.Alpha masks of the fonts
+func drawGlyph(dst *image.RGBA, r image.Rectangle, c color.RGBA, mask image.Image, mp image.Point) {
+	alpha, ok := mask.(*image.Alpha)
+	if !ok {
+		draw.DrawMask(dst, r, image.NewUniform(c), image.Point{}, mask, mp, draw.Over)
+		return
+	}
+
+	clipped := r.Intersect(dst.Rect)
+	mp = mp.Add(clipped.Min.Sub(r.Min))
+	sr, sg, sb, sa := c.RGBA()
+	const m = 1<<16 - 1
+	for y := 0; y < clipped.Dy(); y++ {
+		di := dst.PixOffset(clipped.Min.X, clipped.Min.Y+y)
+		mi := alpha.PixOffset(mp.X, mp.Y+y)
+		for x := 0; x < clipped.Dx(); x, di, mi = x+1, di+4, mi+1 {
+			ma := uint32(alpha.Pix[mi])
+			if ma == 0 {
+				continue
+			}
+			ma |= ma << 8
+
+			a := (m - sa*ma/m) * 0x101
+			d := dst.Pix[di : di+4 : di+4]
+			d[0] = uint8((uint32(d[0])*a + sr*ma) / m >> 8)
+			d[1] = uint8((uint32(d[1])*a + sg*ma) / m >> 8)
+			d[2] = uint8((uint32(d[2])*a + sb*ma) / m >> 8)
+			d[3] = uint8((uint32(d[3])*a + sa*ma) / m >> 8)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// TextGenerator creates the challenge of a captcha: the text drawn in the
+// image and the answers accepted for it. Returning no answers makes the
+// displayed text the only answer.
+type TextGenerator interface {
+	Generate(cfg CaptchaConfig) (display string, answers []string, err error)
+}
+
+// CharsetGenerator is the default TextGenerator. It draws cfg.Length random
+// characters of cfg.Charset, or of cfg.Type, which are also the answer.
+type CharsetGenerator struct{}
+
+// Generate implements TextGenerator
+func (CharsetGenerator) Generate(cfg CaptchaConfig) (string, []string, error) {
+	if cfg.Charset == "" && charset(cfg.Type) == "" {
+		return "", nil, fmt.Errorf("unknown captcha type %d", cfg.Type)
+	}
+	if err := CheckText(cfg); err != nil {
+		return "", nil, err
+	}
+	return generateRandomText(cfg.Length, cfg.charsetRunes()), nil, nil
+}
+
+// Defaults and bounds of the TypeMath settings
+const (
+	DefaultMathOperators = "+-" // Operators of TypeMath expressions when MathOperators is empty
+	DefaultMathMax       = 20   // Largest TypeMath operand when MathMax is 0
+	MaxMathOperand       = 999  // Largest MathMax allowed
+)
+
+// ErrInvalidText is wrapped by the errors of CheckText
+var ErrInvalidText = errors.New("invalid captcha text settings")
+
+// MathGenerator is the TextGenerator of TypeMath. It draws an expression
+// such as "7 + 3 =" of two operands between MathMin and MathMax, and one of
+// MathOperators, whose result is the answer.
+type MathGenerator struct{}
+
+// Generate implements TextGenerator
+func (MathGenerator) Generate(cfg CaptchaConfig) (string, []string, error) {
+	if err := CheckText(cfg); err != nil {
+		return "", nil, err
+	}
+	operators := cfg.mathOperators()
+	operands := cfg.mathOperands()
+
+	rnd := newRandSource()
+	defer rnd.release()
+
+	op := operators[rnd.Intn(len(operators))]
+	a := operands[rnd.Intn(len(operands))]
+	b := operands[rnd.Intn(len(operands))]
+	if op == '-' && a < b && !cfg.MathNegative {
+		a, b = b, a
+	}
+
+	display := strconv.Itoa(a) + " " + mathSymbol(cfg, op) + " " + strconv.Itoa(b) + " ="
+	return display, []string{strconv.Itoa(mathResult(op, a, b))}, nil
+}
+
+// mathResult applies the operator op to a and b
+func mathResult(op byte, a, b int) int {
+	switch op {
+	case '-':
+		return a - b
+	case '*':
+		return a * b
+	}
+	return a + b
+}
+
+// mathSymbol returns the symbol op is drawn with: the typographic minus and
+// times signs when the font has them, ASCII otherwise as the basic font has
+// no other characters
+func mathSymbol(cfg CaptchaConfig, op byte) string {
+	switch op {
+	case '-':
+		if fontHas(cfg, '−') {
+			return "−"
+		}
+		return "-"
+	case '*':
+		if fontHas(cfg, '×') {
+			return "×"
+		}
+		return "x"
+	}
+	return "+"
+}
+
+// mathOperators returns the operators of the TypeMath expressions of cfg
+func (cfg CaptchaConfig) mathOperators() string {
+	if cfg.MathOperators == "" {
+		return DefaultMathOperators
+	}
+	return cfg.MathOperators
+}
+
+// mathRange returns the smallest and largest TypeMath operands of cfg
+func (cfg CaptchaConfig) mathRange() (int, int) {
+	if cfg.MathMax == 0 {
+		return cfg.MathMin, DefaultMathMax
+	}
+	return cfg.MathMin, cfg.MathMax
+}
+
+// mathOperands returns the TypeMath operands of cfg, from MathMin to
+// MathMax, without those written with ambiguous digits when
+// ExcludeAmbiguous is set
+func (cfg CaptchaConfig) mathOperands() []int {
+	lo, hi := cfg.mathRange()
+	operands := make([]int, 0, max(hi-lo+1, 0))
+	for n := lo; n <= hi; n++ {
+		if cfg.ExcludeAmbiguous && strings.ContainsAny(strconv.Itoa(n), AmbiguousChars) {
+			continue
+		}
+		operands = append(operands, n)
+	}
+	return operands
+}
+
+// mathResults counts the distinct results of the TypeMath expressions of
+// cfg, 0 when its settings are invalid
+func mathResults(cfg CaptchaConfig) int {
+	if CheckText(cfg) != nil {
+		return 0
+	}
+	operands := cfg.mathOperands()
+
+	// Results are within ±MaxMathOperand², offset to index a bitset
+	const offset = MaxMathOperand * MaxMathOperand
+	seen := make([]uint64, (2*offset+1)/64+1)
+	count := 0
+	for i := 0; i < len(cfg.mathOperators()); i++ {
+		op := cfg.mathOperators()[i]
+		for _, a := range operands {
+			for _, b := range operands {
+				if op == '-' && a < b && !cfg.MathNegative {
+					continue
+				}
+				r := mathResult(op, a, b) + offset
+				if seen[r/64]&(1<<(r%64)) == 0 {
+					seen[r/64] |= 1 << (r % 64)
+					count++
+				}
+			}
+		}
+	}
+	return count
+}
+
+// CheckText returns an error when cfg can't generate captcha texts: a
+// Charset that isn't UTF-8 or has fewer than 2 distinct characters, once
+// the ambiguous ones are excluded with ExcludeAmbiguous, or for TypeMath,
+// operators other than "+", "-" and "*", or operands outside
+// [0, MaxMathOperand], out of order or all excluded, for TypeQuestion, no
+// Questions or one with a blank question or answer, or for TypeWord, a
+// blank word or fewer than MinWordlist words within the length bounds
+func CheckText(cfg CaptchaConfig) error {
+	switch {
+	case cfg.TextGenerator != nil:
+		return nil
+	case cfg.Type == TypeQuestion:
+		return checkQuestions(cfg.Questions)
+	case cfg.Type == TypeWord:
+		return checkWords(cfg)
+	case cfg.Type != TypeMath:
+		return checkCharset(cfg)
+	}
+	for _, op := range cfg.mathOperators() {
+		if !strings.ContainsRune("+-*", op) {
+			return fmt.Errorf("%w: MathOperators %q has %q, only +, - and * are supported", ErrInvalidText, cfg.MathOperators, op)
+		}
+	}
+	lo, hi := cfg.mathRange()
+	if lo < 0 || hi > MaxMathOperand || lo > hi {
+		return fmt.Errorf("%w: math operands from %d to %d are out of [0, %d]", ErrInvalidText, lo, hi, MaxMathOperand)
+	}
+	if len(cfg.mathOperands()) == 0 {
+		return fmt.Errorf("%w: no math operand from %d to %d is free of ambiguous digits", ErrInvalidText, lo, hi)
+	}
+	return nil
+}
+
+// checkCharset returns an error when the charset of cfg can't make captchas
+func checkCharset(cfg CaptchaConfig) error {
+	if cfg.Charset == "" && !cfg.ExcludeAmbiguous {
+		return nil
+	}
+	if !utf8.ValidString(cfg.Charset) {
+		return fmt.Errorf("%w: Charset %q isn't valid UTF-8", ErrInvalidText, cfg.Charset)
+	}
+	if len(cfg.charsetRunes()) < 2 {
+		if cfg.ExcludeAmbiguous {
+			return fmt.Errorf("%w: charset %q has fewer than 2 distinct characters without the ambiguous ones", ErrInvalidText, cfg.charset())
+		}
+		return fmt.Errorf("%w: Charset %q has fewer than 2 distinct characters", ErrInvalidText, cfg.Charset)
+	}
+	return nil
+}
+
+// questionAnswers returns the number of distinct answers of the Questions of
+// cfg, as compared when verifying
+func questionAnswers(cfg CaptchaConfig) int {
+	normalizer := cfg.Normalizer()
+	distinct := make(map[string]struct{}, len(cfg.Questions))
+	for _, pair := range cfg.Questions {
+		distinct[normalizer.Normalize(collapseSpace(pair.Answer))] = struct{}{}
+	}
+	return len(distinct)
+}
+
+// questionText returns the question to send as text along with the image of
+// a captcha of cfg, "" unless QuestionText is set
+func questionText(cfg CaptchaConfig, data captchaData) string {
+	if cfg.Type != TypeQuestion || !cfg.QuestionText || cfg.TextGenerator != nil {
+		return ""
+	}
+	return data.value
+}
+
+// checkQuestions returns an error when the pairs of TypeQuestion can't make
+// captchas
+func checkQuestions(questions []QuestionAnswer) error {
+	if len(questions) == 0 {
+		return fmt.Errorf("%w: TypeQuestion needs Questions", ErrInvalidText)
+	}
+	for i, pair := range questions {
+		if strings.TrimSpace(pair.Question) == "" || strings.TrimSpace(pair.Answer) == "" {
+			return fmt.Errorf("%w: question %d has a blank question or answer", ErrInvalidText, i)
+		}
+		if !utf8.ValidString(pair.Question) || !utf8.ValidString(pair.Answer) {
+			return fmt.Errorf("%w: question %d isn't valid UTF-8", ErrInvalidText, i)
+		}
+	}
+	return nil
+}
+
+// mustValidText panics when cfg can't generate captcha texts, so a bad
+// setting is caught when the routes are set up
+func mustValidText(cfg CaptchaConfig) {
+	if err := CheckText(cfg); err != nil {
+		panic(err)
+	}
+}
+
+// QuestionAnswer is a question of TypeQuestion and its answer
+type QuestionAnswer struct {
+	Question string // Drawn in the image, e.g. "What color is the sky?"
+	Answer   string // Compared following CaseSensitive and TrimAnswers, e.g. "blue"
+}
+
+// QuestionGenerator is the TextGenerator of TypeQuestion. It picks one of
+// cfg.Questions uniformly, drawing the question and accepting its answer.
+type QuestionGenerator struct{}
+
+// Generate implements TextGenerator
+func (QuestionGenerator) Generate(cfg CaptchaConfig) (string, []string, error) {
+	if err := CheckText(cfg); err != nil {
+		return "", nil, err
+	}
+
+	rnd := newRandSource()
+	defer rnd.release()
+
+	pair := cfg.Questions[rnd.Intn(len(cfg.Questions))]
+	return pair.Question, []string{collapseSpace(pair.Answer)}, nil
+}
+
+// textGenerator returns the TextGenerator of cfg
+func textGenerator(cfg CaptchaConfig) TextGenerator {
+	if cfg.TextGenerator != nil {
+		return cfg.TextGenerator
+	}
+	switch cfg.Type {
+	case TypeMath:
+		return MathGenerator{}
+	case TypeQuestion:
+		return QuestionGenerator{}
+	case TypeWord:
+		return WordGenerator{}
+	}
+	return CharsetGenerator{}
+}
@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// cjkCharset returns n distinct CJK ideographs, as many as a charset of
+// common Chinese characters has
+func cjkCharset(n int) string {
+	var chars strings.Builder
+	for r := rune(0x4E00); r < 0x4E00+rune(n); r++ {
+		chars.WriteRune(r)
+	}
+	return chars.String()
+}
+
+func TestCJKCharsetRoundTrip(t *testing.T) {
+	cfg := DefaultCaptchaConfig()
+	cfg.Charset = cjkCharset(3500) + cjkCharset(100) // Repeats count once
+	h := testRouter(cfg)
+
+	// Deduplicated once and shared by every captcha
+	runes := cfg.charsetRunes()
+	if len(runes) != 3500 {
+		t.Fatalf("%d distinct characters, want 3500", len(runes))
+	}
+	if again := cfg.charsetRunes(); &again[0] != &runes[0] {
+		t.Error("charset deduplicated again for a second captcha")
+	}
+
+	for i := 0; i < 20; i++ {
+		cookie := generateCookie(t, h)
+		text, ok := store.answer(cookie.Value)
+		if !ok {
+			t.Fatal("generated captcha not in the store")
+		}
+		if n := utf8.RuneCountInString(text); n != cfg.Length {
+			t.Fatalf("text %q has %d characters, want %d", text, n, cfg.Length)
+		}
+		for _, r := range text {
+			if r < 0x4E00 || r >= 0x4E00+3500 {
+				t.Fatalf("text %q has %q, outside the charset", text, r)
+			}
+		}
+
+		answer, want := text, 200
+		if i%2 == 1 {
+			// Another character of the charset in place of the last one
+			last, _ := utf8.DecodeLastRuneInString(text)
+			answer, want = strings.TrimSuffix(text, string(last))+string(0x4E00+(last-0x4E00+1)%3500), 400
+		}
+		if w := verifyRequest(h, cookie, answer); w.Code != want {
+			t.Errorf("answer %q to %q: got %d %s, want %d", answer, text, w.Code, w.Body, want)
+		}
+	}
+}
+
+// BenchmarkGenerateCJK generates captchas of a 3,500 character charset,
+// which is deduplicated once on setup
+func BenchmarkGenerateCJK(b *testing.B) {
+	cfg := DefaultCaptchaConfig()
+	cfg.Charset = cjkCharset(3500)
+	mustValidText(cfg)
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, _, err := textGenerator(cfg).Generate(cfg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWordsFilteredOnce(t *testing.T) {
+	cfg := DefaultCaptchaConfig()
+	cfg.Type = TypeWord
+	cfg.WordMaxLength = 6
+	mustValidText(cfg)
+
+	words := cfg.words()
+	if again := cfg.words(); &again[0] != &words[0] {
+		t.Error("word list filtered again for a second captcha")
+	}
+	for i := 0; i < 100; i++ {
+		word, _, err := WordGenerator{}.Generate(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := utf8.RuneCountInString(word); n > 6 {
+			t.Fatalf("word %q longer than WordMaxLength", word)
+		}
+	}
+
+	// Other settings filter the list again
+	cfg.WordMaxLength = 5
+	for _, word := range cfg.words() {
+		if utf8.RuneCountInString(word) > 5 {
+			t.Fatalf("word %q longer than WordMaxLength 5", word)
+		}
+	}
+
+	// So does another list, whose check is kept along with its words
+	cfg.Wordlist = []string{"apple", " "}
+	if _, _, err := (WordGenerator{}).Generate(cfg); !errors.Is(err, ErrInvalidText) {
+		t.Errorf("Generate with a blank word: %v, want ErrInvalidText", err)
+	}
+	if err := CheckText(cfg); !errors.Is(err, ErrInvalidText) {
+		t.Errorf("CheckText with a blank word: %v, want ErrInvalidText", err)
+	}
+}
+
+func TestExcludeAmbiguous(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		set  func(*CaptchaConfig)
+	}{
+		{"Numeric", func(cfg *CaptchaConfig) { cfg.Type = TypeNumeric }},
+		{"Alphabetic", func(cfg *CaptchaConfig) { cfg.Type = TypeAlphabetic }},
+		{"Alphanumeric", func(cfg *CaptchaConfig) { cfg.Type = TypeAlphanumeric }},
+		{"Charset", func(cfg *CaptchaConfig) { cfg.Charset = "0123456789OoIlSsZzBxyz" }},
+		{"Math", func(cfg *CaptchaConfig) {
+			cfg.Type = TypeMath
+			cfg.MathOperators = "+-*"
+			cfg.MathMax = 120
+		}},
+		{"Word", func(cfg *CaptchaConfig) { cfg.Type = TypeWord }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultCaptchaConfig()
+			cfg.ExcludeAmbiguous = true
+			tt.set(&cfg)
+			mustValidText(cfg)
+
+			for i := 0; i < 5000; i++ {
+				text, _, err := textGenerator(cfg).Generate(cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if at := strings.IndexAny(text, AmbiguousChars); at >= 0 {
+					t.Fatalf("captcha %q has the ambiguous %q", text, text[at])
+				}
+			}
+		})
+	}
+}
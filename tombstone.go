@@ -0,0 +1,62 @@
+package middleware
+
+import "time"
+
+// ErrCodeAlreadyUsed is returned when a captcha that was already verified is
+// submitted again
+const ErrCodeAlreadyUsed = "captcha_already_used"
+
+// tombstoneTTL is how long a consumed captcha is remembered
+const tombstoneTTL = 60 * time.Second
+
+// tombstone remembers how a consumed captcha was verified
+type tombstone struct {
+	expires int64 // Unix nanoseconds
+	solved  bool
+}
+
+// outcome returns the result of the verification that consumed the captcha
+func (t tombstone) outcome() string {
+	if t.solved {
+		return ResultSuccess
+	}
+	return ResultInvalid
+}
+
+// bury leaves a tombstone for a consumed captcha, recording whether it was
+// solved, see consumeCaptcha
+func (s *CaptchaStore) bury(id string, solved bool) {
+	s.buryUntil(id, solved, time.Now().Add(tombstoneTTL))
+}
+
+// buryUntil leaves a tombstone for id remembered until expires
+func (s *CaptchaStore) buryUntil(id string, solved bool, expires time.Time) {
+	s.mu.Lock()
+	s.tombstones[id] = tombstone{expires: expires.UnixNano(), solved: solved}
+	s.mu.Unlock()
+}
+
+// claim leaves an unsolved tombstone for id remembered until expires, unless
+// a recent one exists, which it returns
+func (s *CaptchaStore) claim(id string, expires time.Time) (tombstone, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, exists := s.tombstones[id]; exists && time.Now().UnixNano() <= t.expires {
+		return t, true
+	}
+	s.tombstones[id] = tombstone{expires: expires.UnixNano()}
+	return tombstone{}, false
+}
+
+// tombstone returns the tombstone of a consumed captcha, if it is recent
+func (s *CaptchaStore) tombstone(id string) (tombstone, bool) {
+	s.mu.RLock()
+	t, exists := s.tombstones[id]
+	s.mu.RUnlock()
+
+	if !exists || time.Now().UnixNano() > t.expires {
+		return tombstone{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderTrace carries the trace token of a new captcha, see Verification
+const HeaderTrace = "X-Captcha-Trace"
+
+// generateTrace creates the trace token of a captcha. Unlike the captcha ID
+// it grants nothing, so it can be logged and shared freely.
+func generateTrace() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// verification returns the outcome of verifying the captcha
+func (d captchaData) verification(captchaID, result string) Verification {
+	return Verification{
+		CaptchaID: captchaID,
+		Result:    result,
+		Metadata:  d.metadata,
+		Trace:     d.trace,
+		Variant:   d.variant,
+	}
+}
+
+// setTrace sends the trace token of a new captcha
+func setTrace(c *gin.Context, data captchaData) {
+	c.Header(HeaderTrace, data.trace)
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+// glyphTransform is the rotation, in radians, and the horizontal shear of a
+// character, and the factor it is scaled down by to fit the image
+type glyphTransform struct {
+	angle, skew float64
+	shrink      float64 // 0 keeps the size
+}
+
+// randomSpread returns a random value between -limit and limit, drawing
+// nothing from rnd when limit is 0 so that disabled settings leave the
+// rest of the render unchanged
+func randomSpread(rnd *randSource, limit float64) float64 {
+	if limit == 0 {
+		return 0
+	}
+	return (float64(rnd.Intn(2001))/1000 - 1) * limit
+}
+
+// glyphTransform returns a random transform of a character within
+// MaxRotation and MaxSkew
+func (cfg CaptchaConfig) glyphTransform(rnd *randSource) glyphTransform {
+	return glyphTransform{
+		angle: randomSpread(rnd, cfg.MaxRotation*math.Pi/180),
+		skew:  randomSpread(rnd, cfg.MaxSkew),
+	}
+}
+
+// identity reports whether t leaves the glyph as it is
+func (t glyphTransform) identity() bool {
+	return t.angle == 0 && t.skew == 0 && t.shrink == 0
+}
+
+// matrix returns the shear, then rotation and scaling, of t as the
+// coefficients of a 2x2 matrix
+func (t glyphTransform) matrix() (a00, a01, a10, a11 float64) {
+	sin, cos := math.Sincos(t.angle)
+	if t.shrink != 0 {
+		sin, cos = sin*t.shrink, cos*t.shrink
+	}
+	return cos, cos*t.skew - sin, sin, sin*t.skew + cos
+}
+
+// bounds returns the bounds of the rectangle r once transformed around its
+// center
+func (t glyphTransform) bounds(r image.Rectangle) image.Rectangle {
+	a00, a01, a10, a11 := t.matrix()
+	cx := float64(r.Min.X+r.Max.X) / 2
+	cy := float64(r.Min.Y+r.Max.Y) / 2
+
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, corner := range [4]image.Point{r.Min, {r.Max.X, r.Min.Y}, {r.Min.X, r.Max.Y}, r.Max} {
+		x, y := float64(corner.X)-cx, float64(corner.Y)-cy
+		x, y = a00*x+a01*y+cx, a10*x+a11*y+cy
+		minX, minY = min(minX, x), min(minY, y)
+		maxX, maxY = max(maxX, x), max(maxY, y)
+	}
+	return image.Rect(int(math.Floor(minX)), int(math.Floor(minY)), int(math.Ceil(maxX)), int(math.Ceil(maxY)))
+}
+
+// apply transforms the glyph mask drawn at dr around the center of dr. It
+// returns the bounds of the transformed glyph and its mask, in its own
+// buffer whose coordinates are those of the image.
+func (t glyphTransform) apply(dr image.Rectangle, mask image.Image, maskp image.Point) (image.Rectangle, *image.Alpha) {
+	a00, a01, a10, a11 := t.matrix()
+	cx := float64(dr.Min.X+dr.Max.X) / 2
+	cy := float64(dr.Min.Y+dr.Max.Y) / 2
+	bounds := t.bounds(dr)
+
+	// Mask coordinates are moved to image ones before the transform
+	x, y := float64(dr.Min.X-maskp.X)-cx, float64(dr.Min.Y-maskp.Y)-cy
+	ox, oy := a00*x+a01*y+cx, a10*x+a11*y+cy
+	s2d := f64.Aff3{a00, a01, ox, a10, a11, oy}
+
+	dst := image.NewAlpha(bounds)
+	xdraw.BiLinear.Transform(dst, s2d, mask, image.Rectangle{maskp, maskp.Add(dr.Size())}, draw.Src, nil)
+	return bounds, dst
+}
@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wprimadi/gin-captcha/assets"
+)
+
+// updateGolden rewrites the golden images from the current renders
+var updateGolden = flag.Bool("update", false, "rewrite the golden images in testdata")
+
+// goldenTolerance is the share of pixels allowed to differ from a golden
+// image by more than goldenDelta in a channel, for the float rounding of
+// architectures fusing multiplications and additions
+const (
+	goldenTolerance = 0.002
+	goldenDelta     = 16
+)
+
+func TestTransformGolden(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		set  func(*CaptchaConfig)
+	}{
+		{"identity", func(cfg *CaptchaConfig) { cfg.Font = assets.Font() }},
+		{"rotated", func(cfg *CaptchaConfig) {
+			cfg.Font = assets.Font()
+			cfg.MaxRotation = 30
+		}},
+		{"skewed", func(cfg *CaptchaConfig) {
+			cfg.Font = assets.Font()
+			cfg.MaxSkew = 0.5
+		}},
+		{"rotated-skewed", func(cfg *CaptchaConfig) {
+			cfg.Font = assets.Font()
+			cfg.MaxRotation = 45
+			cfg.MaxSkew = 0.3
+		}},
+		{"basic-rotated", func(cfg *CaptchaConfig) { cfg.MaxRotation = 30 }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultCaptchaConfig()
+			tc.set(&cfg)
+			render := func() *image.RGBA {
+				white := color.RGBA{255, 255, 255, 255}
+				img := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
+				fillImage(img, white)
+				drawText(img, "Ab3xQ7", cfg, newSeededSource([32]byte{42}), renderColors{background: white, text: color.RGBA{A: 255}})
+				return img
+			}
+			img := render()
+			if again := render(); !bytes.Equal(img.Pix, again.Pix) {
+				t.Fatal("the same seed renders differently")
+			}
+
+			path := filepath.Join("testdata", "transform", tc.name+".png")
+			if *updateGolden {
+				var buf bytes.Buffer
+				if err := png.Encode(&buf, img); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatalf("%v, run with -update to create it", err)
+			}
+			defer f.Close()
+			golden, err := png.Decode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if golden.Bounds() != img.Bounds() {
+				t.Fatalf("bounds %v, golden %v", img.Bounds(), golden.Bounds())
+			}
+			differing := 0
+			for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+				for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+					if !closeColors(img.RGBAAt(x, y), color.RGBAModel.Convert(golden.At(x, y)).(color.RGBA)) {
+						differing++
+					}
+				}
+			}
+			if share := float64(differing) / float64(img.Rect.Dx()*img.Rect.Dy()); share > goldenTolerance {
+				t.Errorf("%d pixels (%.2f%%) differ from %s, run with -update if the change is intended", differing, 100*share, path)
+			}
+		})
+	}
+}
+
+// closeColors reports whether no channel of a and b differs by more than
+// goldenDelta
+func closeColors(a, b color.RGBA) bool {
+	near := func(x, y uint8) bool { return max(x, y)-min(x, y) <= goldenDelta }
+	return near(a.R, b.R) && near(a.G, b.G) && near(a.B, b.B) && near(a.A, b.A)
+}
+
+func TestGlyphTransformBounds(t *testing.T) {
+	r := image.Rect(10, 20, 30, 60) // 20 by 40, centered on (20, 40)
+	for _, tc := range []struct {
+		name string
+		t    glyphTransform
+		want image.Rectangle
+	}{
+		{"Identity", glyphTransform{}, r},
+		{"QuarterTurn", glyphTransform{angle: math.Pi / 2}, image.Rect(0, 30, 40, 50)},
+		{"Shrunk", glyphTransform{shrink: 0.5}, image.Rect(15, 30, 25, 50)},
+		{"Skewed", glyphTransform{skew: 0.5}, image.Rect(0, 20, 40, 60)},
+	} {
+		if got := tc.t.bounds(r); got != tc.want {
+			t.Errorf("%s: bounds %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	if !(glyphTransform{}).identity() || (glyphTransform{skew: 0.1}).identity() {
+		t.Error("identity")
+	}
+}
@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"cmp"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ContextKeyTrusted is set to true when a trusted cookie let the request through
+const ContextKeyTrusted = "captcha_trusted"
+
+// DefaultTrustedCookie is the name of the trusted cookie when TrustedCookie
+// is empty
+const DefaultTrustedCookie = "captcha-trusted"
+
+// TrustedPrecedence decides which wins when a request carries both a valid
+// trusted cookie and a captcha answer
+type TrustedPrecedence int
+
+const (
+	PreferTrusted TrustedPrecedence = iota // Let the request through on the cookie, leaving the captcha unused
+	PreferCaptcha                          // Verify the captcha, refreshing the cookie when it is solved
+)
+
+// trustedEnabled reports whether the trusted client feature is configured
+func trustedEnabled(cfg CaptchaConfig) bool {
+	return cfg.TrustedDuration > 0 && cfg.TrustedKeys != nil
+}
+
+// trustedCookie returns the name of the trusted cookie of cfg
+func (cfg CaptchaConfig) trustedCookie() string {
+	return cmp.Or(cfg.TrustedCookie, DefaultTrustedCookie)
+}
+
+// trustedMessage returns the data covered by the trusted cookie signature.
+// Cookies are revoked by retiring the keys of TrustedKeys that signed them,
+// which every replica configured with the same keys agrees on.
+func trustedMessage(cfg CaptchaConfig, expiry int64, clientIP string) []byte {
+	msg := strconv.FormatInt(expiry, 10)
+	if cfg.TrustedBindIP {
+		msg += "|" + clientIP
+	}
+	return []byte(msg)
+}
+
+// setTrustedCookie marks the client as trusted for cfg.TrustedDuration
+func setTrustedCookie(c *gin.Context, cfg CaptchaConfig) {
+	expiry := time.Now().Add(cfg.TrustedDuration).Unix()
+	signature := cfg.TrustedKeys.Sign(trustedMessage(cfg, expiry, c.ClientIP()))
+	value := strconv.FormatInt(expiry, 10) + "." + hex.EncodeToString(signature)
+	c.SetCookie(cfg.trustedCookie(), value, int(cfg.TrustedDuration.Seconds()), cookiePath(c, cfg), "", false, true)
+}
+
+// hasTrustedCookie reports whether the request carries a valid trusted cookie
+func hasTrustedCookie(c *gin.Context, cfg CaptchaConfig) bool {
+	value, err := c.Cookie(cfg.trustedCookie())
+	if err != nil {
+		return false
+	}
+
+	expiryStr, encoded, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+
+	expiry, err := strconv.ParseInt(expiryStr, 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return false
+	}
+
+	signature, err := hex.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	return cfg.TrustedKeys.Verify(trustedMessage(cfg, expiry, c.ClientIP()), signature)
+}
+
+// trustedPasses reports whether the trusted cookie lets the request through
+// without verifying a captcha. With PreferCaptcha, a request carrying a
+// captcha ID and answer has them verified instead.
+func trustedPasses(c *gin.Context, cfg CaptchaConfig) bool {
+	if !trustedEnabled(cfg) || !hasTrustedCookie(c, cfg) {
+		return false
+	}
+	if cfg.TrustedPrecedence == PreferCaptcha {
+		return !carriesCaptcha(c, cfg)
+	}
+	if cfg.TrustedBurnsCaptcha {
+		burnCaptcha(c, cfg)
+	}
+	return true
+}
+
+// carriesCaptcha reports whether the request carries both a captcha ID and
+// an answer
+func carriesCaptcha(c *gin.Context, cfg CaptchaConfig) bool {
+	id, _ := readSources(c, cfg.idNames(), cfg.idSources(), false)
+	answer, _ := readSources(c, cfg.answerNames(), cfg.answerSources(), false)
+	return id != "" && answer != ""
+}
+
+// burnCaptcha removes the captcha sent along with a trusted cookie, so it
+// can't be used by another request. No tombstone is left, it wasn't
+// verified.
+func burnCaptcha(c *gin.Context, cfg CaptchaConfig) {
+	id, _ := readSources(c, cfg.idNames(), cfg.idSources(), false)
+	if id == "" {
+		return
+	}
+	if captchaID, ok := unsignID(cfg, id); ok {
+		removeCaptcha(c, cfg, captchaID)
+	}
+}
@@ -0,0 +1,227 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// trustedRouter is testRouter with trusted cookies, answering "trusted" or
+// "solved" depending on how the request got through
+func trustedRouter(precedence TrustedPrecedence, burns bool) *gin.Engine {
+	cfg := testConfig()
+	cfg.TrustedDuration = time.Hour
+	cfg.TrustedKeys = NewKeyRing([]byte("0123456789abcdef0123456789abcdef"))
+	cfg.TrustedPrecedence = precedence
+	cfg.TrustedBurnsCaptcha = burns
+
+	r := gin.New()
+	r.GET("/captcha", GenerateCaptcha(cfg))
+	r.POST("/verify", VerifyCaptchaWithConfig(cfg), func(c *gin.Context) {
+		if c.GetBool(ContextKeyTrusted) {
+			c.String(200, "trusted")
+			return
+		}
+		c.String(200, "solved")
+	})
+	return r
+}
+
+// trustedRequest posts answer for the captcha of id to h, along with the
+// trusted cookie when it isn't empty
+func trustedRequest(h http.Handler, id, answer, trusted string) *httptest.ResponseRecorder {
+	form := url.Values{DefaultIDField: {id}, DefaultAnswerField: {answer}}
+	req := httptest.NewRequest("POST", "/verify", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if trusted != "" {
+		req.AddCookie(&http.Cookie{Name: DefaultTrustedCookie, Value: trusted})
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// trustedCookie returns the trusted cookie set on w, "" when there is none
+func trustedCookie(w *httptest.ResponseRecorder) string {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == DefaultTrustedCookie {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+func TestTrustedPrecedence(t *testing.T) {
+	for _, tc := range []struct {
+		precedence TrustedPrecedence
+		burns      bool
+		token      string // "valid", "invalid" or "none"
+		answer     string // "right" or "wrong"
+		body       string // Response, "" for a rejection
+		refreshed  bool   // Whether a trusted cookie is set
+		consumed   bool   // Whether the captcha can't be solved afterwards
+	}{
+		{PreferTrusted, false, "valid", "right", "trusted", false, false},
+		{PreferTrusted, false, "valid", "wrong", "trusted", false, false},
+		{PreferTrusted, true, "valid", "right", "trusted", false, true},
+		{PreferTrusted, true, "valid", "wrong", "trusted", false, true},
+		{PreferTrusted, false, "invalid", "right", "solved", true, true},
+		{PreferTrusted, false, "invalid", "wrong", "", false, true},
+		{PreferTrusted, false, "none", "right", "solved", true, true},
+		{PreferTrusted, false, "none", "wrong", "", false, true},
+		{PreferCaptcha, false, "valid", "right", "solved", true, true},
+		{PreferCaptcha, false, "valid", "wrong", "", false, true},
+		{PreferCaptcha, true, "valid", "right", "solved", true, true},
+		{PreferCaptcha, true, "valid", "wrong", "", false, true},
+		{PreferCaptcha, false, "invalid", "right", "solved", true, true},
+		{PreferCaptcha, false, "invalid", "wrong", "", false, true},
+		{PreferCaptcha, false, "none", "right", "solved", true, true},
+		{PreferCaptcha, false, "none", "wrong", "", false, true},
+	} {
+		name := fmt.Sprintf("captcha=%t/burns=%t/%s/%s", tc.precedence == PreferCaptcha, tc.burns, tc.token, tc.answer)
+		t.Run(name, func(t *testing.T) {
+			h := trustedRouter(tc.precedence, tc.burns)
+
+			var token string
+			switch tc.token {
+			case "valid":
+				// Solving a captcha trusts the client
+				w := trustedRequest(h, generateCookie(t, h).Value, "abc123", "")
+				if token = trustedCookie(w); token == "" {
+					t.Fatalf("no trusted cookie after solving a captcha: %d %s", w.Code, w.Body)
+				}
+			case "invalid":
+				token = fmt.Sprintf("%d.%x", time.Now().Add(time.Hour).Unix(), "forged signature")
+			}
+			answer := "abc123"
+			if tc.answer == "wrong" {
+				answer = "wrong"
+			}
+
+			id := generateCookie(t, h).Value
+			w := trustedRequest(h, id, answer, token)
+			switch {
+			case tc.body == "" && w.Code != 400:
+				t.Errorf("got %d %s, want a rejection", w.Code, w.Body)
+			case tc.body != "" && (w.Code != 200 || w.Body.String() != tc.body):
+				t.Errorf("got %d %s, want 200 %s", w.Code, w.Body, tc.body)
+			}
+			if refreshed := trustedCookie(w) != ""; refreshed != tc.refreshed {
+				t.Errorf("trusted cookie set: %t, want %t", refreshed, tc.refreshed)
+			}
+
+			// The captcha sent along is left usable unless it was verified or burned
+			consumed := trustedRequest(h, id, "abc123", "").Code != 200
+			if consumed != tc.consumed {
+				t.Errorf("captcha consumed: %t, want %t", consumed, tc.consumed)
+			}
+		})
+	}
+}
+
+func TestTrustedWithoutCaptcha(t *testing.T) {
+	for _, precedence := range []TrustedPrecedence{PreferTrusted, PreferCaptcha} {
+		h := trustedRouter(precedence, false)
+		token := trustedCookie(trustedRequest(h, generateCookie(t, h).Value, "abc123", ""))
+
+		// A trusted client needn't send a captcha, whichever wins
+		if w := trustedRequest(h, "", "", token); w.Code != 200 || w.Body.String() != "trusted" {
+			t.Errorf("precedence %d: got %d %s, want 200 trusted", precedence, w.Code, w.Body)
+		}
+	}
+}
+
+func TestTrustedCookieName(t *testing.T) {
+	if DefaultTrustedCookie != "captcha-trusted" {
+		t.Errorf("DefaultTrustedCookie = %q, want captcha-trusted", DefaultTrustedCookie)
+	}
+
+	cfg := testConfig()
+	cfg.TrustedDuration = time.Hour
+	cfg.TrustedKeys = NewKeyRing([]byte("0123456789abcdef0123456789abcdef"))
+	cfg.TrustedCookie = "site-trust"
+	r := gin.New()
+	r.GET("/captcha", GenerateCaptcha(cfg))
+	r.POST("/verify", VerifyCaptchaWithConfig(cfg), func(c *gin.Context) {
+		c.String(200, "%t", c.GetBool(ContextKeyTrusted))
+	})
+
+	w := trustedRequest(r, generateCookie(t, r).Value, "abc123", "")
+	var token string
+	for _, c := range w.Result().Cookies() {
+		switch c.Name {
+		case "site-trust":
+			token = c.Value
+		case DefaultTrustedCookie:
+			t.Errorf("trusted cookie set under the default name")
+		}
+	}
+	if token == "" {
+		t.Fatalf("no site-trust cookie after solving a captcha: %d %s", w.Code, w.Body)
+	}
+
+	// Only the configured name is read back
+	req := httptest.NewRequest("POST", "/verify", nil)
+	req.AddCookie(&http.Cookie{Name: "site-trust", Value: token})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 200 || w.Body.String() != "true" {
+		t.Errorf("site-trust cookie: got %d %s, want 200 true", w.Code, w.Body)
+	}
+	if w := trustedRequest(r, "", "", token); w.Code == 200 {
+		t.Errorf("token under the default name: got %d %s, want a rejection", w.Code, w.Body)
+	}
+
+	cfg.TrustedCookie = "bad name"
+	if err := CheckNames(cfg); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("CheckNames(TrustedCookie %q) = %v, want ErrInvalidName", cfg.TrustedCookie, err)
+	}
+}
+
+func TestTrustedRevocation(t *testing.T) {
+	oldKey, newKey := []byte("0123456789abcdef0123456789abcdef"), []byte("fedcba9876543210fedcba9876543210")
+	cfg := testConfig()
+	cfg.TrustedDuration = time.Hour
+	cfg.TrustedKeys = NewKeyRing(oldKey)
+	r := gin.New()
+	r.GET("/captcha", GenerateCaptcha(cfg))
+	r.POST("/verify", VerifyCaptchaWithConfig(cfg), func(c *gin.Context) {
+		c.String(200, "%t", c.GetBool(ContextKeyTrusted))
+	})
+	token := trustedCookie(trustedRequest(r, generateCookie(t, r).Value, "abc123", ""))
+
+	// Rotating keeps the cookies signed with the previous key
+	cfg.TrustedKeys.Rotate(newKey)
+	if w := trustedRequest(r, "", "", token); w.Code != 200 || w.Body.String() != "true" {
+		t.Errorf("after rotating: got %d %s, want 200 true", w.Code, w.Body)
+	}
+
+	// Retiring it revokes them, while new cookies pass
+	cfg.TrustedKeys.Retire(oldKey)
+	if w := trustedRequest(r, "", "", token); w.Code == 200 {
+		t.Errorf("after retiring: got %d %s, want a rejection", w.Code, w.Body)
+	}
+	fresh := trustedCookie(trustedRequest(r, generateCookie(t, r).Value, "abc123", ""))
+	if w := trustedRequest(r, "", "", fresh); w.Code != 200 || w.Body.String() != "true" {
+		t.Errorf("cookie signed with the new key: got %d %s, want 200 true", w.Code, w.Body)
+	}
+
+	// Another replica built with the new key alone agrees
+	replica := cfg
+	replica.TrustedKeys = NewKeyRing(newKey)
+	other := gin.New()
+	other.POST("/verify", VerifyCaptchaWithConfig(replica), func(c *gin.Context) { c.String(200, "%t", c.GetBool(ContextKeyTrusted)) })
+	if w := trustedRequest(other, "", "", token); w.Code == 200 {
+		t.Errorf("revoked cookie on another replica: got %d %s, want a rejection", w.Code, w.Body)
+	}
+	if w := trustedRequest(other, "", "", fresh); w.Code != 200 {
+		t.Errorf("new cookie on another replica: got %d %s, want 200", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultTTLRateLimit is the TTL lookups allowed per captcha and minute when
+// TTLRateLimit is 0
+const DefaultTTLRateLimit = 30
+
+// ttlRateWindow is the window TTLRateLimit counts lookups over
+const ttlRateWindow = time.Minute
+
+// ttlRateLimit returns the TTL lookups allowed per captcha and window
+func (cfg CaptchaConfig) ttlRateLimit() int {
+	if cfg.TTLRateLimit > 0 {
+		return cfg.TTLRateLimit
+	}
+	return DefaultTTLRateLimit
+}
+
+// decoyCaptcha is decoded for unknown IDs, so they take as long to answer as
+// expired ones
+var decoyCaptcha = sync.OnceValue(func() string {
+	value, _ := encodeCaptcha(captchaData{
+		value:    "decoy",
+		answers:  hashAnswers("decoy"),
+		issuedAt: time.Unix(0, 0),
+		trace:    generateTrace(),
+	})
+	return value
+})
+
+// CaptchaTTL is a handler returning how long the captcha whose ID is the
+// "id" route parameter stays valid, e.g. mounted on "/captcha/:id/ttl", so
+// client countdowns can resync with the server. It responds with the
+// remaining time in milliseconds and the attempts left, without extending
+// or consuming the captcha. Unknown and expired IDs get the same 404 after
+// the same work, so the handler can't tell which IDs exist. Lookups are
+// limited per ID to TTLRateLimit a minute.
+func CaptchaTTL(config ...CaptchaConfig) gin.HandlerFunc {
+	cfg := DefaultCaptchaConfig()
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+
+	return func(c *gin.Context) {
+		captchaID, ok := unsignID(cfg, c.Param("id"))
+		if !ok {
+			c.JSON(400, gin.H{"error": "Invalid captcha ID", "code": ErrCodeIDTampered})
+			return
+		}
+
+		// Limit every ID alike, whether it exists or not
+		if cfg.state().incr("ttl:"+captchaID, ttlRateWindow) > cfg.ttlRateLimit() {
+			c.Header("Retry-After", strconv.Itoa(int(ttlRateWindow.Seconds())))
+			c.JSON(429, gin.H{"error": "Too many captcha TTL requests"})
+			return
+		}
+
+		value, exists, err := cfg.captchaStore().Get(captchaID)
+		if err != nil {
+			logError(c, cfg, captchaID, err)
+			c.JSON(500, gin.H{"error": "Failed to load captcha"})
+			return
+		}
+		if !exists {
+			value = decoyCaptcha()
+		}
+		data, err := decodeCaptcha(value)
+
+		// The decoy is always expired
+		remaining := time.Until(data.expiresAt())
+		if !exists || err != nil || remaining <= 0 {
+			c.JSON(404, gin.H{"error": "Invalid or expired captcha"})
+			return
+		}
+
+		// Captchas are single-use, an outstanding one has its only attempt left
+		c.JSON(200, gin.H{
+			"ttl_ms":             remaining.Milliseconds(),
+			"attempts_remaining": 1,
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// EventWarmup is logged for every completed stage of Warmup
+const EventWarmup = "captcha.warmup"
+
+// Warmup does the work the first requests would otherwise pay for, so it
+// can run before a server is marked ready. For every config, it generates,
+// renders and encodes a throwaway captcha, filling the random source and
+// encoder pools. It also asks every registered sample pack for each
+// character, so lazily loaded packs are decoded. Each stage is logged as an
+// EventWarmup with its duration through the Logger of its config. Nothing
+// is stored, and Warmup returns the context error when ctx is done before
+// it finishes.
+func Warmup(ctx context.Context, configs ...CaptchaConfig) error {
+	if len(configs) == 0 {
+		configs = []CaptchaConfig{DefaultCaptchaConfig()}
+	}
+
+	for _, cfg := range configs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		start := time.Now()
+		if err := warmupRender(cfg); err != nil {
+			return fmt.Errorf("warming up rendering: %w", err)
+		}
+		logWarmup(cfg, "render", start)
+	}
+
+	samplePacksMu.RLock()
+	packs := make(map[string]SamplePack, len(samplePacks))
+	for lang, pack := range samplePacks {
+		packs[lang] = pack
+	}
+	samplePacksMu.RUnlock()
+
+	for lang, pack := range packs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		start := time.Now()
+		for _, char := range charset(TypeAlphanumeric) {
+			pack.Sample(char)
+		}
+		logWarmup(configs[0], "audio:"+lang, start)
+	}
+
+	return nil
+}
+
+// warmupRender generates, renders and encodes a captcha without storing it
+func warmupRender(cfg CaptchaConfig) error {
+	text, _, err := textGenerator(cfg).Generate(cfg)
+	if err != nil {
+		return err
+	}
+	cfg.Length = len(text)
+
+	img, err := generateCaptchaImage(text, newSeed(), cfg)
+	if err != nil {
+		return err
+	}
+
+	buf, err := encodePooled(img)
+	if err != nil {
+		return err
+	}
+	releaseBuffer(buf)
+	return nil
+}
+
+// logWarmup logs a completed Warmup stage
+func logWarmup(cfg CaptchaConfig, stage string, start time.Time) {
+	if cfg.Logger != nil {
+		cfg.Logger.Log(Event{Type: EventWarmup, Stage: stage, Duration: time.Since(start)})
+	}
+}
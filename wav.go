@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Sample is mono 16-bit PCM audio
+type Sample struct {
+	Rate int     // Samples per second
+	Data []int16 // PCM samples
+}
+
+// DecodeWAV reads an uncompressed 8 or 16-bit PCM WAV file. Multi-channel
+// audio is mixed down to mono.
+func DecodeWAV(r io.Reader) (Sample, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Sample{}, err
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return Sample{}, errors.New("wav: not a RIFF WAVE file")
+	}
+
+	var channels, bits, rate int
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return Sample{}, errors.New("wav: missing data chunk")
+			}
+			return Sample{}, err
+		}
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+
+		switch string(chunk[0:4]) {
+		case "fmt ":
+			fmtChunk := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, fmtChunk); err != nil {
+				return Sample{}, err
+			}
+			if size < 16 || binary.LittleEndian.Uint16(fmtChunk[0:2]) != 1 {
+				return Sample{}, errors.New("wav: only PCM is supported")
+			}
+			channels = int(binary.LittleEndian.Uint16(fmtChunk[2:4]))
+			rate = int(binary.LittleEndian.Uint32(fmtChunk[4:8]))
+			bits = int(binary.LittleEndian.Uint16(fmtChunk[14:16]))
+
+		case "data":
+			if channels == 0 || (bits != 8 && bits != 16) || rate <= 0 {
+				return Sample{}, errors.New("wav: unsupported or missing format")
+			}
+			raw := make([]byte, size)
+			if _, err := io.ReadFull(r, raw); err != nil {
+				return Sample{}, err
+			}
+			return Sample{Rate: rate, Data: decodePCM(raw, channels, bits)}, nil
+
+		default:
+			if _, err := io.CopyN(io.Discard, r, size+size%2); err != nil {
+				return Sample{}, err
+			}
+		}
+	}
+}
+
+// decodePCM converts interleaved PCM frames to mono 16-bit samples
+func decodePCM(raw []byte, channels, bits int) []int16 {
+	frameSize := channels * bits / 8
+	data := make([]int16, len(raw)/frameSize)
+	for i := range data {
+		frame := raw[i*frameSize:]
+		sum := 0
+		for ch := 0; ch < channels; ch++ {
+			if bits == 8 {
+				sum += (int(frame[ch]) - 128) << 8
+			} else {
+				sum += int(int16(binary.LittleEndian.Uint16(frame[ch*2:])))
+			}
+		}
+		data[i] = int16(sum / channels)
+	}
+	return data
+}
+
+// wavHeaderSize is the size of the header written by encodeWAV
+const wavHeaderSize = 44
+
+// encodeWAV writes s as a mono 16-bit PCM WAV file
+func encodeWAV(w io.Writer, s Sample) error {
+	dataSize := len(s.Data) * 2
+
+	var header [wavHeaderSize]byte
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(36+dataSize))
+	copy(header[8:16], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:20], 16)
+	binary.LittleEndian.PutUint16(header[20:22], 1) // PCM
+	binary.LittleEndian.PutUint16(header[22:24], 1) // Mono
+	binary.LittleEndian.PutUint32(header[24:28], uint32(s.Rate))
+	binary.LittleEndian.PutUint32(header[28:32], uint32(s.Rate*2))
+	binary.LittleEndian.PutUint16(header[32:34], 2)
+	binary.LittleEndian.PutUint16(header[34:36], 16)
+	copy(header[36:40], "data")
+	binary.LittleEndian.PutUint32(header[40:44], uint32(dataSize))
+
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, s.Data)
+}
+
+// resample converts s to rate with linear interpolation
+func resample(s Sample, rate int) Sample {
+	if s.Rate == rate || len(s.Data) == 0 {
+		return s
+	}
+
+	n := int(int64(len(s.Data)) * int64(rate) / int64(s.Rate))
+	data := make([]int16, n)
+	step := float64(s.Rate) / float64(rate)
+	for i := range data {
+		pos := float64(i) * step
+		j := int(pos)
+		if j+1 >= len(s.Data) {
+			data[i] = s.Data[len(s.Data)-1]
+			continue
+		}
+		frac := pos - float64(j)
+		data[i] = int16(float64(s.Data[j])*(1-frac) + float64(s.Data[j+1])*frac)
+	}
+	return Sample{Rate: rate, Data: data}
+}
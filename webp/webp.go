@@ -0,0 +1,35 @@
+// Package webp registers middleware.FormatWebP, encoding captchas as
+// lossless WebP images. It lives in its own package so that only its users
+// depend on the encoder; enable it with a blank import:
+//
+//	import _ "github.com/wprimadi/gin-captcha/webp"
+package webp
+
+import (
+	"image"
+	"io"
+
+	"github.com/HugoSmits86/nativewebp"
+	middleware "github.com/wprimadi/gin-captcha"
+)
+
+// ContentType is the content type of the WebP responses
+const ContentType = "image/webp"
+
+func init() {
+	middleware.RegisterEncoder(middleware.FormatWebP, Encoder{})
+}
+
+// Encoder implements middleware.ImageEncoder with a pure Go lossless WebP
+// encoder
+type Encoder struct{}
+
+// ContentType returns "image/webp"
+func (Encoder) ContentType() string {
+	return ContentType
+}
+
+// Encode writes img to w as a lossless WebP image
+func (Encoder) Encode(w io.Writer, img image.Image) error {
+	return nativewebp.Encode(w, img, nil)
+}
@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"bytes"
+	"cmp"
+	"html/template"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wprimadi/gin-captcha/assets"
+)
+
+// Widget configures the accessible captcha widget rendered by WidgetHTML
+type Widget struct {
+	RefreshURL string     // Route answering with a new captcha in JSON, e.g. GenerateCaptchaFromJSON; empty hides the refresh button
+	AudioURL   string     // Route serving the audio of a captcha, with ":id" where its ID goes; empty hides the audio button
+	Text       WidgetText // Strings shown and announced by the widget; empty fields use DefaultWidgetText
+}
+
+// WidgetText holds the strings of the widget, to be translated per locale
+type WidgetText struct {
+	Label        string // Label of the answer field
+	Instructions string // How to solve the captcha, linked to the image and field with aria-describedby
+	ImageAlt     string // Alt text of the image, which must not give the answer away
+	Refresh      string // Refresh button
+	Refreshed    string // Announced once a new captcha is shown
+	PlayAudio    string // Audio button, while stopped
+	StopAudio    string // Audio button, while playing
+	Failed       string // Announced when a new captcha can't be loaded
+}
+
+// DefaultWidgetText is the English text of the widget
+var DefaultWidgetText = WidgetText{
+	Label:        "Verification code",
+	Instructions: "Type the characters shown in the image. Use the audio button to hear them instead.",
+	ImageAlt:     "Verification image with distorted characters",
+	Refresh:      "New code",
+	Refreshed:    "A new verification image is shown.",
+	PlayAudio:    "Play audio code",
+	StopAudio:    "Stop audio code",
+	Failed:       "A new verification code could not be loaded.",
+}
+
+// text returns the strings of the widget, defaults filled in
+func (w Widget) text() WidgetText {
+	t, d := w.Text, DefaultWidgetText
+	return WidgetText{
+		Label:        cmp.Or(t.Label, d.Label),
+		Instructions: cmp.Or(t.Instructions, d.Instructions),
+		ImageAlt:     cmp.Or(t.ImageAlt, d.ImageAlt),
+		Refresh:      cmp.Or(t.Refresh, d.Refresh),
+		Refreshed:    cmp.Or(t.Refreshed, d.Refreshed),
+		PlayAudio:    cmp.Or(t.PlayAudio, d.PlayAudio),
+		StopAudio:    cmp.Or(t.StopAudio, d.StopAudio),
+		Failed:       cmp.Or(t.Failed, d.Failed),
+	}
+}
+
+// widgetTemplate renders the widget. The answer field and the image are
+// described by the instructions, the buttons are native buttons so they are
+// reachable with the keyboard, and changes are announced in a live region.
+var widgetTemplate = template.Must(template.New("widget").Parse(`<div class="captcha-widget" role="group" aria-labelledby="{{.Prefix}}-label">
+<img id="{{.Prefix}}-image" src="{{.Src}}" alt="{{.Text.ImageAlt}}" width="{{.Width}}" height="{{.Height}}" aria-describedby="{{.Prefix}}-instructions">
+<p id="{{.Prefix}}-instructions">{{.Text.Instructions}}</p>
+<input type="hidden" id="{{.Prefix}}-id" name="{{.IDField}}" value="{{.CaptchaID}}">
+<label id="{{.Prefix}}-label" for="{{.Prefix}}-answer">{{.Text.Label}}</label>
+<input type="text" id="{{.Prefix}}-answer" name="{{.AnswerField}}" inputmode="{{.InputMode}}" autocomplete="off" autocapitalize="off" spellcheck="false" required aria-describedby="{{.Prefix}}-instructions">
+{{- if .RefreshURL}}
+<button type="button" id="{{.Prefix}}-refresh" aria-controls="{{.Prefix}}-image">{{.Text.Refresh}}</button>
+{{- end}}
+{{- if .AudioURL}}
+<button type="button" id="{{.Prefix}}-audio-toggle" aria-controls="{{.Prefix}}-audio" aria-pressed="false">{{.Text.PlayAudio}}</button>
+<audio id="{{.Prefix}}-audio" hidden></audio>
+{{- end}}
+<p id="{{.Prefix}}-status" role="status" aria-live="polite"></p>
+{{- if or .RefreshURL .AudioURL}}
+<script>
+{{.Script}}({{.Prefix}}, {{.Text}}, {{.RefreshURL}}, {{.AudioURL}});
+</script>
+{{- end}}
+</div>`))
+
+// widgetData is the data of widgetTemplate
+type widgetData struct {
+	Prefix      string
+	Src         template.URL
+	Width       int
+	Height      int
+	CaptchaID   string
+	IDField     string
+	AnswerField string
+	InputMode   string
+	RefreshURL  string
+	AudioURL    string
+	Text        WidgetText
+	Script      template.JS
+}
+
+// WidgetHTML creates a captcha like IssueForTemplate and returns the markup
+// of an accessible widget showing it, to be placed inside a form: the image
+// with an alt text that doesn't reveal the answer, instructions the image
+// and answer field point to with aria-describedby, and keyboard-accessible
+// refresh and audio buttons as configured by cfg.Widget.
+func WidgetHTML(c *gin.Context, cfg CaptchaConfig) (template.HTML, error) {
+	id, src, data, err := issueForTemplate(c, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	// Element IDs must be unique when a page holds several widgets
+	base := basePath(c, cfg)
+	var buf bytes.Buffer
+	err = widgetTemplate.Execute(&buf, widgetData{
+		Prefix:      "captcha-" + data.trace,
+		Src:         src,
+		Width:       cfg.Width,
+		Height:      cfg.Height,
+		CaptchaID:   id,
+		IDField:     cfg.idNames().field,
+		AnswerField: cfg.answerNames().field,
+		InputMode:   data.inputMode(),
+		RefreshURL:  underBase(base, cfg.Widget.RefreshURL),
+		AudioURL:    underBase(base, cfg.Widget.AudioURL),
+		Text:        cfg.Widget.text(),
+		Script:      template.JS(assets.WidgetScript()),
+	})
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
@@ -0,0 +1,197 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/wprimadi/gin-captcha/assets"
+)
+
+// MinWordlist is the fewest words a TypeWord config may pick from, once
+// filtered by WordMinLength, WordMaxLength and ExcludeAmbiguous, so that
+// guessing a word stays unlikely
+const MinWordlist = 100
+
+// WordGenerator is the TextGenerator of TypeWord. It picks one of the words
+// of cfg.Wordlist, or of DefaultWordlist, uniformly among those between
+// WordMinLength and WordMaxLength characters. The word is also the answer.
+type WordGenerator struct{}
+
+// Generate implements TextGenerator
+func (WordGenerator) Generate(cfg CaptchaConfig) (string, []string, error) {
+	set := cfg.wordSet()
+	if set.err != nil {
+		return "", nil, set.err
+	}
+	words := set.words
+
+	rnd := newRandSource()
+	defer rnd.release()
+
+	return words[rnd.Intn(len(words))], nil, nil
+}
+
+// LoadWordlist reads a word list with one word per line. Spaces around the
+// words are dropped, and blank lines and lines starting with "#" skipped.
+func LoadWordlist(r io.Reader) ([]string, error) {
+	var words []string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		if !utf8.ValidString(word) {
+			return nil, fmt.Errorf("captcha: word list line %d isn't valid UTF-8", line)
+		}
+		words = append(words, word)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("captcha: read word list: %w", err)
+	}
+	return words, nil
+}
+
+// defaultWordlist is the embedded word list, read on first use
+var defaultWordlist = sync.OnceValue(func() []string {
+	words, err := LoadWordlist(bytes.NewReader(assets.Wordlist()))
+	if err != nil {
+		// The embedded file is known to be valid
+		panic(err)
+	}
+	return words
+})
+
+// DefaultWordlist returns the words TypeWord picks from when Wordlist is
+// empty: common English words of 4 to 8 lower case letters
+func DefaultWordlist() []string {
+	return slices.Clone(defaultWordlist())
+}
+
+// wordlist returns the Wordlist of cfg, the default one when it is empty
+func (cfg CaptchaConfig) wordlist() []string {
+	if len(cfg.Wordlist) == 0 {
+		return defaultWordlist()
+	}
+	return cfg.Wordlist
+}
+
+// maxWordSets is how many word lists keep their filtered words, those of
+// the least recently used one being dropped past it
+const maxWordSets = 8
+
+// wordSetKey identifies a word list, by its backing array, along with the
+// settings filtering it
+type wordSetKey struct {
+	first     *string
+	n         int
+	minLength int
+	maxLength int
+	exclude   bool
+}
+
+// wordSet is a word list filtered for a config and the error checking it
+type wordSet struct {
+	words []string
+	err   error
+}
+
+// wordSets holds the word lists in use, filtered and checked when the
+// handlers are set up rather than for every captcha. Lists are told apart
+// by their backing array, so a Wordlist must not be modified once in use.
+var wordSets = newLRU[wordSetKey, *wordSet](maxWordSets)
+
+// wordSet returns the word list of cfg filtered and checked, see words and
+// checkWords
+func (cfg CaptchaConfig) wordSet() *wordSet {
+	list := cfg.wordlist()
+	key := wordSetKey{
+		n:         len(list),
+		minLength: cfg.WordMinLength,
+		maxLength: cfg.WordMaxLength,
+		exclude:   cfg.ExcludeAmbiguous,
+	}
+	if len(list) > 0 {
+		key.first = &list[0]
+	}
+	if set, ok := wordSets.get(key); ok {
+		return set
+	}
+
+	set := &wordSet{words: filterWords(cfg, list)}
+	set.err = checkWordSet(cfg, list, set.words)
+	return wordSets.add(key, set)
+}
+
+// words returns the distinct words TypeWord picks from with cfg: those of
+// its word list between WordMinLength and WordMaxLength characters, without
+// those written with ambiguous characters when ExcludeAmbiguous is set. They
+// are shared and must not be modified.
+func (cfg CaptchaConfig) words() []string {
+	return cfg.wordSet().words
+}
+
+// filterWords returns the distinct words of list TypeWord picks from with
+// cfg, see words
+func filterWords(cfg CaptchaConfig, list []string) []string {
+	words := make([]string, 0, len(list))
+	seen := make(map[string]struct{}, len(list))
+	for _, word := range list {
+		n := utf8.RuneCountInString(word)
+		switch {
+		case n < cfg.WordMinLength, cfg.WordMaxLength > 0 && n > cfg.WordMaxLength:
+			continue
+		case cfg.ExcludeAmbiguous && strings.ContainsAny(word, AmbiguousChars):
+			continue
+		}
+		if _, ok := seen[word]; ok {
+			continue
+		}
+		seen[word] = struct{}{}
+		words = append(words, word)
+	}
+	return words
+}
+
+// wordAnswers returns the number of distinct answers of the words of cfg,
+// as compared when verifying, e.g. "Apple" and "apple" counting once unless
+// CaseSensitive is set
+func wordAnswers(cfg CaptchaConfig) int {
+	normalizer := cfg.Normalizer()
+	distinct := make(map[string]struct{})
+	for _, word := range cfg.words() {
+		distinct[normalizer.Normalize(word)] = struct{}{}
+	}
+	return len(distinct)
+}
+
+// checkWords returns an error when the word list of cfg is invalid or has
+// fewer than MinWordlist words to pick from
+func checkWords(cfg CaptchaConfig) error {
+	return cfg.wordSet().err
+}
+
+// checkWordSet returns the error of checkWords for the word list of cfg and
+// the words filtered from it
+func checkWordSet(cfg CaptchaConfig, list, words []string) error {
+	for i, word := range list {
+		if strings.TrimSpace(word) == "" || !utf8.ValidString(word) {
+			return fmt.Errorf("%w: word %d is blank or isn't valid UTF-8", ErrInvalidText, i)
+		}
+	}
+	if cfg.WordMaxLength > 0 && cfg.WordMaxLength < cfg.WordMinLength {
+		return fmt.Errorf("%w: WordMaxLength %d is below WordMinLength %d",
+			ErrInvalidText, cfg.WordMaxLength, cfg.WordMinLength)
+	}
+	if n := len(words); n < MinWordlist {
+		return fmt.Errorf("%w: TypeWord needs at least %d distinct words within the length bounds, has %d",
+			ErrInvalidText, MinWordlist, n)
+	}
+	return nil
+}
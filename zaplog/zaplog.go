@@ -0,0 +1,71 @@
+// Package zaplog writes the captcha middleware events to a zap logger. It
+// lives in its own package so that only its users depend on zap.
+package zaplog
+
+import (
+	"log/slog"
+
+	middleware "github.com/wprimadi/gin-captcha"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Logger implements middleware.Logger on top of a zap logger, with the event
+// type as the message and the same field keys as middleware.SlogLogger
+type Logger struct {
+	l *zap.Logger
+}
+
+// New returns a Logger writing events to l
+func New(l *zap.Logger) *Logger {
+	return &Logger{l: l}
+}
+
+// Log writes ev at the level returned by ev.Level
+func (z *Logger) Log(ev middleware.Event) {
+	ce := z.l.Check(level(ev.Level()), ev.Type)
+	if ce == nil {
+		return
+	}
+
+	attrs := ev.Attrs()
+	fields := make([]zap.Field, len(attrs))
+	for i, a := range attrs {
+		fields[i] = field(a)
+	}
+	ce.Write(fields...)
+}
+
+// level converts a slog level to the closest zap level
+func level(l slog.Level) zapcore.Level {
+	switch {
+	case l >= slog.LevelError:
+		return zapcore.ErrorLevel
+	case l >= slog.LevelWarn:
+		return zapcore.WarnLevel
+	case l >= slog.LevelInfo:
+		return zapcore.InfoLevel
+	}
+	return zapcore.DebugLevel
+}
+
+// field converts a slog attribute to a zap field of the same type
+func field(a slog.Attr) zap.Field {
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return zap.String(a.Key, a.Value.String())
+	case slog.KindInt64:
+		return zap.Int64(a.Key, a.Value.Int64())
+	case slog.KindDuration:
+		return zap.Duration(a.Key, a.Value.Duration())
+	case slog.KindGroup:
+		group := a.Value.Group()
+		return zap.Object(a.Key, zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+			for _, a := range group {
+				field(a).AddTo(enc)
+			}
+			return nil
+		}))
+	}
+	return zap.Any(a.Key, a.Value.Any())
+}